@@ -0,0 +1,59 @@
+// Package layout is the directory layout docker2fs converts an image into
+// and runInNamespace runs it from. Both tools derive their paths from the
+// same base here, so they can't drift apart.
+package layout
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// BaseEnv points the default base of both tools elsewhere
+const BaseEnv = "PROXY_POOL_PATH"
+
+// DefaultBase is the base used when BaseEnv is not set
+const DefaultBase = "/tmp/proxy_pool"
+
+// StateDir holds the pid and state files of named containers, it is not
+// under a base
+const StateDir = "/run/runInNamespace"
+
+// Paths is the layout under a base directory
+type Paths struct {
+	Base     string
+	Layers   string
+	Config   string
+	Manifest string
+	// Volume and Overlay are only used by runInNamespace, Overlay is the
+	// overlay work directory given by its -base flag
+	Volume  string
+	Overlay string
+	State   string
+}
+
+// New returns the layout under base
+func New(base string) *Paths {
+	return &Paths{
+		Base:     base,
+		Layers:   filepath.Join(base, "layers"),
+		Config:   filepath.Join(base, "config.json"),
+		Manifest: filepath.Join(base, "manifest.json"),
+		Volume:   filepath.Join(base, "volume"),
+		Overlay:  filepath.Join(base, "overlay"),
+		State:    StateDir,
+	}
+}
+
+// DefaultBasePath returns BaseEnv if set, otherwise DefaultBase
+func DefaultBasePath() string {
+	if base := os.Getenv(BaseEnv); base != "" {
+		return base
+	}
+	return DefaultBase
+}
+
+// CompleteMarker is written next to a layer directory once it is fully
+// extracted, a directory without it was left by an interrupted extraction
+func CompleteMarker(layerDir string) string {
+	return layerDir + ".complete"
+}
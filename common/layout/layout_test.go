@@ -0,0 +1,36 @@
+package layout
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	got := *New("/srv/img")
+	want := Paths{
+		Base:     "/srv/img",
+		Layers:   "/srv/img/layers",
+		Config:   "/srv/img/config.json",
+		Manifest: "/srv/img/manifest.json",
+		Volume:   "/srv/img/volume",
+		Overlay:  "/srv/img/overlay",
+		State:    StateDir,
+	}
+	if got != want {
+		t.Errorf("New = %+v, want %+v", got, want)
+	}
+}
+
+func TestDefaultBasePath(t *testing.T) {
+	t.Setenv(BaseEnv, "")
+	if got := DefaultBasePath(); got != DefaultBase {
+		t.Errorf("DefaultBasePath without %s = %q, want %q", BaseEnv, got, DefaultBase)
+	}
+	t.Setenv(BaseEnv, "/data/images")
+	if got := DefaultBasePath(); got != "/data/images" {
+		t.Errorf("DefaultBasePath = %q, want /data/images", got)
+	}
+}
+
+func TestCompleteMarker(t *testing.T) {
+	if got := CompleteMarker("/srv/img/layers/abc"); got != "/srv/img/layers/abc.complete" {
+		t.Errorf("CompleteMarker = %q", got)
+	}
+}
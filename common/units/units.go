@@ -0,0 +1,18 @@
+// Package units formats sizes for the output of docker2fs and runInNamespace
+package units
+
+import "fmt"
+
+// HumanSize formats n bytes with binary prefixes, e.g. 1.5MiB
+func HumanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
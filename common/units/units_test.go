@@ -0,0 +1,23 @@
+package units
+
+import "testing"
+
+func TestHumanSize(t *testing.T) {
+	for _, test := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{10 << 20, "10.0MiB"},
+		{3 << 30, "3.0GiB"},
+		{1<<40 + 1<<39, "1.5TiB"},
+		{1 << 62, "4.0EiB"},
+	} {
+		if got := HumanSize(test.n); got != test.want {
+			t.Errorf("HumanSize(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"common/layout"
+	"docker2fs/converter"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// registryFlags are the flags of every command that talks to a registry
+type registryFlags struct {
+	mirror     *string
+	httpProxy  *string
+	httpsProxy *string
+	noProxy    *string
+	insecure   *bool
+	caCerts    stringList
+}
+
+func addRegistryFlags(fs *flag.FlagSet) *registryFlags {
+	f := &registryFlags{
+		mirror:     fs.String("mirror", "", "pull docker.io images through this registry host, keeping the repository path"),
+		httpProxy:  fs.String("http-proxy", "", "proxy for plain HTTP registry requests, default $HTTP_PROXY"),
+		httpsProxy: fs.String("https-proxy", "", "proxy for HTTPS registry requests, default $HTTPS_PROXY"),
+		noProxy:    fs.String("no-proxy", "", "comma separated hosts, domains and CIDRs reached without the proxy, default $NO_PROXY"),
+		insecure:   fs.Bool("insecure", false, "allow plain HTTP registries and skip TLS certificate verification"),
+	}
+	fs.Var(&f.caCerts, "ca-cert", "PEM file of extra root certificates for registry TLS, can be repeated")
+	return f
+}
+
+// apply sets the registry options of config from the flags
+func (f *registryFlags) apply(config *converter.ConverterConfig) {
+	config.Mirror = *f.mirror
+	config.HTTPProxy = *f.httpProxy
+	config.HTTPSProxy = *f.httpsProxy
+	config.NoProxy = *f.noProxy
+	config.Insecure = *f.insecure
+	config.CACerts = f.caCerts
+}
+
+func convertCommand(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	basePath := fs.String("path", layout.DefaultBasePath(), "output directory")
+	concurrency := fs.Int("concurrent-images", 1, "number of images converted in parallel")
+	registry := addRegistryFlags(fs)
+	blobHost := fs.String("blob-host", "", "fetch layer blobs from this host instead of the registry")
+	manifestFirst := fs.Bool("manifest-first", false, "write manifest.json and config.json before pulling layers, for runInNamespace --overlay-lazy-extract")
+	bundleFS := fs.String("bundle", "", "also pack the layers into bundle.img as squashfs or ext4 images")
+	report := fs.Bool("report", false, "print the compressed, extracted and on-disk size of each image")
+	onlyConfigChanged := fs.Bool("convert-only-config-changed", false, "don't pull again if the layers match the existing manifest")
+	timeout := fs.Duration("timeout", 0, "abort the conversion after this long, 0 means no limit")
+	preserveTimestamps := fs.Bool("preserve-timestamps", false, "give implicitly created directories the image created time, or $SOURCE_DATE_EPOCH, as mtime")
+	idShift := fs.Int("id-shift", 0, "add this to the uid and gid of every extracted file, for runInNamespace --userns mapping root to it, needs root")
+	squash := fs.Bool("squash", false, "merge all layers into a single lower directory")
+	indexPolicy := fs.String("index-policy", converter.IndexPolicyHost, "for a manifest list: host converts the host platform, error fails, all converts every platform into <path>/<platform>")
+	strictCompression := fs.Bool("detect-compression-from-mediatype", false, "trust only the layer media type for its compression, fail on unknown media types")
+	downloadConcurrency := fs.Int("download-concurrency", 3, "layers of one image downloaded in parallel")
+	extractConcurrency := fs.Int("extract-concurrency", runtime.NumCPU(), "downloaded layers of one image extracted in parallel")
+	maxOpenFiles := fs.Int64("max-open-files", 0, "limit the files held open by parallel pulls and extractions, 0 means no limit")
+	rateLimit := fs.Int("rate-limit", 0, "cap the download rate of all layers together in bytes per second, 0 means no limit")
+	cacheDir := fs.String("cache-dir", converter.DefaultCacheDir(), "keep compressed layers by digest here and reuse them, empty disables the cache")
+	skipForeign := fs.Bool("skip-foreign", false, "leave out foreign layers (Windows base layers) with a warning instead of fetching them from their urls")
+	refresh := fs.Bool("refresh", false, "resolve the source and fetch its manifest and config again instead of resuming from the ones already in -path")
+	offline := fs.Bool("offline", false, "convert from the manifest, config and layers already in -path and -cache-dir, never touching the network")
+	platform := fs.String("platform", "", "os/arch[/variant] to pull from a manifest list, all pulls every platform like -index-policy all, default the host")
+	variant := fs.String("variant", "", "cpu variant to pull and require, e.g. v7 or v8 for arm, overrides the one of -platform")
+	fs.Parse(args)
+	sources := fs.Args()
+	if len(sources) == 0 {
+		return errors.New("usage: docker2fs convert [flags] <ref|docker-archive:file[:tag]>...")
+	}
+	if *rateLimit < 0 {
+		return errors.Errorf("invalid -rate-limit %d, it must not be negative", *rateLimit)
+	}
+	if *platform == "all" {
+		*indexPolicy = converter.IndexPolicyAll
+	}
+	switch *indexPolicy {
+	case converter.IndexPolicyHost, converter.IndexPolicyError, converter.IndexPolicyAll:
+	default:
+		return errors.Errorf("unknown index policy %s, expected host, error or all", *indexPolicy)
+	}
+	if *variant != "" && *indexPolicy == converter.IndexPolicyAll {
+		return errors.New("-variant picks one image, it can't be used with -platform all or -index-policy all")
+	}
+	config := converter.ConverterConfig{
+		Path:                *basePath,
+		BlobHost:            *blobHost,
+		ManifestFirst:       *manifestFirst,
+		BundleFS:            *bundleFS,
+		Report:              *report,
+		OnlyConfigChanged:   *onlyConfigChanged,
+		PreserveTimestamps:  *preserveTimestamps,
+		IDShift:             *idShift,
+		Squash:              *squash,
+		IndexPolicy:         *indexPolicy,
+		StrictCompression:   *strictCompression,
+		CacheDir:            *cacheDir,
+		Offline:             *offline,
+		Refresh:             *refresh,
+		SkipForeign:         *skipForeign,
+		DownloadConcurrency: *downloadConcurrency,
+		ExtractConcurrency:  *extractConcurrency,
+		RateLimit:           converter.NewRateLimiter(*rateLimit),
+		MaxOpenFiles:        converter.NewFileLimiter(*maxOpenFiles),
+		Variant:             *variant,
+	}
+	registry.apply(&config)
+	if *platform != "" && *platform != "all" {
+		p, err := v1.ParsePlatform(*platform)
+		if err != nil {
+			return errors.Wrap(err, "parse platform")
+		}
+		config.Platform = p
+	}
+	// interrupted pulls remove their partial files before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if len(sources) == 1 {
+		config.Source = sources[0]
+		res, err := converter.Convert(ctx, config)
+		if err != nil {
+			return err
+		}
+		printReports(res)
+		return nil
+	}
+	results, err := converter.ConvertBatch(ctx, config, sources, *concurrency)
+	for _, res := range results {
+		if res != nil {
+			printReports(res)
+		}
+	}
+	return err
+}
+
+func pullCommand(args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ExitOnError)
+	basePath := fs.String("path", layout.DefaultBasePath(), "output directory")
+	registry := addRegistryFlags(fs)
+	timeout := fs.Duration("timeout", 0, "abort the pull after this long, 0 means no limit")
+	downloadConcurrency := fs.Int("download-concurrency", 3, "layers downloaded in parallel")
+	rateLimit := fs.Int("rate-limit", 0, "cap the download rate of all layers together in bytes per second, 0 means no limit")
+	cacheDir := fs.String("cache-dir", converter.DefaultCacheDir(), "keep compressed layers by digest here and reuse them, empty disables the cache")
+	refresh := fs.Bool("refresh", false, "resolve the source and fetch its manifest and config again instead of resuming from the ones already in -path")
+	platform := fs.String("platform", "", "os/arch[/variant] to pull from a manifest list, default the host")
+	variant := fs.String("variant", "", "cpu variant to pull and require, e.g. v7 or v8 for arm, overrides the one of -platform")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: docker2fs pull [flags] <ref>")
+	}
+	if *rateLimit < 0 {
+		return errors.Errorf("invalid -rate-limit %d, it must not be negative", *rateLimit)
+	}
+	config := converter.ConverterConfig{
+		Source:              fs.Arg(0),
+		Path:                *basePath,
+		CacheDir:            *cacheDir,
+		Refresh:             *refresh,
+		DownloadConcurrency: *downloadConcurrency,
+		RateLimit:           converter.NewRateLimiter(*rateLimit),
+		Variant:             *variant,
+	}
+	registry.apply(&config)
+	if *platform != "" {
+		p, err := v1.ParsePlatform(*platform)
+		if err != nil {
+			return errors.Wrap(err, "parse platform")
+		}
+		config.Platform = p
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	res, err := converter.Pull(ctx, config)
+	if err != nil {
+		return err
+	}
+	for _, info := range res.LayerInfos {
+		fmt.Println(info.Path + ".tar")
+	}
+	return nil
+}
+
+// printReports prints the size report of res and of its platforms, if
+// convert -report asked for them
+func printReports(res *converter.Result) {
+	if res.Report != nil {
+		fmt.Println(res.Source, res.Report)
+	}
+	for _, platform := range res.Platforms {
+		printReports(platform)
+	}
+}
+
+// parseCheckArgs parses check [flags] <ref>, the registry flags are the
+// same as for convert
+func parseCheckArgs(args []string) (converter.ConverterConfig, error) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	registry := addRegistryFlags(fs)
+	config := converter.ConverterConfig{}
+	err := fs.Parse(args)
+	if err != nil {
+		return config, err
+	}
+	if fs.NArg() != 1 {
+		return config, errors.New("usage: docker2fs check [flags] <ref>")
+	}
+	config.Source = fs.Arg(0)
+	registry.apply(&config)
+	return config, nil
+}
+
+func checkCommand(args []string) error {
+	config, err := parseCheckArgs(args)
+	if err != nil {
+		return err
+	}
+	issues, err := converter.Check(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		fmt.Println(config.Source, "OK")
+		return nil
+	}
+	for _, issue := range issues {
+		fmt.Println(config.Source, issue)
+	}
+	return errors.Errorf("%d issue(s) found in %s", len(issues), config.Source)
+}
+
+func inspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	output := fs.String("o", "table", "output format: table or json")
+	registry := addRegistryFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: docker2fs inspect [flags] <ref>")
+	}
+	if *output != "table" && *output != "json" {
+		return errors.Errorf("unknown output format %s", *output)
+	}
+	config := converter.ConverterConfig{Source: fs.Arg(0)}
+	registry.apply(&config)
+	infos, err := converter.Inspect(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "marshal layers")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tMEDIA TYPE\tSIZE")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", info.Digest, info.MediaType, info.Size)
+	}
+	return w.Flush()
+}
+
+func gcCommand(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	basePath := fs.String("path", layout.DefaultBasePath(), "directory passed to convert -path")
+	dryRun := fs.Bool("dry-run", false, "only list what would be removed")
+	fs.Parse(args)
+	removed, err := converter.GC(*basePath, *dryRun)
+	for _, p := range removed {
+		if *dryRun {
+			fmt.Println("would remove", p)
+		} else {
+			fmt.Println("removed", p)
+		}
+	}
+	return err
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	basePath := fs.String("path", layout.DefaultBasePath(), "directory passed to convert -path")
+	fs.Parse(args)
+	checks, err := converter.Verify(*basePath)
+	bad := 0
+	for _, c := range checks {
+		if c.Err != nil {
+			bad++
+			fmt.Println(c.Digest.String(), "FAILED:", c.Err)
+			continue
+		}
+		fmt.Println(c.Digest.String(), "OK")
+	}
+	if err != nil {
+		return err
+	}
+	if bad > 0 {
+		return errors.Errorf("%d layer(s) failed verification", bad)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"common/layout"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParseCheckArgs(t *testing.T) {
+	// a bare check is a usage error, not a conversion of the default image
+	if _, err := parseCheckArgs(nil); err == nil {
+		t.Error("check without a reference should fail")
+	}
+	config, err := parseCheckArgs([]string{
+		"-mirror", "mirror.example.com",
+		"-http-proxy", "http://proxy:3128",
+		"-https-proxy", "http://proxy:3129",
+		"-no-proxy", "internal.example.com",
+		"-insecure",
+		"-ca-cert", "a.pem", "-ca-cert", "b.pem",
+		"library/alpine:3.20",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Source != "library/alpine:3.20" || config.Mirror != "mirror.example.com" ||
+		config.HTTPProxy != "http://proxy:3128" || config.HTTPSProxy != "http://proxy:3129" ||
+		config.NoProxy != "internal.example.com" || !config.Insecure {
+		t.Errorf("parseCheckArgs = %+v", config)
+	}
+	if !reflect.DeepEqual(config.CACerts, []string{"a.pem", "b.pem"}) {
+		t.Errorf("CACerts = %v, want [a.pem b.pem]", config.CACerts)
+	}
+}
+
+func TestInspectCommandArgs(t *testing.T) {
+	// bad arguments fail before the registry is asked
+	for _, args := range [][]string{nil, {"a", "b"}, {"-o", "yaml", "alpine"}} {
+		if err := inspectCommand(args); err == nil {
+			t.Errorf("inspectCommand(%q) succeeded", args)
+		}
+	}
+}
+
+func TestInspectRegistryFlags(t *testing.T) {
+	// inspect reaches registries like convert does, the missing CA file
+	// fails it before any request
+	caCert := filepath.Join(t.TempDir(), "missing.pem")
+	err := inspectCommand([]string{"-ca-cert", caCert, "127.0.0.1:1/test:latest"})
+	if err == nil || !strings.Contains(err.Error(), caCert) {
+		t.Errorf("inspect -ca-cert %s = %v, want an error naming it", caCert, err)
+	}
+}
+
+// pushPlatforms serves a manifest list of random linux/amd64 and
+// linux/arm64/v8 images from an in-memory registry and returns its reference
+func pushPlatforms(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	var index v1.ImageIndex = empty.Index
+	for _, platform := range []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configFile, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		configFile = configFile.DeepCopy()
+		configFile.OS, configFile.Architecture, configFile.Variant = platform.OS, platform.Architecture, platform.Variant
+		img, err = mutate.ConfigFile(img, configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	}
+	ref := strings.TrimPrefix(server.URL, "http://") + "/app:latest"
+	tag, err := name.NewTag(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, index); err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestConvertPlatformAll(t *testing.T) {
+	source := pushPlatforms(t)
+	dir := t.TempDir()
+	err := convertCommand([]string{"-path", dir, "-cache-dir", "", "-insecure", "-platform", "all", source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one directory per platform sharing <path>/layers, nothing at the top
+	for _, platformDir := range []string{"linux-amd64", "linux-arm64-v8"} {
+		for _, file := range []string{"manifest.json", "config.json", "layers.json"} {
+			if _, err := os.Stat(filepath.Join(dir, platformDir, file)); err != nil {
+				t.Error(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, platformDir, "layers")); !os.IsNotExist(err) {
+			t.Errorf("%s has its own layers directory", platformDir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+		t.Error("-platform all wrote a manifest.json for the manifest list")
+	}
+	layers, err := filepath.Glob(filepath.Join(layout.New(dir).Layers, "*.complete"))
+	if err != nil || len(layers) != 2 {
+		t.Errorf("the shared layers directory has %v complete layers, want 2", layers)
+	}
+
+	if err := convertCommand([]string{"-path", t.TempDir(), "-platform", "all", "-variant", "v8", source}); err == nil {
+		t.Error("-platform all accepted -variant")
+	}
+	// a single platform is converted at the top of -path
+	dir = t.TempDir()
+	err = convertCommand([]string{"-path", dir, "-cache-dir", "", "-insecure", "-platform", "linux/arm64/v8", source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "linux-arm64-v8")); !os.IsNotExist(err) {
+		t.Error("a single platform was converted into a platform directory")
+	}
+}
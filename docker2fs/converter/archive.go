@@ -0,0 +1,96 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// archivePrefix marks a Source that is a `docker save` tarball instead of
+// a registry reference: docker-archive:<file>[:<repo:tag>]
+const archivePrefix = "docker-archive:"
+
+// archiveRegistry and archiveRepository name the images of an archive
+// saved without a tag, resolved.json needs a repository to record the
+// digest under
+const (
+	archiveRegistry   = "localhost"
+	archiveRepository = "docker-archive"
+)
+
+// archiveSource splits an archive Source into the tarball path and the
+// optional tag of the image in it, ok is false for registry references.
+// The path and the tag may both contain ':', as in
+// docker-archive:/data/app:v1.tar:app:v1, the tag starts after the first
+// ':' with an existing file before it and a valid tag after it.
+func archiveSource(source string) (file string, tag string, ok bool) {
+	rest, ok := strings.CutPrefix(source, archivePrefix)
+	if !ok {
+		return "", "", false
+	}
+	for i := 0; i < len(rest); i++ {
+		if rest[i] != ':' {
+			continue
+		}
+		if info, err := os.Stat(rest[:i]); err != nil || info.IsDir() {
+			continue
+		}
+		if _, err := name.NewTag(rest[i+1:]); err == nil {
+			return rest[:i], rest[i+1:], true
+		}
+	}
+	return rest, "", true
+}
+
+// loadArchiveImage reads the image from the `docker save` tarball named by
+// config.Source. Without a tag the tarball must hold exactly one image.
+// Layers are read from the tarball, nothing is fetched.
+func loadArchiveImage(config *ConverterConfig) (*Image, error) {
+	file, tagStr, _ := archiveSource(config.Source)
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(file)
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("read manifest.json of %s", file))
+	}
+	var tag *name.Tag
+	if tagStr != "" {
+		t, err := name.NewTag(tagStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse archive tag")
+		}
+		tag = &t
+	} else if len(manifest) != 1 {
+		tags := []string{}
+		for _, desc := range manifest {
+			tags = append(tags, desc.RepoTags...)
+		}
+		return nil, errors.Errorf("%s holds %d images, pick one with %s%s:<tag> (%s)",
+			file, len(manifest), archivePrefix, file, strings.Join(tags, ", "))
+	} else if len(manifest[0].RepoTags) > 0 {
+		t, err := name.NewTag(manifest[0].RepoTags[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "parse archive tag")
+		}
+		tag = &t
+	}
+	img, err := tarball.Image(opener, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("load image from %s", file))
+	}
+	var ref name.Reference = tag
+	if tag == nil {
+		untagged, err := name.NewTag(archiveRepository, name.WithDefaultRegistry(archiveRegistry))
+		if err != nil {
+			return nil, errors.Wrap(err, "parse archive repository")
+		}
+		ref = untagged
+	}
+	return &Image{Ref: ref, Img: img}, nil
+}
@@ -0,0 +1,78 @@
+package converter
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestArchiveSource(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"plain.tar", "app:v1.tar"} {
+		if err := os.WriteFile(path.Join(dir, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		source string
+		file   string
+		tag    string
+	}{
+		{archivePrefix + dir + "/plain.tar", dir + "/plain.tar", ""},
+		{archivePrefix + dir + "/plain.tar:busybox:latest", dir + "/plain.tar", "busybox:latest"},
+		{archivePrefix + dir + "/plain.tar:localhost:5000/app:v2", dir + "/plain.tar", "localhost:5000/app:v2"},
+		{archivePrefix + dir + "/app:v1.tar", dir + "/app:v1.tar", ""},
+		{archivePrefix + dir + "/app:v1.tar:app:v1", dir + "/app:v1.tar", "app:v1"},
+		// not a valid tag, the whole rest is the file and fails to open later
+		{archivePrefix + dir + "/plain.tar:Bad Tag", dir + "/plain.tar:Bad Tag", ""},
+	}
+	for _, test := range tests {
+		file, tag, ok := archiveSource(test.source)
+		if !ok || file != test.file || tag != test.tag {
+			t.Errorf("archiveSource(%q) = %q, %q, %v, want %q, %q", test.source, file, tag, ok, test.file, test.tag)
+		}
+	}
+	if _, _, ok := archiveSource("example.com/app:v1"); ok {
+		t.Error("a registry reference is not an archive")
+	}
+}
+
+func TestLoadArchiveImageWithColons(t *testing.T) {
+	tag, err := name.NewTag("example.com/test:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(t.TempDir(), "test:v1.tar")
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "x"}))
+	err = tarball.WriteToFile(file, tag, image.Img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{archivePrefix + file, archivePrefix + file + ":example.com/test:v1"} {
+		loaded, err := loadArchiveImage(&ConverterConfig{Source: source})
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if loaded.Ref.String() != tag.String() {
+			t.Errorf("%s: reference = %s, want %s", source, loaded.Ref, tag)
+		}
+	}
+}
+
+// writeArchive saves image as a docker-archive in dir and returns its
+// convert source
+func writeArchive(t *testing.T, image *Image, dir, file string) string {
+	t.Helper()
+	tag, err := name.NewTag(image.Ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tarball.WriteToFile(path.Join(dir, file), tag, image.Img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archivePrefix + path.Join(dir, file)
+}
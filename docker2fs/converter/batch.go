@@ -0,0 +1,63 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+
+	"common/layout"
+
+	"github.com/pkg/errors"
+)
+
+var refDirReplacer = strings.NewReplacer("/", "_", ":", "_", "@", "_")
+
+// ConvertBatch converts several images with up to concurrency workers.
+// Each image gets its own directory under base.Path and all of them share
+// base.Path/layers, so a layer used by several images is pulled once.
+// Other settings are copied from base. Results are in the order of
+// sources, nil for the images that failed.
+func ConvertBatch(ctx context.Context, base ConverterConfig, sources []string, concurrency int) ([]*Result, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan int)
+	results := make([]*Result, len(sources))
+	failed := make([]string, 0)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				source := sources[i]
+				config := base
+				config.Source = source
+				config.Path = path.Join(base.Path, refDirReplacer.Replace(source))
+				config.LayersPath = layout.New(base.Path).Layers
+				res, err := convert(ctx, &config)
+				mu.Lock()
+				results[i] = res
+				if err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %v", source, err))
+				} else {
+					slog.Info("converted", "source", source, "path", config.Path)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range sources {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if len(failed) > 0 {
+		return results, errors.Errorf("%d of %d images failed:\n%s", len(failed), len(sources), strings.Join(failed, "\n"))
+	}
+	return results, nil
+}
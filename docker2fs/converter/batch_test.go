@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"common/layout"
+)
+
+func TestConvertBatch(t *testing.T) {
+	dir := t.TempDir()
+	shared := testLayer(t, tarEntry{Name: "shared", Body: "both images"})
+	first := writeArchive(t, testImage(t, shared, testLayer(t, tarEntry{Name: "first", Body: "1"})), dir, "first.tar")
+	second := writeArchive(t, testImage(t, shared, testLayer(t, tarEntry{Name: "second", Body: "2"})), dir, "second.tar")
+	missing := archivePrefix + path.Join(dir, "missing.tar")
+	sources := []string{first, missing, second}
+
+	for _, concurrency := range []int{0, 1, 3} {
+		base := ConverterConfig{Path: t.TempDir()}
+		results, err := ConvertBatch(context.Background(), base, sources, concurrency)
+		// one failure fails the batch after the others were converted
+		if err == nil || !strings.HasPrefix(err.Error(), "1 of 3 images failed:\n"+missing+": ") {
+			t.Fatalf("concurrency %d: ConvertBatch = %v, want the failure of %s", concurrency, err, missing)
+		}
+		if len(results) != 3 || results[1] != nil {
+			t.Fatalf("concurrency %d: results = %v, want nil only for the missing archive", concurrency, results)
+		}
+		layers := layout.New(base.Path).Layers
+		for i, source := range []string{first, "", second} {
+			if source == "" {
+				continue
+			}
+			res := results[i]
+			if res == nil || res.Source != source {
+				t.Fatalf("concurrency %d: result %d = %+v, want %s in the order of the sources", concurrency, i, res, source)
+			}
+			// each image has its own directory, the layers are shared
+			if want := path.Join(base.Path, refDirReplacer.Replace(source)); res.Path != want || res.LayersPath != layers {
+				t.Errorf("concurrency %d: %s converted into %s with layers %s, want %s and %s",
+					concurrency, source, res.Path, res.LayersPath, want, layers)
+			}
+			if _, err := os.Stat(res.ManifestPath); err != nil {
+				t.Errorf("concurrency %d: %v", concurrency, err)
+			}
+		}
+		entries, err := os.ReadDir(layers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hexes := map[string]bool{}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				hexes[entry.Name()] = true
+			}
+		}
+		if len(hexes) != 3 {
+			t.Errorf("concurrency %d: layers dir has %v, want the shared layer once and one layer per image", concurrency, hexes)
+		}
+	}
+}
+
+func TestConvertBatchAllFail(t *testing.T) {
+	dir := t.TempDir()
+	sources := []string{archivePrefix + path.Join(dir, "a.tar"), archivePrefix + path.Join(dir, "b.tar")}
+	results, err := ConvertBatch(context.Background(), ConverterConfig{Path: t.TempDir()}, sources, 2)
+	if err == nil || !strings.HasPrefix(err.Error(), "2 of 2 images failed:") {
+		t.Fatalf("ConvertBatch = %v, want both failures", err)
+	}
+	// every failure is listed, in whatever order the workers finished
+	for _, source := range sources {
+		if !strings.Contains(err.Error(), source+": ") {
+			t.Errorf("the error does not list %s: %v", source, err)
+		}
+	}
+	if results[0] != nil || results[1] != nil {
+		t.Errorf("results = %v, want none", results)
+	}
+}
@@ -0,0 +1,169 @@
+package converter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A bundle stores every layer of an image as a filesystem image in one
+// file, so the runtime can loop-mount the layers without per-layer
+// directories:
+//
+//	[layer 0 image][padding]...[layer n image][padding][index JSON][index length][magic]
+//
+// The index length is a little-endian uint64 and the magic is bundleMagic.
+// Layer images start on bundleAlign boundaries as loop devices need
+// block-aligned offsets.
+const (
+	bundleMagic = "D2FSBNDL"
+	bundleAlign = 4096
+)
+
+// BundleLayer locates one layer image inside the bundle
+type BundleLayer struct {
+	Digest string `json:"digest"`
+	FSType string `json:"fsType"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// BundleIndex lists the layers in manifest order, bottom layer first
+type BundleIndex struct {
+	Layers []BundleLayer `json:"layers"`
+}
+
+// dirSize sums the size of the files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// buildLayerImage creates a read-only filesystem image of dir at out.
+// squashfs needs squashfs-tools, ext4 only needs e2fsprogs.
+func buildLayerImage(dir, out, fsType string) error {
+	var cmd *exec.Cmd
+	switch fsType {
+	case "squashfs":
+		cmd = exec.Command("mksquashfs", dir, out, "-noappend", "-quiet")
+	case "ext4":
+		size, err := dirSize(dir)
+		if err != nil {
+			return errors.Wrap(err, "measure layer directory")
+		}
+		// room for inodes and metadata on top of the file data
+		size = size + size/5 + 4<<20
+		cmd = exec.Command("mkfs.ext4", "-q", "-F", "-O", "^has_journal", "-d", dir, out,
+			strconv.FormatInt(size/1024, 10)+"k")
+	default:
+		return errors.Errorf("unsupported bundle filesystem %s", fsType)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("%s: %s", cmd.String(), output))
+	}
+	return nil
+}
+
+// appendFile copies src to the end of w and pads it to bundleAlign,
+// returning the unpadded size
+func appendFile(w io.Writer, src string) (int64, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := io.Copy(w, file)
+	if err != nil {
+		return 0, err
+	}
+	if pad := (bundleAlign - size%bundleAlign) % bundleAlign; pad > 0 {
+		_, err = w.Write(make([]byte, pad))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// createBundle packs the extracted layers into Path/bundle.img
+func createBundle(config *ConverterConfig, image *Image) error {
+	layers, err := image.Img.Layers()
+	if err != nil {
+		return errors.Wrap(err, "get image layers")
+	}
+	bundlePath := path.Join(config.Path, "bundle.img")
+	tmpPath := bundlePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "create bundle file")
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	index := &BundleIndex{}
+	var offset int64
+	// a repeated layer keeps its position in the index but points at the
+	// image already in the bundle
+	packed := map[string]BundleLayer{}
+	for _, layer := range layers {
+		hash, err := layer.Digest()
+		if err != nil {
+			return errors.Wrap(err, "get image layer digest")
+		}
+		if entry, ok := packed[hash.String()]; ok {
+			index.Layers = append(index.Layers, entry)
+			continue
+		}
+		layerImage := path.Join(config.layersDir(), hash.Hex+"."+config.BundleFS)
+		err = buildLayerImage(path.Join(config.layersDir(), hash.Hex), layerImage, config.BundleFS)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("build layer image %s", hash.String()))
+		}
+		size, err := appendFile(file, layerImage)
+		os.Remove(layerImage)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("append layer %s to bundle", hash.String()))
+		}
+		entry := BundleLayer{
+			Digest: hash.String(),
+			FSType: config.BundleFS,
+			Offset: offset,
+			Size:   size,
+		}
+		packed[hash.String()] = entry
+		index.Layers = append(index.Layers, entry)
+		offset += size + (bundleAlign-size%bundleAlign)%bundleAlign
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "marshal bundle index")
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(trailer, uint64(len(data)))
+	data = append(append(data, trailer...), bundleMagic...)
+	_, err = file.Write(data)
+	if err != nil {
+		return errors.Wrap(err, "write bundle index")
+	}
+	err = file.Close()
+	if err != nil {
+		return errors.Wrap(err, "close bundle file")
+	}
+	return os.Rename(tmpPath, bundlePath)
+}
@@ -0,0 +1,78 @@
+package converter
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// readBundle reads the index back from the trailer the way runInNamespace does
+func readBundle(t *testing.T, bundlePath string) ([]byte, *BundleIndex) {
+	t.Helper()
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := data[len(data)-8-len(bundleMagic):]
+	if string(trailer[8:]) != bundleMagic {
+		t.Fatalf("bundle ends with %q, want the magic", trailer[8:])
+	}
+	indexLen := int(binary.LittleEndian.Uint64(trailer[:8]))
+	indexEnd := len(data) - len(trailer)
+	index := &BundleIndex{}
+	err = json.Unmarshal(data[indexEnd-indexLen:indexEnd], index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, index
+}
+
+func TestCreateBundleRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip(err)
+	}
+	base := testLayer(t, tarEntry{Name: "etc/os-release", Body: "test"})
+	app := testLayer(t, tarEntry{Name: "app/bin", Body: "app", Mode: 0755})
+	image := testImage(t, base, app, base)
+	config := testConfig(t)
+	config.BundleFS = "ext4"
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createBundle(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, index := readBundle(t, path.Join(config.Path, "bundle.img"))
+	if len(index.Layers) != 3 {
+		t.Fatalf("the index has %d layers, want 3", len(index.Layers))
+	}
+	for i, layer := range []v1.Layer{base, app, base} {
+		digest, _ := layer.Digest()
+		entry := index.Layers[i]
+		if entry.Digest != digest.String() || entry.FSType != "ext4" {
+			t.Errorf("layer %d = %+v, want %s on ext4", i, entry, digest)
+		}
+		if entry.Offset%bundleAlign != 0 {
+			t.Errorf("layer %d starts at %d, not on a %d boundary", i, entry.Offset, bundleAlign)
+		}
+		// the ext4 superblock magic 0xef53 is 1080 bytes into the image
+		if magic := binary.LittleEndian.Uint16(data[entry.Offset+1080:]); magic != 0xef53 {
+			t.Errorf("layer %d at %d is not an ext4 image, magic %#x", i, entry.Offset, magic)
+		}
+	}
+	// the repeated layer points at the image already packed
+	if index.Layers[2] != index.Layers[0] {
+		t.Errorf("the repeated layer = %+v, want %+v", index.Layers[2], index.Layers[0])
+	}
+	if index.Layers[1].Offset < index.Layers[0].Offset+index.Layers[0].Size {
+		t.Error("the layer images overlap")
+	}
+}
@@ -0,0 +1,135 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// DefaultCacheDir is ~/.cache/docker2fs, or empty when there is no home
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(dir, "docker2fs")
+}
+
+// cacheBlob downloads the compressed blob of layer into blobPath. The
+// registry client checks the digest while reading, a blob is only
+// renamed into place once complete and verified.
+func cacheBlob(ctx context.Context, config *ConverterConfig, layer v1.Layer, blobPath string) error {
+	err := os.MkdirAll(path.Dir(blobPath), os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "create cache directory")
+	}
+	reader, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	reader = throttle(ctx, config, reader)
+	defer reader.Close()
+	// images converted at the same time may cache the same blob
+	file, err := os.CreateTemp(path.Dir(blobPath), path.Base(blobPath)+".*.partial")
+	if err != nil {
+		return errors.Wrap(err, "create cache file")
+	}
+	_, err = io.Copy(file, &contextReader{ctx: ctx, r: reader})
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), blobPath)
+}
+
+// openCompressed returns the compressed blob of layer. With a cache
+// directory the blob is taken from the cache, downloading it first if this
+// digest was never pulled, so images sharing layers download them once,
+// and linked next to the layer before it is read.
+// Only downloads count against RateLimit, reading the cache doesn't.
+func openCompressed(ctx context.Context, config *ConverterConfig, layer v1.Layer) (io.ReadCloser, error) {
+	if config.CacheDir == "" {
+		reader, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		return throttle(ctx, config, reader), nil
+	}
+	hash, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	blobPath := cachedBlobPath(config.CacheDir, hash)
+	_, err = os.Stat(blobPath)
+	if err == nil {
+		slog.Debug("layer served from cache", "digest", hash.String(), "path", blobPath)
+	} else if os.IsNotExist(err) {
+		err = cacheBlob(ctx, config, layer, blobPath)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cache layer %s", hash.String()))
+		}
+	} else {
+		return nil, errors.Wrap(err, fmt.Sprintf("open cached layer %s", hash.String()))
+	}
+	layerBlob := layerBlobPath(config.layersDir(), hash)
+	err = linkBlob(blobPath, layerBlob)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("link cached layer %s", hash.String()))
+	}
+	return os.Open(layerBlob)
+}
+
+// layerBlobPath is where the compressed blob of digest is kept next to its
+// layer when converting with a cache, an offline convert still finds it
+// after the cache is pruned
+func layerBlobPath(layersDir string, digest v1.Hash) string {
+	return path.Join(layersDir, digest.Hex+".blob")
+}
+
+// linkBlob hardlinks the cached blob to dst, or copies it when the cache is
+// on another filesystem
+func linkBlob(blobPath, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Link(blobPath, dst)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+	slog.Debug("copying cached layer", "path", blobPath, "err", err)
+	src, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	file, err := os.CreateTemp(path.Dir(dst), path.Base(dst)+".*.partial")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, src)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), dst)
+}
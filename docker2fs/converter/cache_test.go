@@ -0,0 +1,119 @@
+package converter
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// countingLayer counts the downloads of its compressed blob
+type countingLayer struct {
+	v1.Layer
+	downloads *atomic.Int32
+}
+
+func (l *countingLayer) Compressed() (io.ReadCloser, error) {
+	l.downloads.Add(1)
+	return l.Layer.Compressed()
+}
+
+func TestSharedLayerServedFromCache(t *testing.T) {
+	downloads := &atomic.Int32{}
+	layer := &countingLayer{Layer: testLayer(t, tarEntry{Name: "shared", Body: "shared"}), downloads: downloads}
+	cacheDir := t.TempDir()
+	first, second := testConfig(t), testConfig(t)
+	for _, config := range []*ConverterConfig{first, second} {
+		config.CacheDir = cacheDir
+		err := pullLayers(context.Background(), config, testImage(t, layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("the shared layer was downloaded %d times, want once", n)
+	}
+	digest, _ := layer.Digest()
+	cached, err := os.Stat(cachedBlobPath(cacheDir, digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []*ConverterConfig{first, second} {
+		if !layerComplete(config.layersDir(), digest.Hex) {
+			t.Errorf("layer not extracted under %s", config.Path)
+		}
+		linked, err := os.Stat(layerBlobPath(config.layersDir(), digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(cached, linked) {
+			t.Errorf("the blob under %s is not a hard link of the cached one", config.Path)
+		}
+	}
+}
+
+func TestLinkBlobCopies(t *testing.T) {
+	blob := path.Join(t.TempDir(), "blob")
+	err := os.WriteFile(blob, []byte("blob"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /dev/shm is a tmpfs, a hard link into it from the test directory fails with EXDEV
+	dir, err := os.MkdirTemp("/dev/shm", "linkblob")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Link(blob, path.Join(dir, "probe")); err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+		t.Skip("the test directory and /dev/shm are on the same filesystem")
+	}
+	dst := path.Join(dir, "layer.blob")
+	err = linkBlob(blob, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil || string(data) != "blob" {
+		t.Errorf("copied blob = %q, %v", data, err)
+	}
+}
+
+func TestOfflineAfterCachePruned(t *testing.T) {
+	layer := testLayer(t, tarEntry{Name: "file", Body: "x"})
+	image := testImage(t, layer)
+	config := testConfig(t)
+	config.CacheDir = t.TempDir()
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMetadata(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// prune the cache and lose the extracted layer, the blob next to it is left
+	digest, _ := layer.Digest()
+	for _, p := range []string{config.CacheDir, path.Join(config.layersDir(), digest.Hex)} {
+		err = os.RemoveAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Offline = true
+	local, err := loadLocalImage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pullLayers(context.Background(), config, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path.Join(config.layersDir(), digest.Hex, "file")); err != nil || string(data) != "x" {
+		t.Errorf("file = %q, %v", data, err)
+	}
+}
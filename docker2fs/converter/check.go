@@ -0,0 +1,263 @@
+package converter
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// qemuNames maps GOARCH values to the binfmt_misc handler names
+// registered by qemu-user-static
+var qemuNames = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"arm64":   "aarch64",
+	"arm":     "arm",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+func hostPlatform() v1.Platform {
+	return v1.Platform{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+	}
+}
+
+// canEmulate reports whether a binfmt_misc handler is registered for arch
+func canEmulate(arch string) bool {
+	qemu, ok := qemuNames[arch]
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(path.Join("/proc/sys/fs/binfmt_misc", "qemu-"+qemu))
+	return err == nil
+}
+
+// choosePlatform picks the platform to check, preferring the host and
+// falling back to one that can be emulated. Issues are appended for
+// platforms that can't run here.
+func choosePlatform(ctx context.Context, config *ConverterConfig, ref name.Reference) (v1.Platform, []string, error) {
+	host := hostPlatform()
+	options, err := config.remoteOptions(ctx)
+	if err != nil {
+		return host, nil, err
+	}
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return host, nil, errors.Wrap(err, "fetch source descriptor")
+	}
+	if !desc.MediaType.IsIndex() {
+		return host, nil, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return host, nil, errors.Wrap(err, "get image index")
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return host, nil, errors.Wrap(err, "get index manifest")
+	}
+	var emulated *v1.Platform
+	available := []string{}
+	for _, m := range manifest.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		available = append(available, m.Platform.String())
+		if m.Platform.OS != host.OS {
+			continue
+		}
+		if m.Platform.Architecture == host.Architecture {
+			return host, nil, nil
+		}
+		if emulated == nil && canEmulate(m.Platform.Architecture) {
+			emulated = m.Platform
+		}
+	}
+	if emulated != nil {
+		return *emulated, []string{fmt.Sprintf("no %s image, %s will run under emulation", host.String(), emulated.String())}, nil
+	}
+	return host, nil, errors.Errorf("no image for %s and none can be emulated, available: %s",
+		host.String(), strings.Join(available, ", "))
+}
+
+// indexLayers builds the merged file list of all layers without extracting
+// them, applying whiteouts in order from the bottom layer to the top. Only
+// the entries keep accepts are recorded, with their parent directories.
+func indexLayers(layers []v1.Layer, keep func(header *tar.Header) bool) (map[string]*tar.Header, error) {
+	files := map[string]*tar.Header{}
+	for _, layer := range layers {
+		hash, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		reader, err := layer.Uncompressed()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("layer %s Uncompressed", hash.String()))
+		}
+		tr := tar.NewReader(reader)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return nil, errors.Wrap(err, fmt.Sprintf("read layer %s", hash.String()))
+			}
+			p := path.Join("/", header.Name)
+			dir, base := path.Split(p)
+			if base == ".wh..wh..opq" {
+				removeTree(files, path.Clean(dir), false)
+				continue
+			}
+			if strings.HasPrefix(base, ".wh.") {
+				removeTree(files, path.Join(dir, strings.TrimPrefix(base, ".wh.")), true)
+				continue
+			}
+			if !keep(header) {
+				continue
+			}
+			files[p] = header
+			// parent directories may not have entries of their own
+			for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+				if _, ok := files[dir]; ok {
+					break
+				}
+				files[dir] = &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}
+			}
+		}
+		reader.Close()
+	}
+	return files, nil
+}
+
+func removeTree(files map[string]*tar.Header, p string, self bool) {
+	if self {
+		delete(files, p)
+	}
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for f := range files {
+		if strings.HasPrefix(f, prefix) {
+			delete(files, f)
+		}
+	}
+}
+
+// resolvePath follows symlinks in p, including in parent directories,
+// and returns the header of the final file
+func resolvePath(files map[string]*tar.Header, p string) (*tar.Header, bool) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	current := "/"
+	for hops := 0; len(parts) > 0; {
+		next := path.Join(current, parts[0])
+		parts = parts[1:]
+		header, ok := files[next]
+		if !ok {
+			return nil, false
+		}
+		if header.Typeflag != tar.TypeSymlink {
+			if len(parts) == 0 {
+				return header, true
+			}
+			current = next
+			continue
+		}
+		hops++
+		if hops > 40 {
+			return nil, false
+		}
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(current, target)
+		}
+		parts = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), parts...)
+		current = "/"
+	}
+	return files["/"], true
+}
+
+// lookPath finds an executable in the image the same way a shell would
+func lookPath(files map[string]*tar.Header, file string, env []string) (string, bool) {
+	if strings.Contains(file, "/") {
+		header, ok := resolvePath(files, file)
+		return file, ok && header.Typeflag != tar.TypeDir && header.Mode&0111 != 0
+	}
+	pathEnv := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			pathEnv = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range strings.Split(pathEnv, ":") {
+		p := path.Join("/", dir, file)
+		header, ok := resolvePath(files, p)
+		if ok && header.Typeflag != tar.TypeDir && header.Mode&0111 != 0 {
+			return p, true
+		}
+	}
+	return file, false
+}
+
+// Check reports the issues that would stop the image from running
+// on this host, reading only layer file lists
+func Check(ctx context.Context, config ConverterConfig) ([]string, error) {
+	ref, err := config.reference()
+	if err != nil {
+		return nil, err
+	}
+	platform, issues, err := choosePlatform(ctx, &config, ref)
+	if err != nil {
+		return append(issues, err.Error()), nil
+	}
+	options, err := config.remoteOptions(ctx, remote.WithPlatform(platform))
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(ref, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch source image")
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image config")
+	}
+	if configFile.OS != platform.OS ||
+		(configFile.Architecture != platform.Architecture && !canEmulate(configFile.Architecture)) {
+		issues = append(issues, fmt.Sprintf("image is built for %s/%s and can't run on %s",
+			configFile.OS, configFile.Architecture, platform.String()))
+	}
+	argv := append(append([]string{}, configFile.Config.Entrypoint...), configFile.Config.Cmd...)
+	if len(argv) == 0 {
+		return append(issues, "image declares neither Entrypoint nor Cmd"), nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image layers")
+	}
+	// resolving the entrypoint only needs the symlinks on the way and the
+	// executables it may end at, not the whole file list of the image
+	files, err := indexLayers(layers, func(header *tar.Header) bool {
+		return header.Typeflag == tar.TypeSymlink ||
+			(header.Typeflag != tar.TypeDir && header.Mode&0111 != 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := lookPath(files, argv[0], configFile.Config.Env); !ok {
+		issues = append(issues, fmt.Sprintf("entrypoint %s not found in image", argv[0]))
+	}
+	return issues, nil
+}
@@ -0,0 +1,72 @@
+package converter
+
+import (
+	"archive/tar"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// checkKeep is the filter Check indexes layers with
+func checkKeep(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeSymlink ||
+		(header.Typeflag != tar.TypeDir && header.Mode&0111 != 0)
+}
+
+func TestIndexLayersLookPath(t *testing.T) {
+	base := testLayer(t,
+		tarEntry{Name: "bin", Link: "usr/bin"},
+		tarEntry{Name: "usr/", Dir: true},
+		tarEntry{Name: "usr/bin/", Dir: true},
+		tarEntry{Name: "usr/bin/busybox", Body: "elf", Mode: 0755},
+		tarEntry{Name: "usr/bin/sh", Link: "busybox"},
+		tarEntry{Name: "usr/bin/tool", Body: "elf", Mode: 0755},
+		tarEntry{Name: "usr/bin/notexec", Body: "elf", Mode: 0644},
+		tarEntry{Name: "opt/app/", Dir: true},
+		tarEntry{Name: "opt/app/run", Body: "elf", Mode: 0755},
+		tarEntry{Name: "etc/passwd", Body: "root:x:0:0::/root:/bin/sh\n"},
+	)
+	top := testLayer(t,
+		tarEntry{Name: "usr/bin/.wh.tool", Body: ""},
+		tarEntry{Name: "opt/app/.wh..wh..opq", Body: ""},
+		tarEntry{Name: "opt/app/start", Body: "elf", Mode: 0755},
+	)
+	files, err := indexLayers([]v1.Layer{base, top}, checkKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只记录 symlink 和可执行文件
+	if _, ok := files["/etc/passwd"]; ok {
+		t.Error("/etc/passwd should not be indexed")
+	}
+	env := []string{"PATH=/bin:/opt/app"}
+	for _, test := range []struct {
+		file  string
+		found bool
+	}{
+		{"sh", true},
+		{"/bin/sh", true},
+		{"busybox", true},
+		{"tool", false},
+		{"notexec", false},
+		{"run", false},
+		{"start", true},
+		{"/opt/app/start", true},
+		{"missing", false},
+	} {
+		if _, ok := lookPath(files, test.file, env); ok != test.found {
+			t.Errorf("lookPath(%s) found = %v, want %v", test.file, ok, test.found)
+		}
+	}
+}
+
+func TestResolvePathSymlinkLoop(t *testing.T) {
+	layer := testLayer(t, tarEntry{Name: "a", Link: "b"}, tarEntry{Name: "b", Link: "a"})
+	files, err := indexLayers([]v1.Layer{layer}, checkKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resolvePath(files, "/a"); ok {
+		t.Error("a symlink loop should not resolve")
+	}
+}
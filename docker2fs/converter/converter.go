@@ -0,0 +1,990 @@
+// Package converter pulls images from a registry and lays them out as
+// extracted layer directories for runInNamespace
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"common/layout"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// ConverterConfig describes the conversion of one image
+type ConverterConfig struct {
+	// Source is a registry reference, or docker-archive:<file>[:<tag>]
+	// for a tarball written by `docker save`
+	Source string
+	Path   string
+	// LayersPath overrides where layers are stored, so that images
+	// converted in one batch can share them. Defaults to Path/layers.
+	LayersPath string
+	// Mirror replaces Docker Hub (docker.io, registry-1.docker.io) in
+	// Source, for hosts that can only reach Hub through a mirror
+	Mirror string
+	// BlobHost serves layer blobs instead of the source registry,
+	// manifest and config are still fetched from the registry
+	BlobHost string
+	// ManifestFirst writes manifest.json and config.json before pulling
+	// layers, so a runtime waiting on them can start as soon as the
+	// layers it needs are extracted
+	ManifestFirst bool
+	// BundleFS, if set, also packs the layers into Path/bundle.img as
+	// filesystem images of this type (squashfs or ext4)
+	BundleFS string
+	// Report prints a SizeReport once the image is converted
+	Report bool
+	// OnlyConfigChanged skips pulling when the manifest already at Path
+	// has the same layers, only the config and manifest are rewritten
+	OnlyConfigChanged bool
+	// PreserveTimestamps gives directories without an entry in the layer
+	// tar the image created time, or SOURCE_DATE_EPOCH, so extracting twice
+	// gives the same tree
+	PreserveTimestamps bool
+	// IDShift is added to the uid and gid of every extracted file, to
+	// match a user namespace mapping container root to IDShift. Layers
+	// already extracted are not shifted again.
+	IDShift int
+	// Squash merges all layers into one directory after extraction and
+	// rewrites manifest.json to list only that one
+	Squash bool
+	// IndexPolicy decides how a manifest list is converted, see
+	// IndexPolicyHost. Empty means host.
+	IndexPolicy string
+	// StrictCompression takes the layer compression from its media type
+	// instead of sniffing the blob, unknown media types and blobs that
+	// don't match their media type are errors
+	StrictCompression bool
+	// CacheDir keeps compressed blobs by digest, so a layer shared by
+	// several images or converted again is downloaded once. Empty
+	// disables the cache.
+	CacheDir string
+	// Offline converts from what an earlier conversion left in Path and
+	// the blob cache without any network access, failing if a layer is
+	// neither extracted nor cached
+	Offline bool
+	// Refresh resolves the source and fetches its manifest and config
+	// again, instead of resuming from the ones an earlier conversion of
+	// the same source left in Path
+	Refresh bool
+	// DownloadConcurrency and ExtractConcurrency bound the layers of one
+	// image downloaded and extracted at the same time, 0 means 1.
+	// Extraction of a downloaded layer overlaps the other downloads.
+	DownloadConcurrency int
+	ExtractConcurrency  int
+	// RateLimit caps the download rate, copies of the config share it, so
+	// it covers every image of a batch together. nil means no limit.
+	RateLimit *RateLimiter
+	// MaxOpenFiles bounds the files held open by pulls and extractions,
+	// shared by copies of the config like RateLimit. nil means no limit.
+	MaxOpenFiles *FileLimiter
+	// HTTPProxy, HTTPSProxy and NoProxy configure the proxy for registry
+	// requests, each falls back to its environment variable when empty
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+	// Insecure allows plain HTTP registries and skips TLS verification
+	Insecure bool
+	// SkipForeign leaves foreign layers out, an empty directory stands
+	// in for each, instead of fetching them from the urls of their
+	// descriptor
+	SkipForeign bool
+	// CACerts are PEM files of extra root certificates trusted for
+	// registries, on top of the system ones
+	CACerts []string
+	// Platform selects the image of a manifest list, nil means the host
+	// platform subject to IndexPolicy
+	Platform *v1.Platform
+	// Variant overrides the variant of Platform or the host platform,
+	// e.g. v7 for arm, and the pulled image must have it
+	Variant string
+	// pullOnly leaves the layers as <hex>.tar without extracting them, set by Pull
+	pullOnly bool
+	// dirTime is the mtime of directories the layer tars don't record,
+	// set by pullLayers with PreserveTimestamps
+	dirTime time.Time
+}
+
+// platform returns the platform to pull from a manifest list
+func (config *ConverterConfig) platform() v1.Platform {
+	platform := hostPlatform()
+	if config.Platform != nil {
+		platform = *config.Platform
+	}
+	if config.Variant != "" {
+		platform.Variant = config.Variant
+	}
+	return platform
+}
+
+// normalVariant fills in the variant arm64 images usually leave out
+func normalVariant(arch, variant string) string {
+	if arch == "arm64" && variant == "" {
+		return "v8"
+	}
+	return variant
+}
+
+// matchPlatform is the platform to look up in a manifest list. An arm64
+// entry usually leaves out v8, so v8 is not matched on, checkVariant
+// still requires it of the pulled image.
+func matchPlatform(platform v1.Platform) v1.Platform {
+	if platform.Architecture == "arm64" && platform.Variant == "v8" {
+		platform.Variant = ""
+	}
+	return platform
+}
+
+// checkVariant fails if the pulled image is not of the wanted variant.
+// A source that is a single image instead of a manifest list is pulled
+// whatever its platform, so its config is checked as well.
+func checkVariant(img v1.Image, want v1.Platform) error {
+	if want.Variant == "" {
+		return nil
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "get image config")
+	}
+	got := normalVariant(configFile.Architecture, configFile.Variant)
+	if got != normalVariant(want.Architecture, want.Variant) {
+		return errors.Errorf("image is %s/%s variant %q, not the requested %s",
+			configFile.OS, configFile.Architecture, configFile.Variant, want.String())
+	}
+	return nil
+}
+
+func (config *ConverterConfig) layersDir() string {
+	if config.LayersPath != "" {
+		return config.LayersPath
+	}
+	return layout.New(config.Path).Layers
+}
+
+// LayerInfo describes a pulled layer, written to layers.json for tooling
+type LayerInfo struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType"`
+	Path      string `json:"path,omitempty"`
+}
+
+type Image struct {
+	Ref name.Reference
+	Img v1.Image
+}
+
+// taggedDigest returns the tag of a name@digest reference that also carries
+// a tag, such as img:tag@sha256:..., or "" if there is none
+func taggedDigest(ref name.Reference) string {
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		return ""
+	}
+	base := strings.SplitN(digest.String(), "@", 2)[0]
+	repo := base[strings.LastIndex(base, "/")+1:]
+	if i := strings.LastIndex(repo, ":"); i >= 0 {
+		return repo[i+1:]
+	}
+	return ""
+}
+
+// checkOS fails for images that don't run on Linux, such as Windows
+// images, their layers don't make a Linux rootfs
+func checkOS(config *ConverterConfig, img v1.Image) error {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "get image config")
+	}
+	if configFile.OS == "windows" {
+		return errors.Errorf("%s is a Windows image (os %s, os.version %s), Windows images are not supported",
+			config.Source, configFile.OS, configFile.OSVersion)
+	}
+	return nil
+}
+
+func createImage(ctx context.Context, config *ConverterConfig) (*Image, error) {
+	image, err := loadImage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOS(config, image.Img)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// loadImage returns the source image from an archive, an earlier
+// conversion or the registry
+func loadImage(ctx context.Context, config *ConverterConfig) (*Image, error) {
+	if _, _, ok := archiveSource(config.Source); ok {
+		return loadArchiveImage(config)
+	}
+	if config.Offline {
+		return loadLocalImage(config)
+	}
+	// -only-config-changed asks the registry whether the config changed
+	if !config.Refresh && !config.OnlyConfigChanged {
+		image, err := resumeImage(ctx, config)
+		if image != nil || err != nil {
+			return image, err
+		}
+	}
+	ref, err := config.reference()
+	if err != nil {
+		return nil, err
+	}
+	// the registry is only asked for the digest, the tag may point elsewhere by now
+	if tag := taggedDigest(ref); tag != "" {
+		slog.Warn("reference has both a tag and a digest, pulling by digest",
+			"source", config.Source, "tag", tag, "digest", ref.Identifier())
+	}
+	platform := config.platform()
+	options, err := config.remoteOptions(ctx, remote.WithPlatform(matchPlatform(platform)))
+	if err != nil {
+		return nil, err
+	}
+	image, err := remote.Image(ref, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch source image")
+	}
+	err = checkVariant(image, platform)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		Ref: ref,
+		Img: image,
+	}, nil
+}
+
+// extractLayer extracts the tar pullLayer wrote, xattrs are the extended
+// attributes pullLayer collected from it
+func extractLayer(ctx context.Context, config *ConverterConfig, layer v1.Layer, xattrs []fileXattrs) error {
+	hash, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	layerTarPath := path.Join(config.layersDir(), hash.Hex+".tar")
+	extractDir := path.Join(config.layersDir(), hash.Hex)
+	// the marker goes first, a directory without it is extracted again
+	err = os.Remove(layout.CompleteMarker(extractDir))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, fmt.Sprintf("remove complete marker of layer %s", hash.String()))
+	}
+	// extract next to the final directory and rename it into place, so the
+	// layer directory only appears once it is complete
+	partialDir := extractDir + ".partial"
+	err = os.RemoveAll(partialDir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("remove partial layer directory %s", hash.String()))
+	}
+	err = os.MkdirAll(partialDir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("create layer directory %s", hash.String()))
+	}
+	// tar keeps the archive and one extracted file open at a time
+	release, err := acquireFiles(ctx, config, 2)
+	if err != nil {
+		os.RemoveAll(partialDir)
+		return err
+	}
+	defer release()
+	// keep mode bits regardless of umask and the numeric uid/gid recorded in
+	// the tar, the host's passwd has nothing to do with the image's users.
+	// Only root can chown, others extract as themselves.
+	args := []string{"-xf", layerTarPath, "-C", partialDir, "--preserve-permissions", "--numeric-owner"}
+	if os.Geteuid() == 0 {
+		args = append(args, "--same-owner")
+	}
+	cmd := exec.CommandContext(ctx, "tar", args...)
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(partialDir)
+		return errors.Wrap(err, fmt.Sprintf("extract layer %s", hash.String()))
+	}
+	if config.IDShift > 0 {
+		err = shiftOwners(partialDir, config.IDShift)
+		if err != nil {
+			os.RemoveAll(partialDir)
+			return errors.Wrap(err, fmt.Sprintf("shift owners of layer %s", hash.String()))
+		}
+	}
+	err = restoreXattrs(partialDir, xattrs)
+	if err != nil {
+		os.RemoveAll(partialDir)
+		return errors.Wrap(err, fmt.Sprintf("restore extended attributes of layer %s", hash.String()))
+	}
+	if config.PreserveTimestamps {
+		err = fixDirTimes(layerTarPath, partialDir, config.dirTime)
+		if err != nil {
+			os.RemoveAll(partialDir)
+			return errors.Wrap(err, fmt.Sprintf("set directory times of layer %s", hash.String()))
+		}
+	}
+	err = os.RemoveAll(extractDir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("remove old layer directory %s", hash.String()))
+	}
+	err = os.Rename(partialDir, extractDir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("rename layer directory %s", hash.String()))
+	}
+	err = os.WriteFile(layout.CompleteMarker(extractDir), nil, 0644)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("write complete marker of layer %s", hash.String()))
+	}
+	return nil
+}
+
+// layerComplete reports whether the layer hex under layersDir was fully
+// extracted and its tar kept for verify
+func layerComplete(layersDir, hex string) bool {
+	extractDir := path.Join(layersDir, hex)
+	info, err := os.Stat(extractDir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	for _, p := range []string{layout.CompleteMarker(extractDir), extractDir + ".tar"} {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// blobHostLayer fetches the compressed blob from another host while the
+// rest of the layer metadata comes from the registry manifest
+type blobHostLayer struct {
+	v1.Layer
+	blob v1.Layer
+}
+
+func (l *blobHostLayer) Compressed() (io.ReadCloser, error) {
+	return l.blob.Compressed()
+}
+
+func withBlobHost(ctx context.Context, config *ConverterConfig, ref name.Reference, layer v1.Layer) (v1.Layer, error) {
+	hash, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	blobRef, err := name.NewDigest(fmt.Sprintf("%s/%s@%s",
+		config.BlobHost, ref.Context().RepositoryStr(), hash.String()), config.nameOptions()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse blob host reference")
+	}
+	options, err := config.remoteOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := remote.Layer(blobRef, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("fetch layer %s from blob host", hash.String()))
+	}
+	return &blobHostLayer{Layer: layer, blob: blob}, nil
+}
+
+// mediaTypeCompression returns the compression a layer media type declares
+func mediaTypeCompression(mediaType types.MediaType) (compression.Compression, error) {
+	switch mediaType {
+	case types.DockerLayer, types.DockerForeignLayer, types.OCILayer, types.OCIRestrictedLayer:
+		return compression.Gzip, nil
+	case types.DockerUncompressedLayer, types.OCIUncompressedLayer, types.OCIUncompressedRestrictedLayer:
+		return compression.Uncompressed, nil
+	case types.OCILayerZStd:
+		return compression.Zstd, nil
+	}
+	return compression.Uncompressed, errors.Errorf("media type %s doesn't declare a known compression", mediaType)
+}
+
+func compressionName(c compression.Compression) string {
+	switch c {
+	case compression.Gzip:
+		return "gzip"
+	case compression.Zstd:
+		return "zstd"
+	}
+	return "uncompressed"
+}
+
+// pullLayer writes the uncompressed tar of layer under the layers
+// directory and returns the extended attributes recorded in it
+func pullLayer(ctx context.Context, config *ConverterConfig, layer v1.Layer) ([]fileXattrs, error) {
+	hash, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	// the blob connection and the tar file being written
+	release, err := acquireFiles(ctx, config, 2)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// Pull the layer from source, we need to retry in case of
+	// the layer is compressed or uncompressed
+	var reader io.ReadCloser
+	reader, err = openCompressed(ctx, config, layer)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("layer %s Compressed", hash.String()))
+	}
+	defer reader.Close()
+	ds, err := compression.DecompressStream(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("decompress layer %s", hash.String()))
+	}
+	defer ds.Close()
+	if config.StrictCompression {
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("get layer %s media type", hash.String()))
+		}
+		want, err := mediaTypeCompression(mediaType)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("layer %s", hash.String()))
+		}
+		if got := ds.GetCompression(); got != want {
+			return nil, errors.Errorf("layer %s has media type %s but its content is %s",
+				hash.String(), mediaType, compressionName(got))
+		}
+	}
+	layerTarPath := path.Join(config.layersDir(), hash.Hex+".tar")
+	layerTarDir := filepath.Dir(layerTarPath)
+	err = os.MkdirAll(layerTarDir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("create layer directory %s", hash.String()))
+	}
+	// write next to the final path so an interrupted pull never leaves a
+	// truncated <hex>.tar behind
+	partialPath := layerTarPath + ".partial"
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("write layer %s create file", hash.String()))
+	}
+	xattrs, err := copyLayerTar(file, &contextReader{ctx: ctx, r: ds})
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return nil, errors.Wrap(err, fmt.Sprintf("write layer %s to file", hash.String()))
+	}
+	err = os.Rename(partialPath, layerTarPath)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("rename layer %s", hash.String()))
+	}
+	return xattrs, nil
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func layerInfo(config *ConverterConfig, layer v1.Layer) (*LayerInfo, error) {
+	hash, err := layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("layer %s DiffID", hash.String()))
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("layer %s Size", hash.String()))
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("layer %s MediaType", hash.String()))
+	}
+	return &LayerInfo{
+		Digest:    hash.String(),
+		DiffID:    diffID.String(),
+		Size:      size,
+		MediaType: string(mediaType),
+		Path:      path.Join(config.layersDir(), hash.Hex),
+	}, nil
+}
+
+func createLayersFile(config *ConverterConfig, infos []*LayerInfo) error {
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal layers file")
+	}
+	layersPath := path.Join(config.Path, "layers.json")
+	err = os.MkdirAll(filepath.Dir(layersPath), os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "create layers directory")
+	}
+	err = os.WriteFile(layersPath, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write layers file")
+	}
+	return nil
+}
+
+// layerLocks serializes work on the same layer across concurrent conversions
+var layerLocks sync.Map
+
+// claimLayer locks the layer hash under the shared layers directory and
+// reports whether it still has to be pulled. The returned function
+// releases the lock once the layer is extracted or given up on. Only the
+// layers directory on disk says what is extracted, gc or a removed store
+// may have taken away a layer an earlier convert of this process pulled.
+func claimLayer(config *ConverterConfig, hash v1.Hash) (func(), bool) {
+	key := path.Join(config.layersDir(), hash.Hex)
+	lock, _ := layerLocks.LoadOrStore(key, &sync.Mutex{})
+	release := lock.(*sync.Mutex).Unlock
+	lock.(*sync.Mutex).Lock()
+	// another convert or an earlier run got this layer through, only
+	// incomplete ones are pulled and extracted again
+	if layerComplete(config.layersDir(), hash.Hex) {
+		slog.Debug("layer already extracted", "digest", hash.String())
+		release()
+		return nil, false
+	}
+	return release, true
+}
+
+// LayerFailure records a layer that could not be pulled and why
+type LayerFailure struct {
+	Digest string
+	Err    error
+}
+
+// PullLayersError reports every failed layer along with the ones that
+// completed, so that a retry can target the failures
+type PullLayersError struct {
+	Completed []string
+	Failed    []LayerFailure
+}
+
+func (e *PullLayersError) Error() string {
+	lines := []string{fmt.Sprintf("%d of %d layers failed",
+		len(e.Failed), len(e.Failed)+len(e.Completed))}
+	for _, failure := range e.Failed {
+		lines = append(lines, fmt.Sprintf("  failed %s: %v", failure.Digest, failure.Err))
+	}
+	for _, digest := range e.Completed {
+		lines = append(lines, fmt.Sprintf("  completed %s", digest))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pullLayers pulls every layer even if some fail, and returns a
+// *PullLayersError describing the failures
+func pullLayers(ctx context.Context, config *ConverterConfig, image *Image) error {
+	layers, err := image.Img.Layers()
+	if err != nil {
+		return errors.Wrap(err, "get image layers")
+	}
+	if config.PreserveTimestamps {
+		config.dirTime, err = dirTime(image.Img)
+		if err != nil {
+			return err
+		}
+	}
+	pullErr := &PullLayersError{}
+	// a layer listed several times is pulled once, layers.json still has
+	// an entry for every position
+	hashes := make([]v1.Hash, 0, len(layers))
+	unique, uniqueHashes := []v1.Layer{}, []v1.Hash{}
+	skipped := []v1.Layer{}
+	failed := map[v1.Hash]error{}
+	seen := map[v1.Hash]bool{}
+	for _, layer := range layers {
+		hash, err := layer.Digest()
+		if err != nil {
+			return errors.Wrap(err, "get image layer digest")
+		}
+		hashes = append(hashes, hash)
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		urls, foreign, err := foreignURLs(layer)
+		if err != nil {
+			failed[hash] = errors.Wrap(err, fmt.Sprintf("get layer %s descriptor", hash.String()))
+			continue
+		}
+		if foreign && config.SkipForeign {
+			skipped = append(skipped, layer)
+			continue
+		}
+		if foreign && len(urls) == 0 {
+			failed[hash] = errors.Errorf("foreign layer %s has no urls to fetch it from, convert with -skip-foreign to leave it out", hash.String())
+			continue
+		}
+		if foreign {
+			// the registry is tried first, then the urls
+			slog.Info("fetching foreign layer", "digest", hash.String(), "urls", urls)
+		} else if config.BlobHost != "" {
+			layer, err = withBlobHost(ctx, config, image.Ref, layer)
+			if err != nil {
+				failed[hash] = err
+				continue
+			}
+		}
+		unique = append(unique, layer)
+		uniqueHashes = append(uniqueHashes, hash)
+	}
+	infoOf := map[v1.Hash]*LayerInfo{}
+	for _, layer := range skipped {
+		hash, _ := layer.Digest()
+		err := skipForeignLayer(config, hash)
+		var info *LayerInfo
+		if err == nil {
+			info, err = layerInfo(config, layer)
+		}
+		if err != nil {
+			failed[hash] = err
+			continue
+		}
+		infoOf[hash] = info
+	}
+	for i, err := range pipelineLayers(ctx, config, unique) {
+		hash := uniqueHashes[i]
+		var info *LayerInfo
+		if err == nil {
+			info, err = layerInfo(config, unique[i])
+		}
+		if err != nil {
+			failed[hash] = err
+			continue
+		}
+		infoOf[hash] = info
+	}
+	infos := make([]*LayerInfo, 0, len(layers))
+	reported := map[v1.Hash]bool{}
+	for _, hash := range hashes {
+		if info, ok := infoOf[hash]; ok {
+			infos = append(infos, info)
+		}
+		if reported[hash] {
+			continue
+		}
+		reported[hash] = true
+		if err, ok := failed[hash]; ok {
+			pullErr.Failed = append(pullErr.Failed, LayerFailure{Digest: hash.String(), Err: err})
+		} else {
+			pullErr.Completed = append(pullErr.Completed, hash.String())
+		}
+	}
+	if len(pullErr.Failed) > 0 {
+		return pullErr
+	}
+	return createLayersFile(config, infos)
+}
+
+func createManifest(config *ConverterConfig, image *Image) error {
+	manifest, err := image.Img.RawManifest()
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	manifestPath := layout.New(config.Path).Manifest
+	file, err := os.Create(manifestPath)
+	if err != nil {
+		return errors.Wrap(err, "create manifest file")
+	}
+	defer file.Close()
+	_, err = file.Write(manifest)
+	if err != nil {
+		return errors.Wrap(err, "write manifest file")
+	}
+	return nil
+}
+
+// Resolved records which digest the source reference resolved to, so the
+// same image can be converted again with Reference
+type Resolved struct {
+	Source    string `json:"source"`
+	Digest    string `json:"digest"`
+	Reference string `json:"reference"`
+}
+
+// createResolvedFile writes resolved.json next to manifest.json
+func createResolvedFile(config *ConverterConfig, image *Image) error {
+	digest, err := image.Img.Digest()
+	if err != nil {
+		return errors.Wrap(err, "get image digest")
+	}
+	resolved := &Resolved{
+		Source:    config.Source,
+		Digest:    digest.String(),
+		Reference: image.Ref.Context().Digest(digest.String()).String(),
+	}
+	data, err := json.MarshalIndent(resolved, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal resolved digest")
+	}
+	err = os.WriteFile(path.Join(config.Path, "resolved.json"), data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write resolved file")
+	}
+	return nil
+}
+
+func createConfig(config *ConverterConfig, image *Image) error {
+	configFile, err := image.Img.RawConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "get image config")
+	}
+	configPath := layout.New(config.Path).Config
+	file, err := os.Create(configPath)
+	if err != nil {
+		return errors.Wrap(err, "create config file")
+	}
+	defer file.Close()
+	_, err = file.Write(configFile)
+	if err != nil {
+		return errors.Wrap(err, "write config file")
+	}
+	return nil
+}
+
+func convertBundle(config *ConverterConfig, image *Image) error {
+	if config.BundleFS == "" {
+		return nil
+	}
+	slog.Info("creating bundle", "source", config.Source, "fs", config.BundleFS)
+	return createBundle(config, image)
+}
+
+// Result describes a converted image. Converting a manifest list with
+// IndexPolicyAll gives one Result per platform in Platforms.
+type Result struct {
+	Source string
+	// Digest is the manifest digest the source resolved to and Reference
+	// pins the source to it
+	Digest    string
+	Reference string
+	// Path holds config.json and manifest.json, Layers the extracted layer
+	// directories, possibly shared with other images
+	Path         string
+	ConfigPath   string
+	ManifestPath string
+	LayersPath   string
+	// LayerInfos lists the layers in manifest order, as in layers.json
+	LayerInfos []*LayerInfo
+	// Report is set when ConverterConfig.Report is
+	Report    *SizeReport
+	Platforms []*Result
+}
+
+// result describes image once converted as config asks
+func result(config *ConverterConfig, image *Image) (*Result, error) {
+	digest, err := image.Img.Digest()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image digest")
+	}
+	layers, err := image.Img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image layers")
+	}
+	infos := make([]*LayerInfo, 0, len(layers))
+	for _, layer := range layers {
+		info, err := layerInfo(config, layer)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	paths := layout.New(config.Path)
+	res := &Result{
+		Source:       config.Source,
+		Digest:       digest.String(),
+		Reference:    image.Ref.Context().Digest(digest.String()).String(),
+		Path:         config.Path,
+		ConfigPath:   paths.Config,
+		ManifestPath: paths.Manifest,
+		LayersPath:   config.layersDir(),
+		LayerInfos:   infos,
+	}
+	if config.Report {
+		res.Report, err = sizeReport(config, image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// writeMetadata writes config.json, manifest.json and resolved.json,
+// config first so that a complete manifest always has its config
+func writeMetadata(config *ConverterConfig, image *Image) error {
+	err := createConfig(config, image)
+	if err != nil {
+		return err
+	}
+	err = createManifest(config, image)
+	if err != nil {
+		return err
+	}
+	return createResolvedFile(config, image)
+}
+
+// layersManifestPath returns the manifest listing the pulled layers of the
+// image converted into dir, which is manifest.orig.json once squashed
+func layersManifestPath(dir string) string {
+	orig := path.Join(dir, "manifest.orig.json")
+	if _, err := os.Stat(orig); err == nil {
+		return orig
+	}
+	return layout.New(dir).Manifest
+}
+
+// sameLayers reports whether the manifest already at config.Path lists
+// the same layers as image and all of them are extracted
+func sameLayers(config *ConverterConfig, image *Image) (bool, error) {
+	file, err := os.Open(layersManifestPath(config.Path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "open existing manifest")
+	}
+	defer file.Close()
+	old, err := v1.ParseManifest(file)
+	if err != nil {
+		return false, errors.Wrap(err, "parse existing manifest")
+	}
+	manifest, err := image.Img.Manifest()
+	if err != nil {
+		return false, errors.Wrap(err, "get image manifest")
+	}
+	if len(old.Layers) != len(manifest.Layers) {
+		return false, nil
+	}
+	for i, layer := range manifest.Layers {
+		if old.Layers[i].Digest != layer.Digest {
+			return false, nil
+		}
+		if !layerComplete(config.layersDir(), layer.Digest.Hex) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func convertSquash(config *ConverterConfig, image *Image) error {
+	if !config.Squash {
+		return nil
+	}
+	slog.Info("squashing layers", "source", config.Source)
+	return squashLayers(config, image)
+}
+
+// Convert pulls config.Source and writes it under config.Path for
+// runInNamespace to run
+func Convert(ctx context.Context, config ConverterConfig) (*Result, error) {
+	return convert(ctx, &config)
+}
+
+func convert(ctx context.Context, config *ConverterConfig) (*Result, error) {
+	slog.Info("converting", "source", config.Source, "path", config.Path)
+	err := checkIDShift(config.IDShift)
+	if err != nil {
+		return nil, err
+	}
+	// gc doesn't run until the manifest naming the pulled layers is written
+	unlock, err := lockLayers(config.layersDir(), syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	res, err := applyIndexPolicy(ctx, config)
+	if res != nil || err != nil {
+		return res, err
+	}
+	image, err := createImage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.OnlyConfigChanged {
+		same, err := sameLayers(config, image)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			slog.Info("layers unchanged, only rewriting config", "source", config.Source)
+			err = writeMetadata(config, image)
+			if err != nil {
+				return nil, err
+			}
+			err = convertSquash(config, image)
+			if err != nil {
+				return nil, err
+			}
+			return result(config, image)
+		}
+	}
+	if config.ManifestFirst {
+		err = os.MkdirAll(config.Path, os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrap(err, "create output directory")
+		}
+		err = writeMetadata(config, image)
+		if err != nil {
+			return nil, err
+		}
+		err = pullLayers(ctx, config, image)
+		if err != nil {
+			return nil, err
+		}
+		err = convertBundle(config, image)
+		if err != nil {
+			return nil, err
+		}
+		err = convertSquash(config, image)
+		if err != nil {
+			return nil, err
+		}
+		return result(config, image)
+	}
+	err = pullLayers(ctx, config, image)
+	if err != nil {
+		return nil, err
+	}
+	err = convertBundle(config, image)
+	if err != nil {
+		return nil, err
+	}
+	err = writeMetadata(config, image)
+	if err != nil {
+		return nil, err
+	}
+	err = convertSquash(config, image)
+	if err != nil {
+		return nil, err
+	}
+	return result(config, image)
+}
@@ -0,0 +1,793 @@
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"common/layout"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// tarEntry is one file of a test layer, a directory when Dir is set and a
+// symlink to Link when Link is set
+type tarEntry struct {
+	Name string
+	Body string
+	Mode int64
+	Dir  bool
+	Link string
+	PAX  map[string]string
+	Uid  int
+	Gid  int
+	// Uname is the recorded owner name, extraction must ignore it
+	Uname string
+	// ModTime is the recorded mtime, the zero time when unset
+	ModTime time.Time
+}
+
+// layerTar returns an uncompressed tar of entries
+func layerTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:       entry.Name,
+			Mode:       entry.Mode,
+			Uid:        entry.Uid,
+			Gid:        entry.Gid,
+			Uname:      entry.Uname,
+			ModTime:    entry.ModTime,
+			PAXRecords: entry.PAX,
+			Format:     tar.FormatPAX,
+		}
+		switch {
+		case entry.Dir:
+			hdr.Typeflag = tar.TypeDir
+			if hdr.Mode == 0 {
+				hdr.Mode = 0755
+			}
+		case entry.Link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.Link
+			hdr.Mode = 0777
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.Body))
+			if hdr.Mode == 0 {
+				hdr.Mode = 0644
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(entry.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testLayer returns a gzip layer holding entries
+func testLayer(t *testing.T, entries ...tarEntry) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(layerTar(t, entries...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// brokenLayer returns a layer whose content is not a tar, extracting it fails
+func brokenLayer(t *testing.T) v1.Layer {
+	t.Helper()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(strings.Repeat("not a tar", 100))), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// testImage returns a linux/amd64 image of layers, as if pulled from
+// example.com/test
+func testImage(t *testing.T, layers ...v1.Layer) *Image {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS = "linux"
+	configFile.Architecture = "amd64"
+	configFile.Config.Entrypoint = []string{"/bin/sh"}
+	img, err = mutate.ConfigFile(img, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Image{Ref: name.MustParseReference("example.com/test:latest"), Img: img}
+}
+
+// testConfig returns a config converting into a fresh temporary directory
+func testConfig(t *testing.T) *ConverterConfig {
+	t.Helper()
+	dir := t.TempDir()
+	return &ConverterConfig{Source: "example.com/test:latest", Path: dir}
+}
+
+func TestPullLayersWritesLayersFile(t *testing.T) {
+	first := testLayer(t, tarEntry{Name: "etc/", Dir: true}, tarEntry{Name: "etc/os-release", Body: "ID=test\n"})
+	second := testLayer(t, tarEntry{Name: "bin/", Dir: true}, tarEntry{Name: "bin/true", Body: "#!/bin/sh\n", Mode: 0755})
+	// a layer listed twice is pulled once but keeps both entries
+	image := testImage(t, first, second, first)
+	config := testConfig(t)
+
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path.Join(config.Path, "layers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []LayerInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		t.Fatal(err)
+	}
+	layers := []v1.Layer{first, second, first}
+	if len(infos) != len(layers) {
+		t.Fatalf("layers.json has %d entries, want %d", len(infos), len(layers))
+	}
+	for i, layer := range layers {
+		digest, _ := layer.Digest()
+		diffID, _ := layer.DiffID()
+		size, _ := layer.Size()
+		want := LayerInfo{
+			Digest:    digest.String(),
+			DiffID:    diffID.String(),
+			Size:      size,
+			MediaType: string(types.DockerLayer),
+			Path:      path.Join(config.layersDir(), digest.Hex),
+		}
+		if infos[i] != want {
+			t.Errorf("layers.json entry %d = %+v, want %+v", i, infos[i], want)
+		}
+		if !layerComplete(config.layersDir(), digest.Hex) {
+			t.Errorf("layer %d is not marked complete", i)
+		}
+	}
+	body, err := os.ReadFile(path.Join(infos[1].Path, "bin/true"))
+	if err != nil || string(body) != "#!/bin/sh\n" {
+		t.Errorf("bin/true = %q, %v", body, err)
+	}
+}
+
+func TestPullLayersReportsFailures(t *testing.T) {
+	good := testLayer(t, tarEntry{Name: "good", Body: "good"})
+	broken := brokenLayer(t)
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, testImage(t, good, broken))
+	pullErr, ok := err.(*PullLayersError)
+	if !ok {
+		t.Fatalf("pullLayers = %v, want a *PullLayersError", err)
+	}
+	goodDigest, _ := good.Digest()
+	brokenDigest, _ := broken.Digest()
+	if len(pullErr.Completed) != 1 || pullErr.Completed[0] != goodDigest.String() {
+		t.Errorf("Completed = %v, want %s", pullErr.Completed, goodDigest)
+	}
+	if len(pullErr.Failed) != 1 || pullErr.Failed[0].Digest != brokenDigest.String() || pullErr.Failed[0].Err == nil {
+		t.Fatalf("Failed = %+v, want %s", pullErr.Failed, brokenDigest)
+	}
+	if !strings.HasPrefix(err.Error(), "1 of 2 layers failed\n  failed "+brokenDigest.String()) {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	// the layer that did complete is kept for a retry
+	if !layerComplete(config.layersDir(), goodDigest.Hex) {
+		t.Error("the good layer is not marked complete")
+	}
+	if _, err := os.Stat(path.Join(config.Path, "layers.json")); !os.IsNotExist(err) {
+		t.Error("layers.json was written for a failed pull")
+	}
+}
+
+func TestPullLayersRepeatedLayerOnce(t *testing.T) {
+	downloads := &atomic.Int32{}
+	layer := &countingLayer{Layer: testLayer(t, tarEntry{Name: "repeated", Body: "repeated"}), downloads: downloads}
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, testImage(t, layer, testLayer(t, tarEntry{Name: "other"}), layer, layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("the repeated layer was downloaded %d times, want once", n)
+	}
+
+	// a repeated layer that fails is reported once
+	broken := brokenLayer(t)
+	brokenDigest, _ := broken.Digest()
+	err = pullLayers(context.Background(), testConfig(t), testImage(t, broken, layer, broken))
+	pullErr, ok := err.(*PullLayersError)
+	if !ok {
+		t.Fatalf("pullLayers = %v, want a *PullLayersError", err)
+	}
+	if len(pullErr.Failed) != 1 || pullErr.Failed[0].Digest != brokenDigest.String() || len(pullErr.Completed) != 1 {
+		t.Errorf("Failed = %+v, Completed = %v, want one of each", pullErr.Failed, pullErr.Completed)
+	}
+}
+
+func TestLayersDir(t *testing.T) {
+	config := &ConverterConfig{Path: "/srv/img"}
+	if got := config.layersDir(); got != layout.New("/srv/img").Layers {
+		t.Errorf("layersDir = %s, want the layout's layers directory", got)
+	}
+	config.LayersPath = "/srv/shared"
+	if got := config.layersDir(); got != "/srv/shared" {
+		t.Errorf("layersDir with LayersPath = %s, want /srv/shared", got)
+	}
+}
+
+func TestBlobHost(t *testing.T) {
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "from the blob host"}))
+	layers, err := image.Img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := startRegistry(t)
+	blobs := startRegistry(t)
+	ref := source.push(t, image, "team/app")
+	blobs.push(t, image, "team/app")
+
+	config := ConverterConfig{Source: ref, Path: t.TempDir(), BlobHost: blobs.Host, Insecure: true}
+	_, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the layer comes from the same repository on the blob host, the
+	// manifest from the registry
+	if source.fetched("/blobs/" + hash.String()) {
+		t.Error("the layer blob was fetched from the registry")
+	}
+	if !blobs.fetched("/v2/team/app/blobs/" + hash.String()) {
+		t.Error("the layer blob was not fetched from the blob host")
+	}
+	if !source.fetched("/manifests/latest") || blobs.fetched("/manifests/") {
+		t.Error("the manifest should come from the registry only")
+	}
+	data, err := os.ReadFile(path.Join(config.layersDir(), hash.Hex, "file"))
+	if err != nil || string(data) != "from the blob host" {
+		t.Errorf("extracted file = %q, %v", data, err)
+	}
+
+	// a blob host without the layer fails the pull instead of falling back
+	missing := startRegistry(t)
+	config = ConverterConfig{Source: ref, Path: t.TempDir(), BlobHost: missing.Host, Insecure: true}
+	_, err = Convert(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), hash.String()) {
+		t.Errorf("Convert = %v, want the layer to fail", err)
+	}
+	if source.fetched("/blobs/" + hash.String()) {
+		t.Error("the registry was used after the blob host failed")
+	}
+}
+
+func TestTaggedDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"example.com/team/app:v1", ""},
+		{"example.com/team/app@" + digest, ""},
+		{"example.com/team/app:v1@" + digest, "v1"},
+		{"example.com:5000/app@" + digest, ""},
+		{"example.com:5000/app:v1@" + digest, "v1"},
+		{"app:latest@" + digest, "latest"},
+	}
+	for _, test := range tests {
+		ref, err := name.ParseReference(test.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := taggedDigest(ref); got != test.want {
+			t.Errorf("taggedDigest(%s) = %q, want %q", test.ref, got, test.want)
+		}
+	}
+}
+
+func TestTaggedDigestPullsByDigest(t *testing.T) {
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "pinned"}))
+	digest, err := image.Img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := startRegistry(t)
+	reg.push(t, image, "app")
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// the tag was never pushed, only the digest is asked for
+	source := reg.Host + "/app:moved@" + digest.String()
+	_, err = Convert(context.Background(), ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.fetched("/manifests/moved") || !reg.fetched("/manifests/"+digest.String()) {
+		t.Error("the manifest was not fetched by digest")
+	}
+	if !strings.Contains(logs.String(), "level=WARN msg=\"reference has both a tag and a digest, pulling by digest\"") ||
+		!strings.Contains(logs.String(), "tag=moved") {
+		t.Errorf("no warning about the tag in %q", logs.String())
+	}
+}
+
+func TestResolvedFile(t *testing.T) {
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "resolved"}))
+	digest, err := image.Img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := startRegistry(t)
+	source := reg.push(t, image, "team/app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	_, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path.Join(config.Path, "resolved.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := Resolved{}
+	if err := json.Unmarshal(data, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	want := Resolved{Source: source, Digest: digest.String(), Reference: reg.Host + "/team/app@" + digest.String()}
+	if resolved != want {
+		t.Errorf("resolved.json = %+v, want %+v", resolved, want)
+	}
+
+	// the recorded reference converts the same image again
+	again := ConverterConfig{Source: resolved.Reference, Path: t.TempDir(), Insecure: true}
+	res, err := Convert(context.Background(), again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digest != digest.String() {
+		t.Errorf("converting %s gave digest %s, want %s", resolved.Reference, res.Digest, digest)
+	}
+}
+
+// cancelingLayer cancels the pull once its blob starts being read
+type cancelingLayer struct {
+	v1.Layer
+	cancel context.CancelFunc
+}
+
+func (l *cancelingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return &cancelingReader{ReadCloser: rc, cancel: l.cancel}, nil
+}
+
+type cancelingReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.ReadCloser.Read(p[:min(len(p), 512)])
+}
+
+func TestPullLayersCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	layer := &cancelingLayer{Layer: testLayer(t, tarEntry{Name: "big", Body: strings.Repeat("x", 1<<20)}), cancel: cancel}
+	digest, _ := layer.Digest()
+	config := testConfig(t)
+	err := pullLayers(ctx, config, testImage(t, layer))
+	pullErr, ok := err.(*PullLayersError)
+	if !ok || len(pullErr.Failed) != 1 || !errors.Is(pullErr.Failed[0].Err, context.Canceled) {
+		t.Fatalf("pullLayers = %v, want the layer canceled", err)
+	}
+	// nothing half written is left for the next convert to trust
+	layersDir := config.layersDir()
+	for _, p := range []string{
+		path.Join(layersDir, digest.Hex+".tar"),
+		path.Join(layersDir, digest.Hex+".tar.partial"),
+		path.Join(layersDir, digest.Hex),
+		path.Join(layersDir, digest.Hex+".partial"),
+		path.Join(config.Path, "layers.json"),
+	} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind by the canceled pull", p)
+		}
+	}
+}
+
+func TestConvertTimeout(t *testing.T) {
+	reg := startRegistry(t)
+	source := reg.push(t, testImage(t, testLayer(t, tarEntry{Name: "file"})), "app")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	_, err := Convert(ctx, config)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Convert = %v, want the deadline exceeded", err)
+	}
+	if reg.fetched("/blobs/") {
+		t.Error("blobs were fetched after the deadline")
+	}
+	if _, err := os.Stat(path.Join(config.Path, "manifest.json")); !os.IsNotExist(err) {
+		t.Error("manifest.json was written after the deadline")
+	}
+}
+
+// mediaTypeLayer declares a media type regardless of its content
+type mediaTypeLayer struct {
+	v1.Layer
+	mediaType types.MediaType
+}
+
+func (l *mediaTypeLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func TestMediaTypeCompression(t *testing.T) {
+	tests := []struct {
+		mediaType types.MediaType
+		want      compression.Compression
+		ok        bool
+	}{
+		{types.DockerLayer, compression.Gzip, true},
+		{types.DockerForeignLayer, compression.Gzip, true},
+		{types.OCILayer, compression.Gzip, true},
+		{types.OCIRestrictedLayer, compression.Gzip, true},
+		{types.DockerUncompressedLayer, compression.Uncompressed, true},
+		{types.OCIUncompressedLayer, compression.Uncompressed, true},
+		{types.OCIUncompressedRestrictedLayer, compression.Uncompressed, true},
+		{types.OCILayerZStd, compression.Zstd, true},
+		{types.OCIConfigJSON, compression.Uncompressed, false},
+		{"application/vnd.example.layer", compression.Uncompressed, false},
+	}
+	for _, test := range tests {
+		got, err := mediaTypeCompression(test.mediaType)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("mediaTypeCompression(%s) = %s, %v, want %s ok %v",
+				test.mediaType, compressionName(got), err, compressionName(test.want), test.ok)
+		}
+	}
+}
+
+func TestStrictCompression(t *testing.T) {
+	gzipped := testLayer(t, tarEntry{Name: "file", Body: "gzip"})
+	tests := []struct {
+		mediaType types.MediaType
+		strict    bool
+		err       string
+	}{
+		{types.DockerLayer, true, ""},
+		{types.OCILayer, true, ""},
+		{types.OCIUncompressedLayer, true, "has media type " + string(types.OCIUncompressedLayer) + " but its content is gzip"},
+		{types.OCILayerZStd, true, "but its content is gzip"},
+		{"application/vnd.example.layer", true, "doesn't declare a known compression"},
+		// without strict the blob is sniffed whatever it claims to be
+		{types.OCIUncompressedLayer, false, ""},
+		{"application/vnd.example.layer", false, ""},
+	}
+	for _, test := range tests {
+		config := testConfig(t)
+		config.StrictCompression = test.strict
+		layer := &mediaTypeLayer{Layer: gzipped, mediaType: test.mediaType}
+		_, err := pullLayer(context.Background(), config, layer)
+		if test.err == "" && err != nil {
+			t.Errorf("%s strict %v: %v", test.mediaType, test.strict, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s strict %v = %v, want %q", test.mediaType, test.strict, err, test.err)
+		}
+		// a rejected layer leaves no tar behind
+		digest, _ := layer.Digest()
+		_, statErr := os.Stat(path.Join(config.layersDir(), digest.Hex+".tar"))
+		if (test.err == "") != (statErr == nil) {
+			t.Errorf("%s strict %v: tar written %v, want %v", test.mediaType, test.strict, statErr == nil, test.err == "")
+		}
+	}
+}
+
+func TestExtractLayerKeepsModeAndOwner(t *testing.T) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	layer := testLayer(t,
+		tarEntry{Name: "private/", Dir: true, Mode: 0700, Uid: 1234, Gid: 5678},
+		tarEntry{Name: "private/shared", Body: "all", Mode: 0777, Uid: 1234, Gid: 5678},
+		tarEntry{Name: "bin/su", Body: "setuid", Mode: 04755},
+		// the name of a host user must not win over the recorded uid
+		tarEntry{Name: "named", Body: "named", Mode: 0640, Uid: 4321, Gid: 4321, Uname: "root"},
+	)
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, testImage(t, layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	dir := path.Join(config.layersDir(), digest.Hex)
+	root := os.Geteuid() == 0
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		uid, gid uint32
+	}{
+		{"private", os.ModeDir | 0700, 1234, 5678},
+		{"private/shared", 0777, 1234, 5678},
+		{"bin/su", os.ModeSetuid | 0755, 0, 0},
+		{"named", 0640, 4321, 4321},
+	}
+	for _, test := range tests {
+		info, err := os.Lstat(path.Join(dir, test.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Mode() != test.mode {
+			t.Errorf("%s mode = %v, want %v", test.name, info.Mode(), test.mode)
+		}
+		// only root can give files away, others extract as themselves
+		if !root {
+			continue
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != test.uid || stat.Gid != test.gid {
+			t.Errorf("%s owner = %d:%d, want %d:%d", test.name, stat.Uid, stat.Gid, test.uid, test.gid)
+		}
+	}
+}
+
+func TestConvertResult(t *testing.T) {
+	first := testLayer(t, tarEntry{Name: "etc/", Dir: true}, tarEntry{Name: "etc/os-release", Body: "ID=test\n"})
+	second := testLayer(t, tarEntry{Name: "app", Body: "app"})
+	image := testImage(t, first, second)
+	reg := startRegistry(t)
+	source := reg.push(t, image, "team/app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	res, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := image.Img.Digest()
+	paths := layout.New(config.Path)
+	if res.Source != source || res.Digest != digest.String() || res.Reference != reg.Host+"/team/app@"+digest.String() ||
+		res.Path != config.Path || res.ConfigPath != paths.Config || res.ManifestPath != paths.Manifest ||
+		res.LayersPath != paths.Layers || res.Report != nil || len(res.Platforms) != 0 {
+		t.Errorf("Convert = %+v", res)
+	}
+	// the paths hold what runInNamespace reads
+	rawConfig, _ := image.Img.RawConfigFile()
+	if data, err := os.ReadFile(res.ConfigPath); err != nil || !bytes.Equal(data, rawConfig) {
+		t.Errorf("%s = %s, %v, want the image config", res.ConfigPath, data, err)
+	}
+	file, err := os.Open(res.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := v1.ParseManifest(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LayerInfos matches the manifest and layers.json
+	data, err := os.ReadFile(path.Join(config.Path, "layers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []*LayerInfo
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.LayerInfos) != 2 || len(manifest.Layers) != 2 || len(written) != 2 {
+		t.Fatalf("%d layer infos, %d manifest layers, %d in layers.json, want 2", len(res.LayerInfos), len(manifest.Layers), len(written))
+	}
+	for i, info := range res.LayerInfos {
+		if info.Digest != manifest.Layers[i].Digest.String() || *info != *written[i] {
+			t.Errorf("layer %d = %+v, manifest has %s, layers.json %+v", i, info, manifest.Layers[i].Digest, written[i])
+		}
+		if !layerComplete(res.LayersPath, manifest.Layers[i].Digest.Hex) || info.Path != path.Join(res.LayersPath, manifest.Layers[i].Digest.Hex) {
+			t.Errorf("layer %d is not extracted at %s", i, info.Path)
+		}
+	}
+
+	config.Path = t.TempDir()
+	config.Report = true
+	res, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Report == nil {
+		t.Error("Convert with Report gave no size report")
+	}
+
+	config.Source = reg.Host + "/team/missing:latest"
+	if res, err := Convert(context.Background(), config); err == nil || res != nil {
+		t.Errorf("Convert of a missing image = %+v, %v", res, err)
+	}
+}
+
+func TestPullLayersResumesIncomplete(t *testing.T) {
+	downloads := map[string]*atomic.Int32{}
+	layers := []v1.Layer{}
+	for _, name := range []string{"complete", "unmarked", "tarless"} {
+		downloads[name] = &atomic.Int32{}
+		layers = append(layers, &countingLayer{Layer: testLayer(t, tarEntry{Name: name, Body: name}), downloads: downloads[name]})
+	}
+	config := testConfig(t)
+	layersDir := config.layersDir()
+	// what an earlier, interrupted run left behind: a complete layer with
+	// its marker and tar, a layer interrupted before its marker next to a
+	// half extracted .partial directory, and a marked layer missing its tar
+	for i, name := range []string{"complete", "unmarked", "tarless"} {
+		digest, _ := layers[i].Digest()
+		dir := path.Join(layersDir, digest.Hex)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, "stale"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "tarless" {
+			if err := os.WriteFile(dir+".tar", nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if name != "unmarked" {
+			if err := os.WriteFile(layout.CompleteMarker(dir), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.MkdirAll(dir+".partial", 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := pullLayers(context.Background(), config, testImage(t, layers...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"complete", "unmarked", "tarless"} {
+		digest, _ := layers[i].Digest()
+		dir := path.Join(layersDir, digest.Hex)
+		want := int32(1)
+		if name == "complete" {
+			want = 0
+		}
+		if n := downloads[name].Load(); n != want {
+			t.Errorf("layer %s was downloaded %d times, want %d", name, n, want)
+		}
+		if !layerComplete(layersDir, digest.Hex) {
+			t.Errorf("layer %s is not complete", name)
+		}
+		// a pulled again layer is extracted from scratch
+		_, err := os.Stat(path.Join(dir, "stale"))
+		if (name == "complete") != (err == nil) {
+			t.Errorf("layer %s kept the stale file %v, want %v", name, err == nil, name == "complete")
+		}
+		if _, err := os.Stat(dir + ".partial"); !os.IsNotExist(err) {
+			t.Errorf("layer %s left its .partial directory", name)
+		}
+	}
+}
+
+func TestConvertRejectsWindows(t *testing.T) {
+	windows := v1.Platform{OS: "windows", Architecture: "amd64"}
+	img := platformImage(t, windows, testLayer(t, tarEntry{Name: "Files/", Dir: true}))
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OSVersion = "10.0.17763.5458"
+	img, err = mutate.ConfigFile(img, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := &Image{Ref: name.MustParseReference("example.com/windows:latest"), Img: img}
+	layers, _ := img.Layers()
+	layerDigest, _ := layers[0].Digest()
+
+	reg := startRegistry(t)
+	single := reg.push(t, image, "windows")
+	list, _ := reg.pushIndex(t, "list", []v1.Platform{windows}, []v1.Image{img})
+	archive := writeArchive(t, image, t.TempDir(), "windows.tar")
+	for _, test := range []struct {
+		source   string
+		platform *v1.Platform
+	}{
+		{single, nil},
+		{list, &windows},
+		{archive, nil},
+	} {
+		reg.reset()
+		config := ConverterConfig{Source: test.source, Path: t.TempDir(), Insecure: true, Platform: test.platform}
+		_, err := Convert(context.Background(), config)
+		want := test.source + " is a Windows image (os windows, os.version 10.0.17763.5458), Windows images are not supported"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Convert of %s = %v, want %q", test.source, err, want)
+		}
+		// nothing is pulled or written for it
+		if reg.fetched("/blobs/" + layerDigest.String()) {
+			t.Errorf("Convert of %s fetched layers", test.source)
+		}
+		if _, err := os.Stat(path.Join(config.Path, "manifest.json")); !os.IsNotExist(err) {
+			t.Errorf("Convert of %s wrote manifest.json", test.source)
+		}
+	}
+}
+
+func TestPullLayersAfterLayerRemoved(t *testing.T) {
+	layer := testLayer(t, tarEntry{Name: "file", Body: "again"})
+	digest, _ := layer.Digest()
+	config := testConfig(t)
+	if err := pullLayers(context.Background(), config, testImage(t, layer)); err != nil {
+		t.Fatal(err)
+	}
+	// gc or a removed store takes the layer away between two converts of
+	// one process, the next convert extracts it again
+	if err := os.RemoveAll(config.layersDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pullLayers(context.Background(), config, testImage(t, layer)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path.Join(config.layersDir(), digest.Hex, "file"))
+	if err != nil || string(data) != "again" {
+		t.Errorf("the removed layer has %q, %v", data, err)
+	}
+}
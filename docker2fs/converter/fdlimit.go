@@ -0,0 +1,39 @@
+package converter
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// FileLimiter bounds the files held open by pulls and extractions sharing
+// it, across all images converted in parallel, independently of the
+// number of workers. A nil *FileLimiter doesn't limit anything.
+type FileLimiter struct {
+	files *semaphore.Weighted
+	max   int64
+}
+
+// NewFileLimiter limits the open files to n, it returns nil for 0
+func NewFileLimiter(n int64) *FileLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &FileLimiter{files: semaphore.NewWeighted(n), max: n}
+}
+
+// acquireFiles waits until n more files may be opened under
+// config.MaxOpenFiles and returns the function releasing them
+func acquireFiles(ctx context.Context, config *ConverterConfig, n int64) (func(), error) {
+	limiter := config.MaxOpenFiles
+	if limiter == nil {
+		return func() {}, nil
+	}
+	// a weight above the limit would never be granted
+	n = min(n, limiter.max)
+	err := limiter.files.Acquire(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return func() { limiter.files.Release(n) }, nil
+}
@@ -0,0 +1,67 @@
+package converter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireFilesWaitsForRelease(t *testing.T) {
+	config := &ConverterConfig{MaxOpenFiles: NewFileLimiter(2)}
+	release, err := acquireFiles(context.Background(), config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan func())
+	go func() {
+		// a copy of the config shares the limit, a weight above it is capped
+		copied := *config
+		second, err := acquireFiles(context.Background(), &copied, 3)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("more files were opened than the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	select {
+	case second := <-acquired:
+		second()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the files released were not handed out again")
+	}
+}
+
+func TestAcquireFilesWithoutLimit(t *testing.T) {
+	if limiter := NewFileLimiter(0); limiter != nil {
+		t.Errorf("NewFileLimiter(0) = %v, want nil", limiter)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release, err := acquireFiles(ctx, &ConverterConfig{}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestPullLayersWithOneOpenFile(t *testing.T) {
+	config := testConfig(t)
+	config.MaxOpenFiles = NewFileLimiter(1)
+	config.DownloadConcurrency, config.ExtractConcurrency = 3, 3
+	image := testImage(t,
+		testLayer(t, tarEntry{Name: "a", Body: "a"}),
+		testLayer(t, tarEntry{Name: "b", Body: "b"}),
+		testLayer(t, tarEntry{Name: "c", Body: "c"}),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := pullLayers(ctx, config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+package converter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/pkg/errors"
+)
+
+// foreignURLs reports whether layer is foreign (non-distributable), such
+// as the base layers of Windows images, and returns the urls of its
+// descriptor. The registry usually doesn't have the blob of a foreign
+// layer, it is fetched from these urls.
+func foreignURLs(layer v1.Layer) ([]string, bool, error) {
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return nil, false, err
+	}
+	if mediaType.IsDistributable() {
+		return nil, false, nil
+	}
+	desc, err := partial.Descriptor(layer)
+	if err != nil {
+		return nil, true, err
+	}
+	return desc.URLs, true, nil
+}
+
+// skipForeignLayer stands in an empty directory for a foreign layer, so
+// the image still mounts but lacks the files of that layer. No tar is
+// written, verify reports the layer as missing.
+func skipForeignLayer(config *ConverterConfig, hash v1.Hash) error {
+	extractDir := path.Join(config.layersDir(), hash.Hex)
+	err := os.MkdirAll(extractDir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("create layer directory %s", hash.String()))
+	}
+	err = os.WriteFile(layout.CompleteMarker(extractDir), nil, 0644)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("write complete marker of layer %s", hash.String()))
+	}
+	slog.Warn("skipped foreign layer, the rootfs lacks its files", "digest", hash.String())
+	return nil
+}
@@ -0,0 +1,137 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"common/layout"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// foreignImage returns an image of a regular layer and a foreign layer
+// listing urls, the foreign layer is returned as well
+func foreignImage(t *testing.T, urls ...string) (*Image, v1.Layer) {
+	t.Helper()
+	image := testImage(t, testLayer(t, tarEntry{Name: "regular", Body: "regular"}))
+	foreign := &mediaTypeLayer{Layer: testLayer(t, tarEntry{Name: "foreign", Body: "foreign"}), mediaType: types.DockerForeignLayer}
+	img, err := mutate.Append(image.Img, mutate.Addendum{Layer: foreign, MediaType: types.DockerForeignLayer, URLs: urls})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.Img = img
+	return image, foreign
+}
+
+// serveBlob serves the compressed blob of layer at every path and counts
+// the requests
+func serveBlob(t *testing.T, layer v1.Layer) (string, *atomic.Int32) {
+	t.Helper()
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/blob", requests
+}
+
+func TestForeignURLs(t *testing.T) {
+	// the urls are in the manifest the registry serves
+	reg := startRegistry(t)
+	image, _ := foreignImage(t, "https://example.com/a", "https://example.com/b")
+	ref, err := name.ParseReference(reg.push(t, image, "app"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, foreign, err := foreignURLs(layers[0])
+	if err != nil || foreign || urls != nil {
+		t.Errorf("foreignURLs of a regular layer = %v, %v, %v", urls, foreign, err)
+	}
+	urls, foreign, err = foreignURLs(layers[1])
+	if err != nil || !foreign || len(urls) != 2 || urls[0] != "https://example.com/a" || urls[1] != "https://example.com/b" {
+		t.Errorf("foreignURLs of a foreign layer = %v, %v, %v", urls, foreign, err)
+	}
+}
+
+func TestConvertForeignLayer(t *testing.T) {
+	reg := startRegistry(t)
+	probe, foreign := foreignImage(t)
+	url, requests := serveBlob(t, foreign)
+	image, _ := foreignImage(t, url)
+	// the registry doesn't keep foreign blobs, they come from their urls
+	source := reg.push(t, image, "app")
+	digest, _ := foreign.Digest()
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	_, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() == 0 {
+		t.Error("the foreign layer was not fetched from its url")
+	}
+	layerDir := path.Join(layout.New(config.Path).Layers, digest.Hex)
+	if data, err := os.ReadFile(path.Join(layerDir, "foreign")); err != nil || string(data) != "foreign" {
+		t.Errorf("the foreign layer has %q, %v", data, err)
+	}
+
+	// -skip-foreign leaves an empty layer and never fetches it
+	requests.Store(0)
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, SkipForeign: true}
+	_, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 0 {
+		t.Error("a skipped foreign layer was fetched")
+	}
+	layerDir = path.Join(layout.New(config.Path).Layers, digest.Hex)
+	entries, err := os.ReadDir(layerDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("the skipped layer has %v, %v", entries, err)
+	}
+	if _, err := os.Stat(layout.CompleteMarker(layerDir)); err != nil {
+		t.Error("the skipped layer is not marked complete")
+	}
+	if _, err := os.Stat(layerDir + ".tar"); !os.IsNotExist(err) {
+		t.Error("a tar was written for the skipped layer")
+	}
+
+	// a foreign layer without urls can't be fetched
+	source = reg.push(t, probe, "nourls")
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	_, err = Convert(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "foreign layer "+digest.String()+" has no urls") {
+		t.Errorf("Convert of a foreign layer without urls = %v", err)
+	}
+}
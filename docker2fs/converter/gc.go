@@ -0,0 +1,187 @@
+package converter
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// trackedManifests finds the manifests sharing basePath/layers, written by
+// a single convert at basePath or a batch convert under basePath/*.
+// The original manifest of a squashed image is included, its layers are
+// still needed to verify or squash it again.
+func trackedManifests(basePath string) ([]string, error) {
+	manifests := []string{}
+	for _, name := range []string{"manifest.json", "manifest.orig.json"} {
+		// */*/ holds the platforms of a manifest list converted with
+		// -index-policy all
+		for _, pattern := range []string{path.Join(basePath, "*", name), path.Join(basePath, "*", "*", name)} {
+			found, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, manifest := range found {
+				// a layer may well contain a manifest.json of its own
+				if !strings.HasPrefix(manifest, layout.New(basePath).Layers+"/") {
+					manifests = append(manifests, manifest)
+				}
+			}
+		}
+		top := path.Join(basePath, name)
+		if _, err := os.Stat(top); err == nil {
+			manifests = append(manifests, top)
+		}
+	}
+	return manifests, nil
+}
+
+// liveLayers returns the hex digests of the layers referenced by manifests
+func liveLayers(manifests []string) (map[string]bool, error) {
+	live := map[string]bool{}
+	for _, manifestPath := range manifests {
+		file, err := os.Open(manifestPath)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("open %s", manifestPath))
+		}
+		manifest, err := v1.ParseManifest(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("parse %s", manifestPath))
+		}
+		for _, layer := range manifest.Layers {
+			live[layer.Digest.Hex] = true
+		}
+	}
+	return live, nil
+}
+
+// layerHex strips the suffixes the converter adds to layer files
+func layerHex(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// refsSuffix is the suffix of the refcount file runInNamespace keeps next
+// to each layer it has mounted, holding the number of running containers
+const refsSuffix = ".refs"
+
+// layerRefs reads the refcount of layer hex, 0 if it has no refcount file
+func layerRefs(layersDir, hex string) (int, error) {
+	p := path.Join(layersDir, hex+refsSuffix)
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("open %s", p))
+	}
+	defer file.Close()
+	// runInNamespace rewrites the count under an exclusive lock
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("lock %s", p))
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("read %s", p))
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("parse %s", p))
+	}
+	return count, nil
+}
+
+// lockLayers flocks the lock file next to layersDir with how, LOCK_SH
+// while converting and LOCK_EX while collecting, and returns the function
+// releasing it
+func lockLayers(layersDir string, how int) (func(), error) {
+	p := layersDir + ".lock"
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "create output directory")
+	}
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("open %s", p))
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		slog.Info("waiting for the layers lock", "path", p)
+		err = syscall.Flock(int(file.Fd()), how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("lock %s", p))
+	}
+	// closing the file releases the lock
+	return func() { file.Close() }, nil
+}
+
+// GC removes the entries of basePath/layers that no manifest refers to and
+// returns their paths. Layers still used by a running container are kept
+// even without a manifest. A convert still pulling has not written its
+// manifest yet, gc waits for running converts and pulls through the layers
+// lock and holds it until it is done.
+func GC(basePath string, dryRun bool) ([]string, error) {
+	unlock, err := lockLayers(layout.New(basePath).Layers, syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	manifests, err := trackedManifests(basePath)
+	if err != nil {
+		return nil, err
+	}
+	live, err := liveLayers(manifests)
+	if err != nil {
+		return nil, err
+	}
+	layersDir := layout.New(basePath).Layers
+	entries, err := os.ReadDir(layersDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read layers directory")
+	}
+	removed := []string{}
+	for _, entry := range entries {
+		hex := layerHex(entry.Name())
+		if live[hex] {
+			continue
+		}
+		refs, err := layerRefs(layersDir, hex)
+		if err != nil {
+			return removed, err
+		}
+		if refs > 0 {
+			slog.Info("layer in use, keeping it", "layer", hex, "refs", refs)
+			live[hex] = true
+			continue
+		}
+		p := path.Join(layersDir, entry.Name())
+		if !dryRun {
+			err = os.RemoveAll(p)
+			if err != nil {
+				return removed, errors.Wrap(err, fmt.Sprintf("remove %s", p))
+			}
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
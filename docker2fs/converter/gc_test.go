@@ -0,0 +1,113 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestGCWaitsForConvert(t *testing.T) {
+	base := t.TempDir()
+	// a convert holds the lock from before its first layer until its manifest is written
+	unlock, err := lockLayers(layout.New(base).Layers, syscall.LOCK_SH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := GC(base, true)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("gc ran alongside a convert: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gc didn't run once the convert was done")
+	}
+}
+
+func TestConvertsShareTheLayersLock(t *testing.T) {
+	layersDir := path.Join(t.TempDir(), "layers")
+	first, err := lockLayers(layersDir, syscall.LOCK_SH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first()
+	done := make(chan struct{})
+	go func() {
+		second, err := lockLayers(layersDir, syscall.LOCK_SH)
+		if err == nil {
+			second()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a second convert waited for the first")
+	}
+}
+
+func TestGCKeepsReferencedLayers(t *testing.T) {
+	kept := testLayer(t, tarEntry{Name: "kept", Body: "kept"})
+	orphan := testLayer(t, tarEntry{Name: "orphan", Body: "orphan"})
+	running := testLayer(t, tarEntry{Name: "running", Body: "running"})
+	config := testConfig(t)
+	image := testImage(t, kept)
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMetadata(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// layers of an image whose manifest was removed
+	err = pullLayers(context.Background(), config, testImage(t, orphan, running))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layersDir := config.layersDir()
+	runningDigest, _ := running.Digest()
+	err = os.WriteFile(path.Join(layersDir, runningDigest.Hex+refsSuffix), []byte("1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := GC(config.Path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphanDigest, _ := orphan.Digest()
+	orphanDir := path.Join(layersDir, orphanDigest.Hex)
+	want := []string{orphanDir, layout.CompleteMarker(orphanDir), orphanDir + ".tar"}
+	sort.Strings(removed)
+	sort.Strings(want)
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("GC removed %v, want %v", removed, want)
+	}
+	for _, layer := range []v1.Layer{kept, running} {
+		digest, _ := layer.Digest()
+		if !layerComplete(layersDir, digest.Hex) {
+			t.Errorf("GC removed layer %s", digest.Hex)
+		}
+	}
+	if _, err := os.Stat(orphanDir); !os.IsNotExist(err) {
+		t.Errorf("%s is still there", orphanDir)
+	}
+}
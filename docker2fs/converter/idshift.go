@@ -0,0 +1,52 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// maxID is the largest uid or gid, (uid_t)-1 is reserved
+const maxID = 1<<32 - 2
+
+// checkIDShift fails if shift can't be applied to the ids of a layer
+func checkIDShift(shift int) error {
+	if shift < 0 || int64(shift) > maxID {
+		return errors.Errorf("invalid id shift %d, it must be between 0 and %d", shift, maxID)
+	}
+	if shift > 0 && os.Geteuid() != 0 {
+		return errors.New("shifting uids and gids needs root, the files are chowned")
+	}
+	return nil
+}
+
+// shiftOwners adds shift to the uid and gid of everything under dir, so
+// that a user namespace mapping container root to shift sees the owners
+// the layer tar recorded
+func shiftOwners(dir string, shift int) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("no owner of %s", p)
+		}
+		uid, gid := int64(stat.Uid)+int64(shift), int64(stat.Gid)+int64(shift)
+		if uid > maxID || gid > maxID {
+			return errors.Errorf("%s owned by %d:%d can't be shifted by %d", p, stat.Uid, stat.Gid, shift)
+		}
+		err = os.Lchown(p, int(uid), int(gid))
+		if err != nil {
+			return err
+		}
+		// chown clears the setuid and setgid bits of the file
+		mode := info.Mode()
+		if mode&os.ModeSymlink == 0 && mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			return os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCheckIDShift(t *testing.T) {
+	for _, shift := range []int{-1, maxID + 1} {
+		if err := checkIDShift(shift); err == nil || !strings.Contains(err.Error(), "invalid id shift") {
+			t.Errorf("checkIDShift(%d) = %v", shift, err)
+		}
+	}
+	if err := checkIDShift(0); err != nil {
+		t.Errorf("checkIDShift(0) = %v", err)
+	}
+	err := checkIDShift(100000)
+	if root := os.Geteuid() == 0; (err == nil) != root {
+		t.Errorf("checkIDShift(100000) as root %v = %v", root, err)
+	}
+}
+
+func TestShiftOwners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("shifting owners needs root")
+	}
+	layer := testLayer(t,
+		tarEntry{Name: "dir/", Dir: true, Uid: 0, Gid: 0},
+		tarEntry{Name: "dir/file", Body: "file", Uid: 1000, Gid: 1001},
+		tarEntry{Name: "dir/su", Body: "su", Mode: 04755},
+		tarEntry{Name: "dir/wall", Body: "wall", Mode: 02755, Gid: 5},
+		tarEntry{Name: "dir/link", Link: "file", Uid: 7, Gid: 8},
+	)
+	config := testConfig(t)
+	config.IDShift = 100000
+	err := pullLayers(context.Background(), config, testImage(t, layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	dir := path.Join(config.layersDir(), digest.Hex)
+	tests := []struct {
+		name     string
+		uid, gid uint32
+		mode     os.FileMode
+	}{
+		{"dir", 100000, 100000, os.ModeDir | 0755},
+		{"dir/file", 101000, 101001, 0644},
+		// the setuid and setgid bits chown cleared are restored
+		{"dir/su", 100000, 100000, os.ModeSetuid | 0755},
+		{"dir/wall", 100000, 100005, os.ModeSetgid | 0755},
+		// the link itself is chowned, not its target
+		{"dir/link", 100007, 100008, os.ModeSymlink | 0777},
+	}
+	for _, test := range tests {
+		info, err := os.Lstat(path.Join(dir, test.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != test.uid || stat.Gid != test.gid || info.Mode() != test.mode {
+			t.Errorf("%s = %d:%d %v, want %d:%d %v", test.name, stat.Uid, stat.Gid, info.Mode(), test.uid, test.gid, test.mode)
+		}
+	}
+
+	// ids past the largest one are refused
+	dir = t.TempDir()
+	if err := os.Chown(dir, 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := shiftOwners(dir, maxID-5); err == nil || !strings.Contains(err.Error(), "can't be shifted") {
+		t.Errorf("shiftOwners past the largest id = %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// Index policies decide what convert does when the source is a manifest
+// list: host converts the image for the host platform, error refuses and
+// all converts every platform into its own directory
+const (
+	IndexPolicyHost  = "host"
+	IndexPolicyError = "error"
+	IndexPolicyAll   = "all"
+)
+
+// fetchIndex returns the index manifest the source points at and its
+// digest, or nil if it points at a single image
+func fetchIndex(ctx context.Context, config *ConverterConfig, ref name.Reference) (*v1.IndexManifest, v1.Hash, error) {
+	options, err := config.remoteOptions(ctx)
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return nil, v1.Hash{}, errors.Wrap(err, "fetch source descriptor")
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, v1.Hash{}, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, v1.Hash{}, errors.Wrap(err, "get image index")
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, v1.Hash{}, errors.Wrap(err, "get index manifest")
+	}
+	return manifest, desc.Digest, nil
+}
+
+// indexPlatforms lists the images of an index that have a platform,
+// attestation manifests are marked unknown/unknown and skipped
+func indexPlatforms(index *v1.IndexManifest) []v1.Descriptor {
+	images := []v1.Descriptor{}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || m.Platform.OS == "unknown" {
+			continue
+		}
+		images = append(images, m)
+	}
+	return images
+}
+
+// platformDir names the directory of one platform, e.g. linux-arm64-v8
+func platformDir(platform *v1.Platform) string {
+	return strings.ReplaceAll(platform.String(), "/", "-")
+}
+
+// applyIndexPolicy handles a source pointing at a manifest list. It
+// returns the result once the source is fully handled, nil means the host
+// platform image is converted as usual.
+func applyIndexPolicy(ctx context.Context, config *ConverterConfig) (*Result, error) {
+	// an explicit platform picks one image, the policy doesn't apply,
+	// offline the manifest in Path is already for one platform and a
+	// `docker save` archive holds no manifest lists
+	if _, _, ok := archiveSource(config.Source); ok {
+		return nil, nil
+	}
+	if config.Offline || config.Platform != nil || config.IndexPolicy == "" || config.IndexPolicy == IndexPolicyHost {
+		return nil, nil
+	}
+	ref, err := config.reference()
+	if err != nil {
+		return nil, err
+	}
+	index, digest, err := fetchIndex(ctx, config, ref)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, nil
+	}
+	platforms := indexPlatforms(index)
+	available := make([]string, 0, len(platforms))
+	for _, m := range platforms {
+		available = append(available, m.Platform.String())
+	}
+	switch config.IndexPolicy {
+	case IndexPolicyError:
+		return nil, errors.Errorf("%s is a manifest list (%s), convert a platform-specific digest or use -index-policy host|all",
+			config.Source, strings.Join(available, ", "))
+	case IndexPolicyAll:
+		// every platform is converted by digest into Path/<platform>,
+		// sharing one layers directory
+		res := &Result{
+			Source:     config.Source,
+			Digest:     digest.String(),
+			Reference:  ref.Context().Digest(digest.String()).String(),
+			Path:       config.Path,
+			LayersPath: config.layersDir(),
+		}
+		for _, m := range platforms {
+			platformConfig := *config
+			platformConfig.IndexPolicy = IndexPolicyHost
+			platformConfig.Source = ref.Context().Digest(m.Digest.String()).String()
+			platformConfig.Path = path.Join(config.Path, platformDir(m.Platform))
+			platformConfig.LayersPath = config.layersDir()
+			slog.Info("converting platform", "source", config.Source, "platform", m.Platform.String())
+			platformRes, err := convert(ctx, &platformConfig)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("convert platform %s", m.Platform.String()))
+			}
+			res.Platforms = append(res.Platforms, platformRes)
+		}
+		return res, nil
+	}
+	return nil, errors.Errorf("unknown index policy %s", config.IndexPolicy)
+}
@@ -0,0 +1,225 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// otherPlatform is a platform the host is not
+func otherPlatform() v1.Platform {
+	if hostPlatform().Architecture == "arm64" {
+		return v1.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	return v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+}
+
+// pushTestIndex pushes a manifest list of a host image, an image of
+// otherPlatform and an attestation manifest
+func pushTestIndex(t *testing.T, reg *testRegistry) (string, v1.Hash, []v1.Image) {
+	t.Helper()
+	platforms := []v1.Platform{hostPlatform(), otherPlatform(), {OS: "unknown", Architecture: "unknown"}}
+	images := []v1.Image{}
+	for _, platform := range platforms {
+		layer := testLayer(t, tarEntry{Name: "platform", Body: platform.String()})
+		images = append(images, platformImage(t, platform, layer))
+	}
+	source, digest := reg.pushIndex(t, "app", platforms, images)
+	return source, digest, images
+}
+
+func TestIndexPolicyHost(t *testing.T) {
+	reg := startRegistry(t)
+	source, _, images := pushTestIndex(t, reg)
+	for _, policy := range []string{"", IndexPolicyHost} {
+		config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, IndexPolicy: policy}
+		res, err := Convert(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := images[0].Digest()
+		if res.Digest != want.String() || len(res.Platforms) != 0 {
+			t.Errorf("policy %q converted %s with platforms %v, want the host image %s", policy, res.Digest, res.Platforms, want)
+		}
+		otherDigest, _ := images[1].Digest()
+		if reg.fetched("/manifests/" + otherDigest.String()) {
+			t.Errorf("policy %q fetched the %s image", policy, otherPlatform())
+		}
+		reg.reset()
+	}
+}
+
+func TestIndexPolicyError(t *testing.T) {
+	reg := startRegistry(t)
+	source, _, _ := pushTestIndex(t, reg)
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, IndexPolicy: IndexPolicyError}
+	_, err := Convert(context.Background(), config)
+	want := "is a manifest list (" + hostPlatform().String() + ", " + otherPlatform().String() + ")"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("Convert = %v, want %q", err, want)
+	}
+	if reg.fetched("/blobs/") {
+		t.Error("blobs were fetched for a refused manifest list")
+	}
+	if _, err := os.Stat(path.Join(config.Path, "manifest.json")); !os.IsNotExist(err) {
+		t.Error("manifest.json was written for a refused manifest list")
+	}
+
+	// an explicit platform or a single image is not a manifest list to refuse
+	platform := otherPlatform()
+	config.Platform = &platform
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Errorf("Convert with -platform %s = %v", platform, err)
+	}
+	single := reg.push(t, testImage(t, testLayer(t, tarEntry{Name: "single"})), "single")
+	config = ConverterConfig{Source: single, Path: t.TempDir(), Insecure: true, IndexPolicy: IndexPolicyError}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Errorf("Convert of a single image = %v", err)
+	}
+
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, IndexPolicy: "newest"}
+	if _, err := Convert(context.Background(), config); err == nil || !strings.Contains(err.Error(), "unknown index policy newest") {
+		t.Errorf("Convert with an unknown policy = %v", err)
+	}
+}
+
+func TestIndexPolicyAll(t *testing.T) {
+	reg := startRegistry(t)
+	source, indexDigest, images := pushTestIndex(t, reg)
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, IndexPolicy: IndexPolicyAll}
+	res, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digest != indexDigest.String() || res.Reference != reg.Host+"/app@"+indexDigest.String() {
+		t.Errorf("result pins %s as %s, want the index %s", res.Digest, res.Reference, indexDigest)
+	}
+	// the attestation manifest is not a platform
+	if len(res.Platforms) != 2 {
+		t.Fatalf("converted %d platforms, want 2", len(res.Platforms))
+	}
+	for i, platform := range []v1.Platform{hostPlatform(), otherPlatform()} {
+		platformRes := res.Platforms[i]
+		digest, _ := images[i].Digest()
+		dir := path.Join(config.Path, strings.ReplaceAll(platform.String(), "/", "-"))
+		if platformRes.Digest != digest.String() || platformRes.Path != dir {
+			t.Errorf("platform %s converted %s into %s, want %s into %s",
+				platform, platformRes.Digest, platformRes.Path, digest, dir)
+		}
+		// every platform shares the layers directory of the index
+		if platformRes.LayersPath != res.LayersPath {
+			t.Errorf("platform %s stores layers in %s, want %s", platform, platformRes.LayersPath, res.LayersPath)
+		}
+		if _, err := os.Stat(path.Join(dir, "manifest.json")); err != nil {
+			t.Error(err)
+		}
+		data, err := os.ReadFile(path.Join(platformRes.LayerInfos[0].Path, "platform"))
+		if err != nil || string(data) != platform.String() {
+			t.Errorf("platform %s extracted %q, %v", platform, data, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(config.Path, "unknown-unknown")); !os.IsNotExist(err) {
+		t.Error("the attestation manifest was converted")
+	}
+}
+
+func TestNormalVariant(t *testing.T) {
+	tests := []struct {
+		arch, variant, want string
+	}{
+		{"arm64", "", "v8"},
+		{"arm64", "v8", "v8"},
+		{"arm", "", ""},
+		{"arm", "v7", "v7"},
+		{"amd64", "", ""},
+	}
+	for _, test := range tests {
+		if got := normalVariant(test.arch, test.variant); got != test.want {
+			t.Errorf("normalVariant(%s, %q) = %q, want %q", test.arch, test.variant, got, test.want)
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	tests := map[string]string{
+		"linux/arm64/v8": "linux/arm64",
+		"linux/arm64":    "linux/arm64",
+		"linux/arm/v7":   "linux/arm/v7",
+		"linux/amd64/v2": "linux/amd64/v2",
+	}
+	for platform, want := range tests {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchPlatform(*p); got.String() != want {
+			t.Errorf("matchPlatform(%s) = %s, want %s", platform, got.String(), want)
+		}
+	}
+}
+
+func TestConfigPlatformVariant(t *testing.T) {
+	host := hostPlatform()
+	host.Variant = "v2"
+	if got := (&ConverterConfig{Variant: "v2"}).platform(); got.String() != host.String() {
+		t.Errorf("platform() = %s, want the host with variant v2 %s", got.String(), host.String())
+	}
+	config := &ConverterConfig{Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, Variant: "v7"}
+	if got := config.platform(); got.String() != "linux/arm/v7" {
+		t.Errorf("platform() = %s, want -variant to override the one of -platform", got.String())
+	}
+	// the configured platform itself is left alone
+	if config.Platform.Variant != "v6" {
+		t.Errorf("platform() changed Platform to %s", config.Platform.String())
+	}
+}
+
+func TestConvertVariant(t *testing.T) {
+	reg := startRegistry(t)
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	images := []v1.Image{}
+	for _, platform := range platforms {
+		images = append(images, platformImage(t, platform, testLayer(t, tarEntry{Name: "platform", Body: platform.String()})))
+	}
+	source, _ := reg.pushIndex(t, "app", platforms, images)
+	tests := []struct {
+		platform v1.Platform
+		variant  string
+		want     int
+	}{
+		{v1.Platform{OS: "linux", Architecture: "arm"}, "v7", 1},
+		{v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "v6", 0},
+		// arm64 images usually leave out v8
+		{v1.Platform{OS: "linux", Architecture: "arm64"}, "v8", 2},
+	}
+	for _, test := range tests {
+		platform := test.platform
+		config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true, Platform: &platform, Variant: test.variant}
+		res, err := Convert(context.Background(), config)
+		if err != nil {
+			t.Errorf("%s variant %s: %v", platform.String(), test.variant, err)
+			continue
+		}
+		want, _ := images[test.want].Digest()
+		if res.Digest != want.String() {
+			t.Errorf("%s variant %s converted %s, want the %s image", platform.String(), test.variant, res.Digest, platforms[test.want].String())
+		}
+	}
+
+	// a single image is not picked by platform, its variant is checked
+	single := reg.push(t, &Image{Img: images[0]}, "single")
+	platform := v1.Platform{OS: "linux", Architecture: "arm"}
+	config := ConverterConfig{Source: single, Path: t.TempDir(), Insecure: true, Platform: &platform, Variant: "v7"}
+	_, err := Convert(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), `image is linux/arm variant "v6", not the requested linux/arm/v7`) {
+		t.Errorf("Convert of a v6 image as v7 = %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package converter
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Inspect lists the layers of an image from its manifest and config,
+// none of the layer blobs are downloaded
+func Inspect(ctx context.Context, config ConverterConfig) ([]*LayerInfo, error) {
+	// nothing in config.Path is resumed, the registry is always asked
+	config.Refresh = true
+	image, err := createImage(ctx, &config)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := image.Img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image layers")
+	}
+	infos := make([]*LayerInfo, 0, len(layers))
+	for _, layer := range layers {
+		info, err := layerInfo(&config, layer)
+		if err != nil {
+			return nil, err
+		}
+		// nothing is stored locally
+		info.Path = ""
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	layers := []tarEntry{{Name: "a", Body: "first"}, {Name: "b", Body: "second layer"}}
+	image := testImage(t, testLayer(t, layers[0]), testLayer(t, layers[1]))
+	reg := startRegistry(t)
+	source := reg.push(t, image, "app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	infos, err := Inspect(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgLayers, err := image.Img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(imgLayers) {
+		t.Fatalf("Inspect listed %d layers, want %d", len(infos), len(imgLayers))
+	}
+	for i, layer := range imgLayers {
+		want, err := layerInfo(&config, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Path = ""
+		if *infos[i] != *want {
+			t.Errorf("layer %d = %+v, want %+v", i, infos[i], want)
+		}
+		// only the manifest and config are fetched
+		if reg.fetched("/blobs/" + want.Digest) {
+			t.Errorf("the blob of layer %d was downloaded", i)
+		}
+	}
+	entries, err := os.ReadDir(config.Path)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Inspect wrote %v into the output directory, %v", entries, err)
+	}
+
+	config.Source = reg.Host + "/missing:latest"
+	if _, err := Inspect(context.Background(), config); err == nil {
+		t.Error("Inspect of a missing image succeeded")
+	}
+}
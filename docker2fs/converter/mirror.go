@@ -0,0 +1,48 @@
+package converter
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+// dockerHubRegistries are the names Docker Hub references resolve to,
+// references to any of them go through ConverterConfig.Mirror
+var dockerHubRegistries = map[string]bool{
+	name.DefaultRegistry:   true,
+	"docker.io":            true,
+	"registry-1.docker.io": true,
+}
+
+// mirrorReference returns ref on mirror if ref points at Docker Hub,
+// keeping the repository path and the tag or digest
+func mirrorReference(ref name.Reference, mirror string, options ...name.Option) (name.Reference, error) {
+	if mirror == "" || !dockerHubRegistries[ref.Context().RegistryStr()] {
+		return ref, nil
+	}
+	repo, err := name.NewRepository(mirror+"/"+ref.Context().RepositoryStr(), options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse mirror repository")
+	}
+	if digest, ok := ref.(name.Digest); ok {
+		return repo.Digest(digest.DigestStr()), nil
+	}
+	return repo.Tag(ref.Identifier()), nil
+}
+
+// reference parses Source and applies Mirror
+func (config *ConverterConfig) reference() (name.Reference, error) {
+	ref, err := name.ParseReference(config.Source, config.nameOptions()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	return mirrorReference(ref, config.Mirror, config.nameOptions()...)
+}
+
+// nameOptions are the options for parsing references, Insecure allows
+// plain HTTP registries
+func (config *ConverterConfig) nameOptions() []name.Option {
+	if config.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
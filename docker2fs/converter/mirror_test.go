@@ -0,0 +1,65 @@
+package converter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestMirrorReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		ref    string
+		mirror string
+		want   string
+	}{
+		{"alpine", "mirror.example.com", "mirror.example.com/library/alpine:latest"},
+		{"alpine:3.20", "mirror.example.com", "mirror.example.com/library/alpine:3.20"},
+		{"docker.io/team/app:v1", "mirror.example.com:5000", "mirror.example.com:5000/team/app:v1"},
+		{"index.docker.io/team/app:v1", "mirror.example.com", "mirror.example.com/team/app:v1"},
+		{"registry-1.docker.io/team/app:v1", "mirror.example.com", "mirror.example.com/team/app:v1"},
+		{"alpine@" + digest, "mirror.example.com", "mirror.example.com/library/alpine@" + digest},
+		// other registries and an empty mirror are left alone
+		{"ghcr.io/team/app:v1", "mirror.example.com", "ghcr.io/team/app:v1"},
+		{"alpine:3.20", "", "index.docker.io/library/alpine:3.20"},
+	}
+	for _, test := range tests {
+		ref, err := name.ParseReference(test.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mirrorReference(ref, test.mirror)
+		if err != nil {
+			t.Errorf("mirrorReference(%s, %q) = %v", test.ref, test.mirror, err)
+			continue
+		}
+		if got.Name() != test.want {
+			t.Errorf("mirrorReference(%s, %q) = %s, want %s", test.ref, test.mirror, got.Name(), test.want)
+		}
+	}
+	ref := name.MustParseReference("alpine")
+	if _, err := mirrorReference(ref, "Not A Host"); err == nil {
+		t.Error("mirrorReference accepted an invalid mirror")
+	}
+}
+
+func TestConvertThroughMirror(t *testing.T) {
+	reg := startRegistry(t)
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "mirrored"}))
+	reg.push(t, image, "library/alpine")
+	digest, _ := image.Img.Digest()
+	config := ConverterConfig{Source: "alpine:latest", Path: t.TempDir(), Mirror: reg.Host, Insecure: true}
+	res, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reg.fetched("/v2/library/alpine/manifests/latest") {
+		t.Error("the image was not pulled from the mirror")
+	}
+	// the result keeps the source as given and pins it on the mirror
+	if res.Source != "alpine:latest" || res.Reference != reg.Host+"/library/alpine@"+digest.String() {
+		t.Errorf("Convert = %s as %s", res.Source, res.Reference)
+	}
+}
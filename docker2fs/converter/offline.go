@@ -0,0 +1,200 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"common/layout"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// localImage is the image an earlier conversion left in config.Path,
+// its layers come from the extracted layers or the blob cache
+type localImage struct {
+	config      *ConverterConfig
+	rawManifest []byte
+	rawConfig   []byte
+	manifest    *v1.Manifest
+	diffIDs     map[v1.Hash]v1.Hash
+	// fetch, when set, downloads the blob of a layer by digest instead of
+	// reading it from the cache
+	fetch func(digest v1.Hash) (io.ReadCloser, error)
+}
+
+func (i *localImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *localImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+func (i *localImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *localImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &localLayer{image: i, desc: desc}, nil
+		}
+	}
+	return nil, errors.Errorf("layer %s is not in the manifest", h.String())
+}
+
+// localLayer serves the compressed blob kept next to the layer or in the
+// cache, or the registry when resuming, an already extracted layer is
+// never read
+type localLayer struct {
+	image *localImage
+	desc  v1.Descriptor
+}
+
+func (l *localLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *localLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *localLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+// DiffID comes from the config, computing it would read the blob
+func (l *localLayer) DiffID() (v1.Hash, error) {
+	return l.image.diffIDs[l.desc.Digest], nil
+}
+
+func (l *localLayer) Compressed() (io.ReadCloser, error) {
+	if l.image.fetch != nil {
+		return l.image.fetch(l.desc.Digest)
+	}
+	file, err := os.Open(layerBlobPath(l.image.config.layersDir(), l.desc.Digest))
+	if !os.IsNotExist(err) {
+		return file, err
+	}
+	if l.image.config.CacheDir == "" {
+		return nil, errors.Errorf("offline: layer %s is not extracted and there is no cache", l.desc.Digest.String())
+	}
+	return os.Open(cachedBlobPath(l.image.config.CacheDir, l.desc.Digest))
+}
+
+// cachedBlobPath is where openCompressed keeps the blob of digest
+func cachedBlobPath(cacheDir string, digest v1.Hash) string {
+	return path.Join(cacheDir, "blobs", digest.Algorithm, digest.Hex)
+}
+
+// offlineReference is the reference resolved.json pinned the source to,
+// or the source itself when an earlier version didn't write it
+func offlineReference(config *ConverterConfig) (name.Reference, error) {
+	data, err := os.ReadFile(path.Join(config.Path, "resolved.json"))
+	if os.IsNotExist(err) {
+		return config.reference()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read resolved file")
+	}
+	resolved := &Resolved{}
+	err = json.Unmarshal(data, resolved)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse resolved file")
+	}
+	if resolved.Source != config.Source {
+		return nil, errors.Errorf("offline: %s holds %s, not %s", config.Path, resolved.Source, config.Source)
+	}
+	ref, err := name.ParseReference(resolved.Reference, config.nameOptions()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse resolved reference")
+	}
+	return ref, nil
+}
+
+// readLocalImage reads the manifest and config an earlier conversion
+// wrote into config.Path, the image is pinned to ref
+func readLocalImage(config *ConverterConfig) (*localImage, *v1.ConfigFile, error) {
+	rawManifest, err := os.ReadFile(layersManifestPath(config.Path))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read manifest")
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse manifest")
+	}
+	rawConfig, err := os.ReadFile(layout.New(config.Path).Config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read config")
+	}
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse config")
+	}
+	if len(configFile.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, nil, errors.Errorf("manifest has %d layers but config has %d diffIDs",
+			len(manifest.Layers), len(configFile.RootFS.DiffIDs))
+	}
+	local := &localImage{
+		config:      config,
+		rawManifest: rawManifest,
+		rawConfig:   rawConfig,
+		manifest:    manifest,
+		diffIDs:     map[v1.Hash]v1.Hash{},
+	}
+	for i, layer := range manifest.Layers {
+		local.diffIDs[layer.Digest] = configFile.RootFS.DiffIDs[i]
+	}
+	return local, configFile, nil
+}
+
+// loadLocalImage builds the image from the manifest and config an earlier
+// conversion wrote into config.Path. Every layer must be extracted already
+// or have its blob next to it or in the cache, nothing is fetched.
+func loadLocalImage(config *ConverterConfig) (*Image, error) {
+	ref, err := offlineReference(config)
+	if err != nil {
+		return nil, err
+	}
+	local, _, err := readLocalImage(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "offline")
+	}
+	missing := []string{}
+	for _, layer := range local.manifest.Layers {
+		if layerComplete(config.layersDir(), layer.Digest.Hex) {
+			continue
+		}
+		if _, err := os.Stat(layerBlobPath(config.layersDir(), layer.Digest)); err == nil {
+			continue
+		}
+		if config.CacheDir != "" {
+			if _, err := os.Stat(cachedBlobPath(config.CacheDir, layer.Digest)); err == nil {
+				continue
+			}
+		}
+		missing = append(missing, layer.Digest.String())
+	}
+	if len(missing) > 0 {
+		cache := "there is no cache"
+		if config.CacheDir != "" {
+			cache = "not cached in " + config.CacheDir
+		}
+		return nil, errors.Errorf("offline: %d layer(s) not extracted under %s and %s: %s",
+			len(missing), config.layersDir(), cache, strings.Join(missing, ", "))
+	}
+	img, err := partial.CompressedToImage(local)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("offline: load %s", config.Path))
+	}
+	return &Image{Ref: ref, Img: img}, nil
+}
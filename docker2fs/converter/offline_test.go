@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"common/layout"
+)
+
+func TestConvertOffline(t *testing.T) {
+	reg := startRegistry(t)
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "offline"}))
+	digest, _ := image.Img.Digest()
+	layers, _ := image.Img.Layers()
+	layerDigest, _ := layers[0].Digest()
+	source := reg.push(t, image, "app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), CacheDir: t.TempDir(), Insecure: true}
+	_, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.reset()
+
+	// the image converted into Path converts again without the registry
+	config.Offline = true
+	res, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digest != digest.String() || res.Reference != reg.Host+"/app@"+digest.String() {
+		t.Errorf("offline Convert = %s as %s, want %s", res.Digest, res.Reference, digest)
+	}
+	// a layer that is gone is extracted again from the cache
+	layerDir := path.Join(layout.New(config.Path).Layers, layerDigest.Hex)
+	for _, p := range []string{layerDir, layout.CompleteMarker(layerDir), layerDir + ".tar", layerDir + ".blob"} {
+		if err := os.RemoveAll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path.Join(layerDir, "file")); err != nil || string(data) != "offline" {
+		t.Errorf("the layer extracted from the cache has %q, %v", data, err)
+	}
+	if reg.fetched("/") {
+		t.Error("an offline convert asked the registry")
+	}
+
+	// without the cache the missing layer is listed
+	for _, p := range []string{layerDir, layout.CompleteMarker(layerDir)} {
+		if err := os.RemoveAll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(layerDir + ".blob")
+	config.CacheDir = ""
+	_, err = Convert(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "offline: 1 layer(s) not extracted") ||
+		!strings.Contains(err.Error(), "there is no cache: "+layerDigest.String()) {
+		t.Errorf("offline Convert without the layer = %v", err)
+	}
+
+	// Path holds another source
+	config.Source = reg.Host + "/other:latest"
+	if _, err := Convert(context.Background(), config); err == nil || !strings.Contains(err.Error(), "holds "+source) {
+		t.Errorf("offline Convert of another source = %v", err)
+	}
+	// nothing was converted into an empty Path
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Offline: true, Insecure: true}
+	if _, err := Convert(context.Background(), config); err == nil {
+		t.Error("offline Convert into an empty directory succeeded")
+	}
+	if reg.fetched("/") {
+		t.Error("an offline convert asked the registry")
+	}
+}
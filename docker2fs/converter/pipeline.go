@@ -0,0 +1,92 @@
+package converter
+
+import (
+	"context"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// workers returns n, or 1 if n is not positive
+func workers(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// pipelineLayers pulls and extracts layers in two stages. Download
+// workers write the tar of each layer and hand it to the extraction
+// workers, so extracting one layer overlaps downloading the next. A layer
+// another conversion already pulled or extracted is skipped. The result
+// holds the error of each layer, in the order of layers. With pullOnly
+// only the download stage runs.
+func pipelineLayers(ctx context.Context, config *ConverterConfig, layers []v1.Layer) []error {
+	errs := make([]error, len(layers))
+	releases := make([]func(), len(layers))
+	xattrs := make([][]fileXattrs, len(layers))
+	downloads := make(chan int)
+	// downloads never wait for extraction, only the tars on disk pile up
+	extracts := make(chan int, len(layers))
+
+	var downloading sync.WaitGroup
+	for w := 0; w < workers(config.DownloadConcurrency); w++ {
+		downloading.Add(1)
+		go func() {
+			defer downloading.Done()
+			for i := range downloads {
+				hash, err := layers[i].Digest()
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				release, pull := claimLayer(config, hash)
+				if !pull {
+					continue
+				}
+				if config.pullOnly && layerPulled(config.layersDir(), hash.Hex) {
+					release()
+					continue
+				}
+				xattrs[i], err = pullLayer(ctx, config, layers[i])
+				if err != nil {
+					errs[i] = errors.Wrap(err, "pull image layer")
+					release()
+					continue
+				}
+				// the lock stays held until the layer is extracted
+				releases[i] = release
+				extracts <- i
+			}
+		}()
+	}
+
+	var extracting sync.WaitGroup
+	for w := 0; w < workers(config.ExtractConcurrency); w++ {
+		extracting.Add(1)
+		go func() {
+			defer extracting.Done()
+			for i := range extracts {
+				if config.pullOnly {
+					releases[i]()
+					continue
+				}
+				err := extractLayer(ctx, config, layers[i], xattrs[i])
+				if err != nil {
+					errs[i] = errors.Wrap(err, "extract image layer")
+				}
+				releases[i]()
+			}
+		}()
+	}
+
+	for i := range layers {
+		downloads <- i
+	}
+	close(downloads)
+	downloading.Wait()
+	close(extracts)
+	extracting.Wait()
+	return errs
+}
@@ -0,0 +1,168 @@
+package converter
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+func TestWorkers(t *testing.T) {
+	for n, want := range map[int]int{-1: 1, 0: 1, 1: 1, 4: 4} {
+		if got := workers(n); got != want {
+			t.Errorf("workers(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+// gatedLayer reports each download on started and holds it until proceed
+// is closed
+type gatedLayer struct {
+	v1.Layer
+	started chan<- v1.Layer
+	proceed <-chan struct{}
+}
+
+func (l *gatedLayer) Compressed() (io.ReadCloser, error) {
+	l.started <- l
+	<-l.proceed
+	return l.Layer.Compressed()
+}
+
+// failingLayer fails to download
+type failingLayer struct {
+	v1.Layer
+}
+
+func (l *failingLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestPipelineLayersDownloadConcurrency(t *testing.T) {
+	started := make(chan v1.Layer, 4)
+	proceed := make(chan struct{})
+	layers := []v1.Layer{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		layers = append(layers, &gatedLayer{Layer: testLayer(t, tarEntry{Name: name, Body: name}), started: started, proceed: proceed})
+	}
+	config := testConfig(t)
+	config.DownloadConcurrency = 3
+	done := make(chan []error, 1)
+	go func() { done <- pipelineLayers(context.Background(), config, layers) }()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			close(proceed)
+			t.Fatalf("only %d downloads run in parallel, want 3", i)
+		}
+	}
+	// the fourth waits for a free download worker
+	select {
+	case <-started:
+		t.Error("more downloads run in parallel than DownloadConcurrency")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(proceed)
+	for i, err := range <-done {
+		if err != nil {
+			t.Errorf("layer %d: %v", i, err)
+		}
+	}
+	for _, layer := range layers {
+		digest, _ := layer.Digest()
+		if !layerComplete(config.layersDir(), digest.Hex) {
+			t.Errorf("layer %s is not extracted", digest)
+		}
+	}
+}
+
+func TestPipelineLayersExtractsWhileDownloading(t *testing.T) {
+	started := make(chan v1.Layer, 1)
+	proceed := make(chan struct{})
+	first := testLayer(t, tarEntry{Name: "first", Body: "first"})
+	second := &gatedLayer{Layer: testLayer(t, tarEntry{Name: "second", Body: "second"}), started: started, proceed: proceed}
+	config := testConfig(t)
+	config.DownloadConcurrency = 1
+	done := make(chan []error, 1)
+	go func() { done <- pipelineLayers(context.Background(), config, []v1.Layer{first, second}) }()
+	defer func() { <-done }()
+	defer close(proceed)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second download didn't start")
+	}
+	// the first layer is extracted while the second is still downloading
+	digest, _ := first.Digest()
+	deadline := time.Now().Add(5 * time.Second)
+	for !layerComplete(config.layersDir(), digest.Hex) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first layer waited for the second download to be extracted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipelineLayersErrors(t *testing.T) {
+	good := testLayer(t, tarEntry{Name: "good", Body: "good"})
+	// a valid tar that tar can't extract, a file under a regular file
+	broken := testLayer(t, tarEntry{Name: "file", Body: "file"}, tarEntry{Name: "file/under", Body: "under"})
+	unreachable := &failingLayer{Layer: testLayer(t, tarEntry{Name: "unreachable", Body: "unreachable"})}
+	config := testConfig(t)
+	config.DownloadConcurrency = 2
+	config.ExtractConcurrency = 2
+	errs := pipelineLayers(context.Background(), config, []v1.Layer{good, broken, unreachable})
+	// each error stays at the position of its layer
+	if len(errs) != 3 || errs[0] != nil {
+		t.Fatalf("pipelineLayers = %v", errs)
+	}
+	if errs[1] == nil || !strings.HasPrefix(errs[1].Error(), "extract image layer") {
+		t.Errorf("broken layer = %v, want an extraction error", errs[1])
+	}
+	if errs[2] == nil || !strings.HasPrefix(errs[2].Error(), "pull image layer") || !strings.Contains(errs[2].Error(), "connection reset") {
+		t.Errorf("unreachable layer = %v, want a download error", errs[2])
+	}
+	// failed layers are not recorded as pulled, a retry pulls them again
+	for _, layer := range []v1.Layer{broken, unreachable} {
+		digest, _ := layer.Digest()
+		release, pull := claimLayer(config, digest)
+		if !pull {
+			t.Errorf("layer %s is not pulled again after failing", digest)
+			continue
+		}
+		release()
+		dir := path.Join(config.layersDir(), digest.Hex)
+		for _, p := range []string{dir, dir + ".partial", layout.CompleteMarker(dir)} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("the failed layer left %s", p)
+			}
+		}
+	}
+}
+
+func TestPipelineLayersPullOnly(t *testing.T) {
+	layer := testLayer(t, tarEntry{Name: "file", Body: "pulled"})
+	config := testConfig(t)
+	config.pullOnly = true
+	for i, err := range pipelineLayers(context.Background(), config, []v1.Layer{layer}) {
+		if err != nil {
+			t.Errorf("layer %d: %v", i, err)
+		}
+	}
+	digest, _ := layer.Digest()
+	if !layerPulled(config.layersDir(), digest.Hex) {
+		t.Error("the tar was not written")
+	}
+	if _, err := os.Stat(path.Join(config.layersDir(), digest.Hex)); !os.IsNotExist(err) {
+		t.Error("pullOnly extracted the layer")
+	}
+}
@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// layerPulled reports whether the tar of layer hex is already downloaded
+func layerPulled(layersDir, hex string) bool {
+	_, err := os.Stat(path.Join(layersDir, hex+".tar"))
+	return err == nil
+}
+
+// Pull downloads every layer of config.Source to <hex>.tar under the
+// layers directory without extracting it, and writes config.json,
+// manifest.json and resolved.json. With CacheDir the compressed blobs
+// are cached as well, so a later convert, -offline too, doesn't download
+// them again. Layers already pulled or extracted are skipped.
+func Pull(ctx context.Context, config ConverterConfig) (*Result, error) {
+	config.pullOnly = true
+	slog.Info("pulling", "source", config.Source, "path", config.Path)
+	unlock, err := lockLayers(config.layersDir(), syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	image, err := createImage(ctx, &config)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(config.Path, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "create output directory")
+	}
+	err = pullLayers(ctx, &config, image)
+	if err != nil {
+		return nil, err
+	}
+	err = writeMetadata(&config, image)
+	if err != nil {
+		return nil, err
+	}
+	return result(&config, image)
+}
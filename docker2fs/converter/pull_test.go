@@ -0,0 +1,59 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"common/layout"
+)
+
+func TestPull(t *testing.T) {
+	reg := startRegistry(t)
+	layer := testLayer(t, tarEntry{Name: "file", Body: "pulled"})
+	image := testImage(t, layer)
+	digest, _ := layer.Digest()
+	source := reg.push(t, image, "app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), CacheDir: t.TempDir(), Insecure: true}
+	res, err := Pull(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tar and the metadata are written, nothing is extracted
+	layerDir := path.Join(layout.New(config.Path).Layers, digest.Hex)
+	if len(res.LayerInfos) != 1 || res.LayerInfos[0].Path != layerDir {
+		t.Fatalf("Pull = %+v", res.LayerInfos)
+	}
+	for _, p := range []string{layerDir + ".tar", res.ConfigPath, res.ManifestPath, path.Join(config.Path, "resolved.json"), cachedBlobPath(config.CacheDir, digest)} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, p := range []string{layerDir, layout.CompleteMarker(layerDir)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Pull extracted %s", p)
+		}
+	}
+
+	// a pulled layer is not downloaded again
+	reg.reset()
+	if _, err := Pull(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if reg.fetched("/blobs/" + digest.String()) {
+		t.Error("the pulled layer was downloaded again")
+	}
+
+	// a later offline convert extracts it without the registry
+	config.Offline = true
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path.Join(layerDir, "file")); err != nil || string(data) != "pulled" {
+		t.Errorf("the extracted layer has %q, %v", data, err)
+	}
+	if reg.fetched("/blobs/") {
+		t.Error("the offline convert downloaded a blob")
+	}
+}
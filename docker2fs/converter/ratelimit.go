@@ -0,0 +1,70 @@
+package converter
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter caps the bytes per second downloaded by all pulls sharing
+// it, across the images converted in parallel. A nil *RateLimiter doesn't
+// limit anything.
+type RateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter limits downloads to n bytes per second, it returns nil
+// for 0
+func NewRateLimiter(n int) *RateLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &RateLimiter{limiter: rate.NewLimiter(rate.Limit(n), n)}
+}
+
+// wait blocks until n more bytes may be handed out. WaitN fails for more
+// than the burst at once, so a large read is paid for in bursts.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	burst := l.limiter.Burst()
+	for n > 0 {
+		chunk := min(n, burst)
+		err := l.limiter.WaitN(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// rateLimitedReader waits for the shared limiter before handing out the
+// bytes it read
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.ReadCloser
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *rateLimitedReader) Close() error {
+	return r.r.Close()
+}
+
+// throttle returns reader limited by config.RateLimit, or reader itself
+// without a limit
+func throttle(ctx context.Context, config *ConverterConfig, reader io.ReadCloser) io.ReadCloser {
+	if config.RateLimit == nil {
+		return reader
+	}
+	return &rateLimitedReader{ctx: ctx, r: reader, limiter: config.RateLimit}
+}
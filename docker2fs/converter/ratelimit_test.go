@@ -0,0 +1,53 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiterWithoutLimit(t *testing.T) {
+	if limiter := NewRateLimiter(0); limiter != nil {
+		t.Errorf("NewRateLimiter(0) = %v, want nil", limiter)
+	}
+	reader := io.NopCloser(bytes.NewReader(nil))
+	if got := throttle(context.Background(), &ConverterConfig{}, reader); got != reader {
+		t.Error("throttle without a limit should return the reader itself")
+	}
+}
+
+func TestRateLimitedReadLargerThanBurst(t *testing.T) {
+	const rate = 64 << 10
+	config := &ConverterConfig{RateLimit: NewRateLimiter(rate)}
+	// a copy of the config, as ConvertBatch makes for each image, shares the limit
+	copied := *config
+	data := make([]byte, rate*3/2)
+	reader := throttle(context.Background(), &copied, io.NopCloser(bytes.NewReader(data)))
+	start := time.Now()
+	n, err := reader.Read(make([]byte, 2*rate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("read %d bytes, want all %d at once", n, len(data))
+	}
+	// the burst is free, the other half second of data is waited for
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("read %d bytes at %d B/s in %s", n, rate, elapsed)
+	}
+	if copied.RateLimit != config.RateLimit {
+		t.Error("the copied config has a limiter of its own")
+	}
+}
+
+func TestRateLimitedReadCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config := &ConverterConfig{RateLimit: NewRateLimiter(10)}
+	reader := throttle(ctx, config, io.NopCloser(bytes.NewReader(make([]byte, 100))))
+	if _, err := reader.Read(make([]byte, 100)); err == nil {
+		t.Error("a canceled read should fail instead of waiting")
+	}
+}
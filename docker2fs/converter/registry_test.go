@@ -0,0 +1,152 @@
+package converter
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testRegistry is an in-memory registry recording the paths it was asked for
+type testRegistry struct {
+	Host string
+	// client trusts the certificate of a TLS registry
+	client *http.Client
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// startRegistry serves an in-memory registry over plain HTTP until the test ends
+func startRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	reg, server := newRegistry(t)
+	server.Start()
+	reg.client = server.Client()
+	reg.Host = strings.TrimPrefix(server.URL, "http://")
+	return reg
+}
+
+// startTLSRegistry serves an in-memory registry over HTTPS until the test
+// ends, with a certificate only the returned PEM file makes trusted
+func startTLSRegistry(t *testing.T) (*testRegistry, string) {
+	t.Helper()
+	reg, server := newRegistry(t)
+	server.StartTLS()
+	reg.client = server.Client()
+	reg.Host = strings.TrimPrefix(server.URL, "https://")
+	certFile := path.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return reg, certFile
+}
+
+func newRegistry(t *testing.T) (*testRegistry, *httptest.Server) {
+	reg := &testRegistry{}
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg.mu.Lock()
+		reg.requests = append(reg.requests, r.Method+" "+r.URL.Path)
+		reg.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return reg, server
+}
+
+// push uploads image as repo:tag and returns its reference
+func (reg *testRegistry) push(t *testing.T, image *Image, repo string) string {
+	t.Helper()
+	ref := reg.Host + "/" + repo + ":latest"
+	tag, err := name.NewTag(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, image.Img, remote.WithTransport(reg.client.Transport)); err != nil {
+		t.Fatal(err)
+	}
+	reg.reset()
+	return ref
+}
+
+// platformImage returns an image of layers built for platform
+func platformImage(t *testing.T, platform v1.Platform, layers ...v1.Layer) v1.Image {
+	t.Helper()
+	img := testImage(t, layers...).Img
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS = platform.OS
+	configFile.Architecture = platform.Architecture
+	configFile.Variant = platform.Variant
+	img, err = mutate.ConfigFile(img, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// pushIndex uploads a manifest list of images, each listed with the
+// platform at the same position, as repo:latest and returns its reference
+// and digest
+func (reg *testRegistry) pushIndex(t *testing.T, repo string, platforms []v1.Platform, images []v1.Image) (string, v1.Hash) {
+	t.Helper()
+	var index v1.ImageIndex = empty.Index
+	for i, img := range images {
+		platform := platforms[i]
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+	ref := reg.Host + "/" + repo + ":latest"
+	tag, err := name.NewTag(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, index, remote.WithTransport(reg.client.Transport)); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.reset()
+	return ref, digest
+}
+
+// reset forgets the requests so far
+func (reg *testRegistry) reset() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests = nil
+}
+
+// fetched reports whether a GET of a path containing part was served
+func (reg *testRegistry) fetched(part string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, request := range reg.requests {
+		if strings.HasPrefix(request, "GET ") && strings.Contains(request, part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"common/units"
+
+	"github.com/pkg/errors"
+)
+
+// SizeReport summarizes how much space a converted image takes
+type SizeReport struct {
+	// Compressed is the download size from the manifest
+	Compressed int64
+	// Extracted adds up the files of every layer in the manifest
+	Extracted int64
+	// Deduplicated counts each layer and each hard-linked file once,
+	// which is what the layers actually take on disk
+	Deduplicated int64
+	// Tar is the size of the decompressed layer tarballs kept next to
+	// the extracted directories
+	Tar int64
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// countOnce reports whether the file behind info has not been seen yet
+// and marks it as seen
+func countOnce(info os.FileInfo, seen map[inodeKey]bool) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	key := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	return true
+}
+
+// walkLayer returns the total size of the regular files under dir and the
+// part of it not already counted in seen
+func walkLayer(dir string, seen map[inodeKey]bool) (int64, int64, error) {
+	var total, unique int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		total += info.Size()
+		if countOnce(info, seen) {
+			unique += info.Size()
+		}
+		return nil
+	})
+	return total, unique, err
+}
+
+// sizeReport measures the layers of image under config.layersDir()
+func sizeReport(config *ConverterConfig, image *Image) (*SizeReport, error) {
+	layers, err := image.Img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get image layers")
+	}
+	report := &SizeReport{}
+	seen := map[inodeKey]bool{}
+	for _, layer := range layers {
+		hash, err := layer.Digest()
+		if err != nil {
+			return nil, errors.Wrap(err, "get image layer digest")
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("layer %s Size", hash.String()))
+		}
+		report.Compressed += size
+		total, unique, err := walkLayer(path.Join(config.layersDir(), hash.Hex), seen)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("measure layer %s", hash.String()))
+		}
+		report.Extracted += total
+		report.Deduplicated += unique
+		info, err := os.Stat(path.Join(config.layersDir(), hash.Hex+".tar"))
+		if err == nil && countOnce(info, seen) {
+			report.Tar += info.Size()
+		}
+	}
+	return report, nil
+}
+
+func (r *SizeReport) String() string {
+	return fmt.Sprintf("compressed %s, extracted %s, on disk %s (+%s tar)",
+		units.HumanSize(r.Compressed), units.HumanSize(r.Extracted), units.HumanSize(r.Deduplicated), units.HumanSize(r.Tar))
+}
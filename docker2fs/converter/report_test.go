@@ -0,0 +1,53 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSizeReportString(t *testing.T) {
+	report := &SizeReport{Compressed: 1536, Extracted: 10 << 20, Deduplicated: 5 << 20, Tar: 512}
+	want := "compressed 1.5KiB, extracted 10.0MiB, on disk 5.0MiB (+512B tar)"
+	if got := report.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestSizeReportCountsHardLinksOnce(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	layer := testLayer(t, tarEntry{Name: "a", Body: body}, tarEntry{Name: "b", Body: body})
+	// the same layer twice takes its space once
+	image := testImage(t, layer, layer)
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	dir := path.Join(config.layersDir(), digest.Hex)
+	err = os.Remove(path.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(path.Join(dir, "a"), path.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := sizeReport(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := layer.Size()
+	if report.Compressed != 2*size {
+		t.Errorf("Compressed = %d, want %d", report.Compressed, 2*size)
+	}
+	if report.Extracted != 4000 {
+		t.Errorf("Extracted = %d, want 4000", report.Extracted)
+	}
+	if report.Deduplicated != 1000 {
+		t.Errorf("Deduplicated = %d, want 1000", report.Deduplicated)
+	}
+}
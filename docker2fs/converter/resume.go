@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// resumeImage returns the image an earlier, possibly interrupted,
+// conversion of the same source left in config.Path, so converting again
+// neither re-resolves the tag nor fetches the manifest and config. Layers
+// not extracted yet are fetched from the registry by digest. It returns
+// nil when there is nothing valid to resume from.
+func resumeImage(ctx context.Context, config *ConverterConfig) (*Image, error) {
+	data, err := os.ReadFile(path.Join(config.Path, "resolved.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read resolved file")
+	}
+	resolved := &Resolved{}
+	err = json.Unmarshal(data, resolved)
+	if err != nil {
+		slog.Warn("not resuming, resolved file is invalid", "path", config.Path, "err", err)
+		return nil, nil
+	}
+	if resolved.Source != config.Source {
+		return nil, nil
+	}
+	ref, err := name.ParseReference(resolved.Reference, config.nameOptions()...)
+	if err != nil {
+		slog.Warn("not resuming, resolved reference is invalid", "path", config.Path, "err", err)
+		return nil, nil
+	}
+	local, configFile, err := readLocalImage(config)
+	if err != nil {
+		slog.Warn("not resuming, earlier conversion is incomplete", "path", config.Path, "err", err)
+		return nil, nil
+	}
+	// an earlier conversion of another platform is converted again
+	platform := config.platform()
+	if configFile.OS != platform.OS || configFile.Architecture != platform.Architecture ||
+		(platform.Variant != "" && normalVariant(configFile.Architecture, configFile.Variant) != normalVariant(platform.Architecture, platform.Variant)) {
+		return nil, nil
+	}
+	repo, err := config.reference()
+	if err != nil {
+		return nil, err
+	}
+	// the blobs come from the source repository, which may be a mirror
+	// other than the one resolved.json was written through
+	local.fetch = func(digest v1.Hash) (io.ReadCloser, error) {
+		options, err := config.remoteOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := remote.Layer(repo.Context().Digest(digest.String()), options...)
+		if err != nil {
+			return nil, err
+		}
+		return layer.Compressed()
+	}
+	img, err := partial.CompressedToImage(local)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("resume %s", config.Path))
+	}
+	slog.Info("resuming earlier conversion, pass -refresh to resolve the source again",
+		"source", config.Source, "reference", resolved.Reference)
+	return &Image{Ref: ref, Img: img}, nil
+}
@@ -0,0 +1,106 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"common/layout"
+)
+
+func TestConvertResumes(t *testing.T) {
+	reg := startRegistry(t)
+	layer := testLayer(t, tarEntry{Name: "file", Body: "old"})
+	old := testImage(t, layer)
+	oldDigest, _ := old.Img.Digest()
+	layerDigest, _ := layer.Digest()
+	source := reg.push(t, old, "app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	// the tag moves on after the first conversion
+	moved := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "new"}))
+	newDigest, _ := moved.Img.Digest()
+	reg.push(t, moved, "app")
+
+	// a lost layer is fetched again by digest, the tag is not resolved
+	layerDir := path.Join(layout.New(config.Path).Layers, layerDigest.Hex)
+	for _, p := range []string{layerDir, layout.CompleteMarker(layerDir), layerDir + ".tar"} {
+		if err := os.RemoveAll(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digest != oldDigest.String() || reg.fetched("/manifests/") {
+		t.Errorf("resumed convert gave %s and fetched a manifest %v, want %s from resolved.json", res.Digest, reg.fetched("/manifests/"), oldDigest)
+	}
+	if !reg.fetched("/v2/app/blobs/" + layerDigest.String()) {
+		t.Error("the lost layer was not fetched from the source repository")
+	}
+	if data, err := os.ReadFile(path.Join(layerDir, "file")); err != nil || string(data) != "old" {
+		t.Errorf("the resumed layer has %q, %v", data, err)
+	}
+
+	// -refresh resolves the tag again
+	config.Refresh = true
+	res, err = Convert(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digest != newDigest.String() {
+		t.Errorf("refreshed convert gave %s, want the moved tag %s", res.Digest, newDigest)
+	}
+}
+
+func TestResumeImageSkips(t *testing.T) {
+	reg := startRegistry(t)
+	source := reg.push(t, testImage(t, testLayer(t, tarEntry{Name: "file"})), "app")
+	config := ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if image, err := resumeImage(context.Background(), &config); err != nil || image == nil {
+		t.Fatalf("resumeImage = %v, %v, want the earlier conversion", image, err)
+	}
+	// nothing to resume from for another source or platform
+	other := config
+	other.Source = reg.Host + "/other:latest"
+	platform := otherPlatform()
+	elsewhere := config
+	elsewhere.Platform = &platform
+	for _, c := range []ConverterConfig{other, elsewhere} {
+		if image, err := resumeImage(context.Background(), &c); err != nil || image != nil {
+			t.Errorf("resumeImage of %s for %v = %v, %v, want nothing", c.Source, c.platform(), image, err)
+		}
+	}
+	// an invalid or missing resolved.json is not an error
+	resolved := path.Join(config.Path, "resolved.json")
+	if err := os.WriteFile(resolved, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if image, err := resumeImage(context.Background(), &config); err != nil || image != nil {
+		t.Errorf("resumeImage with an invalid resolved.json = %v, %v", image, err)
+	}
+	if err := os.Remove(resolved); err != nil {
+		t.Fatal(err)
+	}
+	if image, err := resumeImage(context.Background(), &config); err != nil || image != nil {
+		t.Errorf("resumeImage without resolved.json = %v, %v", image, err)
+	}
+	// a manifest that doesn't match its config is converted again
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(layout.New(config.Path).Config, []byte(`{"rootfs":{"diff_ids":[]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if image, err := resumeImage(context.Background(), &config); err != nil || image != nil {
+		t.Errorf("resumeImage of an incomplete conversion = %v, %v", image, err)
+	}
+}
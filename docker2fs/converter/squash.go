@@ -0,0 +1,263 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squashedMediaType is the uncompressed layer type of the manifest's own
+// format for the single layer of a squashed manifest, so tools reading the
+// manifest see a layer type they know. The layer only exists as a directory
+// under the layers path, there is no blob.
+func squashedMediaType(manifestType types.MediaType) types.MediaType {
+	if manifestType == types.OCIManifestSchema1 {
+		return types.OCIUncompressedLayer
+	}
+	return types.DockerUncompressedLayer
+}
+
+// applyWhiteouts removes what the whiteout files of layerDir hide from dst
+func applyWhiteouts(layerDir, dst string) error {
+	return filepath.WalkDir(layerDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !strings.HasPrefix(name, whiteoutPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(layerDir, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if name == whiteoutOpaque {
+			entries, err := os.ReadDir(target)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				err = os.RemoveAll(filepath.Join(target, entry.Name()))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return os.RemoveAll(filepath.Join(target, strings.TrimPrefix(name, whiteoutPrefix)))
+	})
+}
+
+// copyEntry recreates the file at src as dst with the same mode, owner and
+// mtime. Regular files are hard linked, the layers are never modified.
+func copyEntry(src, dst string, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	existing, err := os.Lstat(dst)
+	if err == nil && !(existing.IsDir() && info.IsDir()) {
+		err = os.RemoveAll(dst)
+		if err != nil {
+			return err
+		}
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if existing == nil || !existing.IsDir() {
+			err = os.Mkdir(dst, mode.Perm())
+			if err != nil {
+				return err
+			}
+		}
+		// a directory in an upper layer replaces the metadata of the lower one
+		err = os.Chmod(dst, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		return os.Link(src, dst)
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(target, dst)
+		if err != nil {
+			return err
+		}
+	default:
+		err = syscall.Mknod(dst, stat.Mode, int(stat.Rdev))
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+		// directory times are set once everything is merged
+		return nil
+	}
+	return os.Chtimes(dst, time.Unix(stat.Atim.Unix()), info.ModTime())
+}
+
+// mergeLayer copies the entries of layerDir over dst and records the
+// mtime of its directories in dirTimes
+func mergeLayer(layerDir, dst string, dirTimes map[string]time.Time) error {
+	return filepath.Walk(layerDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(layerDir, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		err = copyEntry(p, target, info)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("merge %s", rel))
+		}
+		if info.IsDir() {
+			dirTimes[target] = info.ModTime()
+		}
+		return nil
+	})
+}
+
+// squashLayers merges the extracted layers of image bottom to top into a
+// single directory, applying whiteouts, and rewrites manifest.json to list
+// only that directory. The original manifest is kept as manifest.orig.json.
+// A directory already squashed from the same layer digests is reused.
+func squashLayers(config *ConverterConfig, image *Image) error {
+	manifest, err := image.Img.Manifest()
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	id := squashID(manifest)
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	squashedDir := path.Join(config.layersDir(), id.Hex)
+	// the same layers were squashed before, by an earlier run or another
+	// image, and the directory only depends on them
+	if _, err := os.Stat(layout.CompleteMarker(squashedDir)); err == nil {
+		slog.Info("layers already squashed", "source", config.Source, "layer", id.Hex)
+		return writeSquashedManifest(config, image, manifest, id, size)
+	}
+	partialDir := squashedDir + ".partial"
+	err = os.RemoveAll(partialDir)
+	if err != nil {
+		return errors.Wrap(err, "remove partial squashed directory")
+	}
+	err = os.MkdirAll(partialDir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "create squashed directory")
+	}
+	dirTimes := map[string]time.Time{}
+	for _, layer := range manifest.Layers {
+		layerDir := path.Join(config.layersDir(), layer.Digest.Hex)
+		err = applyWhiteouts(layerDir, partialDir)
+		if err != nil {
+			os.RemoveAll(partialDir)
+			return errors.Wrap(err, fmt.Sprintf("apply whiteouts of layer %s", layer.Digest.String()))
+		}
+		err = mergeLayer(layerDir, partialDir, dirTimes)
+		if err != nil {
+			os.RemoveAll(partialDir)
+			return errors.Wrap(err, fmt.Sprintf("merge layer %s", layer.Digest.String()))
+		}
+	}
+	// deepest first, setting a child's time doesn't touch its parent
+	dirs := make([]string, 0, len(dirTimes))
+	for dir := range dirTimes {
+		if _, err := os.Stat(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		err = os.Chtimes(dir, dirTimes[dir], dirTimes[dir])
+		if err != nil {
+			os.RemoveAll(partialDir)
+			return errors.Wrap(err, "set squashed directory times")
+		}
+	}
+	err = os.RemoveAll(squashedDir)
+	if err != nil {
+		return errors.Wrap(err, "remove old squashed directory")
+	}
+	err = os.Rename(partialDir, squashedDir)
+	if err != nil {
+		return errors.Wrap(err, "rename squashed directory")
+	}
+	err = os.WriteFile(layout.CompleteMarker(squashedDir), nil, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write complete marker of squashed directory")
+	}
+	return writeSquashedManifest(config, image, manifest, id, size)
+}
+
+// squashID names the squashed layer after the layers it was built from
+func squashID(manifest *v1.Manifest) v1.Hash {
+	h := sha256.New()
+	for _, layer := range manifest.Layers {
+		h.Write([]byte(layer.Digest.String() + "\n"))
+	}
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+}
+
+// writeSquashedManifest keeps the original manifest as manifest.orig.json
+// and writes manifest.json listing only the squashed layer id
+func writeSquashedManifest(config *ConverterConfig, image *Image, manifest *v1.Manifest, id v1.Hash, size int64) error {
+	raw, err := image.Img.RawManifest()
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	err = os.WriteFile(path.Join(config.Path, "manifest.orig.json"), raw, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write original manifest")
+	}
+	squashed := manifest.DeepCopy()
+	squashed.Layers = []v1.Descriptor{{
+		MediaType: squashedMediaType(manifest.MediaType),
+		Digest:    id,
+		Size:      size,
+	}}
+	data, err := json.Marshal(squashed)
+	if err != nil {
+		return errors.Wrap(err, "marshal squashed manifest")
+	}
+	err = os.WriteFile(layout.New(config.Path).Manifest, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write squashed manifest")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// squashImage pulls image into a fresh directory, squashes it and returns
+// the config and the manifest written
+func squashImage(t *testing.T, image *Image) (*ConverterConfig, *v1.Manifest) {
+	t.Helper()
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMetadata(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = squashLayers(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(layout.New(config.Path).Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	manifest, err := v1.ParseManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, manifest
+}
+
+func TestSquashLayers(t *testing.T) {
+	image := testImage(t,
+		testLayer(t, tarEntry{Name: "a/file", Body: "a"}, tarEntry{Name: "b/old", Body: "old"}),
+		testLayer(t, tarEntry{Name: "b/.wh.old"}, tarEntry{Name: "new", Body: "new"}),
+	)
+	config, manifest := squashImage(t, image)
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("squashed manifest has %d layers, want 1", len(manifest.Layers))
+	}
+	layer := manifest.Layers[0]
+	if layer.MediaType != types.DockerUncompressedLayer {
+		t.Errorf("squashed layer media type = %s, want %s", layer.MediaType, types.DockerUncompressedLayer)
+	}
+	if _, err := os.Stat(path.Join(config.Path, "manifest.orig.json")); err != nil {
+		t.Errorf("original manifest: %v", err)
+	}
+	dir := path.Join(config.layersDir(), layer.Digest.Hex)
+	for name, want := range map[string]bool{"a/file": true, "new": true, "b": true, "b/old": false, "b/.wh.old": false} {
+		_, err := os.Lstat(path.Join(dir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s in the squashed layer: %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSquashedMediaTypeFollowsManifest(t *testing.T) {
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "x"}))
+	image.Img = mutate.MediaType(image.Img, types.OCIManifestSchema1)
+	image.Img = mutate.ConfigMediaType(image.Img, types.OCIConfigJSON)
+	_, manifest := squashImage(t, image)
+	if got := manifest.Layers[0].MediaType; got != types.OCIUncompressedLayer {
+		t.Errorf("squashed layer media type = %s, want %s", got, types.OCIUncompressedLayer)
+	}
+}
+
+func TestSquashUnchangedLayersReused(t *testing.T) {
+	image := testImage(t, testLayer(t, tarEntry{Name: "file", Body: "x"}))
+	config, manifest := squashImage(t, image)
+	dir := path.Join(config.layersDir(), manifest.Layers[0].Digest.Hex)
+	if _, err := os.Stat(layout.CompleteMarker(dir)); err != nil {
+		t.Fatalf("complete marker of the squashed layer: %v", err)
+	}
+	before, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an only-config-changed run squashes the same layers again
+	err = writeMetadata(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = squashLayers(config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("the squashed layer was rebuilt although its layers are unchanged")
+	}
+	data, err := os.ReadFile(layout.New(config.Path).Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := v1.ParseManifest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Layers) != 1 || again.Layers[0].Digest != manifest.Layers[0].Digest {
+		t.Errorf("manifest layers after the second squash = %v", again.Layers)
+	}
+}
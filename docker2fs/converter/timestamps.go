@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// sourceDateEpoch is the reproducible-builds variable, seconds since the
+// epoch, that overrides the image created time for directory mtimes
+const sourceDateEpoch = "SOURCE_DATE_EPOCH"
+
+// dirTime returns the mtime of directories the layer tars don't record,
+// SOURCE_DATE_EPOCH when set, otherwise the created time of img. A layer
+// shared by several images gets the time of the first one extracting it.
+func dirTime(img v1.Image) (time.Time, error) {
+	if epoch := os.Getenv(sourceDateEpoch); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "parse "+sourceDateEpoch)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get image config")
+	}
+	if configFile.Created.IsZero() {
+		return time.Unix(0, 0), nil
+	}
+	return configFile.Created.Time, nil
+}
+
+// fixDirTimes sets the mtime of every extracted directory. Directories
+// with an entry in the layer get the recorded time again, as tar may have
+// changed it after restoring it, e.g. by creating symlinks at the end.
+// Directories tar created implicitly get implicit.
+func fixDirTimes(layerTarPath, dir string, implicit time.Time) error {
+	file, err := os.Open(layerTarPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	explicit := map[string]time.Time{}
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read layer tar")
+		}
+		if header.Typeflag == tar.TypeDir {
+			explicit[path.Clean(path.Join("/", header.Name))] = header.ModTime
+		}
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if mtime, ok := explicit[path.Join("/", filepath.ToSlash(rel))]; ok {
+			return os.Chtimes(p, mtime, mtime)
+		}
+		return os.Chtimes(p, implicit, implicit)
+	})
+}
@@ -0,0 +1,86 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// extractDirTimes extracts layer of an image created at created with
+// PreserveTimestamps and returns the mtimes of the directories in it
+func extractDirTimes(t *testing.T, layer v1.Layer, created time.Time) map[string]time.Time {
+	t.Helper()
+	image := testImage(t, layer)
+	configFile, err := image.Img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.Created = v1.Time{Time: created}
+	image.Img, err = mutate.ConfigFile(image.Img, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	config.PreserveTimestamps = true
+	err = pullLayers(context.Background(), config, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	times := map[string]time.Time{}
+	for _, dir := range []string{"explicit", "implicit", "implicit/nested"} {
+		info, err := os.Stat(path.Join(config.layersDir(), digest.Hex, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		times[dir] = info.ModTime().UTC()
+	}
+	return times
+}
+
+func TestPreserveTimestamps(t *testing.T) {
+	recorded := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	newer := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	layer := testLayer(t,
+		tarEntry{Name: "explicit/", Dir: true, ModTime: recorded},
+		// tar creates implicit/ and implicit/nested/ without an entry
+		tarEntry{Name: "implicit/nested/file", Body: "x", ModTime: newer},
+	)
+	first := extractDirTimes(t, layer, created)
+	want := map[string]time.Time{"explicit": recorded, "implicit": created, "implicit/nested": created}
+	for dir, mtime := range want {
+		if !first[dir].Equal(mtime) {
+			t.Errorf("mtime of %s = %s, want %s", dir, first[dir], mtime)
+		}
+	}
+	// the same layer extracted again, into another directory, gets the same times
+	second := extractDirTimes(t, layer, created)
+	for dir := range want {
+		if !second[dir].Equal(first[dir]) {
+			t.Errorf("second extraction: mtime of %s = %s, want %s", dir, second[dir], first[dir])
+		}
+	}
+}
+
+func TestPreserveTimestampsSourceDateEpoch(t *testing.T) {
+	t.Setenv(sourceDateEpoch, "1000")
+	layer := testLayer(t,
+		tarEntry{Name: "explicit/", Dir: true, ModTime: time.Unix(5, 0)},
+		tarEntry{Name: "implicit/nested/file", Body: "epoch"},
+	)
+	times := extractDirTimes(t, layer, time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC))
+	if !times["implicit"].Equal(time.Unix(1000, 0)) {
+		t.Errorf("mtime of implicit = %s, want SOURCE_DATE_EPOCH", times["implicit"])
+	}
+	t.Setenv(sourceDateEpoch, "yesterday")
+	if _, err := dirTime(testImage(t).Img); err == nil {
+		t.Error("a SOURCE_DATE_EPOCH that is not a number should be an error")
+	}
+}
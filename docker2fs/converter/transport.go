@@ -0,0 +1,146 @@
+package converter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// envOr returns value, or the first of the environment variables keys
+// that is set
+func envOr(value string, keys ...string) string {
+	if value != "" {
+		return value
+	}
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// noProxyMatch reports whether host is excluded from proxying by
+// noProxy, a comma separated list of domains, IPs and CIDRs as in NO_PROXY
+func noProxyMatch(host, noProxy string) bool {
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxy parses a proxy setting, a bare host:port means http
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse proxy "+proxy)
+	}
+	return u, nil
+}
+
+// certPool is the system roots plus the certificates in the PEM files
+// caCerts, a file without any certificate is an error
+func certPool(caCerts []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, errors.Wrap(err, "load system certificates")
+	}
+	for _, p := range caCerts {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA certificate")
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no PEM certificate found in %s", p)
+		}
+	}
+	return pool, nil
+}
+
+// transport is the HTTP transport of every registry request. Proxies not
+// set in config fall back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY, and
+// Insecure skips TLS verification, otherwise CACerts are trusted as well.
+func (config *ConverterConfig) transport() (*http.Transport, error) {
+	proxies := map[string]string{
+		"http":  envOr(config.HTTPProxy, "HTTP_PROXY", "http_proxy"),
+		"https": envOr(config.HTTPSProxy, "HTTPS_PROXY", "https_proxy"),
+	}
+	proxyURLs := map[string]*url.URL{}
+	for scheme, proxy := range proxies {
+		if proxy == "" {
+			continue
+		}
+		u, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxyURLs[scheme] = u
+	}
+	noProxy := envOr(config.NoProxy, "NO_PROXY", "no_proxy")
+	t := remote.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if noProxyMatch(strings.ToLower(req.URL.Hostname()), noProxy) {
+			return nil, nil
+		}
+		return proxyURLs[req.URL.Scheme], nil
+	}
+	if config.Insecure {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	} else if len(config.CACerts) > 0 {
+		pool, err := certPool(config.CACerts)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t, nil
+}
+
+// remoteOptions are the options of every registry request
+func (config *ConverterConfig) remoteOptions(ctx context.Context, extra ...remote.Option) ([]remote.Option, error) {
+	t, err := config.transport()
+	if err != nil {
+		return nil, err
+	}
+	options := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithTransport(t),
+	}
+	return append(options, extra...), nil
+}
@@ -0,0 +1,159 @@
+package converter
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNoProxyMatch(t *testing.T) {
+	tests := []struct {
+		host    string
+		noProxy string
+		want    bool
+	}{
+		// loopback never goes through the proxy
+		{"localhost", "", true},
+		{"127.0.0.1", "", true},
+		{"::1", "", true},
+		{"registry.example.com", "", false},
+		{"registry.example.com", "*", true},
+		{"registry.example.com", "registry.example.com", true},
+		{"registry.example.com", "example.com", true},
+		{"registry.example.com", ".example.com", true},
+		{"registry.example.com", " other.com , Example.com ", true},
+		{"registry.example.com", "example.com:5000", true},
+		{"badexample.com", "example.com", false},
+		{"10.1.2.3", "10.0.0.0/8", true},
+		{"192.168.1.1", "10.0.0.0/8", false},
+		{"10.1.2.3", "10.1.2.3", true},
+		// a CIDR matches IPs only
+		{"registry.example.com", "10.0.0.0/8", false},
+	}
+	for _, test := range tests {
+		if got := noProxyMatch(test.host, test.noProxy); got != test.want {
+			t.Errorf("noProxyMatch(%q, %q) = %v, want %v", test.host, test.noProxy, got, test.want)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := map[string]string{
+		"proxy:3128":               "http://proxy:3128",
+		"http://proxy:3128":        "http://proxy:3128",
+		"https://proxy:3129":       "https://proxy:3129",
+		"socks5://user@proxy:1080": "socks5://user@proxy:1080",
+	}
+	for proxy, want := range tests {
+		u, err := parseProxy(proxy)
+		if err != nil || u.String() != want {
+			t.Errorf("parseProxy(%q) = %v, %v, want %s", proxy, u, err, want)
+		}
+	}
+	if _, err := parseProxy("http://proxy:port"); err == nil {
+		t.Error("parseProxy accepted an invalid port")
+	}
+}
+
+// proxyFor returns the proxy config's transport picks for rawURL, "" for none
+func proxyFor(t *testing.T, config *ConverterConfig, rawURL string) string {
+	t.Helper()
+	transport, err := config.transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+func TestTransportProxy(t *testing.T) {
+	for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(key, "")
+	}
+	config := &ConverterConfig{}
+	if got := proxyFor(t, config, "https://registry.example.com/v2/"); got != "" {
+		t.Errorf("no proxy configured, got %s", got)
+	}
+
+	// the proxy is picked by the scheme of the request
+	config = &ConverterConfig{HTTPProxy: "plain:3128", HTTPSProxy: "http://secure:3129", NoProxy: "internal.example.com"}
+	tests := map[string]string{
+		"http://registry.example.com/v2/":  "http://plain:3128",
+		"https://registry.example.com/v2/": "http://secure:3129",
+		"https://internal.example.com/v2/": "",
+		"https://INTERNAL.example.com/v2/": "",
+		"https://127.0.0.1:5000/v2/":       "",
+	}
+	for rawURL, want := range tests {
+		if got := proxyFor(t, config, rawURL); got != want {
+			t.Errorf("proxy for %s = %q, want %q", rawURL, got, want)
+		}
+	}
+
+	// the environment fills in what config leaves out, config wins
+	t.Setenv("https_proxy", "env:3129")
+	t.Setenv("NO_PROXY", "example.com")
+	if got := proxyFor(t, &ConverterConfig{}, "https://registry.example.com/v2/"); got != "" {
+		t.Errorf("NO_PROXY was ignored, got %s", got)
+	}
+	if got := proxyFor(t, &ConverterConfig{}, "https://ghcr.io/v2/"); got != "http://env:3129" {
+		t.Errorf("https_proxy was ignored, got %s", got)
+	}
+	config = &ConverterConfig{HTTPSProxy: "flag:3129", NoProxy: "other.com"}
+	if got := proxyFor(t, config, "https://registry.example.com/v2/"); got != "http://flag:3129" {
+		t.Errorf("the configured proxy lost to the environment, got %s", got)
+	}
+
+	if _, err := (&ConverterConfig{HTTPProxy: "http://proxy:port"}).transport(); err == nil {
+		t.Error("transport accepted an invalid proxy")
+	}
+}
+
+func TestCertPool(t *testing.T) {
+	_, certFile := startTLSRegistry(t)
+	if _, err := certPool([]string{certFile}); err != nil {
+		t.Error(err)
+	}
+	empty := path.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certPool([]string{certFile, empty}); err == nil || !strings.Contains(err.Error(), "no PEM certificate found in "+empty) {
+		t.Errorf("certPool with a file without certificates = %v", err)
+	}
+	if _, err := certPool([]string{path.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("certPool with a missing file succeeded")
+	}
+}
+
+func TestConvertWithCACert(t *testing.T) {
+	reg, certFile := startTLSRegistry(t)
+	source := reg.push(t, testImage(t, testLayer(t, tarEntry{Name: "file", Body: "tls"})), "app")
+	// the self-signed registry is refused until its certificate is trusted
+	config := ConverterConfig{Source: source, Path: t.TempDir()}
+	if _, err := Convert(context.Background(), config); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Convert from an untrusted registry = %v, want a certificate error", err)
+	}
+	config.CACerts = []string{certFile}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Errorf("Convert with -ca-cert = %v", err)
+	}
+	// Insecure doesn't need it
+	config = ConverterConfig{Source: source, Path: t.TempDir(), Insecure: true}
+	if _, err := Convert(context.Background(), config); err != nil {
+		t.Errorf("Convert with -insecure = %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// storedLayer pairs a manifest layer with the diffID from the config.
+// The stored <hex>.tar is decompressed, so it hashes to the diffID.
+type storedLayer struct {
+	Digest v1.Hash
+	DiffID v1.Hash
+}
+
+// storedLayers reads the layers of the image converted into dir
+func storedLayers(dir string) ([]storedLayer, error) {
+	file, err := os.Open(layersManifestPath(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "open manifest")
+	}
+	manifest, err := v1.ParseManifest(file)
+	file.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "parse manifest")
+	}
+	file, err = os.Open(layout.New(dir).Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "open config")
+	}
+	configFile, err := v1.ParseConfigFile(file)
+	file.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "parse config")
+	}
+	if len(configFile.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("%s: manifest has %d layers but config has %d diffIDs",
+			dir, len(manifest.Layers), len(configFile.RootFS.DiffIDs))
+	}
+	layers := make([]storedLayer, 0, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layers = append(layers, storedLayer{Digest: layer.Digest, DiffID: configFile.RootFS.DiffIDs[i]})
+	}
+	return layers, nil
+}
+
+// verifyTar checks that the tar at p hashes to want
+func verifyTar(p string, want v1.Hash) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("read %s", p))
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != want.Hex {
+		return errors.Errorf("sha256 is %s, want %s", got, want.Hex)
+	}
+	return nil
+}
+
+// LayerCheck is the outcome of verifying one stored layer, Err is nil
+// if the tar still hashes to its diffID
+type LayerCheck struct {
+	Digest v1.Hash
+	Err    error
+}
+
+// Verify re-hashes every stored layer tar of the images converted into
+// basePath, each layer shared by several images is checked once
+func Verify(basePath string) ([]LayerCheck, error) {
+	manifests, err := trackedManifests(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, errors.Errorf("no manifest.json found under %s", basePath)
+	}
+	checked := map[v1.Hash]bool{}
+	checks := []LayerCheck{}
+	for _, manifestPath := range manifests {
+		layers, err := storedLayers(path.Dir(manifestPath))
+		if err != nil {
+			return checks, err
+		}
+		for _, layer := range layers {
+			if checked[layer.Digest] {
+				continue
+			}
+			checked[layer.Digest] = true
+			err = verifyTar(path.Join(layout.New(basePath).Layers, layer.Digest.Hex+".tar"), layer.DiffID)
+			checks = append(checks, LayerCheck{Digest: layer.Digest, Err: err})
+		}
+	}
+	return checks, nil
+}
@@ -0,0 +1,99 @@
+package converter
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"common/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestVerify(t *testing.T) {
+	if _, err := Verify(t.TempDir()); err == nil {
+		t.Error("Verify of a directory without images succeeded")
+	}
+
+	dir := t.TempDir()
+	shared := testLayer(t, tarEntry{Name: "shared", Body: "both images"})
+	own := testLayer(t, tarEntry{Name: "own", Body: "first image only"})
+	other := testLayer(t, tarEntry{Name: "other", Body: "second image only"})
+	sources := []string{
+		writeArchive(t, testImage(t, shared, own), dir, "first.tar"),
+		writeArchive(t, testImage(t, shared, other), dir, "second.tar"),
+	}
+	base := t.TempDir()
+	_, err := ConvertBatch(context.Background(), ConverterConfig{Path: base}, sources, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := []v1.Hash{}
+	for _, layer := range []v1.Layer{shared, own, other} {
+		hash, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, hash)
+	}
+	// the shared layer is checked once
+	checks, err := Verify(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("Verify checked %+v, want 3 layers", checks)
+	}
+	for _, check := range checks {
+		if check.Err != nil {
+			t.Errorf("layer %s: %v", check.Digest, check.Err)
+		}
+	}
+
+	// flip one byte of the tar of own, truncate the tar of other
+	layersDir := layout.New(base).Layers
+	ownTar := path.Join(layersDir, digests[1].Hex+".tar")
+	data, err := os.ReadFile(ownTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(ownTar, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path.Join(layersDir, digests[2].Hex+".tar"), 100); err != nil {
+		t.Fatal(err)
+	}
+	checks, err = Verify(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := map[v1.Hash]error{}
+	for _, check := range checks {
+		failed[check.Digest] = check.Err
+	}
+	if failed[digests[0]] != nil {
+		t.Errorf("the intact shared layer failed: %v", failed[digests[0]])
+	}
+	for _, hash := range digests[1:] {
+		if err := failed[hash]; err == nil || !strings.Contains(err.Error(), "sha256 is ") {
+			t.Errorf("corrupted layer %s = %v, want a sha256 mismatch", hash, err)
+		}
+	}
+
+	// a missing tar fails its own check, not the whole verify
+	if err := os.Remove(ownTar); err != nil {
+		t.Fatal(err)
+	}
+	checks, err = Verify(base)
+	if err != nil || len(checks) != 3 {
+		t.Fatalf("Verify = %+v, %v", checks, err)
+	}
+	for _, check := range checks {
+		if check.Digest == digests[1] && !os.IsNotExist(check.Err) {
+			t.Errorf("missing tar = %v, want not exist", check.Err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package converter
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix starts the PAX records holding extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileXattrs are the extended attributes the layer tar records for Name
+type fileXattrs struct {
+	Name  string
+	Attrs map[string]string
+}
+
+// copyLayerTar copies the layer tar from src to dst and collects the
+// SCHILY.xattr.* PAX records on the way, so the tar isn't read a second
+// time to restore them
+func copyLayerTar(dst io.Writer, src io.Reader) ([]fileXattrs, error) {
+	var files []fileXattrs
+	tr := tar.NewReader(io.TeeReader(src, dst))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read layer tar")
+		}
+		// symlinks can't carry user.* attributes
+		if header.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		attrs := map[string]string{}
+		for key, value := range header.PAXRecords {
+			if attr, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+				attrs[attr] = value
+			}
+		}
+		if len(attrs) > 0 {
+			files = append(files, fileXattrs{
+				Name:  strings.TrimPrefix(path.Clean(path.Join("/", header.Name)), "/"),
+				Attrs: attrs,
+			})
+		}
+	}
+	// the end of archive blocks and any padding after them
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// restoreXattrs sets the extended attributes copyLayerTar collected, such
+// as the security.capability of ping. tar only restores user.* attributes
+// by default, and chown, as done by -id-shift, clears
+// security.capability, so they are set once the owners are final.
+//
+// Each file is opened with openat2 RESOLVE_IN_ROOT, a symlink in the layer
+// can't lead outside dir, and a file that is itself a symlink is skipped.
+// Attributes the filesystem doesn't support or the user may not set, only
+// root may set security.* and trusted.*, are skipped with a warning.
+func restoreXattrs(dir string, files []fileXattrs) error {
+	if len(files) == 0 {
+		return nil
+	}
+	root, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for _, file := range files {
+		err = setFileXattrs(root, file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setFileXattrs(root *os.File, file fileXattrs) error {
+	name := file.Name
+	if name == "" {
+		name = "."
+	}
+	fd, err := unix.Openat2(int(root.Fd()), name, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "open %s", file.Name)
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", file.Name)
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		slog.Warn("skipping extended attributes of a symlink", "path", file.Name)
+		return nil
+	}
+	// an O_PATH descriptor can't be passed to fsetxattr, its /proc link
+	// names exactly the opened file
+	fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	for attr, value := range file.Attrs {
+		err = unix.Setxattr(fdPath, attr, []byte(value), 0)
+		if err == unix.ENOTSUP || err == unix.EPERM {
+			slog.Warn("skipping extended attribute", "path", file.Name, "attr", attr, "err", err)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "set %s of %s", attr, file.Name)
+		}
+	}
+	return nil
+}
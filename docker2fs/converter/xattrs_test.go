@@ -0,0 +1,118 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getXattr(t *testing.T, p, attr string) (string, bool) {
+	t.Helper()
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(p, attr, buf)
+	if err == unix.ENODATA {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("getxattr %s of %s: %v", attr, p, err)
+	}
+	return string(buf[:n]), true
+}
+
+func TestCopyLayerTarCollectsXattrs(t *testing.T) {
+	data := layerTar(t,
+		tarEntry{Name: "bin/", Dir: true},
+		tarEntry{Name: "bin/ping", Body: "ping", PAX: map[string]string{
+			"SCHILY.xattr.security.capability": "cap",
+			"SCHILY.xattr.user.note":           "hello",
+		}},
+		tarEntry{Name: "./bin/sh", Link: "ping", PAX: map[string]string{"SCHILY.xattr.user.note": "link"}},
+		tarEntry{Name: "bin/plain", Body: "plain"},
+	)
+	var out bytes.Buffer
+	files, err := copyLayerTar(&out, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("copied %d bytes, want the %d bytes of the tar unchanged", out.Len(), len(data))
+	}
+	if len(files) != 1 || files[0].Name != "bin/ping" {
+		t.Fatalf("collected %+v, want only bin/ping", files)
+	}
+	if files[0].Attrs["user.note"] != "hello" || files[0].Attrs["security.capability"] != "cap" {
+		t.Errorf("bin/ping attributes = %v", files[0].Attrs)
+	}
+}
+
+func TestPullLayersRestoresXattrs(t *testing.T) {
+	layer := testLayer(t,
+		tarEntry{Name: "etc/", Dir: true, PAX: map[string]string{"SCHILY.xattr.user.dir": "d"}},
+		tarEntry{Name: "etc/file", Body: "x", PAX: map[string]string{"SCHILY.xattr.user.note": "hello"}},
+	)
+	config := testConfig(t)
+	err := pullLayers(context.Background(), config, testImage(t, layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	dir := path.Join(config.layersDir(), digest.Hex)
+	if value, _ := getXattr(t, path.Join(dir, "etc/file"), "user.note"); value != "hello" {
+		t.Errorf("user.note of etc/file = %q, want hello", value)
+	}
+	if value, _ := getXattr(t, path.Join(dir, "etc"), "user.dir"); value != "d" {
+		t.Errorf("user.dir of etc = %q, want d", value)
+	}
+}
+
+func TestRestoreXattrsStaysInLayer(t *testing.T) {
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// a layer whose symlinks point out of the layer directory
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(victim, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../"+victim, filepath.Join(dir, "relative")); err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{"user.pwned": "1"}
+	restoreXattrs(dir, []fileXattrs{{Name: "escape/victim", Attrs: attrs}})
+	restoreXattrs(dir, []fileXattrs{{Name: "relative", Attrs: attrs}})
+	err := restoreXattrs(dir, []fileXattrs{{Name: "link", Attrs: attrs}})
+	if err != nil {
+		t.Errorf("a symlink should be skipped, got %v", err)
+	}
+	if _, ok := getXattr(t, victim, "user.pwned"); ok {
+		t.Fatal("extended attribute was set outside the layer directory")
+	}
+}
+
+func TestRestoreXattrsSkipsUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// no namespace "bogus." exists, the kernel answers EOPNOTSUPP
+	err := restoreXattrs(dir, []fileXattrs{{Name: "file", Attrs: map[string]string{
+		"bogus.attr": "1",
+		"user.kept":  "2",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := getXattr(t, filepath.Join(dir, "file"), "user.kept"); value != "2" {
+		t.Errorf("user.kept = %q, want 2", value)
+	}
+}
@@ -6,9 +6,13 @@ require (
 	github.com/containerd/containerd v1.7.24
 	github.com/google/go-containerregistry v0.20.2
 	github.com/pkg/errors v0.9.1
+	golang.org/x/sync v0.5.0
+	golang.org/x/sys v0.18.0
+	golang.org/x/time v0.5.0
 )
 
 require (
+	common v0.0.0
 	github.com/containerd/log v0.1.0 // indirect
 	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
 	github.com/docker/cli v27.1.1+incompatible // indirect
@@ -20,6 +24,6 @@ require (
 	github.com/opencontainers/image-spec v1.1.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/vbatts/tar-split v0.11.3 // indirect
-	golang.org/x/sync v0.5.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 )
+
+replace common => ../common
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// setupLogger routes progress messages to stderr at the given level,
+// quiet only lets errors through. Command results still go to stdout.
+func setupLogger(level string, quiet bool) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return errors.Wrap(err, "parse log level")
+	}
+	if quiet {
+		lvl = slog.LevelError
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
+
+// parseLogFlags parses the flags shared by all subcommands and returns
+// the remaining arguments
+func parseLogFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("docker2fs", flag.ContinueOnError)
+	level := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	quiet := fs.Bool("quiet", false, "only log errors")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = setupLogger(*level, *quiet)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
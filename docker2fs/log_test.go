@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestParseLogFlags(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	tests := []struct {
+		args    []string
+		enabled slog.Level
+		muted   slog.Level
+	}{
+		{[]string{"convert"}, slog.LevelInfo, slog.LevelDebug},
+		{[]string{"-log-level", "debug", "convert"}, slog.LevelDebug, slog.LevelDebug - 1},
+		{[]string{"-log-level", "WARN", "convert"}, slog.LevelWarn, slog.LevelInfo},
+		{[]string{"-log-level", "error", "convert"}, slog.LevelError, slog.LevelWarn},
+		// quiet wins over an explicit level
+		{[]string{"-log-level", "debug", "-quiet", "convert"}, slog.LevelError, slog.LevelWarn},
+	}
+	for _, test := range tests {
+		rest, err := parseLogFlags(test.args)
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+		if !reflect.DeepEqual(rest, []string{"convert"}) {
+			t.Errorf("%v: remaining args %v, want [convert]", test.args, rest)
+		}
+		handler := slog.Default().Handler()
+		if !handler.Enabled(context.Background(), test.enabled) || handler.Enabled(context.Background(), test.muted) {
+			t.Errorf("%v: level %v should be the lowest enabled", test.args, test.enabled)
+		}
+	}
+	if _, err := parseLogFlags([]string{"-log-level", "verbose", "convert"}); err == nil {
+		t.Error("an unknown log level was accepted")
+	}
+}
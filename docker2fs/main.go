@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	"common/layout"
+	"docker2fs/converter"
+)
+
+func main() {
+	args, err := parseLogFlags(os.Args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			slog.Error(err.Error())
+		}
+		os.Exit(2)
+	}
+	if len(args) > 0 && args[0] == "check" {
+		err := checkCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "inspect" {
+		err := inspectCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "gc" {
+		err := gcCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "verify" {
+		err := verifyCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "pull" {
+		err := pullCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "run" {
+		err := runCommand(args[1:])
+		// the container's exit status becomes ours
+		if code, ok := exitCode(err); ok {
+			os.Exit(code)
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "convert" {
+		err := convertCommand(args[1:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	_, err = converter.Convert(context.Background(), converter.ConverterConfig{
+		Source: "dockerpull.org/tedcy/proxy_pool",
+		Path:   layout.DefaultBasePath(),
+	})
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"common/layout"
+	"docker2fs/converter"
+
+	"github.com/pkg/errors"
+)
+
+// runCommand implements run [flags] <ref> [runInNamespace flags] [command...].
+// It converts ref into a store directory and launches it with the
+// runInNamespace binary, which finds the image there through
+// PROXY_POOL_PATH. A temporary store is removed once runCommand returns,
+// whether the conversion failed, the container exited or a signal stopped
+// either, unless -keep is given. With -lazy-extract the runtime starts
+// right away with --overlay-lazy-extract and waits only for the layers the
+// image needs while the conversion goes on.
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	storePath := fs.String("path", "", "convert into this directory instead of a temporary one, it is never removed")
+	keep := fs.Bool("keep", false, "keep the temporary directory once the container exits")
+	runtimePath := fs.String("runtime", "runInNamespace", "the runInNamespace binary, looked up in PATH")
+	registry := addRegistryFlags(fs)
+	cacheDir := fs.String("cache-dir", converter.DefaultCacheDir(), "keep compressed layers by digest here and reuse them, empty disables the cache")
+	lazy := fs.Bool("lazy-extract", false, "start the runtime with --overlay-lazy-extract while the layers are still being pulled")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return errors.New("usage: docker2fs run [flags] <ref> [runInNamespace flags] [command...]")
+	}
+	runtimeBin, err := exec.LookPath(*runtimePath)
+	if err != nil {
+		return errors.Wrap(err, "find runInNamespace, pass -runtime")
+	}
+	// from here on a signal must not kill us before the store is cleaned up:
+	// it cancels the conversion, or reaches the runtime once it is running
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	store, cleanup, err := runStore(*storePath, *keep)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runtime := make(chan *os.Process, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go handleRunSignals(sigs, cancel, runtime, done)
+	config := converter.ConverterConfig{
+		Source:   fs.Arg(0),
+		Path:     store,
+		CacheDir: *cacheDir,
+	}
+	registry.apply(&config)
+	if *lazy {
+		return launchLazy(ctx, cancel, config, runtimeBin, fs.Args()[1:], runtime)
+	}
+	_, err = converter.Convert(ctx, config)
+	if err != nil {
+		return err
+	}
+	return launch(runtimeBin, store, fs.Args()[1:], runtime)
+}
+
+// exitCode returns the runtime's exit status for run to exit with, a
+// runtime killed by a signal gives 128+n like a shell does
+func exitCode(err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return exitErr.ExitCode(), true
+}
+
+// runStore returns the store to convert into and the cleanup to defer. An
+// explicit path is never removed, a temporary one is unless keep is set.
+func runStore(storePath string, keep bool) (string, func(), error) {
+	if storePath != "" {
+		return storePath, func() {}, nil
+	}
+	store, err := os.MkdirTemp("", "docker2fs-run-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create temporary directory")
+	}
+	if keep {
+		return store, func() { slog.Info("kept converted image", "path", store) }, nil
+	}
+	return store, func() { os.RemoveAll(store) }, nil
+}
+
+// handleRunSignals cancels the conversion on Ctrl-C or SIGTERM until the
+// runtime is sent on runtime. After that Ctrl-C reaches the runtime through
+// the terminal's process group and SIGTERM is forwarded to it.
+func handleRunSignals(sigs <-chan os.Signal, cancel func(), runtime <-chan *os.Process, done <-chan struct{}) {
+	var process *os.Process
+	for {
+		select {
+		case process = <-runtime:
+		case sig := <-sigs:
+			// the runtime may have started while the signal was on its way
+			select {
+			case process = <-runtime:
+			default:
+			}
+			if process == nil {
+				cancel()
+			} else if sig == syscall.SIGTERM {
+				process.Signal(sig)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// launch runs the runtime on the image converted into store, hands its
+// process to the signal handler and waits for it, the store is only removed
+// after that
+func launch(runtimeBin, store string, args []string, runtime chan<- *os.Process) error {
+	cmd, err := startRuntime(runtimeBin, store, args, runtime)
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// launchLazy converts with ManifestFirst while the runtime, started with
+// --overlay-lazy-extract, waits for the layers it needs. A failed
+// conversion stops the runtime and an exited runtime cancels the
+// conversion, both are over before the store is removed.
+func launchLazy(ctx context.Context, cancel func(), config converter.ConverterConfig, runtimeBin string, args []string, runtime chan<- *os.Process) error {
+	config.ManifestFirst = true
+	converted := make(chan error, 1)
+	go func() {
+		_, err := converter.Convert(ctx, config)
+		converted <- err
+	}()
+	cmd, err := startRuntime(runtimeBin, config.Path, append([]string{"--overlay-lazy-extract"}, args...), runtime)
+	if err != nil {
+		cancel()
+		<-converted
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err = <-converted:
+		if err != nil {
+			cmd.Process.Signal(syscall.SIGTERM)
+			<-exited
+			return err
+		}
+		return <-exited
+	case err = <-exited:
+		cancel()
+		<-converted
+		return err
+	}
+}
+
+// startRuntime starts the runtime on store and hands its process to the
+// signal handler
+func startRuntime(runtimeBin, store string, args []string, runtime chan<- *os.Process) (*exec.Cmd, error) {
+	cmd := exec.Command(runtimeBin, args...)
+	cmd.Env = append(os.Environ(), layout.BaseEnv+"="+store)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return nil, errors.Wrap(err, "start runInNamespace")
+	}
+	runtime <- cmd.Process
+	return cmd, nil
+}
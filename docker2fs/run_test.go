@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+func TestRunStore(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	explicit := t.TempDir()
+	store, cleanup, err := runStore(explicit, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, err := os.Stat(store); store != explicit || err != nil {
+		t.Errorf("the store given with -path was removed or replaced: %s, %v", store, err)
+	}
+	for _, keep := range []bool{false, true} {
+		store, cleanup, err := runStore("", keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+		if _, err := os.Stat(store); os.IsNotExist(err) == keep {
+			t.Errorf("keep %v: the temporary store exists %v after cleanup", keep, !os.IsNotExist(err))
+		}
+	}
+}
+
+// emptyTmp points TMPDIR at a fresh directory and fails the test if the run
+// leaves anything in it
+func emptyTmp(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Cleanup(func() {
+		entries, _ := os.ReadDir(tmp)
+		if len(entries) != 0 {
+			t.Errorf("the run left %v behind", entries)
+		}
+	})
+}
+
+// testArchive writes a random image of layers layers as a docker archive
+func testArchive(t *testing.T, layers int64) string {
+	t.Helper()
+	tag, err := name.NewTag("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	err = tarball.WriteToFile(archive, tag, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestRunRemovesStoreOnFailedConvert(t *testing.T) {
+	emptyTmp(t)
+	err := runCommand([]string{"-runtime", "/bin/true", "-cache-dir", "", "docker-archive:" + filepath.Join(t.TempDir(), "missing.tar")})
+	if err == nil {
+		t.Fatal("converting a missing archive should fail")
+	}
+}
+
+func TestRunRegistryFlags(t *testing.T) {
+	emptyTmp(t)
+	// run takes the same registry flags as convert, the missing CA file
+	// fails the pull before any request
+	caCert := filepath.Join(t.TempDir(), "missing.pem")
+	err := runCommand([]string{"-runtime", "/bin/true", "-cache-dir", "", "-ca-cert", caCert, "127.0.0.1:1/test:latest"})
+	if err == nil || !strings.Contains(err.Error(), caCert) {
+		t.Errorf("run -ca-cert %s = %v, want an error naming it", caCert, err)
+	}
+}
+
+func TestRunRemovesStoreOnSignal(t *testing.T) {
+	emptyTmp(t)
+	dir := t.TempDir()
+	archive := testArchive(t, 1)
+	// the runtime sends SIGTERM to docker2fs, which forwards it back
+	runtime := filepath.Join(dir, "runtime")
+	err := os.WriteFile(runtime, []byte("#!/bin/sh\ntrap 'exit 7' TERM\nkill -TERM $PPID\nsleep 5 & wait\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCommand([]string{"-runtime", runtime, "-cache-dir", "", "docker-archive:" + archive})
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 7 {
+		t.Errorf("run = %v, want the runtime's exit status 7 from the forwarded SIGTERM", err)
+	}
+}
+
+func TestRunLazyExtract(t *testing.T) {
+	emptyTmp(t)
+	dir := t.TempDir()
+	archive := testArchive(t, 2)
+	// the runtime is told to wait for the layers and finds the manifest
+	// written before them
+	runtime := filepath.Join(dir, "runtime")
+	script := "#!/bin/sh\n[ \"$1\" = --overlay-lazy-extract ] || exit 3\n" +
+		"for i in $(seq 100); do [ -s \"$PROXY_POOL_PATH/manifest.json\" ] && exit 0; sleep 0.05; done\nexit 4\n"
+	err := os.WriteFile(runtime, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCommand([]string{"-runtime", runtime, "-cache-dir", "", "-lazy-extract", "docker-archive:" + archive})
+	if err != nil {
+		t.Errorf("run -lazy-extract = %v", err)
+	}
+}
+
+func TestRunLazyExtractStopsRuntimeOnFailedConvert(t *testing.T) {
+	emptyTmp(t)
+	dir := t.TempDir()
+	runtime := filepath.Join(dir, "runtime")
+	err := os.WriteFile(runtime, []byte("#!/bin/sh\ntrap 'exit 7' TERM\nsleep 5 & wait\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = runCommand([]string{"-runtime", runtime, "-cache-dir", "", "-lazy-extract", "docker-archive:" + filepath.Join(dir, "missing.tar")})
+	if _, ok := err.(*exec.ExitError); err == nil || ok {
+		t.Errorf("run -lazy-extract = %v, want the conversion error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("the runtime was not stopped after the conversion failed, run took %v", elapsed)
+	}
+}
+
+func TestRunSignaledRuntimeExitCode(t *testing.T) {
+	emptyTmp(t)
+	archive := testArchive(t, 1)
+	runtime := filepath.Join(t.TempDir(), "runtime")
+	err := os.WriteFile(runtime, []byte("#!/bin/sh\nkill -KILL $$\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCommand([]string{"-runtime", runtime, "-cache-dir", "", "docker-archive:" + archive})
+	// a shell reports a command killed by SIGKILL as 137, not ExitCode's -1
+	if code, ok := exitCode(err); !ok || code != 128+int(syscall.SIGKILL) {
+		t.Errorf("exitCode(%v) = %d, %v, want %d", err, code, ok, 128+int(syscall.SIGKILL))
+	}
+	if code, ok := exitCode(errors.New("convert failed")); ok {
+		t.Errorf("a conversion error gave the exit code %d", code)
+	}
+}
+
+func TestRunSignalCancelsConvert(t *testing.T) {
+	sigs := make(chan os.Signal, 1)
+	runtime := make(chan *os.Process, 1)
+	done := make(chan struct{})
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleRunSignals(sigs, cancel, runtime, done)
+	sigs <- syscall.SIGINT
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("a signal during the conversion didn't cancel it")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"runInNamespace/container"
+
+	"github.com/pkg/errors"
+)
+
+// statsCommand 实现 stats [--no-stream] <name|pid>
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	noStream := fs.Bool("no-stream", false, "只输出一次")
+	interval := fs.Duration("interval", time.Second, "刷新间隔")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("用法: stats [--no-stream] <name|pid>")
+	}
+	return container.Stats(os.Stdout, fs.Arg(0), *interval, *noStream)
+}
+
+// cgroupCleanupCommand 实现 cgroup-cleanup [--dry-run]
+func cgroupCleanupCommand(args []string) error {
+	fs := flag.NewFlagSet("cgroup-cleanup", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "只列出残留的 cgroup，不删除")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("用法: cgroup-cleanup [--dry-run]")
+	}
+	removed, err := container.CleanupCgroups(*dryRun)
+	for _, dir := range removed {
+		if *dryRun {
+			fmt.Println(dir)
+		} else {
+			fmt.Println("removed", dir)
+		}
+	}
+	return err
+}
+
+// cleanupCommand 实现 cleanup [--dry-run] [--base dir]，卸载 base 目录中残留的挂载
+func cleanupCommand(args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	baseDir := fs.String("base", container.DefaultSpec().BaseDir, "overlay 工作目录")
+	dryRun := fs.Bool("dry-run", false, "只列出残留的挂载，不卸载")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("用法: cleanup [--dry-run] [--base dir]")
+	}
+	unmounted, err := container.CleanupMounts(*baseDir, *dryRun)
+	for _, mount := range unmounted {
+		if *dryRun {
+			fmt.Println(mount)
+		} else {
+			fmt.Println("unmounted", mount)
+		}
+	}
+	return err
+}
+
+// execCommand 实现 exec <name|pid> <cmd...>，在运行中的容器内启动一个新命令
+func execCommand(args []string) error {
+	if len(args) < 2 {
+		return errors.New("用法: exec <name|pid> <cmd...>")
+	}
+	return container.Exec(args[0], args[1:])
+}
+
+// killCommand 实现 kill [-s SIGNAL] <name|pid>，直接向容器的 1 号进程发送信号
+func killCommand(args []string) error {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	sigName := fs.String("s", "KILL", "要发送的信号名或编号")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("用法: kill [-s SIGNAL] <name|pid>")
+	}
+	target := fs.Arg(0)
+	// 允许把 -s 写在容器名后面
+	err = fs.Parse(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.Errorf("多余的参数: %s", strings.Join(fs.Args(), " "))
+	}
+	sig, err := container.ParseSignal(*sigName)
+	if err != nil {
+		return err
+	}
+	return container.Kill(target, sig)
+}
+
+// commitCommand 实现 commit [--persist dir | --upperdir dir] [-m comment]，
+// 把容器在 upperdir 中的修改追加为镜像的新 layer
+func commitCommand(args []string) error {
+	defaults := container.DefaultSpec()
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	persist := fs.String("persist", "", "容器运行时使用的 --persist 目录")
+	upperDir := fs.String("upperdir", "", "容器运行时使用的 --upperdir 目录")
+	configPath := fs.String("config", defaults.ConfigPath, "镜像 config.json 路径")
+	manifestPath := fs.String("manifest", defaults.ManifestPath, "镜像 manifest.json 路径")
+	layersRoot := fs.String("layers", defaults.LayersRoot, "docker2fs 解压出的 layers 目录")
+	comment := fs.String("m", "", "写入新 layer history 的说明")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || (*persist == "") == (*upperDir == "") {
+		return errors.New("用法: commit [-m comment] --persist dir | --upperdir dir")
+	}
+	if *persist != "" {
+		*upperDir = filepath.Join(*persist, "upper")
+	}
+	digest, err := container.Commit(container.CommitOptions{
+		UpperDir:     *upperDir,
+		ConfigPath:   *configPath,
+		ManifestPath: *manifestPath,
+		LayersRoot:   *layersRoot,
+		Comment:      *comment,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest)
+	return nil
+}
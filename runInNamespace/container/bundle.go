@@ -0,0 +1,161 @@
+package container
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bundle.img 的格式见 docker2fs 的 bundle.go:
+// 各 layer 的文件系统镜像依次拼接，末尾是索引 JSON、8 字节小端索引长度和 bundleMagic
+const bundleMagic = "D2FSBNDL"
+
+// BundleLayer 是 bundle 索引中的一个 layer
+type BundleLayer struct {
+	Digest string `json:"digest"`
+	FSType string `json:"fsType"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// BundleIndex 按 manifest 顺序列出 layer，最底层在前
+type BundleIndex struct {
+	Layers []BundleLayer `json:"layers"`
+}
+
+// readBundleIndex 读取 bundle 末尾的索引
+func readBundleIndex(bundlePath string) (*BundleIndex, error) {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, 8+len(bundleMagic))
+	if info.Size() < int64(len(trailer)) {
+		return nil, errors.Errorf("%s 不是 bundle 文件", bundlePath)
+	}
+	_, err = file.ReadAt(trailer, info.Size()-int64(len(trailer)))
+	if err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != bundleMagic {
+		return nil, errors.Errorf("%s 不是 bundle 文件", bundlePath)
+	}
+	indexLen := int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if indexLen <= 0 || indexLen > info.Size()-int64(len(trailer)) {
+		return nil, errors.Errorf("bundle %s 的索引长度 %d 无效", bundlePath, indexLen)
+	}
+	data := make([]byte, indexLen)
+	_, err = file.ReadAt(data, info.Size()-int64(len(trailer))-indexLen)
+	if err != nil {
+		return nil, err
+	}
+	var index BundleIndex
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, errors.Wrap(err, "解析 bundle 索引时出错")
+	}
+	return &index, nil
+}
+
+// attachLoop 把 file 中 [offset, offset+size) 这一段只读地挂到一个空闲的 loop 设备上
+// 设置了 autoclear，调用方需要在 mount 之后再关闭返回的设备，设备在最后一次 umount 后自动释放
+func attachLoop(file *os.File, offset, size int64) (*os.File, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "打开 /dev/loop-control 时出错")
+	}
+	defer ctl.Close()
+	for {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, errors.Wrap(err, "获取空闲 loop 设备时出错")
+		}
+		device := fmt.Sprintf("/dev/loop%d", n)
+		loop, err := os.OpenFile(device, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "打开 %s 时出错", device)
+		}
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(file.Fd()))
+		if err == unix.EBUSY {
+			// 设备在 GET_FREE 之后被别人占用了，换一个
+			loop.Close()
+			continue
+		}
+		if err != nil {
+			loop.Close()
+			return nil, errors.Wrapf(err, "关联 %s 时出错", device)
+		}
+		info := &unix.LoopInfo64{
+			Offset:    uint64(offset),
+			Sizelimit: uint64(size),
+			Flags:     unix.LO_FLAGS_READ_ONLY | unix.LO_FLAGS_AUTOCLEAR,
+		}
+		copy(info.File_name[:], file.Name())
+		err = unix.IoctlLoopSetStatus64(int(loop.Fd()), info)
+		if err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return nil, errors.Wrapf(err, "设置 %s 的偏移时出错", device)
+		}
+		return loop, nil
+	}
+}
+
+// mountBundle 把 bundle 中的每个 layer 通过 loop 设备只读挂载到 mountRoot 下
+// 返回 overlay 的 lowerdir 列表，顺序和 lowerDirsOf 一致
+func mountBundle(bundlePath, mountRoot string, dryRun bool) ([]string, error) {
+	index, err := readBundleIndex(bundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 bundle 索引时出错")
+	}
+	var file *os.File
+	if !dryRun {
+		file, err = os.Open(bundlePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "打开 bundle 时出错")
+		}
+		defer file.Close()
+	}
+	lowerDirs := []string{}
+	seen := map[string]bool{}
+	for i := len(index.Layers) - 1; i >= 0; i-- {
+		layer := index.Layers[i]
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+		target := filepath.Join(mountRoot, strings.TrimPrefix(layer.Digest, "sha256:"))
+		err = mkdirAll(target, dryRun)
+		if err != nil {
+			return nil, errors.Wrapf(err, "创建 %s 目录时出错", target)
+		}
+		slog.Info("mounting bundle layer", "cmd", fmt.Sprintf("mount -t %s -o ro,loop,offset=%d,sizelimit=%d %s %s",
+			layer.FSType, layer.Offset, layer.Size, bundlePath, target))
+		if !dryRun {
+			loop, err := attachLoop(file, layer.Offset, layer.Size)
+			if err != nil {
+				return nil, err
+			}
+			err = mount(loop.Name(), target, layer.FSType, syscall.MS_RDONLY, "", dryRun)
+			loop.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		lowerDirs = append(lowerDirs, target)
+	}
+	return lowerDirs, nil
+}
@@ -0,0 +1,122 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeBundle 按 docker2fs 的格式写出 bundle：各段数据依次拼接，末尾是索引、索引长度和 bundleMagic
+func writeBundle(t *testing.T, index *BundleIndex, data []byte) string {
+	t.Helper()
+	raw, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(trailer, uint64(len(raw)))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.img")
+	content := append(append(append(append([]byte{}, data...), raw...), trailer...), bundleMagic...)
+	err = os.WriteFile(bundlePath, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundlePath
+}
+
+func TestReadBundleIndex(t *testing.T) {
+	index := &BundleIndex{Layers: []BundleLayer{
+		{Digest: "sha256:aaaa", FSType: "squashfs", Offset: 0, Size: 100},
+		{Digest: "sha256:bbbb", FSType: "squashfs", Offset: 4096, Size: 200},
+	}}
+	bundlePath := writeBundle(t, index, make([]byte, 8192))
+	got, err := readBundleIndex(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, index) {
+		t.Errorf("readBundleIndex = %+v, want %+v", got, index)
+	}
+}
+
+func TestReadBundleIndexRejects(t *testing.T) {
+	dir := t.TempDir()
+	badLength := make([]byte, 8)
+	binary.LittleEndian.PutUint64(badLength, 1<<40)
+	for name, content := range map[string][]byte{
+		"short":     []byte("D2FS"),
+		"magic":     append(make([]byte, 64), "NOTABNDL"...),
+		"length":    append(append([]byte("{}"), badLength...), bundleMagic...),
+		"zero":      append(make([]byte, 8), bundleMagic...),
+		"json":      append(append([]byte("{{"), 2, 0, 0, 0, 0, 0, 0, 0), bundleMagic...),
+		"truncated": []byte(bundleMagic),
+	} {
+		bundlePath := filepath.Join(dir, name)
+		err := os.WriteFile(bundlePath, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBundleIndex(bundlePath); err == nil {
+			t.Errorf("readBundleIndex accepted a bundle with a bad %s", name)
+		}
+	}
+}
+
+func TestMountBundleDryRunOrder(t *testing.T) {
+	index := &BundleIndex{Layers: []BundleLayer{
+		{Digest: "sha256:aaaa", FSType: "squashfs", Offset: 0, Size: 100},
+		{Digest: "sha256:bbbb", FSType: "squashfs", Offset: 4096, Size: 100},
+		// 重复的 layer 指向已经打包的镜像，只挂载一次
+		{Digest: "sha256:aaaa", FSType: "squashfs", Offset: 0, Size: 100},
+	}}
+	bundlePath := writeBundle(t, index, make([]byte, 8192))
+	mountRoot := filepath.Join(t.TempDir(), "layers")
+	lowerDirs, err := mountBundle(bundlePath, mountRoot, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 和 lowerDirsOf 一样最上层在前，重复的 layer 留在最上面的位置
+	want := []string{filepath.Join(mountRoot, "aaaa"), filepath.Join(mountRoot, "bbbb")}
+	if !reflect.DeepEqual(lowerDirs, want) {
+		t.Errorf("lowerDirs = %v, want %v", lowerDirs, want)
+	}
+	if _, err := os.Stat(mountRoot); !os.IsNotExist(err) {
+		t.Error("the dry run created the mount directories")
+	}
+}
+
+func TestAttachLoopAtOffset(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices need root")
+	}
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skip(err)
+	}
+	// loop 设备按 512 字节的扇区计算大小，文件系统镜像的大小都是扇区的整数倍
+	data := bytes.Repeat([]byte("layer..."), 1024)
+	index := &BundleIndex{Layers: []BundleLayer{{Digest: "sha256:aaaa", FSType: "squashfs", Offset: 4096, Size: int64(len(data))}}}
+	bundlePath := writeBundle(t, index, append(make([]byte, 4096), data...))
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	loop, err := attachLoop(file, index.Layers[0].Offset, index.Layers[0].Size)
+	if err != nil {
+		t.Skip(err)
+	}
+	// autoclear 在最后一次关闭时释放设备
+	defer loop.Close()
+	got, err := io.ReadAll(loop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("the loop device has %d bytes, want the %d bytes of the layer", len(got), len(data))
+	}
+}
@@ -0,0 +1,164 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cgroupParent 是本工具在 cgroup v2 根下使用的父 cgroup，容器的 cgroup 都建在它下面
+const cgroupParent = "runInNamespace"
+
+// cgroupControllers 是为容器 cgroup 打开的控制器，stats 读取它们的统计
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// containerCgroupName 返回容器 cgroup 的目录名，有 --name 时用容器名，否则用父进程的 pid
+func containerCgroupName(spec *Spec) string {
+	if spec.Name != "" {
+		return spec.Name
+	}
+	return "run-" + strconv.Itoa(os.Getpid())
+}
+
+// enableControllers 在 dir 的 cgroup.subtree_control 中逐个打开 cgroupControllers，
+// 内核没有启用的控制器跳过
+func enableControllers(dir string) {
+	for _, controller := range cgroupControllers {
+		err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+		if err != nil {
+			slog.Debug("cannot enable cgroup controller", "dir", dir, "controller", controller, "err", err)
+		}
+	}
+}
+
+// createContainerCgroup 在 cgroupParent 下为容器创建 cgroup，返回打开的目录，
+// 子进程通过 SysProcAttr.CgroupFD 在 clone 时直接进入其中，它的所有进程都留在这个 cgroup 里。
+// 没有 cgroup v2 或没有权限时返回 nil，容器留在父进程所在的 cgroup 中
+func createContainerCgroup(spec *Spec) (*os.File, error) {
+	root, err := cgroup2Root()
+	if err != nil {
+		slog.Warn("running without a cgroup of its own", "err", err)
+		return nil, nil
+	}
+	parent := filepath.Join(root, cgroupParent)
+	dir := filepath.Join(parent, containerCgroupName(spec))
+	slog.Info("creating cgroup", "cmd", "mkdir -p "+dir)
+	err = os.Mkdir(parent, 0755)
+	if err != nil && !os.IsExist(err) {
+		slog.Warn("running without a cgroup of its own", "err", err)
+		return nil, nil
+	}
+	enableControllers(root)
+	enableControllers(parent)
+	// 同名容器异常退出时残留的空 cgroup 直接复用
+	err = os.Mkdir(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		slog.Warn("running without a cgroup of its own", "err", err)
+		return nil, nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "打开容器的 cgroup 时出错")
+	}
+	return file, nil
+}
+
+// removeContainerCgroup 在容器退出后删除它的 cgroup。1 号进程退出后内核才杀死 pid namespace
+// 中的其余进程，cgroup 可能还要过一会儿才变空，没能删除的留给 cgroup-cleanup
+func removeContainerCgroup(dir string) {
+	slog.Info("removing cgroup", "cmd", "rmdir "+dir)
+	var err error
+	for i := 0; i < 50; i++ {
+		err = syscall.Rmdir(dir)
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil && err != syscall.ENOENT {
+		slog.Warn("cannot remove cgroup, run cgroup-cleanup later", "dir", dir, "err", err)
+	}
+}
+
+// cgroupPopulated 读取 cgroup.events 中的 populated，为 1 表示该 cgroup 或其子 cgroup 中还有进程
+func cgroupPopulated(dir string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "populated" {
+			return fields[1] == "1", nil
+		}
+	}
+	return false, errors.Errorf("%s/cgroup.events 中没有 populated", dir)
+}
+
+// orphanedCgroups 返回 parent 下没有存活进程的 cgroup，子 cgroup 排在父 cgroup 之前
+// 以便按顺序 rmdir，parent 本身不包含在内
+func orphanedCgroups(parent string) ([]string, error) {
+	var orphans []string
+	err := filepath.WalkDir(parent, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == parent {
+			return nil
+		}
+		populated, err := cgroupPopulated(path)
+		if err != nil {
+			return err
+		}
+		if populated {
+			return nil
+		}
+		orphans = append(orphans, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(orphans)))
+	return orphans, nil
+}
+
+// CleanupCgroups 删除 cgroupParent 下没有进程的残留 cgroup，返回删除的目录
+// dryRun 时只返回残留的目录，不删除
+func CleanupCgroups(dryRun bool) ([]string, error) {
+	root, err := cgroup2Root()
+	if err != nil {
+		return nil, err
+	}
+	parent := filepath.Join(root, cgroupParent)
+	if _, err := os.Stat(parent); os.IsNotExist(err) {
+		return nil, nil
+	}
+	orphans, err := orphanedCgroups(parent)
+	if err != nil {
+		return nil, errors.Wrap(err, "查找残留的 cgroup 时出错")
+	}
+	if dryRun {
+		return orphans, nil
+	}
+	removed := []string{}
+	for _, dir := range orphans {
+		// 检查之后可能有进程加入，此时 rmdir 返回 EBUSY，跳过即可
+		err = syscall.Rmdir(dir)
+		if err == syscall.EBUSY {
+			continue
+		}
+		if err != nil {
+			return removed, errors.Wrapf(err, "删除 cgroup %s 时出错", dir)
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
@@ -0,0 +1,69 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeCgroup 在 parent 下创建一个假的 cgroup 目录，populated 决定 cgroup.events 的内容
+func writeCgroup(t *testing.T, dir string, populated bool) {
+	t.Helper()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := "populated 0\nfrozen 0\n"
+	if populated {
+		events = "populated 1\nfrozen 0\n"
+	}
+	err = os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte(events), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrphanedCgroups(t *testing.T) {
+	parent := t.TempDir()
+	writeCgroup(t, parent, true)
+	writeCgroup(t, filepath.Join(parent, "running"), true)
+	writeCgroup(t, filepath.Join(parent, "stale"), false)
+	writeCgroup(t, filepath.Join(parent, "stale", "child"), false)
+	writeCgroup(t, filepath.Join(parent, "mixed"), true)
+	writeCgroup(t, filepath.Join(parent, "mixed", "empty"), false)
+
+	orphans, err := orphanedCgroups(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 子 cgroup 排在父 cgroup 之前，有进程的 cgroup 和 parent 本身不在其中
+	want := []string{
+		filepath.Join(parent, "stale", "child"),
+		filepath.Join(parent, "stale"),
+		filepath.Join(parent, "mixed", "empty"),
+	}
+	if !reflect.DeepEqual(orphans, want) {
+		t.Errorf("orphanedCgroups = %v, want %v", orphans, want)
+	}
+}
+
+func TestOrphanedCgroupsMissingEvents(t *testing.T) {
+	parent := t.TempDir()
+	err := os.Mkdir(filepath.Join(parent, "broken"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orphanedCgroups(parent); err == nil {
+		t.Error("a cgroup without cgroup.events should be an error")
+	}
+}
+
+func TestContainerCgroupName(t *testing.T) {
+	if name := containerCgroupName(&Spec{Name: "web"}); name != "web" {
+		t.Errorf("containerCgroupName = %q, want web", name)
+	}
+	if name := containerCgroupName(&Spec{}); name == "" || name == cgroupParent {
+		t.Errorf("containerCgroupName without a name = %q", name)
+	}
+}
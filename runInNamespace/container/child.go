@@ -0,0 +1,274 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setEnv 设置容器命令的环境变量，dryRun 时 Run 在调用方的进程中执行，只检查不设置
+func setEnv(envVars []string, dryRun bool) error {
+	slog.Debug("setting env vars", "env", envVars)
+	for _, e := range envVars {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("无效的环境变量: %s", e)
+		}
+		if dryRun {
+			continue
+		}
+		err := os.Setenv(parts[0], parts[1])
+		if err != nil {
+			return errors.Wrap(err, "设置环境变量时出错")
+		}
+	}
+	return nil
+}
+
+// runPrep 在容器内运行 --prep 指定的命令，环境变量和工作目录与容器命令相同
+func runPrep(prep string, dryRun bool) error {
+	if prep == "" {
+		return nil
+	}
+	slog.Info("running prep command", "cmd", "/bin/sh -c "+prep)
+	if dryRun {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", prep)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// childProcess 处理子进程的逻辑，任何一步失败都返回标明该步骤的 *StepError
+func childProcess(spec *Spec) error {
+	// profile 路径在宿主机上，需要在 pivot_root 之前读取
+	var seccompProfile *SeccompProfile
+	if spec.Seccomp != "" {
+		profile, err := loadSeccompProfile(spec.Seccomp)
+		if err != nil {
+			return stepError(StepSeccomp, errors.Wrap(err, "加载 seccomp profile 时出错"))
+		}
+		seccompProfile = profile
+	}
+
+	// --verbose-mount 时在 pivot_root 之前打印本次新增或变化的 mountinfo，挂载步骤失败时也打印
+	logMounts := func() {}
+	if spec.VerboseMount && !spec.DryRun {
+		logMounts = mountLogger()
+	}
+	defer logMounts()
+	err := mountRecPrivate(spec.SlaveVolume, spec.DryRun)
+	if err != nil {
+		return stepError(StepMountPrivate, errors.Wrap(err, "mountRecPrivate 时出错"))
+	}
+	image, err := loadRuntimeConfig(spec)
+	if err != nil {
+		return stepError(StepLoadConfig, errors.Wrap(err, "读取 config.json 时出错"))
+	}
+	env, err := imageEnv(spec, image)
+	if err != nil {
+		return stepError(StepSetEnv, err)
+	}
+	err = setEnv(env, spec.DryRun)
+	if err != nil {
+		return stepError(StepSetEnv, errors.Wrap(err, "设置环境变量时出错"))
+	}
+
+	targetDir := filepath.Join(spec.BaseDir, "merged")
+	if spec.Rootfs != "" {
+		err = mountRootfs(spec.Rootfs, targetDir, spec.DryRun)
+		if err != nil {
+			return stepError(StepMountRootfs, errors.Wrap(err, "挂载 rootfs 时出错"))
+		}
+	} else {
+		err = setLayers(spec, targetDir)
+		if err != nil {
+			return stepError(StepMountOverlay, errors.Wrap(err, "设置 layers 时出错"))
+		}
+	}
+
+	err = mountBaseFs(targetDir, spec.ShmSize, spec.Privileged, spec.UserNS, spec.DryRun)
+	if err != nil {
+		return stepError(StepMountBaseFs, errors.Wrap(err, "挂载基础文件系统时出错"))
+	}
+
+	if spec.MaskProc {
+		err = maskProc(targetDir, spec.DryRun)
+		if err != nil {
+			return stepError(StepMaskProc, err)
+		}
+	}
+
+	err = mountVolume(spec.VolumeDir, targetDir, spec.SlaveVolume, spec.NoSymlinkVolumes, spec.Privileged, spec.DryRun)
+	if err != nil {
+		return stepError(StepMountVolume, errors.Wrap(err, "挂载 volume 时出错"))
+	}
+	err = mountImageVolumes(targetDir, image.Volumes, spec.Volumes, spec.NoSymlinkVolumes, spec.Privileged, spec.DryRun)
+	if err != nil {
+		return stepError(StepMountVolume, errors.Wrap(err, "挂载镜像声明的 volume 时出错"))
+	}
+
+	err = setHostname(targetDir, spec.Hostname, spec.DryRun)
+	if err != nil {
+		return stepError(StepSetHostname, errors.Wrap(err, "设置主机名时出错"))
+	}
+	err = writeHosts(targetDir, spec.Hostname, spec.AddHosts, spec.OverwriteHosts, spec.DryRun)
+	if err != nil {
+		return stepError(StepWriteHosts, errors.Wrap(err, "写入 /etc/hosts 时出错"))
+	}
+	// 共享宿主机网络时不设置 resolv.conf，保留镜像自带的文件
+	if !spec.hostNetwork() {
+		err = setupResolvConf(targetDir, spec.DNSMode, spec.DryRun)
+		if err != nil {
+			return stepError(StepResolvConf, errors.Wrap(err, "设置 /etc/resolv.conf 时出错"))
+		}
+	}
+	if spec.WriteNsswitch {
+		err = writeNsswitch(targetDir, spec.DryRun)
+		if err != nil {
+			return stepError(StepNsswitch, errors.Wrap(err, "写入 /etc/nsswitch.conf 时出错"))
+		}
+	}
+
+	logMounts()
+	err = chroot(targetDir, spec.DryRun)
+	if err != nil {
+		return stepError(StepPivotRoot, errors.Wrap(err, "chroot 时出错"))
+	}
+
+	// 在 exec 之前才切换目录，pivot_root 之后的挂载步骤仍然以 / 为当前目录
+	cwd := commandDir(image, spec.EntrypointCwd)
+	slog.Info("changing working dir", "cmd", "cd "+cwd)
+	if !spec.DryRun {
+		err = os.Chdir(cwd)
+		if err != nil {
+			return stepError(StepChdir, errors.Wrapf(err, "切换到工作目录 %s 时出错", cwd))
+		}
+	}
+
+	err = runPrep(spec.Prep, spec.DryRun)
+	if err != nil {
+		return stepError(StepPrep, errors.Wrap(err, "运行准备命令时出错"))
+	}
+
+	// 启动容器命令并连接标准输入输出
+	argv := commandArgv(image, spec.Args, spec.ShellForm)
+	slog.Info("running command", "cmd", strings.Join(argv, " "))
+	if spec.DryRun {
+		return nil
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if seccompProfile != nil {
+		// 过滤器只作用于当前线程，锁定线程保证 fork/exec 在同一个线程上进行
+		runtime.LockOSThread()
+		slog.Info("applying seccomp profile", "profile", spec.Seccomp)
+		err = applySeccomp(seccompProfile)
+		if err != nil {
+			return stepError(StepSeccomp, errors.Wrap(err, "加载 seccomp 过滤器时出错"))
+		}
+	}
+	err = cmd.Start()
+	if err != nil {
+		return stepError(StepStartCommand, errors.Wrapf(err, "运行 %s 时出错", argv[0]))
+	}
+	if spec.Init {
+		stop := forwardSignals(cmd.Process)
+		defer stop()
+		return reapUntil(cmd.Process.Pid)
+	}
+	// 容器命令的退出状态原样返回，由 main 转发为进程的退出码
+	err = cmd.Wait()
+	if _, ok := err.(*exec.ExitError); ok {
+		return err
+	}
+	if err != nil {
+		return stepError(StepWaitCommand, errors.Wrapf(err, "运行 %s 时出错", argv[0]))
+	}
+	return nil
+}
+
+// readSpec 读取父进程经管道传来的 Spec
+func readSpec() (*Spec, error) {
+	file := os.NewFile(specFd, "spec")
+	defer file.Close()
+	spec := &Spec{}
+	err := json.NewDecoder(file).Decode(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取父进程传来的配置时出错")
+	}
+	return spec, nil
+}
+
+// Init 必须在使用本包的程序的 main 开头调用。Run 重新执行当前程序来进入新的
+// namespace，在这个子进程中 Init 运行容器并以容器命令的退出码退出，否则直接返回
+func Init() {
+	if len(os.Args) < 2 || os.Args[1] != childArg {
+		return
+	}
+	spec, err := readSpec()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	err = SetupLogger(spec.LogLevel, spec.Quiet)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if spec.usesStdin() {
+		setStdin(spec.Stdin)
+	}
+	// 这时的 /proc 还是宿主机的，/proc/self 指向宿主机 pid namespace 中的 pid
+	hostPid, _ := os.Readlink("/proc/self")
+	closeStepFdOnExec()
+	err = childProcess(spec)
+	if code, ok := ExitCode(err); ok {
+		os.Exit(code)
+	}
+	if err != nil {
+		// 传回父进程的错误由父进程打印，保留挂载时父进程要等到退出才能打印，这里先打印
+		if !reportStep(err) || spec.KeepMounts {
+			slog.Error(err.Error())
+		}
+		if spec.KeepMounts && !spec.DryRun {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			keepMounts(os.Stderr, spec, hostPid, sigs)
+			signal.Stop(sigs)
+		}
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// keepMounts 在容器启动失败后保留它的 mount namespace 以便排查，向 w 打印要查看的路径
+// 和释放挂载的方法，从 sigs 收到 SIGINT 或 SIGTERM 后返回，进程退出时 mount namespace 随之销毁
+func keepMounts(w io.Writer, spec *Spec, hostPid string, sigs <-chan os.Signal) {
+	upperDir, workDir, err := overlayDirs(spec.BaseDir, spec.UpperDir, spec.Persist)
+	if err != nil {
+		upperDir, workDir = "?", "?"
+	}
+	slog.Info("keeping mounts", "pid", hostPid)
+	fmt.Fprintf(w, "--keep-mounts: 容器启动失败，挂载保留在 pid %s 的 mount namespace 中\n", hostPid)
+	fmt.Fprintf(w, "  rootfs: %s\n", filepath.Join(spec.BaseDir, "merged"))
+	fmt.Fprintf(w, "  upper:  %s\n", upperDir)
+	fmt.Fprintf(w, "  work:   %s\n", workDir)
+	fmt.Fprintf(w, "  进入:   nsenter --target %s --mount --root\n", hostPid)
+	fmt.Fprintf(w, "  释放:   按 Ctrl-C 或 kill -TERM %s\n", hostPid)
+	sig := <-sigs
+	slog.Info("releasing mounts", "pid", hostPid, "signal", sig)
+}
@@ -0,0 +1,102 @@
+package container
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepMountsPrintsHowToRelease(t *testing.T) {
+	spec := DefaultSpec()
+	spec.BaseDir = t.TempDir()
+	var out bytes.Buffer
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		keepMounts(&out, spec, "4242", sigs)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("keepMounts returned before a signal")
+	case <-time.After(100 * time.Millisecond):
+	}
+	sigs <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepMounts didn't return on SIGTERM")
+	}
+	hint := out.String()
+	for _, want := range []string{
+		"pid 4242",
+		filepath.Join(spec.BaseDir, "merged"),
+		"nsenter --target 4242 --mount --root",
+		"kill -TERM 4242",
+	} {
+		if !strings.Contains(hint, want) {
+			t.Errorf("the keep-mounts hint has no %q:\n%s", want, hint)
+		}
+	}
+}
+
+func TestRunPrep(t *testing.T) {
+	if err := runPrep("", false); err != nil {
+		t.Errorf("an empty prep = %v", err)
+	}
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "prepared")
+	// 准备命令继承容器命令的环境变量和工作目录
+	t.Setenv("PREP_TEST_NAME", "prepared")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	err = runPrep(`touch "$PREP_TEST_NAME"`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("the prep command did not run in the working dir: %v", err)
+	}
+
+	os.Remove(marker)
+	err = runPrep(`touch "$PREP_TEST_NAME"`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("a dry run ran the prep command")
+	}
+
+	err = runPrep("exit 3", false)
+	if code, ok := ExitCode(err); !ok || code != 3 {
+		t.Errorf("runPrep(exit 3) = %v, want exit status 3", err)
+	}
+}
+
+func TestPrepRunsBeforeCommand(t *testing.T) {
+	spec := testImage(t, map[string]any{"Cmd": []string{"/app"}})
+	spec.Prep = "mkdir -p /run/app"
+	plan := captureLog(t, func() {
+		err := Run(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	chdir := strings.Index(plan, `cmd="cd /"`)
+	prep := strings.Index(plan, `cmd="/bin/sh -c mkdir -p /run/app"`)
+	command := strings.Index(plan, "cmd=/app")
+	if chdir < 0 || prep < chdir || command < prep {
+		t.Errorf("the prep command should run after cd and before the command:\n%s", plan)
+	}
+}
@@ -0,0 +1,386 @@
+package container
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"common/layout"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	dockerLayerType = "application/vnd.docker.image.rootfs.diff.tar"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// commitSkip 是每次启动时由 runInNamespace 写入 rootfs 的文件，不属于容器的修改
+var commitSkip = map[string]bool{
+	hostsFile:    true,
+	resolvFile:   true,
+	hostnameFile: true,
+	nsswitchFile: true,
+}
+
+// CommitOptions 描述 commit 读取的 upperdir 和要更新的镜像
+type CommitOptions struct {
+	// UpperDir 是容器 overlay 的 upperdir，即 --upperdir 或 --persist 目录下的 upper
+	UpperDir     string
+	ConfigPath   string
+	ManifestPath string
+	LayersRoot   string
+	// Comment 写入新 layer 在 config.json 中的 history
+	Comment string
+}
+
+// opaqueDir 判断 overlay 是否把 dir 标记为 opaque，userns 中挂载的 overlay 使用 user. 前缀的 xattr
+func opaqueDir(dir string) bool {
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		buf := make([]byte, 1)
+		n, err := syscall.Getxattr(dir, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// addTarEntry 把 upperdir 中的 p 写入 tar，overlay 的 whiteout 设备和 opaque 目录
+// 转换为 OCI 的 .wh. 文件，links 记录已写入的硬链接 inode
+func addTarEntry(tw *tar.Writer, p, rel string, info os.FileInfo, links map[uint64]string) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	if info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0 {
+		// 0:0 字符设备是 overlay 的 whiteout，表示下层的同名文件被删除
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)),
+			ModTime:  info.ModTime(),
+		})
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(p)
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid, hdr.Gid = int(stat.Uid), int(stat.Gid)
+	// 只保留数字 uid/gid 和 mtime，内容相同的 upperdir 生成相同的 layer
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if info.Mode().IsRegular() && stat.Nlink > 1 {
+		if first, ok := links[stat.Ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[stat.Ino] = rel
+		}
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	}
+	if info.IsDir() && opaqueDir(p) {
+		// opaque 目录隐藏下层同名目录的全部内容
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Join(rel, whiteoutOpaque),
+			ModTime:  info.ModTime(),
+		})
+	}
+	return nil
+}
+
+// writeUpperTar 把 upperDir 打包为 OCI layer 写入 w，跳过 commitSkip 中的文件
+func writeUpperTar(w io.Writer, upperDir string) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := filepath.Walk(upperDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." || commitSkip[rel] {
+			return nil
+		}
+		err = addTarEntry(tw, p, rel, info, links)
+		if err != nil {
+			return errors.Wrapf(err, "打包 %s 时出错", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// copyUpperDir 把 upperDir 复制为 layersRoot 下的 layer 目录，保留 overlay 的 whiteout，
+// 该目录直接作为 lowerdir 使用，写完后和 docker2fs 一样创建完成标记
+func copyUpperDir(upperDir, layerDir string) error {
+	partial := layerDir + ".partial"
+	err := os.RemoveAll(partial)
+	if err != nil {
+		return err
+	}
+	slog.Info("copying upperdir", "cmd", "cp -a "+upperDir+" "+partial)
+	out, err := exec.Command("cp", "-a", upperDir, partial).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(partial)
+		return errors.Wrapf(err, "复制 upperdir 时出错: %s", out)
+	}
+	for rel := range commitSkip {
+		err = os.RemoveAll(filepath.Join(partial, rel))
+		if err != nil {
+			os.RemoveAll(partial)
+			return err
+		}
+	}
+	err = os.RemoveAll(layerDir)
+	if err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	err = os.Rename(partial, layerDir)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(layout.CompleteMarker(layerDir), nil, 0644)
+}
+
+// rawJSON 读取 path 中的 JSON 对象，未知的字段原样保留
+func rawJSON(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	object := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, errors.Wrapf(err, "解析 %s 时出错", path)
+	}
+	return object, nil
+}
+
+// setField 把 value 编码后写入 object 的 key
+func setField(object map[string]json.RawMessage, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	object[key] = data
+	return nil
+}
+
+// commitConfig 在 config.json 的 rootfs.diff_ids 和 history 中追加新 layer，返回写入的内容
+func commitConfig(configPath, diffID, comment string) ([]byte, error) {
+	config, err := rawJSON(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 config.json 时出错")
+	}
+	var rootfs struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	var history []map[string]any
+	for key, value := range map[string]any{"rootfs": &rootfs, "history": &history} {
+		if raw, ok := config[key]; ok {
+			err = json.Unmarshal(raw, value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "解析 config.json 的 %s 时出错", key)
+			}
+		}
+	}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	rootfs.Type = "layers"
+	rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	entry := map[string]any{"created": created, "created_by": "runInNamespace commit"}
+	if comment != "" {
+		entry["comment"] = comment
+	}
+	history = append(history, entry)
+	for key, value := range map[string]any{"rootfs": rootfs, "history": history, "created": created} {
+		err = setField(config, key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(configPath, data, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "写入 config.json 时出错")
+	}
+	return data, nil
+}
+
+// commitManifest 在 manifest.json 中追加新 layer，并把 config 的 digest 更新为 configData 的
+func commitManifest(manifestPath, layerDir string, layer Layer, configData []byte) error {
+	manifest, err := rawJSON(manifestPath)
+	if err != nil {
+		return errors.Wrap(err, "读取 manifest.json 时出错")
+	}
+	var mediaType string
+	var layers []map[string]any
+	var config map[string]any
+	for key, value := range map[string]any{"mediaType": &mediaType, "layers": &layers, "config": &config} {
+		if raw, ok := manifest[key]; ok {
+			err = json.Unmarshal(raw, value)
+			if err != nil {
+				return errors.Wrapf(err, "解析 manifest.json 的 %s 时出错", key)
+			}
+		}
+	}
+	layer.MediaType = ociLayerType
+	if mediaType == dockerManifestType {
+		layer.MediaType = dockerLayerType
+	}
+	layers = append(layers, map[string]any{"mediaType": layer.MediaType, "size": layer.Size, "digest": layer.Digest})
+	if config == nil {
+		config = map[string]any{}
+	}
+	sum := sha256.Sum256(configData)
+	config["digest"] = "sha256:" + hex.EncodeToString(sum[:])
+	config["size"] = len(configData)
+	for key, value := range map[string]any{"layers": layers, "config": config} {
+		err = setField(manifest, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(manifestPath, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "写入 manifest.json 时出错")
+	}
+	return commitLayersFile(filepath.Join(filepath.Dir(manifestPath), "layers.json"), layerDir, layer)
+}
+
+// commitLayersFile 在 docker2fs 写的 layers.json 中追加新 layer，文件不存在时跳过
+func commitLayersFile(layersPath, layerDir string, layer Layer) error {
+	data, err := os.ReadFile(layersPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var infos []json.RawMessage
+	err = json.Unmarshal(data, &infos)
+	if err != nil {
+		return errors.Wrap(err, "解析 layers.json 时出错")
+	}
+	info, err := json.Marshal(map[string]any{
+		"digest":    layer.Digest,
+		"diffID":    layer.Digest,
+		"size":      layer.Size,
+		"mediaType": layer.MediaType,
+		"path":      layerDir,
+	})
+	if err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(append(infos, info), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(layersPath, data, 0644)
+}
+
+// Commit 把 UpperDir 中容器的修改打包为新的 layer 追加到镜像，返回 layer 的 digest
+// layer 不压缩，digest 和 diffID 相同。提交时容器不应在运行，否则 upperdir 可能正在被修改
+func Commit(opts CommitOptions) (string, error) {
+	info, err := os.Stat(opts.UpperDir)
+	if err != nil {
+		return "", errors.Wrap(err, "读取 upperdir 时出错")
+	}
+	if !info.IsDir() {
+		return "", errors.Errorf("upperdir %s 不是目录", opts.UpperDir)
+	}
+	err = os.MkdirAll(opts.LayersRoot, 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "创建 layers 目录时出错")
+	}
+	file, err := os.CreateTemp(opts.LayersRoot, "commit-*.tar")
+	if err != nil {
+		return "", errors.Wrap(err, "创建 layer 文件时出错")
+	}
+	defer os.Remove(file.Name())
+	h := sha256.New()
+	err = writeUpperTar(io.MultiWriter(file, h), opts.UpperDir)
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		// CreateTemp 创建的文件是 0600，和 docker2fs 写的 layer 保持一致
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "写入 layer 文件时出错")
+	}
+	hexDigest := hex.EncodeToString(h.Sum(nil))
+	layerDir := filepath.Join(opts.LayersRoot, hexDigest)
+	err = os.Rename(file.Name(), layerDir+".tar")
+	if err != nil {
+		return "", errors.Wrap(err, "保存 layer 文件时出错")
+	}
+	err = copyUpperDir(opts.UpperDir, layerDir)
+	if err != nil {
+		return "", err
+	}
+
+	layer := Layer{Digest: "sha256:" + hexDigest, Size: uint64(size)}
+	configData, err := commitConfig(opts.ConfigPath, layer.Digest, opts.Comment)
+	if err != nil {
+		return "", err
+	}
+	err = commitManifest(opts.ManifestPath, layerDir, layer, configData)
+	if err != nil {
+		return "", err
+	}
+	return layer.Digest, nil
+}
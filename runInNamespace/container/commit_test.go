@@ -0,0 +1,108 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"common/layout"
+)
+
+// upperTarNames 打包 upperDir 并返回 tar 中的文件名
+func upperTarNames(t *testing.T, upperDir string) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	err := writeUpperTar(&buf, upperDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+// writeUpper 在 t.TempDir() 中构造一个 overlay upperdir
+func writeUpper(t *testing.T) string {
+	t.Helper()
+	upper := t.TempDir()
+	for _, dir := range []string{"etc", "opaque"} {
+		err := os.Mkdir(filepath.Join(upper, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{hostsFile, resolvFile, "etc/app.conf", "opaque/kept"} {
+		err := os.WriteFile(filepath.Join(upper, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// overlay 用 0:0 字符设备表示删除的文件
+	err := syscall.Mknod(filepath.Join(upper, "etc/deleted"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Skipf("mknod 0:0 需要 CAP_MKNOD: %v", err)
+	}
+	err = syscall.Setxattr(filepath.Join(upper, "opaque"), "user.overlay.opaque", []byte("y"), 0)
+	if err != nil {
+		t.Skipf("文件系统不支持 user xattr: %v", err)
+	}
+	return upper
+}
+
+func TestWriteUpperTarWhiteouts(t *testing.T) {
+	names := upperTarNames(t, writeUpper(t))
+	want := []string{
+		"etc/",
+		"etc/app.conf",
+		"etc/.wh.deleted",
+		"opaque/",
+		"opaque/.wh..wh..opq",
+		"opaque/kept",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("writeUpperTar = %v, want %v", names, want)
+	}
+}
+
+func TestCopyUpperDir(t *testing.T) {
+	upper := writeUpper(t)
+	layerDir := filepath.Join(t.TempDir(), "abc")
+	err := copyUpperDir(upper, layerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(layout.CompleteMarker(layerDir)); err != nil {
+		t.Errorf("complete marker: %v", err)
+	}
+	for rel := range commitSkip {
+		if _, err := os.Lstat(filepath.Join(layerDir, rel)); !os.IsNotExist(err) {
+			t.Errorf("%s was copied into the layer", rel)
+		}
+	}
+	// lowerdir 中保留 overlay 自己的 whiteout
+	info, err := os.Lstat(filepath.Join(layerDir, "etc/deleted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("etc/deleted mode = %v, want a whiteout device", info.Mode())
+	}
+	if !opaqueDir(filepath.Join(layerDir, "opaque")) {
+		t.Error("opaque lost its overlay.opaque xattr")
+	}
+}
@@ -0,0 +1,212 @@
+// Package container 在新的 namespace 中以 docker2fs 转换出的镜像运行命令
+// 使用本包的程序需要在 main 开头调用 Init
+package container
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// forwardSignals 把当前进程收到的信号转发给 process，返回的函数停止转发
+// 1 号进程用它转发给容器命令，pid namespace 中的 1 号进程默认不响应没有注册处理函数的信号；
+// 父进程用它转发给 1 号进程
+func forwardSignals(process *os.Process) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP,
+		syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				slog.Debug("forwarding signal", "signal", sig)
+				process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// childArg 是重新执行自身进入子进程逻辑时的第一个参数
+const childArg = "child"
+
+// specFd 是子进程读取 Spec 的管道，即 ExtraFiles 中的第一个文件
+const specFd = 3
+
+// runInNamespace 启动子进程并在隔离的 namespace 和 chroot 环境中运行
+// spec 以 JSON 经管道传给子进程，Name 或 PidFile 非空时在运行期间保留 pid 文件，
+// stateDir 下的 state.json 同样只在运行期间存在
+func runInNamespace(spec *Spec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "创建管道时出错")
+	}
+	defer specReader.Close()
+	defer specWriter.Close()
+	stepReader, stepWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "创建管道时出错")
+	}
+	defer stepReader.Close()
+	defer stepWriter.Close()
+
+	cmd := exec.Command("/proc/self/exe", childArg)
+	cmd.ExtraFiles = []*os.File{specReader, stepWriter}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// 设置子进程的 SysProcAttr，进入新的 namespaces
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(spec),
+	}
+	if spec.UserNS {
+		setUserNS(cmd.SysProcAttr)
+	}
+
+	// lazy 模式下 docker2fs 可能还没写出 manifest，等 layer 就绪后才知道要计数哪些 layer
+	if spec.OverlayLazyExtract {
+		slog.Info("waiting for layers", "manifest", spec.ManifestPath, "timeout", spec.LazyTimeout)
+		err = waitForLayers(spec)
+		if err != nil {
+			return stepError(StepWaitLayers, err)
+		}
+	}
+	// 容器运行期间 docker2fs gc 不会删除它使用的 layer
+	release, err := acquireLayers(spec)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cgroup, err := createContainerCgroup(spec)
+	if err != nil {
+		return err
+	}
+	if cgroup != nil {
+		defer removeContainerCgroup(cgroup.Name())
+		defer cgroup.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	// 宿主机上的 Ctrl-C 或 SIGTERM 不直接结束父进程，而是转发给子进程，
+	// 等它退出后再删除 pid 文件、state.json 并释放 layer 引用计数
+	stopForward := forwardSignals(cmd.Process)
+	defer stopForward()
+	// 子进程启动后先读完 spec 再开始运行
+	specReader.Close()
+	stepWriter.Close()
+	_, err = specWriter.Write(data)
+	specWriter.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.Wrap(err, "向子进程传递配置时出错")
+	}
+	// exec、kill 和 stats 可以直接使用这个 pid
+	slog.Info("container started", "pid", cmd.Process.Pid)
+	if spec.Name != "" {
+		err = writePidFile(spec.Name, cmd.Process.Pid)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		defer os.Remove(pidFile(spec.Name))
+	}
+	if spec.PidFile != "" {
+		err = os.WriteFile(spec.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return errors.Wrap(err, "写入 pid 文件时出错")
+		}
+		defer os.Remove(spec.PidFile)
+	}
+	statePath, err := writeState(spec, cmd.Process.Pid)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	defer os.Remove(statePath)
+	err = cmd.Wait()
+	// 子进程在某一步失败时没有打印错误，由调用方根据 StepError 处理
+	if stepErr := readStepReport(stepReader); stepErr != nil {
+		return stepErr
+	}
+	return err
+}
+
+// ExitCode 返回命令的退出码，被信号杀死时按 shell 的惯例返回 128+信号编号
+// 只识别未包装的 *exec.ExitError 和 *ExitStatusError，包装过的错误说明失败发生在运行命令之外
+func ExitCode(err error) (int, bool) {
+	if statusErr, ok := err.(*ExitStatusError); ok {
+		if statusErr.Status.Signaled() {
+			return 128 + int(statusErr.Status.Signal()), true
+		}
+		return statusErr.Status.ExitStatus(), true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return exitErr.ExitCode(), true
+}
+
+// Run 按 spec 启动容器并等待它退出，容器命令失败时返回的错误可以交给 ExitCode
+// DryRun 时只打印执行计划，不需要 root 权限，不进入新的 namespace，也不改动调用方进程的环境变量
+func Run(spec *Spec) error {
+	err := spec.Validate()
+	if err != nil {
+		return err
+	}
+	if spec.DryRun {
+		slog.Info("making volume dir", "cmd", "mkdir -p "+spec.VolumeDir)
+		return childProcess(spec)
+	}
+	err = checkPrivileges(spec.UserNS)
+	if err != nil {
+		return err
+	}
+	err = checkStaleMounts(spec.BaseDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(spec.VolumeDir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "创建 volume 目录时出错")
+	}
+	// 子进程拿到的是同一个标准输入，父进程先读出来随 spec 一起交给它，容器命令的标准输入随之为空
+	if spec.usesStdin() {
+		spec.Stdin, err = readStdin()
+		if err != nil {
+			return errors.Wrap(err, "读取标准输入时出错")
+		}
+	}
+	return runInNamespace(spec)
+}
@@ -0,0 +1,153 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Run 重新执行测试程序进入子进程，子进程和 main 一样先交给 Init
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+// testImage 在临时目录中写出 docker2fs 转换出的镜像布局，layers 是各层的 digest，
+// 返回指向它的 DryRun Spec
+func testImage(t *testing.T, config map[string]any, layers ...string) *Spec {
+	t.Helper()
+	base := t.TempDir()
+	t.Setenv("PROXY_POOL_PATH", base)
+	spec := DefaultSpec()
+	spec.DryRun = true
+	data, err := json.Marshal(map[string]any{"config": config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(spec.ConfigPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := Manifest{SchemaVersion: 2, MediaType: dockerManifestType}
+	for _, digest := range layers {
+		manifest.Layers = append(manifest.Layers, Layer{Digest: digest})
+		err = os.MkdirAll(filepath.Join(spec.LayersRoot, digest[len("sha256:"):], "bin"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(spec.ManifestPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// captureLog 返回 run 期间打印的日志，DryRun 的执行计划就在其中
+func captureLog(t *testing.T, run func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	run()
+	return buf.String()
+}
+
+func TestRunDryRunLeavesEnvAlone(t *testing.T) {
+	spec := testImage(t, map[string]any{
+		"Env":        []string{"RUN_TEST_FROM_IMAGE=1", "PATH=/image/bin"},
+		"Entrypoint": []string{"/bin/true"},
+	}, "sha256:aaaa", "sha256:bbbb")
+	spec.Env = EnvVars{"RUN_TEST_FROM_FLAG=2"}
+	path := os.Getenv("PATH")
+
+	err := Run(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DryRun 在调用方的进程中执行，不能改动它的环境变量
+	for _, key := range []string{"RUN_TEST_FROM_IMAGE", "RUN_TEST_FROM_FLAG"} {
+		if value, ok := os.LookupEnv(key); ok {
+			t.Errorf("Run set %s=%s in the caller's environment", key, value)
+		}
+	}
+	if os.Getenv("PATH") != path {
+		t.Errorf("Run changed PATH to %s", os.Getenv("PATH"))
+	}
+}
+
+func TestRunValidates(t *testing.T) {
+	spec := testImage(t, map[string]any{})
+	spec.Hostname = "web"
+	spec.ShareUTS = true
+	if err := Run(spec); err == nil {
+		t.Error("Run should reject a spec that fails Validate")
+	}
+}
+
+func TestForwardSignalsToInit(t *testing.T) {
+	// 父进程把宿主机上收到的 SIGTERM 转给容器的 1 号进程，自己等它退出
+	init := startTrap(t, "TERM", 9)
+	stop := forwardSignals(init.Process)
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- init.Wait() }()
+	select {
+	case err := <-done:
+		if code, ok := ExitCode(err); !ok || code != 9 {
+			t.Errorf("init exited with %v, want exit status 9 from its trap", err)
+		}
+	case <-time.After(5 * time.Second):
+		init.Process.Kill()
+		t.Fatal("SIGTERM was not forwarded")
+	}
+	stop()
+}
+
+func TestRunDryRunPrintsPlanForMissingLayers(t *testing.T) {
+	spec := testImage(t, map[string]any{
+		"Entrypoint": []string{"/bin/echo"},
+		"Cmd":        []string{"hello"},
+	}, "sha256:aaaa", "sha256:bbbb")
+	// 第二层还没有被 docker2fs 解压
+	err := os.RemoveAll(filepath.Join(spec.LayersRoot, "bbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := captureLog(t, func() {
+		err = Run(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	// overlay 的 lowerdir 从上往下排列
+	lowerdir := "lowerdir=" + filepath.Join(spec.LayersRoot, "bbbb") + ":" + filepath.Join(spec.LayersRoot, "aaaa")
+	for _, want := range []string{
+		"mkdir -p " + spec.VolumeDir,
+		"mount -t overlay overlay -o " + lowerdir,
+		"layers not extracted yet",
+		"cmd=\"/bin/echo hello\"",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("the dry run plan has no %q:\n%s", want, plan)
+		}
+	}
+	for _, dir := range []string{spec.VolumeDir, spec.BaseDir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("the dry run created %s", dir)
+		}
+	}
+}
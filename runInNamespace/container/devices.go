@@ -0,0 +1,108 @@
+package container
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// device 是容器 /dev 中创建的一个字符设备
+type device struct {
+	Name  string
+	Major uint32
+	Minor uint32
+}
+
+// defaultDevices 是非 --privileged 时容器内可见的设备，和 Docker 的默认设备一致
+var defaultDevices = []device{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// defaultDevLinks 是 /dev 中指向 /proc 和 devpts 的符号链接
+var defaultDevLinks = [][2]string{
+	{"/proc/self/fd", "fd"},
+	{"/proc/self/fd/0", "stdin"},
+	{"/proc/self/fd/1", "stdout"},
+	{"/proc/self/fd/2", "stderr"},
+	{"pts/ptmx", "ptmx"},
+}
+
+// mkdev 计算 mknod 使用的设备号
+func mkdev(major, minor uint32) int {
+	return int(major<<8 | minor&0xff | (minor&^0xff)<<12)
+}
+
+// mountDev 在 devDir 上挂载只包含 defaultDevices 的 tmpfs
+// user namespace 中不能 mknod，改为把宿主机上的设备 bind mount 到空文件上
+func mountDev(devDir string, userns, dryRun bool) error {
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	slog.Info("mounting dev filesystem", "cmd", tmpfsCmd("tmpfs", devDir, flagOptions(flags, "mode=755")))
+	err := mount("tmpfs", devDir, "tmpfs", flags, "mode=755", dryRun)
+	if err != nil {
+		return err
+	}
+	for _, dev := range defaultDevices {
+		target := filepath.Join(devDir, dev.Name)
+		if userns {
+			err = bindDevice(filepath.Join("/dev", dev.Name), target, dryRun)
+		} else {
+			err = mknodDevice(dev, target, dryRun)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "创建设备 %s 时出错", target)
+		}
+	}
+	for _, link := range defaultDevLinks {
+		target := filepath.Join(devDir, link[1])
+		slog.Debug("creating dev link", "cmd", "ln -s "+link[0]+" "+target)
+		if dryRun {
+			continue
+		}
+		err = os.Symlink(link[0], target)
+		if err != nil {
+			return errors.Wrapf(err, "创建符号链接 %s 时出错", target)
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		err = mkdirAll(filepath.Join(devDir, dir), dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "创建 /dev/%s 目录时出错", dir)
+		}
+	}
+	return nil
+}
+
+func mknodDevice(dev device, target string, dryRun bool) error {
+	slog.Debug("creating device", "cmd", fmt.Sprintf("mknod -m 666 %s c %d %d", target, dev.Major, dev.Minor))
+	if dryRun {
+		return nil
+	}
+	err := syscall.Mknod(target, syscall.S_IFCHR|0666, mkdev(dev.Major, dev.Minor))
+	if err != nil {
+		return err
+	}
+	// mknod 的权限受 umask 影响
+	return os.Chmod(target, 0666)
+}
+
+func bindDevice(source, target string, dryRun bool) error {
+	slog.Debug("binding device", "cmd", "mount --bind "+source+" "+target)
+	if dryRun {
+		return nil
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return mount(source, target, "", syscall.MS_BIND, "", dryRun)
+}
@@ -0,0 +1,104 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMkdev(t *testing.T) {
+	for _, dev := range [][2]uint32{{1, 3}, {5, 0}, {136, 255}, {259, 256}, {4095, 0xfffff}} {
+		if got, want := mkdev(dev[0], dev[1]), unix.Mkdev(dev[0], dev[1]); uint64(got) != want {
+			t.Errorf("mkdev(%d, %d) = %#x, want %#x", dev[0], dev[1], got, want)
+		}
+	}
+}
+
+func TestMountDev(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mknod needs root")
+	}
+	devDir := t.TempDir()
+	calls := recordMounts(t, nil)
+	err := mountDev(devDir, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mountCall{{"tmpfs", devDir, "tmpfs", syscall.MS_NOSUID | syscall.MS_NOEXEC, "mode=755"}}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("mounts = %+v, want %+v", *calls, want)
+	}
+	names := []string{}
+	for _, dev := range defaultDevices {
+		names = append(names, dev.Name)
+		var stat syscall.Stat_t
+		err := syscall.Lstat(filepath.Join(devDir, dev.Name), &stat)
+		if err != nil {
+			t.Errorf("%s: %v", dev.Name, err)
+			continue
+		}
+		// 权限不受 umask 影响
+		if stat.Mode != syscall.S_IFCHR|0666 || stat.Rdev != unix.Mkdev(dev.Major, dev.Minor) {
+			t.Errorf("%s: mode %#o rdev %#x, want a 0666 character device %d:%d", dev.Name, stat.Mode, stat.Rdev, dev.Major, dev.Minor)
+		}
+	}
+	// 和 Docker 一样只有这些设备
+	if want := []string{"null", "zero", "full", "random", "urandom", "tty"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("default devices = %v, want %v", names, want)
+	}
+	for _, link := range defaultDevLinks {
+		if target, err := os.Readlink(filepath.Join(devDir, link[1])); err != nil || target != link[0] {
+			t.Errorf("/dev/%s -> %q, %v, want %s", link[1], target, err, link[0])
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		if info, err := os.Stat(filepath.Join(devDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("/dev/%s was not created: %v", dir, err)
+		}
+	}
+}
+
+func TestMountDevUserNS(t *testing.T) {
+	devDir := t.TempDir()
+	calls := recordMounts(t, nil)
+	// user namespace 中不能 mknod，把宿主机的设备 bind mount 到空文件上
+	err := mountDev(devDir, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1+len(defaultDevices) {
+		t.Fatalf("mounts = %+v, want the tmpfs and one bind mount per device", *calls)
+	}
+	for i, dev := range defaultDevices {
+		target := filepath.Join(devDir, dev.Name)
+		want := mountCall{source: filepath.Join("/dev", dev.Name), target: target, flags: syscall.MS_BIND}
+		if got := (*calls)[i+1]; got != want {
+			t.Errorf("mount %d = %+v, want %+v", i+1, got, want)
+		}
+		if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+			t.Errorf("the mountpoint of %s is not a regular file: %v", dev.Name, err)
+		}
+	}
+}
+
+func TestMountDevDryRun(t *testing.T) {
+	devDir := t.TempDir()
+	calls := recordMounts(t, nil)
+	for _, userns := range []bool{false, true} {
+		err := mountDev(devDir, userns, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(devDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 || len(entries) != 0 {
+		t.Errorf("a dry run mounted %+v and created %v", *calls, entries)
+	}
+}
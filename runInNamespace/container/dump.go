@@ -0,0 +1,63 @@
+package container
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// RuntimeDump 是 --dump-config 打印的完整运行配置
+type RuntimeDump struct {
+	Spec       *Spec          `json:"options"`
+	Namespaces []string       `json:"namespaces"`
+	Image      *RuntimeConfig `json:"image"`
+	Env        []string       `json:"env"`
+	LowerDirs  []string       `json:"lowerDirs"`
+	UpperDir   string         `json:"upperDir"`
+	WorkDir    string         `json:"workDir"`
+	MergedDir  string         `json:"mergedDir"`
+	Volume     string         `json:"volume"`
+	Command    []string       `json:"command"`
+	Cwd        string         `json:"cwd"`
+}
+
+// Dump 计算 spec 对应的完整运行配置，不挂载也不启动任何进程
+func Dump(spec *Spec) (*RuntimeDump, error) {
+	image, err := loadRuntimeConfig(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 config.json 时出错")
+	}
+	env, err := imageEnv(spec, image)
+	if err != nil {
+		return nil, err
+	}
+	dump := &RuntimeDump{
+		Spec:      spec,
+		Image:     image,
+		Env:       env,
+		MergedDir: filepath.Join(spec.BaseDir, "merged"),
+		Volume:    spec.VolumeDir + ":/volume",
+		Command:   commandArgv(image, spec.Args, spec.ShellForm),
+		Cwd:       commandDir(image, spec.EntrypointCwd),
+	}
+	// --rootfs 时没有 overlay，lowerdir、upperdir 和 workdir 都为空
+	if spec.Rootfs == "" {
+		layers, err := loadManifest(spec.ManifestPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "读取 manifest.json 时出错")
+		}
+		dump.UpperDir, dump.WorkDir, err = overlayDirs(spec.BaseDir, spec.UpperDir, spec.Persist)
+		if err != nil {
+			return nil, err
+		}
+		dump.LowerDirs = lowerDirsOf(layers, spec.LayersRoot)
+		if spec.Bundle != "" {
+			dump.LowerDirs, err = mountBundle(spec.Bundle, filepath.Join(spec.BaseDir, "layers"), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	dump.Namespaces = spec.createdNamespaces()
+	return dump, nil
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EnvVars 是可重复的 --env KEY=VALUE 参数，只给出 KEY 时取宿主机上的同名变量
+type EnvVars []string
+
+func (e *EnvVars) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *EnvVars) Set(value string) error {
+	if strings.SplitN(value, "=", 2)[0] == "" {
+		return errors.Errorf("无效的 --env 参数 %s，格式应为 KEY=VALUE 或 KEY", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// EnvFiles 是可重复的 --env-file 参数，文件每行一个 KEY=VALUE，# 开头的行和空行被忽略
+type EnvFiles []string
+
+func (e *EnvFiles) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *EnvFiles) Set(value string) error {
+	*e = append(*e, value)
+	return nil
+}
+
+// readEnvFile 读取 env 文件中的变量
+func readEnvFile(p string) ([]string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vars := []string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.SplitN(line, "=", 2)[0] == "" {
+			return nil, errors.Errorf("%s 第 %d 行不是 KEY=VALUE: %s", p, n, line)
+		}
+		vars = append(vars, line)
+	}
+	return vars, scanner.Err()
+}
+
+// mergeEnv 依次合并多组环境变量，后出现的同名变量覆盖前面的值并保留前面的位置
+// 只有 KEY 的条目取宿主机上的值，宿主机上没有时忽略
+func mergeEnv(groups ...[]string) []string {
+	merged := []string{}
+	index := map[string]int{}
+	for _, group := range groups {
+		for _, e := range group {
+			if !strings.Contains(e, "=") {
+				value, ok := os.LookupEnv(e)
+				if !ok {
+					continue
+				}
+				e = e + "=" + value
+			}
+			key := strings.SplitN(e, "=", 2)[0]
+			if i, ok := index[key]; ok {
+				merged[i] = e
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// imageEnv 返回容器命令的环境变量，优先级从低到高为镜像的 Env、--env-file 和 --env
+// 需要在 setEnv 之前调用，只有 KEY 的条目取的是宿主机的环境变量
+func imageEnv(spec *Spec, image *RuntimeConfig) ([]string, error) {
+	groups := [][]string{image.Env}
+	for _, p := range spec.EnvFiles {
+		vars, err := readEnvFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "读取 env 文件 %s 时出错", p)
+		}
+		groups = append(groups, vars)
+	}
+	groups = append(groups, spec.Env)
+	return mergeEnv(groups...), nil
+}
@@ -0,0 +1,84 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	t.Setenv("ENV_TEST_HOST", "from-host")
+	tests := []struct {
+		groups [][]string
+		want   []string
+	}{
+		{nil, []string{}},
+		// 后出现的同名变量覆盖前面的值，保留前面的位置
+		{[][]string{{"A=1", "B=2", "C=3"}, {"B=20", "D=4"}, {"A=100"}},
+			[]string{"A=100", "B=20", "C=3", "D=4"}},
+		// 只有 KEY 时取宿主机上的值，没有时忽略
+		{[][]string{{"ENV_TEST_HOST=image", "ENV_TEST_MISSING=image"}, {"ENV_TEST_HOST", "ENV_TEST_MISSING"}},
+			[]string{"ENV_TEST_HOST=from-host", "ENV_TEST_MISSING=image"}},
+		// 值中的 = 原样保留，空值也是值
+		{[][]string{{"OPTS=a=b", "EMPTY=x"}, {"EMPTY="}}, []string{"OPTS=a=b", "EMPTY="}},
+	}
+	for _, test := range tests {
+		if got := mergeEnv(test.groups...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mergeEnv(%q) = %q, want %q", test.groups, got, test.want)
+		}
+	}
+}
+
+func TestImageEnvOrder(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.env")
+	second := filepath.Join(dir, "second.env")
+	err := os.WriteFile(first, []byte("# comment\n\nFILE=first\nIMAGE_ONLY=file\n  SPACED=1  \n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(second, []byte("FILE=second\nFLAG=file\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := DefaultSpec()
+	spec.EnvFiles = EnvFiles{first, second}
+	spec.Env = EnvVars{"FLAG=flag", "NEW=flag"}
+	image := &RuntimeConfig{Env: []string{"PATH=/usr/bin", "IMAGE_ONLY=image", "FILE=image"}}
+	env, err := imageEnv(spec, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 优先级从低到高：镜像的 Env、按顺序的 --env-file、--env
+	want := []string{"PATH=/usr/bin", "IMAGE_ONLY=file", "FILE=second", "SPACED=1", "FLAG=flag", "NEW=flag"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("imageEnv = %q, want %q", env, want)
+	}
+	// 镜像的 Env 不被修改
+	if want := []string{"PATH=/usr/bin", "IMAGE_ONLY=image", "FILE=image"}; !reflect.DeepEqual(image.Env, want) {
+		t.Errorf("image Env changed to %q", image.Env)
+	}
+}
+
+func TestReadEnvFileRejects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.env")
+	err := os.WriteFile(path, []byte("A=1\n=2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readEnvFile(path); err == nil {
+		t.Error("readEnvFile accepted a line without a key")
+	}
+	spec := DefaultSpec()
+	spec.EnvFiles = EnvFiles{filepath.Join(t.TempDir(), "missing.env")}
+	if _, err := imageEnv(spec, &RuntimeConfig{}); err == nil {
+		t.Error("imageEnv accepted a missing env file")
+	}
+	var vars EnvVars
+	for _, value := range []string{"=x", ""} {
+		if err := vars.Set(value); err == nil {
+			t.Errorf("--env accepted %q", value)
+		}
+	}
+}
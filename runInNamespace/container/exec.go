@@ -0,0 +1,217 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// nsFile 是一个打开的 /proc/<pid>/ns/<name> 文件
+type nsFile struct {
+	Name string
+	Flag int
+	File *os.File
+}
+
+// nsFlag 返回 namespace name 的 clone flag，setns 用它确认打开的文件是这种 namespace
+func nsFlag(name string) (int, bool) {
+	if name == "user" {
+		return unix.CLONE_NEWUSER, true
+	}
+	for _, ns := range namespaces {
+		if ns.Name == name {
+			return int(ns.Flag), true
+		}
+	}
+	return 0, false
+}
+
+// openNamespaces 按顺序打开 pid 的 names 这些 namespace，调用方负责关闭
+func openNamespaces(pid int, names []string) ([]nsFile, error) {
+	files := []nsFile{}
+	for _, name := range names {
+		flag, ok := nsFlag(name)
+		if !ok {
+			closeNamespaces(files)
+			return nil, errors.Errorf("未知的 namespace: %s", name)
+		}
+		path := fmt.Sprintf("/proc/%d/ns/%s", pid, name)
+		file, err := os.Open(path)
+		if err != nil {
+			closeNamespaces(files)
+			return nil, errors.Wrapf(err, "打开 %s 时出错", path)
+		}
+		files = append(files, nsFile{Name: name, Flag: flag, File: file})
+	}
+	return files, nil
+}
+
+func closeNamespaces(files []nsFile) {
+	for _, ns := range files {
+		ns.File.Close()
+	}
+}
+
+// nsenterOptions 是 nsenter(1) 加入各个 namespace 的参数
+var nsenterOptions = map[string]string{
+	"user": "--user",
+	"mnt":  "--mount",
+	"uts":  "--uts",
+	"ipc":  "--ipc",
+	"net":  "--net",
+	"pid":  "--pid",
+}
+
+// nsenterArgs 返回用 nsenter 在 pid 的 names 这些 namespace 中运行 argv 的参数
+// --root 和 --wd 在加入 namespace 之前打开，chroot 后工作目录是容器的根目录
+func nsenterArgs(pid int, names []string, argv []string) ([]string, error) {
+	args := []string{"--target", strconv.Itoa(pid)}
+	for _, name := range names {
+		option, ok := nsenterOptions[name]
+		if !ok {
+			return nil, errors.Errorf("未知的 namespace: %s", name)
+		}
+		args = append(args, option)
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	args = append(args, "--root="+root, "--wd="+root, "--")
+	return append(args, argv...), nil
+}
+
+// containerEnv 读取容器命令的环境变量，exec 的命令和容器命令看到同样的环境
+// 1 号进程用 os.Setenv 设置的镜像环境变量不会出现在它自己的 environ 中，
+// 所以优先读取它启动的第一个子进程
+func containerEnv(pid int) ([]string, error) {
+	children, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", pid, pid))
+	if err == nil {
+		if fields := strings.Fields(string(children)); len(fields) > 0 {
+			if child, err := strconv.Atoi(fields[0]); err == nil {
+				pid = child
+			}
+		}
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+	env := []string{}
+	for _, e := range bytes.Split(data, []byte{0}) {
+		if len(e) > 0 {
+			env = append(env, string(e))
+		}
+	}
+	return env, nil
+}
+
+// enterContainer 让当前线程按顺序加入 pid 的 names 这些 namespace 并 chroot 到容器的根目录
+// 之后从这个线程 fork 出的进程都运行在容器内
+func enterContainer(pid int, names []string) error {
+	files, err := openNamespaces(pid, names)
+	if err != nil {
+		return err
+	}
+	defer closeNamespaces(files)
+	// 容器的根目录需要在进入 mount namespace 之前打开
+	root, err := os.Open(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil {
+		return errors.Wrap(err, "打开容器根目录时出错")
+	}
+	defer root.Close()
+
+	// setns 只作用于当前线程，线程不再解锁，命令退出后进程随之退出
+	runtime.LockOSThread()
+	// 和其他线程共享 fs_struct 时不能加入 mount namespace
+	err = syscall.Unshare(syscall.CLONE_FS)
+	if err != nil {
+		return errors.Wrap(err, "unshare CLONE_FS 时出错")
+	}
+	for _, ns := range files {
+		slog.Debug("joining namespace", "ns", ns.Name, "path", ns.File.Name())
+		err = unix.Setns(int(ns.File.Fd()), ns.Flag)
+		if err != nil {
+			return errors.Wrapf(err, "加入 %s namespace 时出错", ns.Name)
+		}
+	}
+	err = syscall.Fchdir(int(root.Fd()))
+	if err != nil {
+		return errors.Wrap(err, "切换到容器根目录时出错")
+	}
+	err = syscall.Chroot(".")
+	if err != nil {
+		return errors.Wrap(err, "chroot 到容器根目录时出错")
+	}
+	return syscall.Chdir("/")
+}
+
+// execCommand 返回在 pid 的 names 这些 namespace 中运行 argv 的命令，names 来自容器的 state.json
+// 多线程的进程不能用 setns 加入 user namespace，Go 程序总是多线程的，
+// 所以有 user namespace 的容器交给 nsenter 加入，其他容器由当前线程加入。
+// 两种情况都按容器环境变量 env 中的 PATH 查找 argv[0]
+func execCommand(pid int, names []string, argv []string, env []string) (*exec.Cmd, error) {
+	if len(names) > 0 && names[0] == "user" {
+		args, err := nsenterArgs(pid, names, argv)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("running command", "cmd", "nsenter "+strings.Join(args, " "), "pid", pid)
+		return exec.Command("nsenter", args...), nil
+	}
+	err := enterContainer(pid, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range env {
+		if path, ok := strings.CutPrefix(e, "PATH="); ok {
+			os.Setenv("PATH", path)
+		}
+	}
+	slog.Info("running command", "cmd", strings.Join(argv, " "), "pid", pid)
+	return exec.Command(argv[0], argv[1:]...), nil
+}
+
+// Exec 在运行中的容器 target（容器名或 pid）内启动 argv 并等待它退出
+// 只加入 state.json 中记录的、为容器创建的 namespace，和宿主机共享的 namespace 不需要加入。
+// pid namespace 只对之后创建的子进程生效，所以命令作为子进程运行。
+// 调用线程会留在容器的 namespace 中，调用方应当在 Exec 返回后退出
+func Exec(target string, argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("没有指定要运行的命令")
+	}
+	pid, err := resolveContainer(target)
+	if err != nil {
+		return err
+	}
+	state, err := findState(stateDir, pid)
+	if err != nil {
+		return err
+	}
+	env, err := containerEnv(pid)
+	if err != nil {
+		return errors.Wrap(err, "读取容器环境变量时出错")
+	}
+	cmd, err := execCommand(pid, state.Namespaces, argv, env)
+	if err != nil {
+		return err
+	}
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "运行 %s 时出错", argv[0])
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCreatedNamespaces(t *testing.T) {
+	spec := &Spec{UserNS: true, ShareUTS: true, Network: "host"}
+	want := []string{"user", "ipc", "mnt", "pid"}
+	if got := spec.createdNamespaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("createdNamespaces = %v, want %v", got, want)
+	}
+	want = []string{"uts", "ipc", "net", "mnt", "pid"}
+	if got := (&Spec{}).createdNamespaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("createdNamespaces = %v, want %v", got, want)
+	}
+}
+
+func TestFindState(t *testing.T) {
+	dir := t.TempDir()
+	for name, state := range map[string]State{
+		"web.state.json": {Name: "web", Pid: 10, Namespaces: []string{"user", "mnt"}},
+		"20.state.json":  {Pid: 20, Namespaces: []string{"mnt"}},
+	} {
+		data, err := json.Marshal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := findState(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Name != "web" || !reflect.DeepEqual(state.Namespaces, []string{"user", "mnt"}) {
+		t.Errorf("findState(10) = %+v", state)
+	}
+	if _, err := findState(dir, 30); err == nil {
+		t.Error("a pid without state.json should be an error")
+	}
+}
+
+func TestOpenNamespaces(t *testing.T) {
+	files, err := openNamespaces(os.Getpid(), []string{"user", "net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNamespaces(files)
+	if len(files) != 2 || files[0].Flag != unix.CLONE_NEWUSER || files[1].Flag != unix.CLONE_NEWNET {
+		t.Errorf("openNamespaces = %+v, want user then net", files)
+	}
+	if _, err := openNamespaces(os.Getpid(), []string{"mnt", "time"}); err == nil {
+		t.Error("an unknown namespace should be an error")
+	}
+}
+
+func TestNsenterArgs(t *testing.T) {
+	args, err := nsenterArgs(42, []string{"user", "mnt", "pid"}, []string{"sh", "-c", "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--target 42 --user --mount --pid --root=/proc/42/root --wd=/proc/42/root -- sh -c id"
+	if got := strings.Join(args, " "); got != want {
+		t.Errorf("nsenterArgs = %q, want %q", got, want)
+	}
+}
+
+// startInNamespaces 用 unshare 在新的 namespace 中启动一个主机名为 inner 的 shell
+func startInNamespaces(t *testing.T, flags ...string) int {
+	t.Helper()
+	args := append(flags, "/bin/sh", "-c", "hostname inner && echo ready && exec sleep 100")
+	command := exec.Command("unshare", args...)
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = command.Start()
+	if err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	t.Cleanup(func() {
+		command.Process.Kill()
+		command.Wait()
+	})
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if line != "ready\n" {
+		t.Skipf("unshare %v did not start", flags)
+	}
+	return command.Process.Pid
+}
+
+// execOutput 在单独的线程中加入 pid 的 namespace 并运行 hostname，
+// 线程锁定的 goroutine 退出后线程随之退出，不影响测试进程
+func execOutput(t *testing.T, pid int, names []string) string {
+	t.Helper()
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		env := []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin"}
+		cmd, err := execCommand(pid, names, []string{"hostname"}, env)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		cmd.Env = env
+		out, err := cmd.Output()
+		done <- result{out, err}
+	}()
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return strings.TrimSpace(string(r.out))
+}
+
+func TestExecCommandJoinsNamespaces(t *testing.T) {
+	pid := startInNamespaces(t, "--uts")
+	if got := execOutput(t, pid, []string{"uts"}); got != "inner" {
+		t.Errorf("hostname = %q, want inner", got)
+	}
+}
+
+func TestExecCommandJoinsUserNamespace(t *testing.T) {
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter is not installed")
+	}
+	pid := startInNamespaces(t, "--user", "--map-root-user", "--uts")
+	if got := execOutput(t, pid, []string{"user", "uts"}); got != "inner" {
+		t.Errorf("hostname = %q, want inner", got)
+	}
+}
@@ -0,0 +1,110 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// fsNames 是 statfs 返回的常见文件系统类型，见 linux/magic.h
+var fsNames = map[int64]string{
+	overlayfsSuperMagic: "overlay",
+	0x01021994:          "tmpfs",
+	0x858458f6:          "ramfs",
+	0xef53:              "ext2/ext3/ext4",
+	0x58465342:          "xfs",
+	0x9123683e:          "btrfs",
+	0x2fc12fc1:          "zfs",
+	0x6969:              "nfs",
+	0xff534d42:          "cifs",
+	0xfe534d42:          "smb2",
+	0x65735546:          "fuse",
+	0x01021997:          "9p",
+	0xf15f:              "ecryptfs",
+	0x61756673:          "aufs",
+	0x4d44:              "vfat",
+	0x2011bab0:          "exfat",
+	0x73717368:          "squashfs",
+	0xe0f5e1e2:          "erofs",
+	0x9660:              "iso9660",
+}
+
+// unsupportedUpperFs 是不能作为 overlay upperdir 的文件系统
+// upper 层需要 trusted.* xattr、d_type 和 RENAME_WHITEOUT，只读文件系统和网络文件系统都不行
+var unsupportedUpperFs = map[string]bool{
+	"overlay":  true,
+	"aufs":     true,
+	"ramfs":    true,
+	"nfs":      true,
+	"cifs":     true,
+	"smb2":     true,
+	"fuse":     true,
+	"9p":       true,
+	"ecryptfs": true,
+	"vfat":     true,
+	"exfat":    true,
+	"squashfs": true,
+	"erofs":    true,
+	"iso9660":  true,
+}
+
+// unsupportedLowerFs 是不能作为 overlay lowerdir 的文件系统，它们自己实现了 dentry 的重新校验
+var unsupportedLowerFs = map[string]bool{
+	"aufs":     true,
+	"ecryptfs": true,
+}
+
+// fsName 返回 statfs 类型的名字，未知的类型返回十六进制的值
+func fsName(fsType int64) string {
+	if name, ok := fsNames[fsType]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", fsType)
+}
+
+// backingFs 返回 dir 所在文件系统的名字
+func backingFs(dir string) (string, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	if err != nil {
+		return "", err
+	}
+	return fsName(int64(fs.Type)), nil
+}
+
+// checkLowerFs 检查 layer 目录所在的文件系统能否作为 overlay 的 lower 层
+func checkLowerFs(lowerDirs []string) error {
+	for _, dir := range lowerDirs {
+		name, err := backingFs(dir)
+		if err != nil {
+			return errors.Wrapf(err, "statfs lowerdir %s 时出错", dir)
+		}
+		if unsupportedLowerFs[name] {
+			return errors.Errorf("lowerdir %s 位于 %s 文件系统上，overlay 不支持，请把 layers 目录放在 ext4、xfs 等本地文件系统上", dir, name)
+		}
+	}
+	return nil
+}
+
+// overlayFsSummary 列出 upperdir 和各 lowerdir 所在的文件系统，用于解释 overlay 挂载失败
+func overlayFsSummary(lowerDirs []string, upperDir string) string {
+	lower := map[string]bool{}
+	names := []string{}
+	for _, dir := range lowerDirs {
+		name, err := backingFs(dir)
+		if err != nil {
+			name = "unknown"
+		}
+		if !lower[name] {
+			lower[name] = true
+			names = append(names, name)
+		}
+	}
+	upper, err := backingFs(upperDir)
+	if err != nil {
+		upper = "unknown"
+	}
+	return fmt.Sprintf("upperdir 位于 %s，lowerdir 位于 %s，详细原因见 dmesg", upper, strings.Join(names, "、"))
+}
@@ -0,0 +1,83 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFsName(t *testing.T) {
+	tests := []struct {
+		fsType int64
+		name   string
+	}{
+		{0x794c7630, "overlay"},
+		{0x01021994, "tmpfs"},
+		{0xef53, "ext2/ext3/ext4"},
+		{0x58465342, "xfs"},
+		{0x6969, "nfs"},
+		// 未知的类型用十六进制表示
+		{0x12345678, "0x12345678"},
+	}
+	for _, test := range tests {
+		if got := fsName(test.fsType); got != test.name {
+			t.Errorf("fsName(%#x) = %s, want %s", test.fsType, got, test.name)
+		}
+	}
+	for _, name := range []string{"ext2/ext3/ext4", "xfs", "btrfs", "tmpfs", "zfs"} {
+		if unsupportedUpperFs[name] || unsupportedLowerFs[name] {
+			t.Errorf("%s should be usable for overlay", name)
+		}
+	}
+	for _, name := range []string{"overlay", "nfs", "fuse", "squashfs", "ramfs"} {
+		if !unsupportedUpperFs[name] {
+			t.Errorf("%s should not be usable as an upperdir", name)
+		}
+	}
+}
+
+func TestBackingFs(t *testing.T) {
+	dir := t.TempDir()
+	mountTestTmpfs(t, dir, 0)
+	if name, err := backingFs(dir); err != nil || name != "tmpfs" {
+		t.Errorf("backingFs(tmpfs) = %s, %v", name, err)
+	}
+	if err := checkLowerFs([]string{dir}); err != nil {
+		t.Errorf("checkLowerFs(tmpfs) = %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if err := checkLowerFs([]string{dir, missing}); err == nil {
+		t.Error("checkLowerFs accepted a missing lowerdir")
+	}
+	// 挂载失败时列出各层所在的文件系统，重复的只列一次
+	summary := overlayFsSummary([]string{dir, dir, missing}, missing)
+	if want := "upperdir 位于 unknown，lowerdir 位于 tmpfs、unknown"; !strings.HasPrefix(summary, want) {
+		t.Errorf("overlayFsSummary = %q, want %q...", summary, want)
+	}
+}
+
+func TestCheckUpperDirRejectsRamfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting ramfs needs root")
+	}
+	dir := t.TempDir()
+	err := syscall.Mount("ramfs", dir, "ramfs", 0, "")
+	if err != nil {
+		t.Skipf("mount ramfs: %v", err)
+	}
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+	upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+	for _, d := range []string{upper, work} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ramfs 不支持 overlay 需要的 xattr
+	err = checkUpperDir(upper, work)
+	if err == nil || !strings.Contains(err.Error(), "ramfs") {
+		t.Errorf("checkUpperDir on ramfs = %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,86 @@
+package container
+
+import (
+	"log/slog"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const hardenAll = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+// hardenedFlags 是各类挂载默认附加的安全标志，和 Docker 的默认值一致
+// /tmp 保留 exec，很多程序会在 /tmp 中生成并执行脚本
+var hardenedFlags = map[string]uintptr{
+	"proc":   hardenAll,
+	"sysfs":  hardenAll,
+	"devpts": syscall.MS_NOSUID | syscall.MS_NOEXEC,
+	"shm":    hardenAll,
+	"run":    hardenAll,
+	"tmp":    syscall.MS_NOSUID | syscall.MS_NODEV,
+	"volume": syscall.MS_NOSUID | syscall.MS_NODEV,
+}
+
+// mountFlags 返回 kind 类挂载的安全标志，--privileged 时不附加任何标志
+func mountFlags(kind string, privileged bool) uintptr {
+	if privileged {
+		return 0
+	}
+	return hardenedFlags[kind]
+}
+
+// flagOptions 把 flags 中的只读和安全标志与 data 拼成 mount -o 的选项，用于日志
+func flagOptions(flags uintptr, data string) string {
+	options := []string{}
+	for _, flag := range []struct {
+		bit  uintptr
+		name string
+	}{
+		{syscall.MS_RDONLY, "ro"},
+		{syscall.MS_NOSUID, "nosuid"},
+		{syscall.MS_NODEV, "nodev"},
+		{syscall.MS_NOEXEC, "noexec"},
+	} {
+		if flags&flag.bit != 0 {
+			options = append(options, flag.name)
+		}
+	}
+	if data != "" {
+		options = append(options, data)
+	}
+	return strings.Join(options, ",")
+}
+
+// fsCmd 生成与 mount(2) 调用等价的 mount 命令，用于日志
+func fsCmd(fstype, source, target, options string) string {
+	if options == "" {
+		return "mount -t " + fstype + " " + source + " " + target
+	}
+	return "mount -t " + fstype + " -o " + options + " " + source + " " + target
+}
+
+// stRelatime 是 statfs 返回的 ST_RELATIME，和 MS_RELATIME 的值不同
+const stRelatime = 0x1000
+
+// hardenBind 给 target 上的 bind mount 加上 flags。bind mount 时传入的标志不生效，需要再 remount 一次，
+// remount 时保留 target 已有的标志，user namespace 中从宿主机继承的标志被锁定，清除会返回 EPERM
+func hardenBind(target string, flags uintptr, dryRun bool) error {
+	if flags == 0 {
+		return nil
+	}
+	slog.Info("hardening bind mount", "cmd", "mount -o remount,bind,"+flagOptions(flags, "")+" "+target)
+	if dryRun {
+		return nil
+	}
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(target, &stat)
+	if err != nil {
+		return errors.Wrapf(err, "statfs %s", target)
+	}
+	keep := uintptr(stat.Flags) & (syscall.MS_RDONLY | hardenAll | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if stat.Flags&stRelatime != 0 {
+		keep |= syscall.MS_RELATIME
+	}
+	return mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|keep|flags, "", dryRun)
+}
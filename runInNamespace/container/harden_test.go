@@ -0,0 +1,93 @@
+package container
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMountFlags(t *testing.T) {
+	tests := []struct {
+		kind  string
+		flags uintptr
+	}{
+		{"proc", hardenAll},
+		{"sysfs", hardenAll},
+		// devpts 上的设备节点需要 dev
+		{"devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC},
+		{"shm", hardenAll},
+		{"run", hardenAll},
+		// /tmp 保留 exec
+		{"tmp", syscall.MS_NOSUID | syscall.MS_NODEV},
+		{"volume", syscall.MS_NOSUID | syscall.MS_NODEV},
+		{"unknown", 0},
+	}
+	for _, test := range tests {
+		if got := mountFlags(test.kind, false); got != test.flags {
+			t.Errorf("mountFlags(%s) = %#x, want %#x", test.kind, got, test.flags)
+		}
+		if got := mountFlags(test.kind, true); got != 0 {
+			t.Errorf("privileged mountFlags(%s) = %#x, want 0", test.kind, got)
+		}
+	}
+}
+
+// mountTestTmpfs 在 dir 上挂载一个带 flags 的 tmpfs，测试结束时卸载
+func mountTestTmpfs(t *testing.T, dir string, flags uintptr) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("mounting tmpfs needs root")
+	}
+	err := syscall.Mount("tmpfs", dir, "tmpfs", flags, "")
+	if err != nil {
+		t.Skipf("mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() { syscall.Unmount(dir, syscall.MNT_DETACH) })
+}
+
+func TestHardenBindKeepsFlags(t *testing.T) {
+	tests := []struct {
+		mounted, harden, want uintptr
+	}{
+		// 已有的只读、安全和 atime 标志保留下来，清除会在 user namespace 中返回 EPERM
+		{syscall.MS_RDONLY | syscall.MS_NOEXEC | syscall.MS_NOATIME, syscall.MS_NOSUID | syscall.MS_NODEV,
+			syscall.MS_RDONLY | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NOSUID | syscall.MS_NODEV},
+		// statfs 的 ST_RELATIME 换成 MS_RELATIME
+		{syscall.MS_RELATIME | syscall.MS_NODIRATIME, syscall.MS_RDONLY,
+			syscall.MS_RELATIME | syscall.MS_NODIRATIME | syscall.MS_RDONLY},
+		{syscall.MS_STRICTATIME, hardenAll, hardenAll},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		mountTestTmpfs(t, dir, test.mounted)
+		calls := recordMounts(t, nil)
+		err := hardenBind(dir, test.harden, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := mountCall{target: dir, flags: syscall.MS_BIND | syscall.MS_REMOUNT | test.want}
+		if len(*calls) != 1 || (*calls)[0] != want {
+			t.Errorf("mounted %#x, harden %#x: mounts = %+v, want %+v", test.mounted, test.harden, *calls, want)
+		}
+	}
+}
+
+func TestHardenBindSkips(t *testing.T) {
+	calls := recordMounts(t, nil)
+	// 没有要加的标志时不 remount，dry run 时只打印
+	for _, test := range []struct {
+		flags  uintptr
+		dryRun bool
+	}{{0, false}, {hardenAll, true}} {
+		err := hardenBind(t.TempDir(), test.flags, test.dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*calls) != 0 {
+		t.Errorf("mounts = %+v, want none", *calls)
+	}
+	if err := hardenBind("/nonexistent", hardenAll, false); err == nil {
+		t.Error("hardenBind on a missing target succeeded")
+	}
+}
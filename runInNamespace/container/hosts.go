@@ -0,0 +1,201 @@
+package container
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// 启动时写入 rootfs 的文件，相对 rootfs 的路径，commit 时跳过
+const (
+	hostsFile    = "etc/hosts"
+	resolvFile   = "etc/resolv.conf"
+	hostnameFile = "etc/hostname"
+	nsswitchFile = "etc/nsswitch.conf"
+)
+
+// HostEntries 是可重复的 --add-host name:ip 参数
+type HostEntries []string
+
+func (h *HostEntries) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *HostEntries) Set(value string) error {
+	// ip 可能是包含冒号的 IPv6 地址，只按第一个冒号切分
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+		return errors.Errorf("无效的 --add-host 参数 %s，格式应为 name:ip", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// hostsContent 生成容器的 /etc/hosts 内容
+func hostsContent(hostname string, addHosts []string) string {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	if hostname != "" {
+		b.WriteString("127.0.1.1\t" + hostname + "\n")
+	}
+	for _, entry := range addHosts {
+		parts := strings.SplitN(entry, ":", 2)
+		b.WriteString(parts[1] + "\t" + parts[0] + "\n")
+	}
+	return b.String()
+}
+
+// setHostname 在新的 uts namespace 中设置主机名，并写入容器的 /etc/hostname，
+// 读取该文件而不调用 gethostname 的程序也能得到同一个名字
+func setHostname(targetDir, hostname string, dryRun bool) error {
+	if hostname == "" {
+		return nil
+	}
+	slog.Info("setting hostname", "cmd", "hostname "+hostname)
+	if !dryRun {
+		err := syscall.Sethostname([]byte(hostname))
+		if err != nil {
+			return err
+		}
+	}
+	return writeHostname(targetDir, hostname, dryRun)
+}
+
+// writeHostname 写入容器的 /etc/hostname，镜像自带的文件总是被覆盖
+func writeHostname(targetDir, hostname string, dryRun bool) error {
+	hostnamePath := filepath.Join(targetDir, hostnameFile)
+	slog.Info("writing hostname file", "path", hostnamePath)
+	if dryRun {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(hostnamePath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "创建 /etc 目录时出错")
+	}
+	// 和 /etc/hosts 一样，镜像中的文件可能是指向容器外路径的符号链接，先删掉再写
+	err = os.Remove(hostnamePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "删除镜像自带的 /etc/hostname 时出错")
+	}
+	return os.WriteFile(hostnamePath, []byte(hostname+"\n"), 0644)
+}
+
+// writeHosts 写入容器的 /etc/hosts，镜像自带的文件只在 overwrite 时覆盖
+// 写入发生在 overlay 的 upper 层，不会修改 layer 目录
+func writeHosts(targetDir, hostname string, addHosts []string, overwrite, dryRun bool) error {
+	hostsPath := filepath.Join(targetDir, hostsFile)
+	if !overwrite {
+		if _, err := os.Lstat(hostsPath); err == nil {
+			slog.Info("keeping image hosts file", "path", hostsPath)
+			return nil
+		}
+	}
+	if hostname == "" && !dryRun {
+		// 没有指定 --hostname 时容器沿用宿主机的主机名
+		name, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "获取主机名时出错")
+		}
+		hostname = name
+	}
+	slog.Info("writing hosts file", "path", hostsPath)
+	if dryRun {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(hostsPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "创建 /etc 目录时出错")
+	}
+	// 镜像中的 /etc/hosts 可能是指向容器外路径的符号链接，先删掉再写
+	err = os.Remove(hostsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "删除镜像自带的 /etc/hosts 时出错")
+	}
+	return os.WriteFile(hostsPath, []byte(hostsContent(hostname, addHosts)), 0644)
+}
+
+// setupResolvConf 把宿主机的 /etc/resolv.conf 提供给容器
+// copy 写入一份快照，bind 只读 bind mount 宿主机文件，容器内能看到 DNS 配置的变化
+func setupResolvConf(targetDir, mode string, dryRun bool) error {
+	// systemd-resolved 下 /etc/resolv.conf 是符号链接，bind mount 时需要实际文件
+	hostPath, err := filepath.EvalSymlinks("/etc/resolv.conf")
+	if err != nil {
+		return errors.Wrap(err, "解析宿主机 /etc/resolv.conf 时出错")
+	}
+	resolvPath := filepath.Join(targetDir, resolvFile)
+	switch mode {
+	case "copy":
+		slog.Info("copying resolv.conf", "cmd", "cp "+hostPath+" "+resolvPath)
+	case "bind":
+		slog.Info("mounting resolv.conf", "cmd", "mount --bind -o ro "+hostPath+" "+resolvPath)
+	default:
+		return errors.Errorf("未知的 dns 模式: %s", mode)
+	}
+	if dryRun {
+		return nil
+	}
+	data, err := os.ReadFile(hostPath)
+	if err != nil {
+		return errors.Wrap(err, "读取宿主机 /etc/resolv.conf 时出错")
+	}
+	err = os.MkdirAll(filepath.Dir(resolvPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "创建 /etc 目录时出错")
+	}
+	// 镜像中的 resolv.conf 也可能是符号链接，换成普通文件，bind mount 才不会跟随到容器外
+	err = os.Remove(resolvPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "删除镜像自带的 /etc/resolv.conf 时出错")
+	}
+	if mode == "copy" {
+		return os.WriteFile(resolvPath, data, 0644)
+	}
+	err = os.WriteFile(resolvPath, nil, 0644)
+	if err != nil {
+		return errors.Wrap(err, "创建 resolv.conf 挂载点时出错")
+	}
+	err = mount(hostPath, resolvPath, "", syscall.MS_BIND, "", dryRun)
+	if err != nil {
+		return err
+	}
+	// bind mount 时 MS_RDONLY 不生效，需要再 remount 一次
+	return mount("", resolvPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "", dryRun)
+}
+
+// nsswitchContent 是镜像没有 /etc/nsswitch.conf 时写入的默认配置，
+// 先查 /etc/hosts 再查 resolv.conf 中的 DNS
+const nsswitchContent = `passwd:         files
+group:          files
+shadow:         files
+hosts:          files dns
+networks:       files
+protocols:      files
+services:       files
+ethers:         files
+rpc:            files
+`
+
+// writeNsswitch 在镜像没有 /etc/nsswitch.conf 时写入默认配置，
+// 不同 libc 在缺少该文件时的解析顺序不一样
+func writeNsswitch(targetDir string, dryRun bool) error {
+	nsswitchPath := filepath.Join(targetDir, nsswitchFile)
+	if _, err := os.Lstat(nsswitchPath); err == nil {
+		slog.Info("keeping image nsswitch.conf", "path", nsswitchPath)
+		return nil
+	}
+	slog.Info("writing nsswitch.conf", "path", nsswitchPath)
+	if dryRun {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(nsswitchPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "创建 /etc 目录时出错")
+	}
+	return os.WriteFile(nsswitchPath, []byte(nsswitchContent), 0644)
+}
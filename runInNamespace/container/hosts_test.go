@@ -0,0 +1,263 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteHostname(t *testing.T) {
+	rootfs := t.TempDir()
+	err := writeHostname(rootfs, "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(rootfs, hostnameFile)
+	if got := readFile(t, path); got != "web\n" {
+		t.Errorf("/etc/hostname = %q, want web", got)
+	}
+	// 镜像自带的文件总是被覆盖
+	err = writeHostname(rootfs, "db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "db\n" {
+		t.Errorf("/etc/hostname = %q, want db", got)
+	}
+}
+
+func TestWriteHostnameReplacesSymlink(t *testing.T) {
+	victim := filepath.Join(t.TempDir(), "hostname")
+	err := os.WriteFile(victim, []byte("host\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := t.TempDir()
+	err = os.Mkdir(filepath.Join(rootfs, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(victim, filepath.Join(rootfs, hostnameFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeHostname(rootfs, "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, victim); got != "host\n" {
+		t.Errorf("the symlink target was written: %q", got)
+	}
+}
+
+func TestWriteHostnameDryRun(t *testing.T) {
+	rootfs := t.TempDir()
+	err := writeHostname(rootfs, "web", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, hostnameFile)); !os.IsNotExist(err) {
+		t.Error("a dry run wrote /etc/hostname")
+	}
+}
+
+func TestCommitSkipsHostname(t *testing.T) {
+	upper := t.TempDir()
+	err := writeHostname(upper, "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := upperTarNames(t, upper); len(names) != 1 || names[0] != "etc/" {
+		t.Errorf("writeUpperTar = %v, want only etc/", names)
+	}
+}
+
+func TestWriteNsswitch(t *testing.T) {
+	rootfs := t.TempDir()
+	err := writeNsswitch(rootfs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(rootfs, nsswitchFile)
+	if got := readFile(t, path); got != nsswitchContent {
+		t.Errorf("/etc/nsswitch.conf = %q", got)
+	}
+	if !strings.Contains(nsswitchContent, "hosts:          files dns\n") {
+		t.Error("hosts should be looked up in /etc/hosts before DNS")
+	}
+}
+
+func TestWriteNsswitchKeepsImageFile(t *testing.T) {
+	rootfs := t.TempDir()
+	err := os.Mkdir(filepath.Join(rootfs, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(rootfs, nsswitchFile)
+	err = os.WriteFile(path, []byte("hosts: dns\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeNsswitch(rootfs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "hosts: dns\n" {
+		t.Errorf("the image nsswitch.conf was replaced with %q", got)
+	}
+}
+
+func TestWriteNsswitchDryRun(t *testing.T) {
+	rootfs := t.TempDir()
+	err := writeNsswitch(rootfs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, nsswitchFile)); !os.IsNotExist(err) {
+		t.Error("a dry run wrote /etc/nsswitch.conf")
+	}
+}
+
+func TestHostEntriesSet(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"db:10.0.0.2", true},
+		{"v6:fd00::2", true},
+		{"lo6:::1", true},
+		{"db", false},
+		{":10.0.0.2", false},
+		{"db:", false},
+		{"db:not-an-ip", false},
+		{"10.0.0.2:db", false},
+	}
+	for _, test := range tests {
+		var entries HostEntries
+		err := entries.Set(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("Set(%q) = %v, want ok %v", test.value, err, test.ok)
+			continue
+		}
+		if test.ok && (len(entries) != 1 || entries[0] != test.value) {
+			t.Errorf("Set(%q) stored %v", test.value, entries)
+		}
+	}
+	var entries HostEntries
+	for _, value := range []string{"a:10.0.0.1", "b:fd00::1"} {
+		err := entries.Set(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := entries.String(); got != "a:10.0.0.1,b:fd00::1" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestHostsContent(t *testing.T) {
+	tests := []struct {
+		hostname string
+		addHosts []string
+		want     string
+	}{
+		{"", nil, "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+		{"web", nil, "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.1.1\tweb\n"},
+		{"web", []string{"db:10.0.0.2", "v6:fd00::2", "lo6:::1"},
+			"127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.1.1\tweb\n" +
+				"10.0.0.2\tdb\nfd00::2\tv6\n::1\tlo6\n"},
+	}
+	for _, test := range tests {
+		if got := hostsContent(test.hostname, test.addHosts); got != test.want {
+			t.Errorf("hostsContent(%q, %v) = %q, want %q", test.hostname, test.addHosts, got, test.want)
+		}
+	}
+}
+
+func TestSetupResolvConf(t *testing.T) {
+	hostPath, err := filepath.EvalSymlinks("/etc/resolv.conf")
+	if err != nil {
+		t.Skipf("宿主机没有 /etc/resolv.conf: %v", err)
+	}
+	hostData := readFile(t, hostPath)
+
+	if err := setupResolvConf(t.TempDir(), "host", false); err == nil || !strings.Contains(err.Error(), "未知的 dns 模式") {
+		t.Errorf("setupResolvConf accepted the mode host: %v", err)
+	}
+	spec := DefaultSpec()
+	spec.DNSMode = "host"
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted the dns mode host")
+	}
+
+	// copy 把镜像中的符号链接换成宿主机文件的快照，不写符号链接的目标
+	rootfs := t.TempDir()
+	victim := filepath.Join(t.TempDir(), "resolv.conf")
+	err = os.WriteFile(victim, []byte("nameserver 10.0.0.1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(rootfs, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(victim, filepath.Join(rootfs, resolvFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := recordMounts(t, nil)
+	err = setupResolvConf(rootfs, "copy", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(rootfs, resolvFile)); got != hostData {
+		t.Errorf("copied resolv.conf = %q, want %q", got, hostData)
+	}
+	if got := readFile(t, victim); got != "nameserver 10.0.0.1\n" {
+		t.Errorf("the symlink target was written: %q", got)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("copy mounted %+v", *calls)
+	}
+
+	// bind 创建空的挂载点，bind mount 后再 remount 为只读
+	rootfs = t.TempDir()
+	err = setupResolvConf(rootfs, "bind", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(rootfs, resolvFile)
+	if got := readFile(t, target); got != "" {
+		t.Errorf("the bind mountpoint has %q", got)
+	}
+	want := []mountCall{
+		{source: hostPath, target: target, flags: syscall.MS_BIND},
+		{target: target, flags: syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("bind mounts = %+v, want %+v", *calls, want)
+	}
+
+	rootfs = t.TempDir()
+	for _, mode := range []string{"copy", "bind"} {
+		err = setupResolvConf(rootfs, mode, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, resolvFile)); !os.IsNotExist(err) {
+		t.Error("a dry run wrote /etc/resolv.conf")
+	}
+}
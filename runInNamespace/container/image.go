@@ -0,0 +1,171 @@
+package container
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Config 是从配置文件读取的运行时信息
+type Config struct {
+	Config SubConfigStruct `json:"config"`
+}
+
+// SubConfigStruct 对应镜像 config.json 中嵌套的 config 对象
+type SubConfigStruct struct {
+	Env          []string            `json:"Env"`
+	Cmd          []string            `json:"Cmd"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	WorkingDir   string              `json:"WorkingDir"`
+	User         string              `json:"User"`
+	Volumes      map[string]struct{} `json:"Volumes"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+}
+
+// RuntimeConfig 是 childProcess 使用的镜像运行配置，config.json 只解析一次
+type RuntimeConfig struct {
+	Env          []string `json:"env"`
+	Cmd          []string `json:"cmd"`
+	Entrypoint   []string `json:"entrypoint"`
+	WorkingDir   string   `json:"workingDir"`
+	User         string   `json:"user"`
+	Volumes      []string `json:"volumes"`
+	ExposedPorts []string `json:"exposedPorts"`
+}
+
+// Manifest 是从配置文件读取的 Layers 信息
+type Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Layers        []Layer
+	// Manifests 只在 manifest list/index 中出现
+	Manifests []json.RawMessage `json:"manifests"`
+}
+
+const (
+	dockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociManifestType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerListType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociIndexType       = "application/vnd.oci.image.index.v1+json"
+	manifestListAdvice = "manifest list/index 包含多个平台的镜像，请用 docker2fs convert --platform os/arch 重新转换"
+)
+
+// manifestError 表示 manifest 完整但不是支持的镜像 manifest，lazy 模式下不用再等待
+type manifestError struct {
+	error
+}
+
+// validate 检查 manifest 是单个平台的 schema 2 镜像 manifest
+func (manifest *Manifest) validate() error {
+	err := manifest.check()
+	if err != nil {
+		return &manifestError{err}
+	}
+	return nil
+}
+
+// check 返回 manifest 不被支持的原因
+func (manifest *Manifest) check() error {
+	switch manifest.MediaType {
+	case dockerListType, ociIndexType:
+		return errors.Errorf("manifest 的 mediaType 是 %s，%s", manifest.MediaType, manifestListAdvice)
+	case dockerManifestType, ociManifestType:
+	case "":
+		// OCI manifest 可以省略 mediaType，此时用 manifests 字段识别 index
+		if manifest.Manifests != nil {
+			return errors.New("manifest 是 OCI index，" + manifestListAdvice)
+		}
+	default:
+		return errors.Errorf("不支持的 manifest mediaType %s", manifest.MediaType)
+	}
+	if manifest.SchemaVersion != 2 {
+		return errors.Errorf("不支持的 manifest schemaVersion %d，只支持 2", manifest.SchemaVersion)
+	}
+	return nil
+}
+
+// Layer 代表一个 Docker 镜像层
+type Layer struct {
+	Digest    string
+	MediaType string
+	Size      uint64
+}
+
+// loadConfig 加载 config.json 文件，路径为 "-" 时从标准输入读取
+func loadConfig(configPath string) (*RuntimeConfig, error) {
+	file, err := openInput(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	err = json.NewDecoder(file).Decode(&config)
+	// 空文件当作没有任何运行配置
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	sub := config.Config
+	return &RuntimeConfig{
+		Env:          sub.Env,
+		Cmd:          sub.Cmd,
+		Entrypoint:   sub.Entrypoint,
+		WorkingDir:   sub.WorkingDir,
+		User:         sub.User,
+		Volumes:      sortedKeys(sub.Volumes),
+		ExposedPorts: sortedKeys(sub.ExposedPorts),
+	}, nil
+}
+
+// loadManifest 加载 manifest.json 文件，路径为 "-" 时从标准输入读取
+func loadManifest(manifestPath string) ([]Layer, error) {
+	file, err := openInput(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var manifest Manifest
+	err = json.NewDecoder(file).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	err = manifest.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.Layers, nil
+}
+
+// commandArgv 返回容器命令的 argv
+// 命令行给出的命令替换镜像的 Cmd，Entrypoint 保留在前面，和 docker run 一致。
+// config.json 中的 Cmd 总是 exec 形式，命令行只给出一个参数且指定了 --shell-form 时
+// 才把它当作 shell 命令交给 /bin/sh -c；都为空时运行 /bin/sh
+func commandArgv(image *RuntimeConfig, args []string, shellForm bool) []string {
+	cmd := image.Cmd
+	if len(args) > 0 {
+		cmd = args
+		if shellForm && len(args) == 1 {
+			cmd = []string{"/bin/sh", "-c", args[0]}
+		}
+	}
+	argv := append(append([]string{}, image.Entrypoint...), cmd...)
+	if len(argv) == 0 {
+		return []string{"/bin/sh"}
+	}
+	return argv
+}
+
+// commandDir 返回容器命令的工作目录，--entrypoint-cwd 优先于镜像的 WorkingDir
+func commandDir(image *RuntimeConfig, entrypointCwd string) string {
+	if entrypointCwd != "" {
+		return entrypointCwd
+	}
+	if image.WorkingDir != "" {
+		return image.WorkingDir
+	}
+	return "/"
+}
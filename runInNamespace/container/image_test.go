@@ -0,0 +1,192 @@
+package container
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigNested(t *testing.T) {
+	// 运行配置在嵌套的 config 对象中，顶层同名字段不是运行配置
+	path := writeConfig(t, `{
+		"architecture": "amd64",
+		"Env": ["TOP_LEVEL=1"],
+		"Cmd": ["/top-level"],
+		"config": {
+			"Env": ["PATH=/usr/bin", "LANG=C.UTF-8"],
+			"Cmd": ["-g", "daemon off;"],
+			"Entrypoint": ["/docker-entrypoint.sh", "nginx"],
+			"WorkingDir": "/srv",
+			"User": "nginx:nginx",
+			"Volumes": {"/var/log": {}, "/data": {}},
+			"ExposedPorts": {"80/tcp": {}, "443/tcp": {}}
+		},
+		"rootfs": {"type": "layers", "diff_ids": []}
+	}`)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RuntimeConfig{
+		Env:          []string{"PATH=/usr/bin", "LANG=C.UTF-8"},
+		Cmd:          []string{"-g", "daemon off;"},
+		Entrypoint:   []string{"/docker-entrypoint.sh", "nginx"},
+		WorkingDir:   "/srv",
+		User:         "nginx:nginx",
+		Volumes:      []string{"/data", "/var/log"},
+		ExposedPorts: []string{"443/tcp", "80/tcp"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("loadConfig = %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadConfigEmpty(t *testing.T) {
+	for _, data := range []string{"", "{}", `{"config": null}`} {
+		config, err := loadConfig(writeConfig(t, data))
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if len(config.Env)+len(config.Cmd)+len(config.Entrypoint)+len(config.Volumes)+len(config.ExposedPorts) != 0 ||
+			config.WorkingDir != "" || config.User != "" {
+			t.Errorf("%q: loadConfig = %+v, want an empty config", data, config)
+		}
+	}
+	if _, err := loadConfig(writeConfig(t, `{"config": {"Cmd": "/bin/sh"}}`)); err == nil {
+		t.Error("loadConfig accepted a string Cmd")
+	}
+}
+
+func TestCommandDir(t *testing.T) {
+	tests := []struct {
+		workingDir, entrypointCwd, want string
+	}{
+		{"", "", "/"},
+		{"/srv", "", "/srv"},
+		{"", "/tmp", "/tmp"},
+		{"/srv", "/tmp", "/tmp"},
+	}
+	for _, test := range tests {
+		image := &RuntimeConfig{WorkingDir: test.workingDir}
+		if got := commandDir(image, test.entrypointCwd); got != test.want {
+			t.Errorf("commandDir(%q, %q) = %q, want %q", test.workingDir, test.entrypointCwd, got, test.want)
+		}
+	}
+}
+
+func TestEntrypointCwdDump(t *testing.T) {
+	spec := testImage(t, map[string]any{"WorkingDir": "/srv"})
+	spec.EntrypointCwd = "/tmp"
+	dump, err := Dump(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只覆盖容器命令的工作目录，镜像的 WorkingDir 保持不变
+	if dump.Cwd != "/tmp" || dump.Image.WorkingDir != "/srv" {
+		t.Errorf("cwd %q, image WorkingDir %q, want /tmp and /srv", dump.Cwd, dump.Image.WorkingDir)
+	}
+	spec.EntrypointCwd = ""
+	dump, err = Dump(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.Cwd != "/srv" {
+		t.Errorf("cwd %q without --entrypoint-cwd, want /srv", dump.Cwd)
+	}
+}
+
+func TestCommandArgv(t *testing.T) {
+	tests := []struct {
+		entrypoint, cmd, args []string
+		shellForm             bool
+		want                  []string
+	}{
+		{nil, nil, nil, false, []string{"/bin/sh"}},
+		{nil, []string{"nginx", "-g", "daemon off;"}, nil, false, []string{"nginx", "-g", "daemon off;"}},
+		// 命令行给出的命令替换 Cmd，Entrypoint 保留在前面
+		{[]string{"/entrypoint.sh"}, []string{"nginx"}, nil, false, []string{"/entrypoint.sh", "nginx"}},
+		{[]string{"/entrypoint.sh"}, []string{"nginx"}, []string{"bash", "-l"}, false, []string{"/entrypoint.sh", "bash", "-l"}},
+		{[]string{"/entrypoint.sh"}, nil, nil, false, []string{"/entrypoint.sh"}},
+		// 没有 --shell-form 时单个参数也按 exec 形式执行
+		{nil, nil, []string{"echo $HOME"}, false, []string{"echo $HOME"}},
+		{nil, []string{"nginx"}, []string{"echo $HOME"}, true, []string{"/bin/sh", "-c", "echo $HOME"}},
+		{[]string{"/entrypoint.sh"}, nil, []string{"echo $HOME"}, true, []string{"/entrypoint.sh", "/bin/sh", "-c", "echo $HOME"}},
+		// --shell-form 只对单个参数生效
+		{nil, nil, []string{"echo", "$HOME"}, true, []string{"echo", "$HOME"}},
+		// config.json 中的 Cmd 总是 exec 形式
+		{nil, []string{"echo $HOME"}, nil, true, []string{"echo $HOME"}},
+	}
+	for _, test := range tests {
+		image := &RuntimeConfig{Entrypoint: test.entrypoint, Cmd: test.cmd}
+		got := commandArgv(image, test.args, test.shellForm)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("commandArgv(%q, %q, %q, %v) = %q, want %q",
+				test.entrypoint, test.cmd, test.args, test.shellForm, got, test.want)
+		}
+	}
+	// 拼接 argv 不能改写镜像的 Entrypoint
+	image := &RuntimeConfig{Entrypoint: make([]string, 1, 4)}
+	image.Entrypoint[0] = "/entrypoint.sh"
+	commandArgv(image, []string{"a"}, false)
+	if got := image.Entrypoint[:2]; got[1] != "" {
+		t.Errorf("commandArgv wrote into the Entrypoint backing array: %q", got)
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	tests := []struct {
+		manifest string
+		err      string
+	}{
+		{`{"schemaVersion": 2, "mediaType": "` + dockerManifestType + `", "layers": []}`, ""},
+		{`{"schemaVersion": 2, "mediaType": "` + ociManifestType + `", "layers": []}`, ""},
+		// OCI manifest 可以省略 mediaType
+		{`{"schemaVersion": 2, "layers": []}`, ""},
+		{`{"schemaVersion": 2, "mediaType": "` + dockerListType + `", "manifests": []}`, "docker2fs convert --platform"},
+		{`{"schemaVersion": 2, "mediaType": "` + ociIndexType + `", "manifests": []}`, "docker2fs convert --platform"},
+		{`{"schemaVersion": 2, "manifests": []}`, "OCI index"},
+		{`{"schemaVersion": 1, "mediaType": "application/vnd.docker.distribution.manifest.v1+prettyjws"}`, "不支持的 manifest mediaType"},
+		{`{"schemaVersion": 1, "mediaType": "` + dockerManifestType + `"}`, "schemaVersion 1"},
+		{`{"mediaType": "` + ociManifestType + `"}`, "schemaVersion 0"},
+	}
+	for _, test := range tests {
+		var manifest Manifest
+		err := json.Unmarshal([]byte(test.manifest), &manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manifest.check()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("check(%s) = %v", test.manifest, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("check(%s) = %v, want an error with %q", test.manifest, err, test.err)
+		}
+		// loadManifest 返回 manifestError，lazy 模式下不再等待
+		path := filepath.Join(t.TempDir(), "manifest.json")
+		err = os.WriteFile(path, []byte(test.manifest), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadManifest(path)
+		if _, ok := err.(*manifestError); !ok {
+			t.Errorf("loadManifest(%s) = %v, want a manifestError", test.manifest, err)
+		}
+	}
+}
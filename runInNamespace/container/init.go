@@ -0,0 +1,45 @@
+package container
+
+import (
+	"fmt"
+	"log/slog"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ExitStatusError 是 --init 回收到的容器命令的非零退出状态
+// --init 时 1 号进程自己调用 wait4，不经过 exec.Cmd.Wait，所以没有 *exec.ExitError
+type ExitStatusError struct {
+	Status syscall.WaitStatus
+}
+
+func (e *ExitStatusError) Error() string {
+	if e.Status.Signaled() {
+		return fmt.Sprintf("signal: %s", e.Status.Signal())
+	}
+	return fmt.Sprintf("exit status %d", e.Status.ExitStatus())
+}
+
+// reapUntil 作为容器的 1 号进程回收所有退出的子进程，包括容器命令留下的孤儿进程，
+// 直到 pid 退出，返回它的退出状态
+func reapUntil(pid int) error {
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "回收子进程时出错")
+		}
+		if wpid != pid {
+			slog.Debug("reaped orphan", "pid", wpid, "status", int(status))
+			continue
+		}
+		if status.Exited() && status.ExitStatus() == 0 {
+			return nil
+		}
+		return &ExitStatusError{Status: status}
+	}
+}
@@ -0,0 +1,126 @@
+package container
+
+import (
+	"bufio"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReapUntilReapsOtherChildren(t *testing.T) {
+	orphan := exec.Command("/bin/sh", "-c", "exit 0")
+	err := orphan.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := exec.Command("/bin/sh", "-c", "sleep 0.1; exit 3")
+	err = command.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reapUntil(command.Process.Pid)
+	code, ok := ExitCode(err)
+	if !ok || code != 3 {
+		t.Fatalf("reapUntil = %v, want exit status 3", err)
+	}
+	// 先退出的子进程也被回收了，不会留下僵尸进程
+	var status syscall.WaitStatus
+	if pid, err := syscall.Wait4(orphan.Process.Pid, &status, syscall.WNOHANG, nil); err != syscall.ECHILD {
+		t.Errorf("the other child was not reaped: wait4 = %d, %v", pid, err)
+	}
+}
+
+func TestReapUntilSignaled(t *testing.T) {
+	command := exec.Command("/bin/sh", "-c", "kill -TERM $$")
+	err := command.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reapUntil(command.Process.Pid)
+	if code, ok := ExitCode(err); !ok || code != 128+int(syscall.SIGTERM) {
+		t.Errorf("reapUntil = %v, want 128+SIGTERM", err)
+	}
+	command = exec.Command("/bin/true")
+	err = command.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reapUntil(command.Process.Pid); err != nil {
+		t.Errorf("reapUntil = %v, want nil for exit status 0", err)
+	}
+}
+
+// startTrap 启动一个收到 sig 时以 code 退出的 shell，等它装好 trap 后返回
+func startTrap(t *testing.T, sig string, code int) *exec.Cmd {
+	t.Helper()
+	command := exec.Command("/bin/sh", "-c", "trap 'exit "+strconv.Itoa(code)+"' "+sig+"; echo ready; while :; do sleep 0.01; done")
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = command.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		command.Process.Kill()
+		t.Fatalf("shell did not start: %q, %v", line, err)
+	}
+	return command
+}
+
+func TestInitForwardsSignals(t *testing.T) {
+	command := startTrap(t, "USR1", 7)
+	stop := forwardSignals(command.Process)
+	defer stop()
+	// 发给 1 号进程的信号转给容器命令，1 号进程自己不退出
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- reapUntil(command.Process.Pid) }()
+	select {
+	case err := <-done:
+		if code, ok := ExitCode(err); !ok || code != 7 {
+			t.Errorf("command exited with %v, want exit status 7 from its trap", err)
+		}
+	case <-time.After(5 * time.Second):
+		command.Process.Kill()
+		t.Fatal("the signal was not forwarded")
+	}
+}
+
+func TestExitStatusError(t *testing.T) {
+	tests := []struct {
+		status syscall.WaitStatus
+		code   int
+		text   string
+	}{
+		// wait4 的状态：正常退出时退出码在第二个字节，被信号杀死时低 7 位是信号编号
+		{3 << 8, 3, "exit status 3"},
+		{255 << 8, 255, "exit status 255"},
+		{syscall.WaitStatus(syscall.SIGKILL), 128 + 9, "signal: killed"},
+		{syscall.WaitStatus(syscall.SIGTERM), 128 + 15, "signal: terminated"},
+		// 生成 core dump 的标志不影响信号编号
+		{syscall.WaitStatus(syscall.SIGSEGV) | 0x80, 128 + 11, "signal: segmentation fault"},
+	}
+	for _, test := range tests {
+		err := &ExitStatusError{Status: test.status}
+		if code, ok := ExitCode(err); !ok || code != test.code {
+			t.Errorf("ExitCode(%#x) = %d, %v, want %d", int(test.status), code, ok, test.code)
+		}
+		if err.Error() != test.text {
+			t.Errorf("Error(%#x) = %q, want %q", int(test.status), err.Error(), test.text)
+		}
+	}
+	// 包装过的错误说明失败发生在运行命令之外
+	if _, ok := ExitCode(errors.Wrap(&ExitStatusError{Status: 3 << 8}, "wrapped")); ok {
+		t.Error("ExitCode unwrapped a wrapped ExitStatusError")
+	}
+}
@@ -0,0 +1,118 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"common/layout"
+
+	"github.com/pkg/errors"
+)
+
+// stateDir 保存 --name 启动的容器的 pid 文件
+const stateDir = layout.StateDir
+
+// signalNames 是 kill -s 支持的信号名
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// sigRTMax 是 Linux 最大的信号编号 SIGRTMAX，即内核的 _NSIG
+const sigRTMax = 64
+
+// ParseSignal 解析信号名（可带 SIG 前缀）或 1 到 SIGRTMAX 之间的信号编号
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > sigRTMax {
+			return 0, errors.Errorf("无效的信号编号: %d，应在 1 到 %d 之间", n, sigRTMax)
+		}
+		return syscall.Signal(n), nil
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !ok {
+		return 0, errors.Errorf("未知的信号: %s", s)
+	}
+	return sig, nil
+}
+
+func pidFile(name string) string {
+	return filepath.Join(stateDir, name+".pid")
+}
+
+// validName 检查容器名能否作为 pid 文件名
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return errors.Errorf("无效的容器名: %q", name)
+	}
+	return nil
+}
+
+// writePidFile 记录容器 1 号进程在宿主机上的 pid，同名容器仍在运行时报错
+func writePidFile(name string, pid int) error {
+	if old, err := readPidFile(name); err == nil && syscall.Kill(old, 0) == nil {
+		return errors.Errorf("名为 %s 的容器正在运行 (pid %d)", name, old)
+	}
+	err := os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "创建状态目录时出错")
+	}
+	return os.WriteFile(pidFile(name), []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+func readPidFile(name string) (int, error) {
+	data, err := os.ReadFile(pidFile(name))
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "解析 pid 文件 %s 时出错", pidFile(name))
+	}
+	return pid, nil
+}
+
+// resolveContainer 把容器名或 pid 解析为宿主机上的 pid
+func resolveContainer(target string) (int, error) {
+	if pid, err := strconv.Atoi(target); err == nil {
+		return pid, nil
+	}
+	err := validName(target)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := readPidFile(target)
+	if os.IsNotExist(errors.Cause(err)) {
+		return 0, errors.Errorf("找不到名为 %s 的容器", target)
+	}
+	return pid, err
+}
+
+// Kill 直接向容器 target（容器名或 pid）的 1 号进程发送信号
+func Kill(target string, sig syscall.Signal) error {
+	pid, err := resolveContainer(target)
+	if err != nil {
+		return err
+	}
+	slog.Info("sending signal", "signal", int(sig), "name", sig.String(), "pid", pid)
+	err = syscall.Kill(pid, sig)
+	if err != nil {
+		return errors.Wrapf(err, "向 pid %d 发送信号时出错", pid)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package container
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		s   string
+		sig syscall.Signal
+		ok  bool
+	}{
+		{"TERM", syscall.SIGTERM, true},
+		{"sigterm", syscall.SIGTERM, true},
+		{"SIGKILL", syscall.SIGKILL, true},
+		{"winch", syscall.SIGWINCH, true},
+		{"9", syscall.SIGKILL, true},
+		{"1", syscall.SIGHUP, true},
+		// SIGRTMAX
+		{"64", syscall.Signal(64), true},
+		{"65", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"BOGUS", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		sig, err := ParseSignal(test.s)
+		if (err == nil) != test.ok || sig != test.sig {
+			t.Errorf("ParseSignal(%q) = %v, %v, want %v, ok %v", test.s, sig, err, test.sig, test.ok)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"web", "web-1", "a.b"} {
+		if err := validName(name); err != nil {
+			t.Errorf("validName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if err := validName(name); err == nil {
+			t.Errorf("validName(%q) accepted an invalid name", name)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lazyPollInterval 是等待 docker2fs 解压 layer 时的轮询间隔
+const lazyPollInterval = 200 * time.Millisecond
+
+// waitForLayers 等待 docker2fs --manifest-first 写出 config.json、manifest.json
+// 并解压完镜像需要的全部 layer
+// overlay 挂载后不能再追加 lowerdir，所以只能在本镜像的 layer 都就绪后挂载，
+// 不必等待同一批次中其他镜像的 layer，超过 LazyTimeout 仍未就绪时返回缺少的文件
+func waitForLayers(spec *Spec) error {
+	deadline := time.Now().Add(spec.LazyTimeout)
+	var missing []string
+	for {
+		missing = missing[:0]
+		// loadConfig 把空文件当作空配置，这里空文件说明 docker2fs 还没写完
+		_, err := loadConfig(spec.ConfigPath)
+		if info, statErr := os.Stat(spec.ConfigPath); err != nil || statErr != nil || info.Size() == 0 {
+			missing = append(missing, spec.ConfigPath)
+		}
+		// manifest.json 可能还没写完，解析失败时同样继续等待
+		layers, err := loadManifest(spec.ManifestPath)
+		if _, ok := err.(*manifestError); ok {
+			return err
+		}
+		if err != nil {
+			missing = append(missing, spec.ManifestPath)
+		} else {
+			for _, dir := range lowerDirsOf(layers, spec.LayersRoot) {
+				info, err := os.Stat(dir)
+				if err != nil || !info.IsDir() {
+					missing = append(missing, dir)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errors.Errorf("等待 layer 超时 (%s)，仍缺少: %v", spec.LazyTimeout, missing)
+		}
+		slog.Debug("waiting for layers", "missing", missing)
+		// 最后一次轮询不睡过截止时间
+		time.Sleep(min(lazyPollInterval, remaining))
+	}
+}
@@ -0,0 +1,79 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForLayersTimesOut(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa", "sha256:bbbb")
+	// docker2fs 还没解压第二层
+	missing := filepath.Join(spec.LayersRoot, "bbbb")
+	err := os.RemoveAll(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.LazyTimeout = 3 * lazyPollInterval / 2
+	start := time.Now()
+	err = waitForLayers(spec)
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("waitForLayers should time out while a layer is missing")
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("the timeout error doesn't name the missing layer: %v", err)
+	}
+	if elapsed < spec.LazyTimeout || elapsed > spec.LazyTimeout+lazyPollInterval {
+		t.Errorf("waited %s for a %s timeout", elapsed, spec.LazyTimeout)
+	}
+}
+
+func TestWaitForLayersExtractedDuringWait(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	dir := filepath.Join(spec.LayersRoot, "aaaa")
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.LazyTimeout = 10 * lazyPollInterval
+	go func() {
+		time.Sleep(lazyPollInterval)
+		os.MkdirAll(dir, 0755)
+	}()
+	err = waitForLayers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForLayersUnsupportedManifest(t *testing.T) {
+	spec := testImage(t, map[string]any{})
+	// manifest 写完了但不是镜像 manifest，继续等待没有意义
+	err := os.WriteFile(spec.ManifestPath, []byte(`{"schemaVersion": 1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.LazyTimeout = time.Minute
+	done := make(chan error, 1)
+	go func() { done <- waitForLayers(spec) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("waitForLayers accepted an unsupported manifest")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForLayers kept waiting on an unsupported manifest")
+	}
+}
+
+func TestValidateLazyTimeout(t *testing.T) {
+	spec := DefaultSpec()
+	spec.OverlayLazyExtract = true
+	spec.LazyTimeout = 0
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted --overlay-lazy-extract without a timeout")
+	}
+}
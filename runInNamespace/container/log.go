@@ -0,0 +1,23 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// SetupLogger 把运行日志按级别输出到 stderr，容器命令的 stdout 不受影响
+// quiet 时只输出错误
+func SetupLogger(level string, quiet bool) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return errors.Wrap(err, "解析日志级别时出错")
+	}
+	if quiet {
+		lvl = slog.LevelError
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
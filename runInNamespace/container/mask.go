@@ -0,0 +1,89 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// maskedPaths 是 --mask-proc 时对容器隐藏的路径，和 Docker 的默认值一致
+// 文件用 /dev/null 覆盖，目录用只读的空 tmpfs 覆盖，不存在的路径跳过
+var maskedPaths = []string{
+	"proc/acpi",
+	"proc/asound",
+	"proc/kcore",
+	"proc/keys",
+	"proc/latency_stats",
+	"proc/sched_debug",
+	"proc/scsi",
+	"proc/timer_list",
+	"proc/timer_stats",
+	"sys/devices/virtual/powercap",
+	"sys/firmware",
+}
+
+// readonlyPaths 是 --mask-proc 时 bind mount 到自身后重新以只读方式挂载的路径
+var readonlyPaths = []string{
+	"proc/bus",
+	"proc/fs",
+	"proc/irq",
+	"proc/sys",
+	"proc/sysrq-trigger",
+}
+
+// maskPath 隐藏 targetDir 下的 p
+func maskPath(targetDir, p string, dryRun bool) error {
+	target := filepath.Join(targetDir, p)
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		slog.Info("masking dir", "cmd", tmpfsCmd("tmpfs", target, "ro"))
+		return mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "", dryRun)
+	}
+	slog.Info("masking file", "cmd", "mount --bind /dev/null "+target)
+	return mount("/dev/null", target, "", syscall.MS_BIND, "", dryRun)
+}
+
+// readonlyPath 把 targetDir 下的 p 重新挂载为只读
+func readonlyPath(targetDir, p string, dryRun bool) error {
+	target := filepath.Join(targetDir, p)
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return nil
+	}
+	slog.Info("binding readonly path", "cmd", "mount --rbind "+target+" "+target)
+	err := mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, "", dryRun)
+	if err != nil {
+		return err
+	}
+	return hardenBind(target, syscall.MS_RDONLY, dryRun)
+}
+
+// maskProc 在 proc 和 sysfs 挂载之后隐藏 maskedPaths，把 readonlyPaths 和整个 /sys 变为只读
+func maskProc(targetDir string, dryRun bool) error {
+	for _, p := range maskedPaths {
+		err := maskPath(targetDir, p, dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "隐藏 /%s 时出错", p)
+		}
+	}
+	for _, p := range readonlyPaths {
+		err := readonlyPath(targetDir, p, dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "把 /%s 挂载为只读时出错", p)
+		}
+	}
+	// 只改这个挂载点的标志，user namespace 中不能 remount sysfs 的 superblock
+	err := hardenBind(filepath.Join(targetDir, "sys"), syscall.MS_RDONLY, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "把 /sys 挂载为只读时出错")
+	}
+	return nil
+}
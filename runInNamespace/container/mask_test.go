@@ -0,0 +1,103 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMaskProc(t *testing.T) {
+	targetDir := t.TempDir()
+	join := func(p string) string { return filepath.Join(targetDir, p) }
+	for _, dir := range []string{"proc/acpi", "proc/sys", "sys/firmware"} {
+		err := os.MkdirAll(join(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"proc/kcore", "proc/sysrq-trigger"} {
+		err := os.WriteFile(join(file), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := recordMounts(t, nil)
+	err := maskProc(targetDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remount := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	// 不存在的路径跳过，目录用只读 tmpfs 覆盖，文件用 /dev/null 覆盖
+	want := []struct {
+		call mountCall
+		// 为 true 时 call.flags 只需包含在实际的标志中，remount 会保留已有的标志
+		contains bool
+	}{
+		{mountCall{source: "tmpfs", target: join("proc/acpi"), fstype: "tmpfs", flags: syscall.MS_RDONLY}, false},
+		{mountCall{source: "/dev/null", target: join("proc/kcore"), flags: syscall.MS_BIND}, false},
+		{mountCall{source: "tmpfs", target: join("sys/firmware"), fstype: "tmpfs", flags: syscall.MS_RDONLY}, false},
+		{mountCall{source: join("proc/sys"), target: join("proc/sys"), flags: syscall.MS_BIND | syscall.MS_REC}, false},
+		{mountCall{target: join("proc/sys"), flags: remount}, true},
+		{mountCall{source: join("proc/sysrq-trigger"), target: join("proc/sysrq-trigger"), flags: syscall.MS_BIND | syscall.MS_REC}, false},
+		{mountCall{target: join("proc/sysrq-trigger"), flags: remount}, true},
+		// 整个 /sys 只读
+		{mountCall{target: join("sys"), flags: remount}, true},
+	}
+	if len(*calls) != len(want) {
+		t.Fatalf("mounts = %+v, want %d mounts", *calls, len(want))
+	}
+	for i, w := range want {
+		got := (*calls)[i]
+		if w.contains {
+			if got.target != w.call.target || got.flags&w.call.flags != w.call.flags {
+				t.Errorf("mount %d = %+v, want a read-only remount of %s", i, got, w.call.target)
+			}
+		} else if got != w.call {
+			t.Errorf("mount %d = %+v, want %+v", i, got, w.call)
+		}
+	}
+}
+
+func TestMaskedPaths(t *testing.T) {
+	// 和 Docker 的默认值一致
+	for _, p := range []string{"proc/kcore", "proc/keys", "proc/timer_list", "sys/firmware"} {
+		if !slices.Contains(maskedPaths, p) {
+			t.Errorf("/%s is not masked", p)
+		}
+	}
+	for _, p := range []string{"proc/sys", "proc/sysrq-trigger", "proc/irq", "proc/bus", "proc/fs"} {
+		if !slices.Contains(readonlyPaths, p) {
+			t.Errorf("/%s is not read-only", p)
+		}
+	}
+	for _, p := range append(append([]string{}, maskedPaths...), readonlyPaths...) {
+		if strings.HasPrefix(p, "/") {
+			t.Errorf("%s should be relative to the rootfs", p)
+		}
+	}
+}
+
+func TestMaskProcDryRun(t *testing.T) {
+	targetDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(targetDir, "proc/sys"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := recordMounts(t, nil)
+	plan := captureLog(t, func() {
+		err = maskProc(targetDir, true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("a dry run mounted %+v", *calls)
+	}
+	target := filepath.Join(targetDir, "proc/sys")
+	if want := `cmd="mount --rbind ` + target + " " + target + `"`; !strings.Contains(plan, want) {
+		t.Errorf("the plan has no %q:\n%s", want, plan)
+	}
+}
@@ -0,0 +1,311 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mountInfo 返回 /proc/self/mountinfo 中挂载点为 target 的最后一行，即最上层的挂载
+func mountInfo(target string) (string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	target = filepath.Clean(target)
+	found := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// 第 5 列是挂载点，空格等字符被转义为 \040
+		if len(fields) > 4 && unescapeMountPath(fields[4]) == target {
+			found = line
+		}
+	}
+	if found == "" {
+		return "", errors.Errorf("mountinfo 中没有 %s", target)
+	}
+	return found, nil
+}
+
+// sysMount 是 mount 实际调用的 mount(2)，测试时可以替换
+var sysMount = syscall.Mount
+
+// mount 调用 mount(2)，dryRun 时调用方已经打印了等价的 mount 命令，这里直接跳过
+func mount(source, target, fstype string, flags uintptr, data string, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	err := sysMount(source, target, fstype, flags, data)
+	if err != nil {
+		return errors.Wrapf(err, "mount %s on %s", source, target)
+	}
+	return nil
+}
+
+// mountLogger 记下当前的 mountinfo，返回的函数打印之后新增或变化的行，多次调用只打印一次
+func mountLogger() func() {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		slog.Warn("reading mountinfo failed", "err", err)
+		return func() {}
+	}
+	before := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		before[line] = true
+	}
+	logged := false
+	return func() {
+		if logged {
+			return
+		}
+		logged = true
+		data, err := os.ReadFile("/proc/self/mountinfo")
+		if err != nil {
+			slog.Warn("reading mountinfo failed", "err", err)
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" && !before[line] {
+				slog.Info("mountinfo", "line", line)
+			}
+		}
+	}
+}
+
+// mountRecPrivate 让容器内的挂载不传播到宿主机
+// slave 为 true 时使用 rslave，宿主机的挂载事件仍然可以传播进来
+func mountRecPrivate(slave, dryRun bool) error {
+	if slave {
+		slog.Info("mounting recursive slave", "cmd", "mount --make-rslave /")
+		return mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, "", dryRun)
+	}
+	slog.Info("mounting recursive private", "cmd", "mount --make-rprivate /")
+	err := mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "", dryRun)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func mountTmpfs(targetDir, size string, dryRun bool) error {
+	data := tmpfsData(size)
+	slog.Info("mounting tmpfs filesystem", "cmd", tmpfsCmd("tmpfs", targetDir, data))
+	err := mount("tmpfs", targetDir, "tmpfs", 0, data, dryRun)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// mkdirAll 创建目录，dryRun 时不创建
+func mkdirAll(dir string, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+// tmpfsSizePattern 是 tmpfs size 参数接受的格式，% 表示占内存的百分比
+var tmpfsSizePattern = regexp.MustCompile(`^[1-9][0-9]*[kmgKMG%]?$`)
+
+// checkTmpfsSize 检查 tmpfs 的 size 参数，为空表示使用默认大小
+func checkTmpfsSize(name, size string) error {
+	if size != "" && !tmpfsSizePattern.MatchString(size) {
+		return errors.Errorf("无效的 %s 大小 %s，格式应为数字加可选的 k、m、g 后缀或 %%", name, size)
+	}
+	return nil
+}
+
+// tmpfsData 生成 tmpfs 的挂载参数，size 为空时不限制大小
+func tmpfsData(size string) string {
+	if size == "" {
+		return ""
+	}
+	return "size=" + size
+}
+
+// tmpfsCmd 返回和 tmpfs 挂载等价的 mount 命令，用于日志
+func tmpfsCmd(source, target, data string) string {
+	return fsCmd("tmpfs", source, target, data)
+}
+
+// prepareDirs 创建 overlay 需要的目录，tmpfsSize 为 "-" 时 base 目录不挂载 tmpfs
+func prepareDirs(baseDir, tmpfsSize string, dirs []string, dryRun bool) error {
+	err := mkdirAll(baseDir, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "创建 base 目录时出错")
+	}
+	if tmpfsSize != noTmpfs {
+		err = mountTmpfs(baseDir, tmpfsSize, dryRun)
+		if err != nil {
+			return errors.Wrap(err, "挂载 tmpfs 时出错")
+		}
+	}
+	slog.Info("making dirs", "cmd", "mkdir -pv "+strings.Join(dirs, " "))
+	if dryRun {
+		return nil
+	}
+	for _, dir := range dirs {
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return errors.Wrapf(err, "创建 %s 目录时出错", dir)
+		}
+	}
+	return nil
+}
+
+// mountBaseFs 挂载 proc、sys、dev 等基础文件系统
+// user namespace 中不允许挂载 devtmpfs，改为递归 bind mount 宿主机的 /dev
+func mountBaseFs(targetDir, shmSize string, privileged, userns, dryRun bool) error {
+	flags := mountFlags("proc", privileged)
+	slog.Info("mounting proc filesystem", "cmd", fsCmd("proc", "none", filepath.Join(targetDir, "proc"), flagOptions(flags, "")))
+	err := mount("none", filepath.Join(targetDir, "proc"), "proc", flags, "", dryRun)
+	if err != nil {
+		return err
+	}
+	flags = mountFlags("sysfs", privileged)
+	slog.Info("mounting sys filesystem", "cmd", fsCmd("sysfs", "none", filepath.Join(targetDir, "sys"), flagOptions(flags, "")))
+	err = mount("none", filepath.Join(targetDir, "sys"), "sysfs", flags, "", dryRun)
+	if err != nil {
+		return err
+	}
+	// 只有 --privileged 时容器才能看到宿主机的全部设备
+	devptsData := ""
+	switch {
+	case !privileged:
+		err = mountDev(filepath.Join(targetDir, "dev"), userns, dryRun)
+		// /dev/ptmx 链接到这个 devpts 实例自己的 ptmx
+		devptsData = "newinstance,ptmxmode=0666,mode=0620"
+	case userns:
+		slog.Info("mounting dev filesystem", "cmd", "mount --rbind /dev "+filepath.Join(targetDir, "dev"))
+		err = mount("/dev", filepath.Join(targetDir, "dev"), "", syscall.MS_BIND|syscall.MS_REC, "", dryRun)
+	default:
+		slog.Info("mounting dev filesystem", "cmd", "mount -t devtmpfs devtmpfs "+filepath.Join(targetDir, "dev"))
+		err = mount("devtmpfs", filepath.Join(targetDir, "dev"), "devtmpfs", 0, "", dryRun)
+	}
+	if err != nil {
+		return err
+	}
+	flags = mountFlags("devpts", privileged)
+	slog.Info("mounting devpts filesystem", "cmd", fsCmd("devpts", "devpts", filepath.Join(targetDir, "dev/pts"), flagOptions(flags, devptsData)))
+	err = mount("devpts", filepath.Join(targetDir, "dev/pts"), "devpts", flags, devptsData, dryRun)
+	if err != nil {
+		return err
+	}
+	shmData := tmpfsData(shmSize)
+	flags = mountFlags("shm", privileged)
+	slog.Info("mounting shm filesystem", "cmd", tmpfsCmd("shm", filepath.Join(targetDir, "dev/shm"), flagOptions(flags, shmData)))
+	err = mount("shm", filepath.Join(targetDir, "dev/shm"), "tmpfs", flags, shmData, dryRun)
+	if err != nil {
+		return err
+	}
+	flags = mountFlags("run", privileged)
+	slog.Info("mounting run filesystem", "cmd", tmpfsCmd("tmpfs", filepath.Join(targetDir, "run"), flagOptions(flags, "")))
+	err = mount("tmpfs", filepath.Join(targetDir, "run"), "tmpfs", flags, "", dryRun)
+	if err != nil {
+		return err
+	}
+	flags = mountFlags("tmp", privileged)
+	slog.Info("mounting tmp filesystem", "cmd", tmpfsCmd("tmpfs", filepath.Join(targetDir, "tmp"), flagOptions(flags, "")))
+	err = mount("tmpfs", filepath.Join(targetDir, "tmp"), "tmpfs", flags, "", dryRun)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func mountVolume(volumeDir, targetDir string, slave, noSymlinks, privileged, dryRun bool) error {
+	resolved, err := resolveVolumeDir(volumeDir, noSymlinks)
+	// Run 在启动子进程之前才创建 volume 目录，dryRun 时它可能还不存在
+	if dryRun && os.IsNotExist(errors.Cause(err)) {
+		resolved, err = filepath.Abs(volumeDir)
+	}
+	if err != nil {
+		return err
+	}
+	volumeDir = resolved
+	targetVolumeDir := filepath.Join(targetDir, "volume")
+	err = mkdirAll(targetVolumeDir, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "创建 volume 目录时出错")
+	}
+	slog.Info("mounting volume filesystem", "cmd", "mount --bind "+volumeDir+" "+targetVolumeDir)
+	err = mount(volumeDir, targetVolumeDir, "", syscall.MS_BIND, "", dryRun)
+	if err != nil {
+		return err
+	}
+	err = hardenBind(targetVolumeDir, mountFlags("volume", privileged), dryRun)
+	if err != nil {
+		return err
+	}
+	if slave {
+		slog.Info("mounting volume slave propagation", "cmd", "mount --make-rslave "+targetVolumeDir)
+		err = mount("", targetVolumeDir, "", syscall.MS_REC|syscall.MS_SLAVE, "", dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pivotOldRoot 是 pivot_root 时放置旧 rootfs 的目录，位于新 rootfs 下，卸载后删除
+const pivotOldRoot = ".pivot_root"
+
+// ensureMountPoint 保证 targetDir 是一个挂载点，pivot_root 要求新 rootfs 是挂载点，
+// 否则返回含义不明的 EINVAL。不是挂载点时把它递归 bind mount 到自身
+func ensureMountPoint(targetDir string, dryRun bool) error {
+	// dry-run 时没有真正挂载 overlay，无法判断，按 overlay 已经挂载处理
+	if dryRun {
+		return nil
+	}
+	if _, err := mountInfo(targetDir); err == nil {
+		return nil
+	}
+	slog.Info("bind mounting rootfs onto itself", "cmd", "mount --rbind "+targetDir+" "+targetDir)
+	err := mount(targetDir, targetDir, "", syscall.MS_BIND|syscall.MS_REC, "", false)
+	if err != nil {
+		return errors.Wrap(err, "把 rootfs bind mount 到自身时出错")
+	}
+	return nil
+}
+
+func chroot(targetDir string, dryRun bool) error {
+	err := ensureMountPoint(targetDir, dryRun)
+	if err != nil {
+		return err
+	}
+	oldRoot := filepath.Join(targetDir, pivotOldRoot)
+	slog.Info("making old root dir", "cmd", "mkdir -p "+oldRoot)
+	err = mkdirAll(oldRoot, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "创建旧 rootfs 目录时出错")
+	}
+	slog.Info("change current dir", "cmd", "cd "+targetDir)
+	if !dryRun {
+		if err := os.Chdir(targetDir); err != nil {
+			return errors.Wrap(err, "chdir 时出错")
+		}
+	}
+	slog.Info("change rootfs", "cmd", "pivot_root . "+pivotOldRoot)
+	if !dryRun {
+		if err := syscall.PivotRoot(".", pivotOldRoot); err != nil {
+			return errors.Wrapf(err, "pivot_root 到 %s 时出错", targetDir)
+		}
+	}
+	// 旧 rootfs 下还有宿主机的挂载，lazy 卸载不会因为 EBUSY 失败
+	slog.Info("unmounting old root", "cmd", "umount -l /"+pivotOldRoot)
+	if !dryRun {
+		if err := syscall.Unmount("/"+pivotOldRoot, syscall.MNT_DETACH); err != nil {
+			return errors.Wrap(err, "umount 旧的 rootfs 时出错")
+		}
+		if err := os.Remove("/" + pivotOldRoot); err != nil {
+			return errors.Wrap(err, "删除旧 rootfs 目录时出错")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// mountCall 是一次 mount(2) 调用的参数
+type mountCall struct {
+	source, target, fstype string
+	flags                  uintptr
+	data                   string
+}
+
+// recordMounts 在测试期间把 mount(2) 换成记录参数，fail 非空时由它决定每次调用的结果
+func recordMounts(t *testing.T, fail func(call mountCall) error) *[]mountCall {
+	t.Helper()
+	calls := &[]mountCall{}
+	saved := sysMount
+	t.Cleanup(func() { sysMount = saved })
+	sysMount = func(source, target, fstype string, flags uintptr, data string) error {
+		call := mountCall{source, target, fstype, flags, data}
+		*calls = append(*calls, call)
+		if fail != nil {
+			return fail(call)
+		}
+		return nil
+	}
+	return calls
+}
+
+func TestMountRecPrivate(t *testing.T) {
+	for _, test := range []struct {
+		slave bool
+		flags uintptr
+	}{
+		{false, syscall.MS_REC | syscall.MS_PRIVATE},
+		// rslave 时宿主机的挂载事件仍然传播进容器
+		{true, syscall.MS_REC | syscall.MS_SLAVE},
+	} {
+		calls := recordMounts(t, nil)
+		err := mountRecPrivate(test.slave, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []mountCall{{target: "/", flags: test.flags}}
+		if len(*calls) != 1 || (*calls)[0] != want[0] {
+			t.Errorf("slave %v: mounts = %+v, want %+v", test.slave, *calls, want)
+		}
+	}
+}
+
+func TestMountVolumeSlavePropagation(t *testing.T) {
+	volumeDir, targetDir := t.TempDir(), t.TempDir()
+	target := filepath.Join(targetDir, "volume")
+	for _, slave := range []bool{false, true} {
+		calls := recordMounts(t, nil)
+		err := mountVolume(volumeDir, targetDir, slave, false, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := (*calls)[len(*calls)-1]
+		rslave := mountCall{target: target, flags: syscall.MS_REC | syscall.MS_SLAVE}
+		if slave && last != rslave {
+			t.Errorf("the volume is not made rslave after its bind mount: %+v", *calls)
+		}
+		if !slave && last == rslave {
+			t.Errorf("the volume is made rslave without --mount-slave-propagation: %+v", *calls)
+		}
+		if first := (*calls)[0]; first.source != volumeDir || first.target != target || first.flags != syscall.MS_BIND {
+			t.Errorf("the volume bind mount = %+v", first)
+		}
+	}
+}
+
+func TestFlagOptions(t *testing.T) {
+	tests := []struct {
+		flags uintptr
+		data  string
+		want  string
+	}{
+		{0, "", ""},
+		{0, "size=64m", "size=64m"},
+		{hardenAll, "", "nosuid,nodev,noexec"},
+		{syscall.MS_RDONLY | syscall.MS_NOSUID, "mode=755", "ro,nosuid,mode=755"},
+		// 只列出 mount -o 能表达的标志
+		{syscall.MS_BIND | syscall.MS_NODEV, "", "nodev"},
+	}
+	for _, test := range tests {
+		if got := flagOptions(test.flags, test.data); got != test.want {
+			t.Errorf("flagOptions(%#x, %q) = %q, want %q", test.flags, test.data, got, test.want)
+		}
+	}
+	if got := fsCmd("proc", "none", "/merged/proc", ""); got != "mount -t proc none /merged/proc" {
+		t.Errorf("fsCmd without options = %q", got)
+	}
+	if got := fsCmd("tmpfs", "shm", "/merged/dev/shm", "nosuid,size=1g"); got != "mount -t tmpfs -o nosuid,size=1g shm /merged/dev/shm" {
+		t.Errorf("fsCmd with options = %q", got)
+	}
+}
+
+func TestMountBaseFsFlags(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the default /dev needs mknod")
+	}
+	targetDir := t.TempDir()
+	for _, dir := range []string{"dev/pts", "dev/shm", "proc", "sys", "run", "tmp"} {
+		err := os.MkdirAll(filepath.Join(targetDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := recordMounts(t, nil)
+	err := mountBaseFs(targetDir, "256m", false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byTarget := map[string]mountCall{}
+	for _, call := range *calls {
+		byTarget[call.target] = call
+	}
+	join := func(p string) string { return filepath.Join(targetDir, p) }
+	want := []mountCall{
+		{"none", join("proc"), "proc", hardenAll, ""},
+		{"none", join("sys"), "sysfs", hardenAll, ""},
+		{"tmpfs", join("dev"), "tmpfs", syscall.MS_NOSUID | syscall.MS_NOEXEC, "mode=755"},
+		{"devpts", join("dev/pts"), "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+		// --shm-size 成为 /dev/shm 的 size 参数
+		{"shm", join("dev/shm"), "tmpfs", hardenAll, "size=256m"},
+		{"tmpfs", join("run"), "tmpfs", hardenAll, ""},
+		// /tmp 保留 exec
+		{"tmpfs", join("tmp"), "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, ""},
+	}
+	for _, call := range want {
+		if got := byTarget[call.target]; got != call {
+			t.Errorf("mount on %s = %+v, want %+v", call.target, got, call)
+		}
+	}
+
+	// --privileged 时不附加安全标志，/dev 是宿主机的全部设备
+	calls = recordMounts(t, nil)
+	err = mountBaseFs(targetDir, "", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range *calls {
+		if call.flags != 0 {
+			t.Errorf("privileged mount on %s has flags %#x", call.target, call.flags)
+		}
+		if call.target == join("dev") && call.fstype != "devtmpfs" {
+			t.Errorf("privileged /dev = %+v, want devtmpfs", call)
+		}
+		if call.target == join("dev/shm") && call.data != "" {
+			t.Errorf("/dev/shm without --shm-size has data %q", call.data)
+		}
+	}
+	// user namespace 中不能挂载 devtmpfs，递归 bind mount 宿主机的 /dev
+	calls = recordMounts(t, nil)
+	err = mountBaseFs(targetDir, "", true, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range *calls {
+		if call.target == join("dev") && (call.source != "/dev" || call.flags != syscall.MS_BIND|syscall.MS_REC) {
+			t.Errorf("privileged userns /dev = %+v, want an rbind of /dev", call)
+		}
+	}
+}
+
+func TestMountLogger(t *testing.T) {
+	dir := t.TempDir()
+	logMounts := mountLogger()
+	// 没有新的挂载时什么也不打印
+	out := captureLog(t, func() { mountLogger()() })
+	if out != "" {
+		t.Errorf("mountinfo logged without a new mount: %s", out)
+	}
+
+	mountTestTmpfs(t, dir, 0)
+	out = captureLog(t, logMounts)
+	if !strings.Contains(out, "msg=mountinfo") || !strings.Contains(out, dir) {
+		t.Errorf("the mountinfo of %s was not logged: %s", dir, out)
+	}
+	// 挂载步骤失败时的 defer 不再重复打印
+	out = captureLog(t, logMounts)
+	if out != "" {
+		t.Errorf("mountinfo logged twice: %s", out)
+	}
+}
+
+func TestMountInfo(t *testing.T) {
+	line, err := mountInfo("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(line); len(fields) < 5 || fields[4] != "/" {
+		t.Errorf("mountInfo(/) = %q", line)
+	}
+	if _, err := mountInfo(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("mountInfo found a path that is not a mount point")
+	}
+}
+
+func TestCheckTmpfsSize(t *testing.T) {
+	for _, size := range []string{"", "512m", "2g", "2G", "1024", "64k", "20%"} {
+		if err := checkTmpfsSize("tmpfs", size); err != nil {
+			t.Errorf("checkTmpfsSize(%q) = %v", size, err)
+		}
+	}
+	for _, size := range []string{"0", "-1", "1.5g", "1t", "m", "512 m", "20%%", "size=1g", "-"} {
+		if err := checkTmpfsSize("tmpfs", size); err == nil {
+			t.Errorf("checkTmpfsSize accepted %q", size)
+		}
+	}
+	spec := DefaultSpec()
+	if spec.TmpfsSize != "50%" {
+		t.Errorf("the default tmpfs size is %q, want 50%%", spec.TmpfsSize)
+	}
+	spec.TmpfsSize = "1.5g"
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted the tmpfs size 1.5g")
+	}
+}
+
+func TestPrepareDirsTmpfsSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		calls []mountCall
+	}{
+		{"512m", []mountCall{{source: "tmpfs", fstype: "tmpfs", data: "size=512m"}}},
+		// 为空时使用内核的默认大小
+		{"", []mountCall{{source: "tmpfs", fstype: "tmpfs"}}},
+		// persist 时 base 目录不挂载 tmpfs
+		{noTmpfs, nil},
+	}
+	for _, test := range tests {
+		baseDir := filepath.Join(t.TempDir(), "overlay")
+		for i := range test.calls {
+			test.calls[i].target = baseDir
+		}
+		calls := recordMounts(t, nil)
+		upper := filepath.Join(baseDir, "upper")
+		err := prepareDirs(baseDir, test.size, []string{upper}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*calls) != len(test.calls) || (len(test.calls) > 0 && (*calls)[0] != test.calls[0]) {
+			t.Errorf("size %q: mounts = %+v, want %+v", test.size, *calls, test.calls)
+		}
+		if _, err := os.Stat(upper); err != nil {
+			t.Errorf("size %q: the upperdir was not created: %v", test.size, err)
+		}
+	}
+}
+
+func TestShmSize(t *testing.T) {
+	spec := DefaultSpec()
+	if spec.ShmSize != "" {
+		t.Errorf("the default shm size is %q, want the tmpfs default", spec.ShmSize)
+	}
+	for _, size := range []string{"64x", "0", "1.5g"} {
+		spec.ShmSize = size
+		if err := spec.Validate(); err == nil || !strings.Contains(err.Error(), "shm") {
+			t.Errorf("Validate(shm size %q) = %v, want an shm size error", size, err)
+		}
+	}
+
+	spec = testImage(t, nil, "sha256:aaaa")
+	spec.ShmSize = "1g"
+	plan := captureLog(t, func() {
+		err := Run(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	shm := filepath.Join(spec.BaseDir, "merged", "dev/shm")
+	if want := "mount -t tmpfs -o nosuid,nodev,noexec,size=1g shm " + shm; !strings.Contains(plan, want) {
+		t.Errorf("the plan has no %q:\n%s", want, plan)
+	}
+}
+
+// chrootTestEnv 非空时 TestChroot 在重新执行的测试进程中 pivot_root 到该目录
+const chrootTestEnv = "CHROOT_TEST_ROOTFS"
+
+func TestChroot(t *testing.T) {
+	if rootfs := os.Getenv(chrootTestEnv); rootfs != "" {
+		// 已经在新的 mount namespace 中，pivot_root 之后列出新的根目录
+		err := mountRecPrivate(false, false)
+		if err == nil {
+			err = chroot(rootfs, false)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		entries, err := os.ReadDir("/")
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			fmt.Println(entry.Name())
+		}
+		os.Exit(0)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("pivot_root needs root")
+	}
+	rootfs := t.TempDir()
+	err := os.WriteFile(filepath.Join(rootfs, "marker"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rootfs 不是挂载点，chroot 先把它 bind mount 到自身
+	command := exec.Command(os.Args[0], "-test.run=^TestChroot$")
+	command.Env = append(os.Environ(), chrootTestEnv+"="+rootfs)
+	command.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	command.Stderr = os.Stderr
+	out, err := command.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// 旧的 rootfs 卸载后挂载点目录也被删除
+	if got := strings.TrimSpace(string(out)); got != "marker" {
+		t.Errorf("the new root has %q, want only the marker", got)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, pivotOldRoot)); !os.IsNotExist(err) {
+		t.Errorf("%s is left in the rootfs: %v", pivotOldRoot, err)
+	}
+}
+
+func TestChrootDryRun(t *testing.T) {
+	targetDir := t.TempDir()
+	calls := recordMounts(t, nil)
+	plan := captureLog(t, func() {
+		err := chroot(targetDir, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(*calls) != 0 {
+		t.Errorf("a dry run mounted %+v", *calls)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, pivotOldRoot)); !os.IsNotExist(err) {
+		t.Error("a dry run created the old root dir")
+	}
+	last := -1
+	for _, cmd := range []string{
+		"mkdir -p " + filepath.Join(targetDir, pivotOldRoot),
+		"cd " + targetDir,
+		"pivot_root . " + pivotOldRoot,
+		"umount -l /" + pivotOldRoot,
+	} {
+		i := strings.Index(plan, `cmd="`+cmd+`"`)
+		if i <= last {
+			t.Errorf("the plan has no %q after the previous step:\n%s", cmd, plan)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// unescapeMountPath 还原 mountinfo 中被转义为 \ooo 八进制的空格、制表符、换行和反斜杠
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountsUnder 从 mountinfo 的内容中找出挂载在 dir 或其子目录上的挂载点，按挂载顺序返回
+func mountsUnder(mountinfo string, dir string) []string {
+	dir = filepath.Clean(dir)
+	mounts := []string{}
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		// 第 5 列是挂载点
+		if len(fields) < 5 {
+			continue
+		}
+		target := unescapeMountPath(fields[4])
+		if target == dir || strings.HasPrefix(target, dir+"/") {
+			mounts = append(mounts, target)
+		}
+	}
+	return mounts
+}
+
+// staleMounts 返回宿主机上 baseDir 中残留的挂载
+// 容器的挂载都在它自己的 mount namespace 中，宿主机上能看到的只会是之前异常退出留下的
+func staleMounts(baseDir string) ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 mountinfo 时出错")
+	}
+	return mountsUnder(string(data), baseDir), nil
+}
+
+// checkStaleMounts 在启动容器前检查 baseDir，有残留挂载时提示先运行 cleanup
+func checkStaleMounts(baseDir string) error {
+	mounts, err := staleMounts(baseDir)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return errors.Errorf("%s 上有残留的挂载 %v，请先运行 cleanup --base %s", baseDir, mounts, baseDir)
+	}
+	return nil
+}
+
+// CleanupMounts 卸载 baseDir 中残留的挂载，返回卸载的挂载点
+// dryRun 时只返回残留的挂载点，不卸载
+func CleanupMounts(baseDir string, dryRun bool) ([]string, error) {
+	mounts, err := staleMounts(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	// 后挂载的可能压在先挂载的上面，逆序卸载
+	unmounted := []string{}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if !dryRun {
+			err = syscall.Unmount(mounts[i], syscall.MNT_DETACH)
+			if err != nil {
+				return unmounted, errors.Wrapf(err, "卸载 %s 时出错", mounts[i])
+			}
+		}
+		unmounted = append(unmounted, mounts[i])
+	}
+	return unmounted, nil
+}
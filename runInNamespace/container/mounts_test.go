@@ -0,0 +1,54 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := []struct {
+		escaped, want string
+	}{
+		{"/srv/overlay", "/srv/overlay"},
+		{`/srv/my\040dir`, "/srv/my dir"},
+		{`/srv/tab\011and\012newline`, "/srv/tab\tand\nnewline"},
+		{`/srv/back\134slash`, `/srv/back\slash`},
+		// 不是三位八进制的反斜杠原样保留
+		{`/srv/a\b`, `/srv/a\b`},
+		{`/srv/a\09`, `/srv/a\09`},
+		{`/srv/end\04`, `/srv/end\04`},
+		{`/srv/\777`, `/srv/\777`},
+	}
+	for _, test := range tests {
+		if got := unescapeMountPath(test.escaped); got != test.want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", test.escaped, got, test.want)
+		}
+	}
+}
+
+func TestMountsUnder(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 0:40 / /srv/overlay rw,relatime - tmpfs tmpfs rw
+41 40 0:41 / /srv/overlay/merged rw,relatime - overlay overlay rw,lowerdir=/l
+42 22 0:42 / /srv/overlay2 rw,relatime - tmpfs tmpfs rw
+43 41 0:43 / /srv/overlay/merged/my\040dir rw,relatime - tmpfs tmpfs rw
+44 22 0:44 / /srv/other rw - tmpfs tmpfs rw
+
+short line
+`
+	tests := []struct {
+		dir  string
+		want []string
+	}{
+		// 按挂载顺序返回，前缀相同的兄弟目录不算在内
+		{"/srv/overlay", []string{"/srv/overlay", "/srv/overlay/merged", "/srv/overlay/merged/my dir"}},
+		{"/srv/overlay/", []string{"/srv/overlay", "/srv/overlay/merged", "/srv/overlay/merged/my dir"}},
+		{"/srv/overlay/merged/my dir", []string{"/srv/overlay/merged/my dir"}},
+		{"/srv/none", []string{}},
+	}
+	for _, test := range tests {
+		if got := mountsUnder(mountinfo, test.dir); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mountsUnder(%s) = %q, want %q", test.dir, got, test.want)
+		}
+	}
+}
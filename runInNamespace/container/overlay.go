@@ -0,0 +1,221 @@
+package container
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// overlayfsSuperMagic 是 statfs 返回的 overlay 文件系统类型
+const overlayfsSuperMagic = 0x794c7630
+
+// checkUpperDir 检查宿主机上的 upperdir 能否作为 overlay 的 upper 层
+// upperdir 不能位于 overlay、nfs 等不支持的文件系统上，workdir 必须和 upperdir 在同一个文件系统
+func checkUpperDir(upperDir, workDir string) error {
+	name, err := backingFs(upperDir)
+	if err != nil {
+		return errors.Wrap(err, "statfs upperdir 时出错")
+	}
+	if unsupportedUpperFs[name] {
+		return errors.Errorf("upperdir %s 位于 %s 文件系统上，不能作为 overlay 的 upper 层，请换到 ext4、xfs、btrfs 或 tmpfs 上", upperDir, name)
+	}
+	var upperStat, workStat syscall.Stat_t
+	err = syscall.Stat(upperDir, &upperStat)
+	if err != nil {
+		return errors.Wrap(err, "stat upperdir 时出错")
+	}
+	err = syscall.Stat(workDir, &workStat)
+	if err != nil {
+		return errors.Wrap(err, "stat workdir 时出错")
+	}
+	if upperStat.Dev != workStat.Dev {
+		return errors.Errorf("workdir %s 和 upperdir %s 不在同一个文件系统", workDir, upperDir)
+	}
+	return nil
+}
+
+// lowerDirsOf 根据 manifest 中的 layers 计算 overlay 的 lowerdir 列表
+// 相同的 layer 只保留最上层的一个，下层重复的内容已被它覆盖
+func lowerDirsOf(layers []Layer, layersRoot string) []string {
+	lowerDirs := []string{}
+	seen := map[string]bool{}
+	// lower要求layers逆序挂载
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		layerPath := filepath.Join(layersRoot, strings.Split(layer.Digest, ":")[1])
+		if seen[layerPath] {
+			continue
+		}
+		seen[layerPath] = true
+		lowerDirs = append(lowerDirs, layerPath)
+	}
+	return lowerDirs
+}
+
+// noTmpfs 作为 prepareDirs 的 tmpfsSize 时 base 目录不挂载 tmpfs
+const noTmpfs = "-"
+
+// overlayDirs 计算 overlay 的 upperdir 和 workdir
+// persistDir 非空时两者都放在它下面，否则 hostUpperDir 非空时 workdir 放在 upperdir 旁边
+func overlayDirs(baseDir, hostUpperDir, persistDir string) (string, string, error) {
+	if persistDir != "" {
+		dir, err := filepath.Abs(persistDir)
+		if err != nil {
+			return "", "", errors.Wrap(err, "解析 persist 目录路径时出错")
+		}
+		return filepath.Join(dir, "upper"), filepath.Join(dir, "work"), nil
+	}
+	if hostUpperDir == "" {
+		return filepath.Join(baseDir, "upper"), filepath.Join(baseDir, "work"), nil
+	}
+	upperDir, err := filepath.Abs(hostUpperDir)
+	if err != nil {
+		return "", "", errors.Wrap(err, "解析 upperdir 路径时出错")
+	}
+	// workdir 必须和 upperdir 在同一个文件系统，放在它的旁边
+	return upperDir, upperDir + ".work", nil
+}
+
+// setLayers 挂载镜像的 overlay rootfs，UpperDir 或 Persist 非空时 upperdir 使用宿主机目录
+// Bundle 非空时 layer 从 bundle 文件中 loop 挂载，不使用 LayersRoot 下的目录
+func setLayers(spec *Spec, targetDir string) error {
+	dryRun := spec.DryRun
+	var lowerDirs []string
+	if spec.Bundle == "" {
+		// 读取 layers 信息
+		layers, err := loadManifest(spec.ManifestPath)
+		if err != nil {
+			return errors.Wrap(err, "读取 manifest.json 时出错")
+		}
+		lowerDirs = lowerDirsOf(layers, spec.LayersRoot)
+		err = checkLowerDirs(lowerDirs)
+		if err != nil && !dryRun {
+			return err
+		}
+		// DryRun 只打印执行计划，layer 还没解压时同样可以打印
+		if err != nil {
+			slog.Warn("layers not extracted yet", "err", err)
+		}
+		if !dryRun {
+			err = checkLowerFs(lowerDirs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// 创建必要的目录
+	upperDir, workDir, err := overlayDirs(spec.BaseDir, spec.UpperDir, spec.Persist)
+	if err != nil {
+		return err
+	}
+	// persist 时写入都落在宿主机目录上，base 目录不需要 tmpfs
+	tmpfsSize := spec.TmpfsSize
+	if spec.Persist != "" {
+		tmpfsSize = noTmpfs
+	}
+	err = prepareDirs(spec.BaseDir, tmpfsSize, []string{upperDir, workDir, targetDir}, dryRun)
+	if err != nil {
+		return err
+	}
+	if spec.Bundle != "" {
+		// 挂载点放在 base 目录下，容器退出后随 mount namespace 一起消失
+		lowerDirs, err = mountBundle(spec.Bundle, filepath.Join(spec.BaseDir, "layers"), dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	if (spec.UpperDir != "" || spec.Persist != "") && !dryRun {
+		err = checkUpperDir(upperDir, workDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// scratch 镜像没有 layer，overlay 不接受空的 lowerdir
+	if len(lowerDirs) == 0 {
+		return mountEmptyRootfs(upperDir, targetDir, dryRun)
+	}
+
+	// 挂载 overlay 文件系统
+	err = mountOverlayFS(lowerDirs, upperDir, workDir, targetDir, spec.OverlayOpts,
+		spec.OverlayRetries, spec.OverlayRetryDelay, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "挂载 overlay 文件系统时出错")
+	}
+	return nil
+}
+
+// mountEmptyRootfs 把 upperdir 直接 bind mount 为容器的根目录，容器内的写入同样落在 upperdir
+// 镜像中没有 proc、dev 等挂载点，需要先创建
+func mountEmptyRootfs(upperDir, targetDir string, dryRun bool) error {
+	dirs := []string{}
+	for _, dir := range []string{"proc", "sys", "dev", "run", "tmp", "etc"} {
+		dirs = append(dirs, filepath.Join(upperDir, dir))
+	}
+	slog.Info("making dirs", "cmd", "mkdir -pv "+strings.Join(dirs, " "))
+	for _, dir := range dirs {
+		err := mkdirAll(dir, dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "创建 %s 目录时出错", dir)
+		}
+	}
+	slog.Info("mounting empty rootfs", "cmd", "mount --bind "+upperDir+" "+targetDir)
+	return mount(upperDir, targetDir, "", syscall.MS_BIND, "", dryRun)
+}
+
+// checkLowerDirs 在挂载前检查每个 layer 目录都已解压，一次性列出所有缺失的 layer
+func checkLowerDirs(lowerDirs []string) error {
+	missing := []string{}
+	for _, dir := range lowerDirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			missing = append(missing, dir)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("%d 个 layer 目录不存在，请先用 docker2fs 解压镜像: %s",
+			len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// mountOverlayFS 挂载 overlay 文件系统，extraOpts 追加在 lowerdir、upperdir 和 workdir 之后，
+// 遇到 EBUSY 时每隔 retryDelay 重试，最多 retries 次
+func mountOverlayFS(lowerDirs []string, upperDir, workDir, targetDir string, extraOpts []string,
+	retries int, retryDelay time.Duration, dryRun bool) error {
+	lowerdir := strings.Join(lowerDirs, ":")
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperDir, workDir)
+	if len(extraOpts) > 0 {
+		options += "," + strings.Join(extraOpts, ",")
+	}
+	// 内核只拷贝一页的挂载参数（含结尾的 \0），超出部分会被截断导致挂载失败
+	if len(options) >= os.Getpagesize() {
+		return errors.Errorf("overlay 挂载参数长度 %d 超过内核限制 %d (%d 个 lowerdir)，请缩短 layers 路径或减少层数",
+			len(options), os.Getpagesize()-1, len(lowerDirs))
+	}
+
+	slog.Info("mounting overlay filesystem", "cmd", "mount -t overlay overlay -o "+options+" "+targetDir)
+
+	// 上一次运行刚 umount 时 workdir 可能短暂处于 busy 状态，EBUSY 时稍后重试
+	err := mount("overlay", targetDir, "overlay", 0, options, dryRun)
+	for i := 0; i < retries && errors.Cause(err) == syscall.EBUSY; i++ {
+		slog.Warn("overlay mount busy, retrying", "attempt", i+1, "delay", retryDelay)
+		time.Sleep(retryDelay)
+		err = mount("overlay", targetDir, "overlay", 0, options, dryRun)
+	}
+	// 内核对不支持的文件系统只返回 EINVAL，原因只在 dmesg 中，这里补上各层所在的文件系统
+	if errors.Cause(err) == syscall.EINVAL {
+		return errors.Wrap(err, "overlay 挂载参数无效，"+overlayFsSummary(lowerDirs, upperDir))
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
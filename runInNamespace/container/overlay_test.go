@@ -0,0 +1,369 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckLowerDirs(t *testing.T) {
+	root := t.TempDir()
+	present := filepath.Join(root, "aaaa")
+	err := os.Mkdir(present, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 解压到一半被中断时可能只剩下同名的文件
+	file := filepath.Join(root, "cccc")
+	err = os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLowerDirs([]string{present}); err != nil {
+		t.Errorf("checkLowerDirs with every layer extracted = %v", err)
+	}
+	missing := filepath.Join(root, "bbbb")
+	err = checkLowerDirs([]string{present, missing, file})
+	if err == nil {
+		t.Fatal("checkLowerDirs accepted missing layers")
+	}
+	// 一次列出所有缺失的 layer
+	for _, dir := range []string{missing, file} {
+		if !strings.Contains(err.Error(), dir) {
+			t.Errorf("the error doesn't name %s: %v", dir, err)
+		}
+	}
+	if strings.Contains(err.Error(), present+",") || !strings.Contains(err.Error(), "2 个") {
+		t.Errorf("the error should list exactly the 2 missing layers: %v", err)
+	}
+}
+
+func TestOverlayDirs(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hostUpper, persist string
+		upper, work        string
+	}{
+		{"", "", "/base/upper", "/base/work"},
+		// workdir 放在 upperdir 旁边，和它在同一个文件系统
+		{"/data/upper", "", "/data/upper", "/data/upper.work"},
+		{"upper", "", filepath.Join(cwd, "upper"), filepath.Join(cwd, "upper.work")},
+		{"", "/data/persist", "/data/persist/upper", "/data/persist/work"},
+	}
+	for _, test := range tests {
+		upper, work, err := overlayDirs("/base", test.hostUpper, test.persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upper != test.upper || work != test.work {
+			t.Errorf("overlayDirs(%q, %q) = %s, %s, want %s, %s", test.hostUpper, test.persist, upper, work, test.upper, test.work)
+		}
+	}
+}
+
+func TestCheckUpperDir(t *testing.T) {
+	upper := t.TempDir()
+	if err := checkUpperDir(upper, upper+".work"); err == nil {
+		t.Error("checkUpperDir accepted a missing workdir")
+	}
+	err := os.Mkdir(upper+".work", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(upper + ".work")
+	if err := checkUpperDir(upper, upper+".work"); err != nil {
+		t.Errorf("checkUpperDir with the workdir next to the upperdir = %v", err)
+	}
+	// /dev/shm 是 tmpfs，和测试目录不在同一个文件系统
+	work, err := os.MkdirTemp("/dev/shm", "work")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(work)
+	if same, _ := sameFs(upper, work); same {
+		t.Skip("the test directory and /dev/shm are on the same filesystem")
+	}
+	if err := checkUpperDir(upper, work); err == nil {
+		t.Error("checkUpperDir accepted a workdir on another filesystem")
+	}
+}
+
+// sameFs 判断两个路径是否在同一个文件系统
+func sameFs(a, b string) (bool, error) {
+	var aStat, bStat syscall.Stat_t
+	if err := syscall.Stat(a, &aStat); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(b, &bStat); err != nil {
+		return false, err
+	}
+	return aStat.Dev == bStat.Dev, nil
+}
+
+func TestSetLayersHostUpperDir(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	spec.UpperDir = filepath.Join(t.TempDir(), "upper")
+	plan := captureLog(t, func() {
+		err := setLayers(spec, filepath.Join(spec.BaseDir, "merged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := "upperdir=" + spec.UpperDir + ",workdir=" + spec.UpperDir + ".work"
+	if !strings.Contains(plan, want) {
+		t.Errorf("the overlay mount has no %q:\n%s", want, plan)
+	}
+}
+
+// shellLayer 把宿主机的 /bin/sh 和它依赖的动态库复制到 layer 目录 dir，容器里可以运行 sh -c，
+// 同时像普通镜像一样带上 proc、sys 等挂载点
+func shellLayer(t *testing.T, dir string) {
+	t.Helper()
+	for _, mountpoint := range []string{"proc", "sys", "dev", "run", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, mountpoint), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{"/bin/sh"}
+	// 静态链接的 sh 没有依赖，ldd 失败时只复制 sh
+	out, _ := exec.Command("ldd", "/bin/sh").Output()
+	for _, field := range strings.Fields(string(out)) {
+		if strings.HasPrefix(field, "/") {
+			files = append(files, field)
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(dir, file)
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(target, data, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunWritesHostUpperDir(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces needs root")
+	}
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	shellLayer(t, filepath.Join(spec.LayersRoot, "aaaa"))
+	spec.DryRun = false
+	spec.UpperDir = filepath.Join(t.TempDir(), "upper")
+	spec.Args = []string{"/bin/sh", "-c", "echo written > /written"}
+	err := Run(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 容器退出后写入仍留在宿主机的 upperdir 中
+	data, err := os.ReadFile(filepath.Join(spec.UpperDir, "written"))
+	if err != nil || string(data) != "written\n" {
+		t.Errorf("the file written in the container is %q in the host upperdir: %v", data, err)
+	}
+}
+
+func TestLowerDirsUseLayersRoot(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa", "sha256:bbbb")
+	// --layers 指向另一个 docker2fs 输出目录中的 layers
+	root := filepath.Join(t.TempDir(), "shared-layers")
+	for _, hex := range []string{"aaaa", "bbbb"} {
+		err := os.MkdirAll(filepath.Join(root, hex), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.RemoveAll(spec.LayersRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.LayersRoot = root
+	plan := captureLog(t, func() {
+		err := setLayers(spec, filepath.Join(spec.BaseDir, "merged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	want := "lowerdir=" + filepath.Join(root, "bbbb") + ":" + filepath.Join(root, "aaaa") + ","
+	if !strings.Contains(plan, want) {
+		t.Errorf("the overlay mount has no %q:\n%s", want, plan)
+	}
+	if strings.Contains(plan, "layers not extracted yet") {
+		t.Errorf("the layers under -layers were reported missing:\n%s", plan)
+	}
+}
+
+func TestLowerDirsOfDedupe(t *testing.T) {
+	layers := []Layer{{Digest: "sha256:aaaa"}, {Digest: "sha256:bbbb"}, {Digest: "sha256:aaaa"}, {Digest: "sha256:cccc"}}
+	got := lowerDirsOf(layers, "/layers")
+	// 最上层在前，重复的 layer 只保留最上面的一个
+	want := []string{"/layers/cccc", "/layers/aaaa", "/layers/bbbb"}
+	if strings.Join(got, ":") != strings.Join(want, ":") {
+		t.Errorf("lowerDirsOf = %v, want %v", got, want)
+	}
+}
+
+func TestMountOverlayFSOptionsTooLong(t *testing.T) {
+	var lowerDirs []string
+	for i := 0; len(strings.Join(lowerDirs, ":")) < os.Getpagesize(); i++ {
+		lowerDirs = append(lowerDirs, filepath.Join("/var/lib/docker2fs/layers", strings.Repeat("a", 60)+string(rune('a'+i%26))))
+	}
+	err := mountOverlayFS(lowerDirs, "/base/upper", "/base/work", "/base/merged", nil, 0, 0, true)
+	if err == nil || !strings.Contains(err.Error(), "超过内核限制") {
+		t.Errorf("mountOverlayFS with %d lowerdirs = %v, want the page size error", len(lowerDirs), err)
+	}
+	// 参数在一页以内时照常挂载，额外的参数追加在 workdir 之后
+	plan := captureLog(t, func() {
+		err = mountOverlayFS(lowerDirs[:2], "/base/upper", "/base/work", "/base/merged", []string{"metacopy=on"}, 0, 0, true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ",workdir=/base/work,metacopy=on /base/merged"; !strings.Contains(plan, want) {
+		t.Errorf("the overlay mount has no %q:\n%s", want, plan)
+	}
+}
+
+func TestMountOverlayFSRetriesBusy(t *testing.T) {
+	retries, retryDelay := 3, 20*time.Millisecond
+	lowerDirs := []string{t.TempDir()}
+	upperDir, workDir := t.TempDir(), t.TempDir()
+
+	tests := []struct {
+		errs  []error
+		calls int
+		cause error
+	}{
+		// 前两次 EBUSY，第三次成功
+		{[]error{syscall.EBUSY, syscall.EBUSY, nil}, 3, nil},
+		// 一直 EBUSY 时重试 retries 次后返回最后的错误
+		{[]error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY}, 4, syscall.EBUSY},
+		// 其他错误不重试
+		{[]error{syscall.ENOENT}, 1, syscall.ENOENT},
+		{[]error{syscall.EINVAL}, 1, syscall.EINVAL},
+	}
+	for _, test := range tests {
+		var calls *[]mountCall
+		calls = recordMounts(t, func(mountCall) error {
+			return test.errs[len(*calls)-1]
+		})
+		start := time.Now()
+		err := mountOverlayFS(lowerDirs, upperDir, workDir, "/merged", nil, retries, retryDelay, false)
+		elapsed := time.Since(start)
+		if errors.Cause(err) != test.cause {
+			t.Errorf("%v: mountOverlayFS = %v, want %v", test.errs, err, test.cause)
+		}
+		if len(*calls) != test.calls {
+			t.Errorf("%v: %d mount calls, want %d", test.errs, len(*calls), test.calls)
+		}
+		if wait := time.Duration(test.calls-1) * retryDelay; elapsed < wait {
+			t.Errorf("%v: retried after %v, want at least %v", test.errs, elapsed, wait)
+		}
+		if test.cause == syscall.EINVAL && !strings.Contains(err.Error(), "overlay 挂载参数无效") {
+			t.Errorf("EINVAL is not explained: %v", err)
+		}
+	}
+}
+
+func TestMountEmptyRootfs(t *testing.T) {
+	upperDir, targetDir := t.TempDir(), t.TempDir()
+	calls := recordMounts(t, nil)
+	err := mountEmptyRootfs(upperDir, targetDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 镜像中没有挂载点，在 upperdir 中创建
+	for _, dir := range []string{"proc", "sys", "dev", "run", "tmp", "etc"} {
+		if info, err := os.Stat(filepath.Join(upperDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("the mountpoint %s was not created: %v", dir, err)
+		}
+	}
+	want := mountCall{source: upperDir, target: targetDir, flags: syscall.MS_BIND}
+	if len(*calls) != 1 || (*calls)[0] != want {
+		t.Errorf("mounts = %+v, want %+v", *calls, want)
+	}
+}
+
+func TestRunWithoutLayers(t *testing.T) {
+	spec := testImage(t, nil)
+	// 空的 config.json 当作没有任何运行配置
+	err := os.WriteFile(spec.ConfigPath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := captureLog(t, func() {
+		err = Run(spec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := filepath.Join(spec.BaseDir, "upper")
+	merged := filepath.Join(spec.BaseDir, "merged")
+	if want := `cmd="mount --bind ` + upper + " " + merged + `"`; !strings.Contains(plan, want) {
+		t.Errorf("the plan does not bind mount the upperdir:\n%s", plan)
+	}
+	if strings.Contains(plan, "mount -t overlay") {
+		t.Errorf("an image without layers is mounted as overlay:\n%s", plan)
+	}
+	if !strings.Contains(plan, "cmd=/bin/sh") {
+		t.Errorf("an empty config should run /bin/sh:\n%s", plan)
+	}
+}
+
+func TestSetLayersPersist(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	spec.DryRun = false
+	spec.Persist = filepath.Join(t.TempDir(), "persist")
+	targetDir := filepath.Join(spec.BaseDir, "merged")
+	upper := filepath.Join(spec.Persist, "upper")
+	for run := 0; run < 2; run++ {
+		calls := recordMounts(t, nil)
+		err := setLayers(spec, targetDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 写入都落在 persist 目录，base 目录不挂载 tmpfs
+		if len(*calls) != 1 || (*calls)[0].fstype != "overlay" {
+			t.Fatalf("run %d: mounts = %+v, want only the overlay", run, *calls)
+		}
+		want := ",upperdir=" + upper + ",workdir=" + filepath.Join(spec.Persist, "work")
+		if !strings.Contains((*calls)[0].data, want) {
+			t.Errorf("run %d: overlay options %q have no %q", run, (*calls)[0].data, want)
+		}
+		if run == 0 {
+			err = os.WriteFile(filepath.Join(upper, "kept"), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 再次运行时保留上一次的写入
+	if _, err := os.Stat(filepath.Join(upper, "kept")); err != nil {
+		t.Errorf("the second run lost the persisted upperdir: %v", err)
+	}
+
+	spec.UpperDir = filepath.Join(t.TempDir(), "upper")
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted -persist with -upperdir")
+	}
+	spec.UpperDir, spec.Rootfs = "", t.TempDir()
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted -persist with -rootfs")
+	}
+}
@@ -0,0 +1,48 @@
+package container
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// overlayOptValues 是 --overlay-opt 允许的 overlay 挂载参数及其取值，
+// 空列表表示参数不带值。lowerdir 等由挂载逻辑决定的参数不能覆盖
+var overlayOptValues = map[string][]string{
+	"metacopy":     {"on", "off"},
+	"redirect_dir": {"on", "off", "follow", "nofollow"},
+	"index":        {"on", "off"},
+	"xino":         {"on", "off", "auto"},
+	"nfs_export":   {"on", "off"},
+	"volatile":     {},
+	"userxattr":    {},
+}
+
+// OverlayOpts 是可重复的 --overlay-opt key=val 参数，追加到 overlay 的挂载参数之后
+type OverlayOpts []string
+
+func (o *OverlayOpts) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *OverlayOpts) Set(value string) error {
+	key, val, hasVal := strings.Cut(value, "=")
+	allowed, ok := overlayOptValues[key]
+	if !ok {
+		return errors.Errorf("不支持的 --overlay-opt %s，只允许 metacopy、redirect_dir、index、xino、nfs_export、volatile 和 userxattr", value)
+	}
+	if len(allowed) == 0 {
+		if hasVal {
+			return errors.Errorf("无效的 --overlay-opt %s，%s 不带值", value, key)
+		}
+		*o = append(*o, value)
+		return nil
+	}
+	for _, v := range allowed {
+		if hasVal && val == v {
+			*o = append(*o, value)
+			return nil
+		}
+	}
+	return errors.Errorf("无效的 --overlay-opt %s，%s 的值只能是 %s", value, key, strings.Join(allowed, "、"))
+}
@@ -0,0 +1,70 @@
+package container
+
+import "testing"
+
+func TestOverlayOptsSet(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"metacopy=on", true},
+		{"metacopy=off", true},
+		{"redirect_dir=follow", true},
+		{"redirect_dir=nofollow", true},
+		{"index=off", true},
+		{"xino=auto", true},
+		{"nfs_export=on", true},
+		{"volatile", true},
+		{"userxattr", true},
+		// 取值不在允许的列表中
+		{"metacopy=yes", false},
+		{"metacopy", false},
+		{"metacopy=", false},
+		{"xino=follow", false},
+		// 不带值的参数不能给值
+		{"volatile=on", false},
+		{"userxattr=", false},
+		// 挂载逻辑决定的参数不能覆盖
+		{"lowerdir=/tmp", false},
+		{"upperdir=/tmp", false},
+		{"workdir=/tmp", false},
+		{"", false},
+		{"Metacopy=on", false},
+	}
+	for _, test := range tests {
+		var opts OverlayOpts
+		err := opts.Set(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("Set(%q) = %v, want ok %v", test.value, err, test.ok)
+		}
+		if test.ok && (len(opts) != 1 || opts[0] != test.value) {
+			t.Errorf("Set(%q) stored %v", test.value, opts)
+		}
+		if !test.ok && len(opts) != 0 {
+			t.Errorf("Set(%q) stored %v after failing", test.value, opts)
+		}
+	}
+	var opts OverlayOpts
+	for _, value := range []string{"metacopy=on", "redirect_dir=on"} {
+		err := opts.Set(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := opts.String(); got != "metacopy=on,redirect_dir=on" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestValidateOverlayOpts(t *testing.T) {
+	// --spec 文件中的参数没有经过 Set，由 Validate 检查
+	spec := DefaultSpec()
+	spec.OverlayOpts = OverlayOpts{"metacopy=on", "volatile"}
+	if err := spec.Validate(); err != nil {
+		t.Errorf("Validate(%v) = %v", spec.OverlayOpts, err)
+	}
+	spec.OverlayOpts = OverlayOpts{"metacopy=on", "lowerdir=/etc"}
+	if err := spec.Validate(); err == nil {
+		t.Errorf("Validate accepted %v", spec.OverlayOpts)
+	}
+}
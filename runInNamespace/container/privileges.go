@@ -0,0 +1,29 @@
+package container
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// geteuid 返回当前的有效 uid，测试时可以替换
+var geteuid = os.Geteuid
+
+// checkPrivileges 在做任何挂载之前检查权限，避免在 childProcess 深处才因为 EPERM 失败
+func checkPrivileges(userns bool) error {
+	if userns || geteuid() == 0 {
+		return nil
+	}
+	return errors.New("必须以 root 运行或使用 --userns")
+}
+
+// setUserNS 让子进程进入新的 user namespace，容器内的 root 映射为调用者自己
+// 未映射的 uid/gid 在容器内显示为 nobody
+func setUserNS(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	// 非特权用户写 gid_map 前必须禁止 setgroups
+	attr.GidMappingsEnableSetgroups = false
+}
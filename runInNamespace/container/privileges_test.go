@@ -0,0 +1,46 @@
+package container
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCheckPrivileges(t *testing.T) {
+	defer func(saved func() int) { geteuid = saved }(geteuid)
+	tests := []struct {
+		euid   int
+		userns bool
+		ok     bool
+	}{
+		{0, false, true},
+		{0, true, true},
+		{1000, false, false},
+		{1000, true, true},
+	}
+	for _, test := range tests {
+		geteuid = func() int { return test.euid }
+		err := checkPrivileges(test.userns)
+		if (err == nil) != test.ok {
+			t.Errorf("checkPrivileges(%v) as euid %d = %v, want ok %v", test.userns, test.euid, err, test.ok)
+		}
+	}
+}
+
+func TestSetUserNSMapsCallerToRoot(t *testing.T) {
+	attr := &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	setUserNS(attr)
+	if attr.Cloneflags != syscall.CLONE_NEWNS|syscall.CLONE_NEWUSER {
+		t.Errorf("cloneflags = %#x, want the mount and user namespaces", attr.Cloneflags)
+	}
+	uid, gid := attr.UidMappings, attr.GidMappings
+	if len(uid) != 1 || uid[0] != (syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getuid(), Size: 1}) {
+		t.Errorf("uid mappings = %v", uid)
+	}
+	if len(gid) != 1 || gid[0] != (syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getgid(), Size: 1}) {
+		t.Errorf("gid mappings = %v", gid)
+	}
+	if attr.GidMappingsEnableSetgroups {
+		t.Error("setgroups must be denied before an unprivileged gid_map write")
+	}
+}
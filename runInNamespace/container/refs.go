@@ -0,0 +1,122 @@
+package container
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// refsSuffix 是 layer 引用计数文件的后缀，文件放在 layer 目录旁边，内容为十进制计数
+// docker2fs gc 不删除计数大于 0 的 layer
+const refsSuffix = ".refs"
+
+func refsFile(layersRoot, hex string) string {
+	return filepath.Join(layersRoot, hex+refsSuffix)
+}
+
+// openRefs 打开并锁住计数文件
+// 计数归零的文件会被删除，拿到锁时如果文件已被删除需要重新打开
+func openRefs(p string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		var st syscall.Stat_t
+		err = syscall.Fstat(int(file.Fd()), &st)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if st.Nlink > 0 {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+// addRefs 把 p 中的计数加上 delta，归零时删除计数文件
+func addRefs(p string, delta int) error {
+	file, err := openRefs(p)
+	if err != nil {
+		return err
+	}
+	// 关闭文件的同时释放锁
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	count := 0
+	if s := strings.TrimSpace(string(data)); s != "" {
+		count, err = strconv.Atoi(s)
+		if err != nil {
+			return errors.Wrapf(err, "解析引用计数 %s 时出错", p)
+		}
+	}
+	count += delta
+	if count <= 0 {
+		return os.Remove(p)
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt([]byte(strconv.Itoa(count)+"\n"), 0)
+	return err
+}
+
+// layerHexes 返回 layers 中不重复的 layer 摘要
+func layerHexes(layers []Layer) []string {
+	hexes := []string{}
+	seen := map[string]bool{}
+	for _, layer := range layers {
+		_, hex, _ := strings.Cut(layer.Digest, ":")
+		if seen[hex] {
+			continue
+		}
+		seen[hex] = true
+		hexes = append(hexes, hex)
+	}
+	return hexes
+}
+
+// acquireLayers 给容器使用的每个 layer 的引用计数加一，返回的函数在容器退出后减一
+// 使用 bundle 或 rootfs 时不读 LayersRoot，不需要计数。lazy 模式下调用方先等 manifest 写完
+func acquireLayers(spec *Spec) (func(), error) {
+	if spec.Bundle != "" || spec.Rootfs != "" {
+		return func() {}, nil
+	}
+	layers, err := loadManifest(spec.ManifestPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 manifest.json 时出错")
+	}
+	hexes := layerHexes(layers)
+	release := func(hexes []string) {
+		for _, hex := range hexes {
+			err := addRefs(refsFile(spec.LayersRoot, hex), -1)
+			if err != nil {
+				slog.Warn("releasing layer ref failed", "layer", hex, "err", err)
+			}
+		}
+	}
+	for i, hex := range hexes {
+		err = addRefs(refsFile(spec.LayersRoot, hex), 1)
+		if err != nil {
+			release(hexes[:i])
+			return nil, errors.Wrapf(err, "增加 layer %s 的引用计数时出错", hex)
+		}
+	}
+	return func() { release(hexes) }, nil
+}
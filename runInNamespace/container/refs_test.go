@@ -0,0 +1,88 @@
+package container
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readRefs(t *testing.T, spec *Spec, hex string) string {
+	t.Helper()
+	data, err := os.ReadFile(refsFile(spec.LayersRoot, hex))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestAcquireLayers(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa", "sha256:bbbb", "sha256:aaaa")
+	release, err := acquireLayers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acquireLayers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一个 layer 在 manifest 中出现两次也只计一次
+	if refs := readRefs(t, spec, "aaaa"); refs != "2" {
+		t.Errorf("refs of aaaa = %q, want 2", refs)
+	}
+	release()
+	if refs := readRefs(t, spec, "bbbb"); refs != "1" {
+		t.Errorf("refs of bbbb = %q, want 1", refs)
+	}
+	second()
+	for _, hex := range []string{"aaaa", "bbbb"} {
+		if _, err := os.Stat(refsFile(spec.LayersRoot, hex)); !os.IsNotExist(err) {
+			t.Errorf("the refs file of %s was kept at zero", hex)
+		}
+	}
+}
+
+func TestAcquireLayersManifestError(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	err := os.Remove(spec.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有计数就启动的容器使用的 layer 可能被 gc 删除
+	if _, err := acquireLayers(spec); err == nil {
+		t.Error("acquireLayers without a manifest should be an error")
+	}
+}
+
+func TestAcquireLayersAfterLazyWait(t *testing.T) {
+	spec := testImage(t, map[string]any{}, "sha256:aaaa")
+	data, err := os.ReadFile(spec.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(spec.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.LazyTimeout = 5 * lazyPollInterval
+	// docker2fs --manifest-first 在等待期间写出 manifest
+	go func() {
+		time.Sleep(lazyPollInterval)
+		os.WriteFile(spec.ManifestPath, data, 0644)
+	}()
+	err = waitForLayers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireLayers(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if refs := readRefs(t, spec, "aaaa"); refs != "1" {
+		t.Errorf("refs of aaaa = %q, want 1", refs)
+	}
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// checkRootfs 检查 --rootfs 指定的目录看起来是一个 rootfs，至少要有 /bin 或 /etc
+func checkRootfs(rootfs string) error {
+	info, err := os.Stat(rootfs)
+	if err != nil {
+		return errors.Wrap(err, "rootfs 目录不存在")
+	}
+	if !info.IsDir() {
+		return errors.Errorf("rootfs %s 不是目录", rootfs)
+	}
+	for _, dir := range []string{"bin", "etc"} {
+		info, err := os.Stat(filepath.Join(rootfs, dir))
+		if err == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return errors.Errorf("%s 不像一个 rootfs，其中既没有 bin 也没有 etc 目录", rootfs)
+}
+
+// rootfsMountpoints 是容器根目录下挂载基础文件系统的目录
+var rootfsMountpoints = []string{"proc", "sys", "dev", "run", "tmp"}
+
+// missingMountpoints 返回 rootfs 中还没有的挂载点目录
+func missingMountpoints(rootfs string) []string {
+	missing := []string{}
+	for _, dir := range rootfsMountpoints {
+		p := filepath.Join(rootfs, dir)
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// mountRootfs 把 --rootfs 指定的目录 bind mount 为容器的根目录，不读 manifest 也不挂载 overlay，
+// 容器内的写入直接落在该目录上。目录中没有 proc、dev 等挂载点时直接在用户的目录中创建，
+// 容器退出后这些空目录仍然留在其中
+func mountRootfs(rootfs, targetDir string, dryRun bool) error {
+	err := checkRootfs(rootfs)
+	if err != nil {
+		return err
+	}
+	slog.Info("making dirs", "cmd", "mkdir -p "+targetDir)
+	err = mkdirAll(targetDir, dryRun)
+	if err != nil {
+		return errors.Wrapf(err, "创建 %s 目录时出错", targetDir)
+	}
+	missing := missingMountpoints(rootfs)
+	if len(missing) > 0 {
+		slog.Warn("creating mountpoints in rootfs", "cmd", "mkdir -pv "+strings.Join(missing, " "))
+	}
+	for _, dir := range missing {
+		err = mkdirAll(dir, dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "创建 %s 目录时出错", dir)
+		}
+	}
+	slog.Info("mounting rootfs", "cmd", "mount --rbind "+rootfs+" "+targetDir)
+	return mount(rootfs, targetDir, "", syscall.MS_BIND|syscall.MS_REC, "", dryRun)
+}
+
+// loadRuntimeConfig 读取镜像的 config.json，--rootfs 时可以没有 config.json，
+// 此时按空配置处理，容器命令默认为 /bin/sh
+func loadRuntimeConfig(spec *Spec) (*RuntimeConfig, error) {
+	image, err := loadConfig(spec.ConfigPath)
+	if spec.Rootfs != "" && os.IsNotExist(err) {
+		return &RuntimeConfig{}, nil
+	}
+	return image, err
+}
@@ -0,0 +1,72 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckRootfs(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"withbin/bin", "withetc/etc", "empty"} {
+		err := os.MkdirAll(filepath.Join(dir, p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bin 是文件而不是目录时不算
+	err := os.MkdirAll(filepath.Join(dir, "binfile"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "binfile", "bin"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rootfs string
+		ok     bool
+	}{
+		{"withbin", true},
+		{"withetc", true},
+		{"empty", false},
+		{"binfile", false},
+		{"binfile/bin", false},
+		{"missing", false},
+	}
+	for _, test := range tests {
+		err := checkRootfs(filepath.Join(dir, test.rootfs))
+		if (err == nil) != test.ok {
+			t.Errorf("checkRootfs(%s) = %v, want ok %v", test.rootfs, err, test.ok)
+		}
+	}
+}
+
+func TestMountRootfsDryRunLeavesRootfsAlone(t *testing.T) {
+	rootfs := t.TempDir()
+	for _, dir := range []string{"etc", "proc"} {
+		err := os.Mkdir(filepath.Join(rootfs, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want []string
+	for _, dir := range []string{"sys", "dev", "run", "tmp"} {
+		want = append(want, filepath.Join(rootfs, dir))
+	}
+	if missing := missingMountpoints(rootfs); !reflect.DeepEqual(missing, want) {
+		t.Errorf("missingMountpoints = %v, want %v", missing, want)
+	}
+	err := mountRootfs(rootfs, filepath.Join(t.TempDir(), "merged"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("the dry run created mountpoints in the rootfs: %v", entries)
+	}
+}
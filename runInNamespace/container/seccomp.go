@@ -0,0 +1,208 @@
+package container
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// SeccompProfile 是 Docker 格式的 seccomp profile，只支持按系统调用名匹配
+type SeccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls"`
+}
+
+// SeccompSyscall 是 profile 中的一条规则
+type SeccompSyscall struct {
+	Names    []string          `json:"names"`
+	Action   string            `json:"action"`
+	ErrnoRet *uint             `json:"errnoRet,omitempty"`
+	Args     []json.RawMessage `json:"args,omitempty"`
+}
+
+const (
+	prSetNoNewPrivs   = 38
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// seccomp_data 中 nr 和 arch 字段的偏移
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// defaultDeniedSyscalls 是默认 profile 中不放行的系统调用，参照 Docker 默认 profile
+var defaultDeniedSyscalls = map[string]bool{
+	"acct": true, "add_key": true, "bpf": true, "clock_adjtime": true, "clock_settime": true,
+	"create_module": true, "delete_module": true, "finit_module": true, "get_kernel_syms": true,
+	"get_mempolicy": true, "init_module": true, "ioperm": true, "iopl": true, "kcmp": true,
+	"kexec_file_load": true, "kexec_load": true, "keyctl": true, "lookup_dcookie": true,
+	"mbind": true, "mount": true, "move_pages": true, "name_to_handle_at": true, "nfsservctl": true,
+	"open_by_handle_at": true, "perf_event_open": true, "pivot_root": true,
+	"process_vm_readv": true, "process_vm_writev": true, "ptrace": true, "query_module": true,
+	"quotactl": true, "reboot": true, "request_key": true, "set_mempolicy": true, "setns": true,
+	"settimeofday": true, "swapon": true, "swapoff": true, "sysfs": true, "_sysctl": true,
+	"umount2": true, "unshare": true, "uselib": true, "userfaultfd": true, "ustat": true,
+	"fsopen": true, "fsconfig": true, "fsmount": true, "fspick": true, "move_mount": true,
+	"open_tree": true,
+}
+
+// defaultSeccompProfile 默认拒绝，只放行当前架构上除 defaultDeniedSyscalls 之外的系统调用
+func defaultSeccompProfile() *SeccompProfile {
+	allowed := []string{}
+	for name := range syscallNumbers {
+		if !defaultDeniedSyscalls[name] {
+			allowed = append(allowed, name)
+		}
+	}
+	return &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []SeccompSyscall{
+			{Names: allowed, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+}
+
+// parseSeccompProfile 解析 Docker 格式的 seccomp profile
+func parseSeccompProfile(data []byte) (*SeccompProfile, error) {
+	var profile SeccompProfile
+	err := json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, errors.Wrap(err, "解析 seccomp profile 时出错")
+	}
+	_, err = seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range profile.Syscalls {
+		_, err = seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &profile, nil
+}
+
+// loadSeccompProfile 读取 --seccomp 指定的 profile，"default" 表示内置的默认 profile
+func loadSeccompProfile(profilePath string) (*SeccompProfile, error) {
+	if profilePath == "default" {
+		return defaultSeccompProfile(), nil
+	}
+	data, err := os.ReadFile(profilePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 seccomp profile 时出错")
+	}
+	return parseSeccompProfile(data)
+}
+
+// seccompAction 把 profile 中的 action 转换为 BPF 的返回值
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = uint32(*errnoRet)
+		}
+		return seccompRetErrno | (errno & 0xffff), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	}
+	return 0, errors.Errorf("不支持的 seccomp action: %s", action)
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// compileSeccompProfile 把 profile 编译为 BPF 程序
+// 带参数条件的规则无法只按系统调用号表达，会被跳过，这类系统调用按默认 action 处理
+func compileSeccompProfile(profile *SeccompProfile) ([]syscall.SockFilter, error) {
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	filter := []syscall.SockFilter{
+		// 其他架构的系统调用号不同，直接杀掉
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	}
+	seen := map[uint32]bool{}
+	for _, rule := range profile.Syscalls {
+		if len(rule.Args) > 0 {
+			slog.Warn("skipping seccomp rule with args", "names", rule.Names)
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		if action == defaultAction {
+			continue
+		}
+		for _, name := range rule.Names {
+			nr, ok := syscallNumbers[name]
+			// profile 通常包含所有架构的系统调用，当前架构没有的直接忽略
+			if !ok || seen[nr] {
+				continue
+			}
+			seen[nr] = true
+			filter = append(filter,
+				bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+				bpfStmt(syscall.BPF_RET|syscall.BPF_K, action),
+			)
+		}
+	}
+	filter = append(filter, bpfStmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+	return filter, nil
+}
+
+// applySeccomp 为当前线程加载 seccomp 过滤器，之后从该线程 fork 的进程都会继承
+// 调用方需要先 runtime.LockOSThread，保证后续 exec 在同一个线程上进行
+func applySeccomp(profile *SeccompProfile) error {
+	if auditArch == 0 {
+		return errors.Errorf("seccomp 不支持 %s 架构", runtime.GOARCH)
+	}
+	filter, err := compileSeccompProfile(profile)
+	if err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return errors.Wrap(errno, "prctl(PR_SET_NO_NEW_PRIVS) 时出错")
+	}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP,
+		seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errors.Wrap(errno, "prctl(PR_SET_SECCOMP) 时出错")
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !amd64 && !arm64
+
+package container
+
+// 其他架构暂不支持 seccomp，applySeccomp 会返回错误
+const auditArch = 0
+
+var syscallNumbers = map[string]uint32{}
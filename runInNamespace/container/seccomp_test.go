@@ -0,0 +1,126 @@
+package container
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+// runFilter 用 filter 用到的几条 BPF 指令解释执行它，返回对 (arch, nr) 的 action
+func runFilter(t *testing.T, filter []syscall.SockFilter, arch, nr uint32) uint32 {
+	t.Helper()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[seccompDataNr:], nr)
+	binary.LittleEndian.PutUint32(data[seccompDataArch:], arch)
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[ins.K:])
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected BPF instruction %+v", ins)
+		}
+	}
+	t.Fatal("the filter fell off its end")
+	return 0
+}
+
+func TestCompileSeccompProfile(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("no syscall table for this architecture")
+	}
+	errno := uint(syscall.ENOSYS)
+	profile, err := parseSeccompProfile([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"syscalls": [
+			{"names": ["read", "write", "not_a_syscall"], "action": "SCMP_ACT_ALLOW"},
+			{"names": ["ptrace", "read"], "action": "SCMP_ACT_KILL_PROCESS"},
+			{"names": ["personality"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0}]},
+			{"names": ["mount"], "action": "SCMP_ACT_ERRNO"},
+			{"names": ["kill"], "action": "SCMP_ACT_LOG"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := compileSeccompProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eperm := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	tests := []struct {
+		name   string
+		action uint32
+	}{
+		{"read", seccompRetAllow},
+		{"write", seccompRetAllow},
+		{"ptrace", seccompRetKillProcess},
+		{"kill", seccompRetLog},
+		// 带参数条件的规则被跳过，按默认 action 处理
+		{"personality", eperm},
+		{"mount", eperm},
+		{"open", eperm},
+	}
+	for _, test := range tests {
+		if got := runFilter(t, filter, auditArch, syscallNumbers[test.name]); got != test.action {
+			t.Errorf("%s: action %#x, want %#x", test.name, got, test.action)
+		}
+	}
+	// 其他架构的系统调用直接杀掉进程
+	if got := runFilter(t, filter, auditArch+1, syscallNumbers["read"]); got != seccompRetKillProcess {
+		t.Errorf("a foreign architecture gets %#x, want kill process", got)
+	}
+
+	profile.DefaultErrnoRet = &errno
+	filter, err = compileSeccompProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runFilter(t, filter, auditArch, syscallNumbers["open"]); got != seccompRetErrno|uint32(syscall.ENOSYS) {
+		t.Errorf("defaultErrnoRet: action %#x, want ENOSYS", got)
+	}
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("no syscall table for this architecture")
+	}
+	profile, err := loadSeccompProfile("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := compileSeccompProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, nr := range syscallNumbers {
+		want := uint32(seccompRetAllow)
+		if defaultDeniedSyscalls[name] {
+			want = seccompRetErrno | uint32(syscall.EPERM)
+		}
+		if got := runFilter(t, filter, auditArch, nr); got != want {
+			t.Errorf("%s: action %#x, want %#x", name, got, want)
+		}
+	}
+}
+
+func TestParseSeccompProfileRejects(t *testing.T) {
+	for _, data := range []string{
+		`{`,
+		`{"defaultAction": "SCMP_ACT_NOTIFY"}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["read"], "action": "SCMP_ACT_TRACE"}]}`,
+	} {
+		if _, err := parseSeccompProfile([]byte(data)); err == nil {
+			t.Errorf("parseSeccompProfile accepted %s", data)
+		}
+	}
+}
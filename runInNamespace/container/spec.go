@@ -0,0 +1,282 @@
+package container
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"common/layout"
+
+	"github.com/pkg/errors"
+)
+
+// Spec 是一个容器的运行配置，父进程通过管道把它原样交给子进程
+// 用 DefaultSpec 得到和命令行默认值一致的配置
+type Spec struct {
+	// Name 非空时把容器 1 号进程的 pid 记录在 stateDir 下，供 kill 使用
+	Name string `json:"name"`
+	// PidFile 非空时在容器运行期间把 1 号进程的 pid 写入该文件
+	PidFile string `json:"pidFile"`
+	// Labels 是 --label 给出的 key=value，和镜像、pid 一起写入 state.json
+	Labels       Labels `json:"labels"`
+	ConfigPath   string `json:"configPath"`
+	ManifestPath string `json:"manifestPath"`
+	LayersRoot   string `json:"layersRoot"`
+	BaseDir      string `json:"baseDir"`
+	VolumeDir    string `json:"volumeDir"`
+	UpperDir     string `json:"upperDir"`
+	// Persist 非空时 overlay 的 upperdir 和 workdir 放在该目录下，容器的写入在重启后仍然保留，
+	// base 目录不再挂载 tmpfs
+	Persist string `json:"persist"`
+	// TmpfsSize 是 base 目录 tmpfs 的 size 挂载参数，限制 upperdir 能占用的内存
+	TmpfsSize string `json:"tmpfsSize"`
+	// ShmSize 是容器 /dev/shm 的 size 挂载参数，为空时使用 tmpfs 的默认大小
+	ShmSize string `json:"shmSize"`
+	// Volumes 是 -v 指定的 hostDir:containerPath，镜像声明的 VOLUME 没有映射时挂载匿名 tmpfs
+	Volumes VolumeMaps `json:"volumes"`
+	// Env 和 EnvFiles 中的变量依次覆盖镜像的 Env，Env 优先
+	Env      EnvVars  `json:"env"`
+	EnvFiles EnvFiles `json:"envFiles"`
+	// Bundle 是 docker2fs convert -bundle 生成的 bundle.img，设置后替代 LayersRoot
+	Bundle string `json:"bundle"`
+	// Rootfs 非空时把这个已经准备好的目录 bind mount 为容器的根目录，不读 manifest 也不挂载 overlay，
+	// 缺少的 proc、sys、dev、run、tmp 挂载点会在该目录中创建
+	Rootfs string `json:"rootfs"`
+	// Init 时 1 号进程转发信号并回收所有子进程，容器命令退出后容器随之退出。
+	// 否则 1 号进程只等待容器命令，容器命令收不到发给容器的信号
+	Init         bool `json:"init"`
+	DryRun       bool `json:"dryRun"`
+	VerboseMount bool `json:"verboseMount"`
+	// OverlayRetries 和 OverlayRetryDelay 控制 overlay 挂载遇到 EBUSY 时的重试
+	OverlayRetries    int           `json:"overlayRetries"`
+	OverlayRetryDelay time.Duration `json:"overlayRetryDelay"`
+	// OverlayOpts 是追加到 overlay 挂载参数之后的 metacopy=on 等参数
+	OverlayOpts OverlayOpts `json:"overlayOpts"`
+	// SlaveVolume 让宿主机上 volume 目录里新增的挂载传播到容器内，反之不传播
+	SlaveVolume bool `json:"slaveVolume"`
+	// NoSymlinkVolumes 时 volume 的宿主机目录中不能有符号链接
+	NoSymlinkVolumes bool `json:"noSymlinkVolumes"`
+	// Seccomp 为 "default" 时使用内置 profile，否则为 Docker 格式的 profile 路径
+	Seccomp  string `json:"seccomp"`
+	Hostname string `json:"hostname"`
+	// AddHosts 是写入容器 /etc/hosts 的额外条目，格式为 name:ip
+	AddHosts       HostEntries `json:"addHosts"`
+	OverwriteHosts bool        `json:"overwriteHosts"`
+	// Network 为 none 时容器在独立的 net namespace 中没有网络，host 时共享宿主机的网络
+	Network string `json:"network"`
+	// ShareIPC、SharePID、ShareUTS 和 ShareNet 时不创建对应的 namespace，和宿主机共享，
+	// ShareNet 等同于 Network 为 host
+	ShareIPC bool `json:"shareIpc"`
+	SharePID bool `json:"sharePid"`
+	ShareUTS bool `json:"shareUts"`
+	ShareNet bool `json:"shareNet"`
+	// DNSMode 为 copy 时写入宿主机 resolv.conf 的快照，bind 时只读挂载宿主机文件
+	DNSMode string `json:"dnsMode"`
+	// WriteNsswitch 时镜像缺少 /etc/nsswitch.conf 则写入默认配置
+	WriteNsswitch bool `json:"writeNsswitch"`
+	// EntrypointCwd 非空时容器命令在该目录下启动，只覆盖这一次 exec 的 WorkingDir
+	EntrypointCwd string `json:"entrypointCwd"`
+	// OverlayLazyExtract 时等待 docker2fs 解压出所需的 layer 后再挂载
+	OverlayLazyExtract bool          `json:"overlayLazyExtract"`
+	LazyTimeout        time.Duration `json:"lazyTimeout"`
+	LogLevel           string        `json:"logLevel"`
+	Quiet              bool          `json:"quiet"`
+	// KeepMounts 时容器启动失败后不退出，保留挂载以便排查
+	KeepMounts bool `json:"keepMounts"`
+	// Prep 在 pivot_root 之后、容器命令之前用 /bin/sh -c 在容器内运行，失败时不启动容器命令
+	Prep string `json:"prep"`
+	// Privileged 时挂载宿主机的全部设备，否则 /dev 中只有 defaultDevices
+	Privileged bool `json:"privileged"`
+	// MaskProc 时隐藏 /proc 和 /sys 中暴露宿主机内核信息的路径，/sys 只读
+	MaskProc bool `json:"maskProc"`
+	// UserNS 时在新的 user namespace 中运行，容器内的 root 映射为调用者，不需要 root 权限
+	UserNS bool `json:"userns"`
+	// ShellForm 时只有一个参数的命令按 /bin/sh -c 运行，否则命令总是按 exec 形式运行
+	ShellForm bool `json:"shellForm"`
+	// ArgsFile 是 JSON 字符串数组形式的容器命令，优先于命令行给出的命令
+	ArgsFile string `json:"argsFile"`
+	// Stdin 是 ConfigPath 或 ManifestPath 为 "-" 时父进程读出的标准输入，子进程从这里读取
+	Stdin []byte `json:"stdin,omitempty"`
+	// Args 是参数之后的容器命令，为空时使用镜像的 Entrypoint 和 Cmd
+	Args []string `json:"args"`
+}
+
+// DefaultSpec 返回默认的运行配置，路径取自 PROXY_POOL_PATH 或 /tmp/proxy_pool
+func DefaultSpec() *Spec {
+	paths := layout.New(layout.DefaultBasePath())
+	return &Spec{
+		ConfigPath:        paths.Config,
+		ManifestPath:      paths.Manifest,
+		LayersRoot:        paths.Layers,
+		BaseDir:           paths.Overlay,
+		VolumeDir:         paths.Volume,
+		TmpfsSize:         "50%",
+		OverlayRetries:    5,
+		OverlayRetryDelay: 100 * time.Millisecond,
+		Network:           "none",
+		DNSMode:           "copy",
+		LazyTimeout:       5 * time.Minute,
+		LogLevel:          "info",
+	}
+}
+
+// LoadSpec 从 JSON 文件读取运行配置，文件中没有给出的字段取 DefaultSpec 的值
+// 字段名和 --dump-config 输出的 options 相同，时长以纳秒为单位，未知字段视为错误
+func LoadSpec(specPath string) (*Spec, error) {
+	file, err := os.Open(specPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	spec := DefaultSpec()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "解析 %s 时出错", specPath)
+	}
+	return spec, nil
+}
+
+// Validate 检查配置中需要特定格式的字段
+func (spec *Spec) Validate() error {
+	if spec.Name != "" {
+		err := validName(spec.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if spec.Persist != "" && spec.UpperDir != "" {
+		return errors.New("--persist 和 --upperdir 不能同时使用")
+	}
+	err := checkTmpfsSize("tmpfs", spec.TmpfsSize)
+	if err != nil {
+		return err
+	}
+	err = checkTmpfsSize("shm", spec.ShmSize)
+	if err != nil {
+		return err
+	}
+	if spec.Rootfs != "" && (spec.Bundle != "" || spec.UpperDir != "" || spec.Persist != "" || spec.OverlayLazyExtract) {
+		return errors.New("--rootfs 不使用 overlay，不能和 --bundle、--upperdir、--persist 或 --overlay-lazy-extract 同时使用")
+	}
+	if spec.ConfigPath == stdinPath && spec.ManifestPath == stdinPath {
+		return errors.New("标准输入只能读一次，--config 和 --manifest 不能都是 -")
+	}
+	if spec.OverlayLazyExtract && spec.LazyTimeout <= 0 {
+		return errors.Errorf("无效的 --lazy-timeout %s，必须大于 0", spec.LazyTimeout)
+	}
+	if spec.usesStdin() && spec.OverlayLazyExtract {
+		return errors.New("--overlay-lazy-extract 需要等待文件写完，--config 和 --manifest 不能是 -")
+	}
+	if spec.Network != "none" && spec.Network != "host" {
+		return errors.Errorf("无效的网络模式 %s，只支持 none 或 host", spec.Network)
+	}
+	// 没有自己的 uts namespace 时设置主机名会改掉宿主机的主机名
+	if spec.ShareUTS && spec.Hostname != "" {
+		return errors.New("--share-uts 时不能用 --hostname，它会修改宿主机的主机名")
+	}
+	// 容器进程不再是 pid namespace 的 1 号进程，无法回收孤儿进程；user namespace 中也不能挂载宿主机 pid namespace 的 proc
+	if spec.SharePID && spec.Init {
+		return errors.New("--share-pid 时容器不是 1 号进程，不能用 --init")
+	}
+	if spec.SharePID && spec.UserNS {
+		return errors.New("--share-pid 不能和 --userns 同时使用，user namespace 中不能挂载宿主机 pid namespace 的 proc")
+	}
+	if spec.DNSMode != "copy" && spec.DNSMode != "bind" {
+		return errors.Errorf("无效的 dns 模式 %s，只支持 copy 或 bind", spec.DNSMode)
+	}
+	for _, volume := range spec.Volumes {
+		err := (&VolumeMaps{}).Set(volume)
+		if err != nil {
+			return err
+		}
+	}
+	for _, opt := range spec.OverlayOpts {
+		err := (&OverlayOpts{}).Set(opt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, label := range spec.Labels {
+		err := (&Labels{}).Set(label)
+		if err != nil {
+			return err
+		}
+	}
+	for _, host := range spec.AddHosts {
+		err := (&HostEntries{}).Set(host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys 返回 config.json 中以对象表示的集合，按字典序排列
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// namespaces 是容器进入的 namespace 及对应的 clone flag
+var namespaces = []struct {
+	Name string
+	Flag uintptr
+}{
+	{"uts", syscall.CLONE_NEWUTS},
+	{"ipc", syscall.CLONE_NEWIPC},
+	{"net", syscall.CLONE_NEWNET},
+	{"mnt", syscall.CLONE_NEWNS},
+	{"pid", syscall.CLONE_NEWPID},
+}
+
+// sharedNamespaces 返回和宿主机共享、不为容器创建的 namespace
+func (spec *Spec) sharedNamespaces() map[string]bool {
+	return map[string]bool{
+		"ipc": spec.ShareIPC,
+		"pid": spec.SharePID,
+		"uts": spec.ShareUTS,
+		"net": spec.hostNetwork(),
+	}
+}
+
+// hostNetwork 报告容器是否共享宿主机的网络
+func (spec *Spec) hostNetwork() bool {
+	return spec.Network == "host" || spec.ShareNet
+}
+
+// createdNamespaces 返回为容器创建的 namespace，user namespace 在最前，
+// 加入时需要按这个顺序，其他 namespace 属于容器的 user namespace
+func (spec *Spec) createdNamespaces() []string {
+	created := []string{}
+	if spec.UserNS {
+		created = append(created, "user")
+	}
+	flags := cloneFlags(spec)
+	for _, ns := range namespaces {
+		if flags&ns.Flag != 0 {
+			created = append(created, ns.Name)
+		}
+	}
+	return created
+}
+
+// cloneFlags 计算子进程的 Cloneflags，和宿主机共享的 namespace 不创建
+func cloneFlags(spec *Spec) uintptr {
+	shared := spec.sharedNamespaces()
+	var flags uintptr
+	for _, ns := range namespaces {
+		if shared[ns.Name] {
+			continue
+		}
+		flags |= ns.Flag
+	}
+	return flags
+}
@@ -0,0 +1,100 @@
+package container
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"common/layout"
+)
+
+func TestDefaultSpecPaths(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv(layout.BaseEnv, base)
+	spec := DefaultSpec()
+	// docker2fs convert -path 写出的布局必须和这里读取的一致
+	paths := layout.New(base)
+	if spec.ConfigPath != paths.Config || spec.ManifestPath != paths.Manifest ||
+		spec.LayersRoot != paths.Layers || spec.BaseDir != paths.Overlay || spec.VolumeDir != paths.Volume {
+		t.Errorf("DefaultSpec paths = %s %s %s %s %s, want the layout under %s",
+			spec.ConfigPath, spec.ManifestPath, spec.LayersRoot, spec.BaseDir, spec.VolumeDir, base)
+	}
+	if stateDir != paths.State {
+		t.Errorf("stateDir = %s, want %s", stateDir, paths.State)
+	}
+}
+
+func TestCloneFlags(t *testing.T) {
+	all := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	tests := []struct {
+		name  string
+		set   func(spec *Spec)
+		flags uintptr
+	}{
+		{"default", func(spec *Spec) {}, all},
+		{"network host", func(spec *Spec) { spec.Network = "host" }, all &^ syscall.CLONE_NEWNET},
+		{"share-net", func(spec *Spec) { spec.ShareNet = true }, all &^ syscall.CLONE_NEWNET},
+		{"share-ipc", func(spec *Spec) { spec.ShareIPC = true }, all &^ syscall.CLONE_NEWIPC},
+		{"share-pid", func(spec *Spec) { spec.SharePID = true }, all &^ syscall.CLONE_NEWPID},
+		{"share-uts", func(spec *Spec) { spec.ShareUTS = true }, all &^ syscall.CLONE_NEWUTS},
+		// mount namespace 总是创建，user namespace 由 setUserNS 另外加上
+		{"share all", func(spec *Spec) {
+			spec.ShareNet, spec.ShareIPC, spec.SharePID, spec.ShareUTS = true, true, true, true
+		}, syscall.CLONE_NEWNS},
+		{"userns", func(spec *Spec) { spec.UserNS = true }, all},
+	}
+	for _, test := range tests {
+		spec := DefaultSpec()
+		test.set(spec)
+		if got := cloneFlags(spec); got != test.flags {
+			t.Errorf("%s: cloneFlags = %#x, want %#x", test.name, got, test.flags)
+		}
+	}
+}
+
+func TestSharedNamespaces(t *testing.T) {
+	spec := DefaultSpec()
+	want := map[string]bool{"ipc": false, "pid": false, "uts": false, "net": false}
+	if got := spec.sharedNamespaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("default sharedNamespaces = %v, want %v", got, want)
+	}
+	if got := spec.createdNamespaces(); !reflect.DeepEqual(got, []string{"uts", "ipc", "net", "mnt", "pid"}) {
+		t.Errorf("default createdNamespaces = %v", got)
+	}
+
+	spec.ShareIPC, spec.ShareUTS, spec.Network = true, true, "host"
+	want = map[string]bool{"ipc": true, "pid": false, "uts": true, "net": true}
+	if got := spec.sharedNamespaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sharedNamespaces = %v, want %v", got, want)
+	}
+	// user namespace 在最前，exec 按这个顺序加入
+	spec.UserNS = true
+	if got := spec.createdNamespaces(); !reflect.DeepEqual(got, []string{"user", "mnt", "pid"}) {
+		t.Errorf("createdNamespaces = %v, want [user mnt pid]", got)
+	}
+}
+
+func TestValidateSharedNamespaces(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(spec *Spec)
+	}{
+		// 会修改宿主机的主机名
+		{"share-uts with hostname", func(spec *Spec) { spec.ShareUTS, spec.Hostname = true, "web" }},
+		{"share-pid with init", func(spec *Spec) { spec.SharePID, spec.Init = true, true }},
+		{"share-pid with userns", func(spec *Spec) { spec.SharePID, spec.UserNS = true, true }},
+		{"unknown network", func(spec *Spec) { spec.Network = "bridge" }},
+	}
+	for _, test := range tests {
+		spec := DefaultSpec()
+		test.set(spec)
+		if err := spec.Validate(); err == nil {
+			t.Errorf("Validate accepted %s", test.name)
+		}
+	}
+	spec := DefaultSpec()
+	spec.ShareUTS, spec.SharePID, spec.ShareIPC, spec.ShareNet = true, true, true, true
+	if err := spec.Validate(); err != nil {
+		t.Errorf("Validate with every namespace shared = %v", err)
+	}
+}
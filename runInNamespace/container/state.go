@@ -0,0 +1,129 @@
+package container
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Labels 是可重复的 --label key=value 参数，记录在容器的 state.json 中
+type Labels []string
+
+func (l *Labels) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *Labels) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("无效的 --label 参数 %s，格式应为 key=value", value)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// byKey 把 label 转为 map，同名的 label 后出现的优先
+func (l Labels) byKey() map[string]string {
+	labels := map[string]string{}
+	for _, entry := range l {
+		parts := strings.SplitN(entry, "=", 2)
+		labels[parts[0]] = parts[1]
+	}
+	return labels
+}
+
+// State 是容器运行期间写在 stateDir 下的元数据，供列出容器的工具读取
+type State struct {
+	Name      string            `json:"name"`
+	Pid       int               `json:"pid"`
+	Image     string            `json:"image"`
+	StartedAt time.Time         `json:"startedAt"`
+	Labels    map[string]string `json:"labels"`
+	// Namespaces 是为容器创建的 namespace，exec 按顺序加入
+	Namespaces []string `json:"namespaces"`
+}
+
+// stateFile 返回容器的 state.json 路径，没有容器名时以 pid 区分
+func stateFile(name string, pid int) string {
+	if name == "" {
+		name = strconv.Itoa(pid)
+	}
+	return filepath.Join(stateDir, name+".state.json")
+}
+
+// imageRef 返回容器使用的镜像
+// docker2fs 把解析出的镜像引用写在 manifest.json 旁边的 resolved.json 中，没有时用 manifest 路径代替
+func imageRef(spec *Spec) string {
+	if spec.Rootfs != "" {
+		return spec.Rootfs
+	}
+	if spec.Bundle != "" {
+		return spec.Bundle
+	}
+	if spec.ManifestPath == stdinPath {
+		return stdinPath
+	}
+	var resolved struct {
+		Reference string `json:"reference"`
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(spec.ManifestPath), "resolved.json"))
+	if err == nil && json.Unmarshal(data, &resolved) == nil && resolved.Reference != "" {
+		return resolved.Reference
+	}
+	return spec.ManifestPath
+}
+
+// findState 在 dir 下查找 pid 对应的 state.json，容器名和 pid 都能找到同一个容器
+func findState(dir string, pid int) (*State, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.state.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			// 容器可能刚好退出
+			continue
+		}
+		state := &State{}
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			return nil, errors.Wrapf(err, "解析 %s 时出错", p)
+		}
+		if state.Pid == pid {
+			return state, nil
+		}
+	}
+	return nil, errors.Errorf("找不到 pid %d 的 state.json，容器不是由 runInNamespace 启动的或已经退出", pid)
+}
+
+// writeState 写入容器的 state.json，返回它的路径，容器退出后由调用方删除
+func writeState(spec *Spec, pid int) (string, error) {
+	state := &State{
+		Name:       spec.Name,
+		Pid:        pid,
+		Image:      imageRef(spec),
+		StartedAt:  time.Now(),
+		Labels:     spec.Labels.byKey(),
+		Namespaces: spec.createdNamespaces(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "创建状态目录时出错")
+	}
+	p := stateFile(spec.Name, pid)
+	err = os.WriteFile(p, append(data, '\n'), 0644)
+	if err != nil {
+		return "", errors.Wrap(err, "写入 state.json 时出错")
+	}
+	return p, nil
+}
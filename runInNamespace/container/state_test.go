@@ -0,0 +1,116 @@
+package container
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	var labels Labels
+	for _, value := range []string{"app=web", "tier=", "app=api", "url=http://a?b=c"} {
+		if err := labels.Set(value); err != nil {
+			t.Errorf("Set(%q) = %v", value, err)
+		}
+	}
+	for _, value := range []string{"app", "=web", ""} {
+		if err := labels.Set(value); err == nil {
+			t.Errorf("Set accepted %q", value)
+		}
+	}
+	// 同名的 label 后出现的优先，值中的 = 原样保留
+	want := map[string]string{"app": "api", "tier": "", "url": "http://a?b=c"}
+	if got := labels.byKey(); !reflect.DeepEqual(got, want) {
+		t.Errorf("byKey = %v, want %v", got, want)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	if got, want := stateFile("web", 42), filepath.Join(stateDir, "web.state.json"); got != want {
+		t.Errorf("stateFile(web) = %s, want %s", got, want)
+	}
+	// 没有容器名时以 pid 区分
+	if got, want := stateFile("", 42), filepath.Join(stateDir, "42.state.json"); got != want {
+		t.Errorf("stateFile(42) = %s, want %s", got, want)
+	}
+}
+
+func TestImageRef(t *testing.T) {
+	dir := t.TempDir()
+	spec := DefaultSpec()
+	spec.ManifestPath = filepath.Join(dir, "manifest.json")
+	if got := imageRef(spec); got != spec.ManifestPath {
+		t.Errorf("imageRef without resolved.json = %s, want the manifest path", got)
+	}
+	resolved := filepath.Join(dir, "resolved.json")
+	for data, want := range map[string]string{
+		`{"reference": "docker.io/library/nginx:1.27"}`: "docker.io/library/nginx:1.27",
+		`{"reference": ""}`:                             spec.ManifestPath,
+		`{`:                                             spec.ManifestPath,
+	} {
+		err := os.WriteFile(resolved, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := imageRef(spec); got != want {
+			t.Errorf("imageRef with resolved.json %s = %s, want %s", data, got, want)
+		}
+	}
+	spec.ManifestPath = stdinPath
+	if got := imageRef(spec); got != stdinPath {
+		t.Errorf("imageRef with the manifest on stdin = %s", got)
+	}
+	spec.Bundle = "/srv/nginx.bundle"
+	if got := imageRef(spec); got != spec.Bundle {
+		t.Errorf("imageRef with a bundle = %s", got)
+	}
+	spec.Rootfs = "/srv/rootfs"
+	if got := imageRef(spec); got != spec.Rootfs {
+		t.Errorf("imageRef with a rootfs = %s", got)
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("writing " + stateDir + " needs root")
+	}
+	spec := DefaultSpec()
+	spec.Name = "state-test-" + strconv.Itoa(os.Getpid())
+	spec.Rootfs = "/srv/rootfs"
+	spec.Labels = Labels{"app=web"}
+	before := time.Now()
+	path, err := writeState(spec, 4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if path != stateFile(spec.Name, 4242) {
+		t.Errorf("writeState wrote %s, want %s", path, stateFile(spec.Name, 4242))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Name != spec.Name || state.Pid != 4242 || state.Image != "/srv/rootfs" ||
+		!reflect.DeepEqual(state.Labels, map[string]string{"app": "web"}) ||
+		!reflect.DeepEqual(state.Namespaces, spec.createdNamespaces()) {
+		t.Errorf("state.json = %+v", state)
+	}
+	if state.StartedAt.Before(before.Add(-time.Second)) || state.StartedAt.After(time.Now()) {
+		t.Errorf("startedAt = %v, want about %v", state.StartedAt, before)
+	}
+	// exec 和 stats 按 pid 找到同一个容器
+	found, err := findState(stateDir, 4242)
+	if err != nil || found.Name != spec.Name {
+		t.Errorf("findState(4242) = %+v, %v", found, err)
+	}
+}
@@ -0,0 +1,173 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"common/units"
+
+	"github.com/pkg/errors"
+)
+
+// cgroup2SuperMagic 是 statfs 返回的 cgroup v2 文件系统类型
+const cgroup2SuperMagic = 0x63677270
+
+// cgroup2Root 返回 cgroup v2 的挂载点，兼容 v1/v2 混合模式下的 unified 目录
+func cgroup2Root() (string, error) {
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var fs syscall.Statfs_t
+		if syscall.Statfs(root, &fs) == nil && fs.Type == cgroup2SuperMagic {
+			return root, nil
+		}
+	}
+	return "", errors.New("找不到 cgroup v2 挂载点")
+}
+
+// cgroupOf 从 /proc/<pid>/cgroup 中读取进程所在的 cgroup v2 路径
+func cgroupOf(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.Errorf("pid %d 不在 cgroup v2 中", pid)
+}
+
+// ContainerStats 是一次采样的资源使用情况，-1 表示 cgroup 中没有对应的文件
+type ContainerStats struct {
+	MemoryBytes int64
+	CPUUsec     int64
+	Pids        int64
+}
+
+// readCgroupInt 读取只有一个整数的 cgroup 文件，文件不存在时返回 -1
+func readCgroupInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCPUUsage 读取 cpu.stat 中的 usage_usec，文件不存在时返回 -1
+func readCPUUsage(path string) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.Errorf("%s 中没有 usage_usec", path)
+}
+
+// readStats 读取 cgroup 目录下的 memory.current、cpu.stat 和 pids.current
+func readStats(cgroupDir string) (*ContainerStats, error) {
+	memory, err := readCgroupInt(filepath.Join(cgroupDir, "memory.current"))
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 memory.current 时出错")
+	}
+	cpu, err := readCPUUsage(filepath.Join(cgroupDir, "cpu.stat"))
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 cpu.stat 时出错")
+	}
+	pids, err := readCgroupInt(filepath.Join(cgroupDir, "pids.current"))
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 pids.current 时出错")
+	}
+	return &ContainerStats{MemoryBytes: memory, CPUUsec: cpu, Pids: pids}, nil
+}
+
+func formatStat(v int64, format func(int64) string) string {
+	if v < 0 {
+		return "-"
+	}
+	return format(v)
+}
+
+// ownCgroup 返回容器 1 号进程所在的 cgroup，它必须是 Run 在 cgroupParent 下为容器创建的，
+// 否则统计到的是宿主机上其他进程的用量
+func ownCgroup(pid int) (string, error) {
+	cgroup, err := cgroupOf(pid)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(cgroup, "/"+cgroupParent+"/") {
+		return "", errors.Errorf("容器 pid %d 没有自己的 cgroup，它在 %s 中", pid, cgroup)
+	}
+	return cgroup, nil
+}
+
+// Stats 每隔 interval 向 w 输出一次容器 target（容器名或 pid）的资源用量，
+// 直到容器退出；noStream 时只输出一次。统计的是 Run 为容器创建的 cgroup
+func Stats(w io.Writer, target string, interval time.Duration, noStream bool) error {
+	pid, err := resolveContainer(target)
+	if err != nil {
+		return err
+	}
+	root, err := cgroup2Root()
+	if err != nil {
+		return err
+	}
+	cgroup, err := ownCgroup(pid)
+	if err != nil {
+		return err
+	}
+	cgroupDir := filepath.Join(root, cgroup)
+
+	// CPU 使用率需要两次采样之间的差值
+	last, err := readStats(cgroupDir)
+	if err != nil {
+		return err
+	}
+	lastTime := time.Now()
+	fmt.Fprintf(w, "%-8s %-30s %-8s %-12s %-6s\n", "PID", "CGROUP", "CPU %", "MEM USAGE", "PIDS")
+	for {
+		time.Sleep(interval)
+		stats, err := readStats(cgroupDir)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		cpu := "-"
+		if stats.CPUUsec >= 0 {
+			usec := float64(stats.CPUUsec - last.CPUUsec)
+			cpu = fmt.Sprintf("%.2f%%", usec/float64(now.Sub(lastTime).Microseconds())*100)
+		}
+		fmt.Fprintf(w, "%-8d %-30s %-8s %-12s %-6s\n", pid, cgroup, cpu,
+			formatStat(stats.MemoryBytes, units.HumanSize),
+			formatStat(stats.Pids, func(n int64) string { return strconv.FormatInt(n, 10) }))
+		if noStream {
+			return nil
+		}
+		if err := syscall.Kill(pid, 0); err != nil {
+			return errors.Errorf("容器 pid %d 已退出", pid)
+		}
+		last, lastTime = stats, now
+	}
+}
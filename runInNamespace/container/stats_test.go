@@ -0,0 +1,72 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadStats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"memory.current": "10485760\n",
+		"cpu.stat":       "usage_usec 123456\nuser_usec 100000\nsystem_usec 23456\nnr_periods 0\n",
+		"pids.current":   "3\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := readStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ContainerStats{MemoryBytes: 10485760, CPUUsec: 123456, Pids: 3}
+	if *stats != want {
+		t.Errorf("readStats = %+v, want %+v", *stats, want)
+	}
+}
+
+func TestReadStatsMissingControllers(t *testing.T) {
+	// 没有打开 memory 和 pids 控制器的 cgroup 中没有对应的文件
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 5\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := readStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ContainerStats{MemoryBytes: -1, CPUUsec: 5, Pids: -1}
+	if *stats != want {
+		t.Errorf("readStats = %+v, want %+v", *stats, want)
+	}
+	if got := formatStat(stats.MemoryBytes, nil); got != "-" {
+		t.Errorf("formatStat(-1) = %q, want -", got)
+	}
+}
+
+func TestReadCPUUsageWithoutUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.stat")
+	err := os.WriteFile(path, []byte("user_usec 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCPUUsage(path); err == nil {
+		t.Error("cpu.stat without usage_usec should be an error")
+	}
+}
+
+func TestReadCgroupIntMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.current")
+	err := os.WriteFile(path, []byte("max\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCgroupInt(path); err == nil {
+		t.Error("a non-numeric memory.current should be an error")
+	}
+}
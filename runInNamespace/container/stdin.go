@@ -0,0 +1,49 @@
+package container
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdinPath 作为 --config 或 --manifest 时从标准输入读取 JSON
+const stdinPath = "-"
+
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+)
+
+// readStdin 读取整个标准输入，标准输入只能读一次，之后的调用返回同样的内容
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinData, stdinErr = io.ReadAll(os.Stdin)
+	})
+	return stdinData, stdinErr
+}
+
+// setStdin 让 readStdin 返回 data，子进程用它拿到父进程读出的标准输入
+func setStdin(data []byte) {
+	stdinOnce.Do(func() {
+		stdinData = data
+	})
+}
+
+// openInput 打开 config.json 或 manifest.json，路径为 "-" 时读取标准输入
+func openInput(p string) (io.ReadCloser, error) {
+	if p != stdinPath {
+		return os.Open(p)
+	}
+	data, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// usesStdin 报告 config 或 manifest 是否从标准输入读取
+func (spec *Spec) usesStdin() bool {
+	return spec.ConfigPath == stdinPath || spec.ManifestPath == stdinPath
+}
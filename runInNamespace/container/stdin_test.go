@@ -0,0 +1,83 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// stdinTestEnv 非空时 TestReadConfigFromStdin 在重新执行的测试进程中从标准输入读取
+const stdinTestEnv = "STDIN_TEST_MODE"
+
+func TestReadConfigFromStdin(t *testing.T) {
+	switch os.Getenv(stdinTestEnv) {
+	case "read":
+		// 标准输入只能读一次，之后的读取和 setStdin 都拿到第一次的内容
+		first, err := loadConfig(stdinPath)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		setStdin([]byte(`{"config": {"Cmd": ["/set"]}}`))
+		second, err := loadConfig(stdinPath)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(strings.Join(first.Cmd, " "), strings.Join(second.Cmd, " "))
+		os.Exit(0)
+	case "set":
+		// 子进程用父进程读出的内容，不读自己的标准输入
+		setStdin([]byte(`{"config": {"Cmd": ["/from-parent"]}}`))
+		config, err := loadConfig(stdinPath)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(strings.Join(config.Cmd, " "))
+		os.Exit(0)
+	}
+
+	run := func(mode string) string {
+		t.Helper()
+		command := exec.Command(os.Args[0], "-test.run=^TestReadConfigFromStdin$")
+		command.Env = append(os.Environ(), stdinTestEnv+"="+mode)
+		command.Stdin = strings.NewReader(`{"config": {"Cmd": ["/from-stdin"]}}`)
+		out, err := command.Output()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", mode, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if got := run("read"); got != "/from-stdin /from-stdin" {
+		t.Errorf("reading stdin twice = %q, want the stdin config both times", got)
+	}
+	if got := run("set"); got != "/from-parent" {
+		t.Errorf("after setStdin = %q, want the parent's config", got)
+	}
+}
+
+func TestUsesStdin(t *testing.T) {
+	spec := DefaultSpec()
+	if spec.usesStdin() {
+		t.Error("the default spec reads stdin")
+	}
+	spec.ConfigPath = stdinPath
+	if !spec.usesStdin() || spec.Validate() != nil {
+		t.Errorf("the config on stdin: usesStdin %v, Validate %v", spec.usesStdin(), spec.Validate())
+	}
+	// 标准输入只能提供一个文件
+	spec.ManifestPath = stdinPath
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted both the config and the manifest on stdin")
+	}
+	// lazy 模式需要反复读取 manifest
+	spec = DefaultSpec()
+	spec.ManifestPath = stdinPath
+	spec.OverlayLazyExtract = true
+	if err := spec.Validate(); err == nil {
+		t.Error("Validate accepted the manifest on stdin with --overlay-lazy-extract")
+	}
+}
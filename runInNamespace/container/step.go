@@ -0,0 +1,99 @@
+package container
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Step 是容器启动过程中的一个步骤，失败时 Run 返回的 *StepError 标明是哪一步
+type Step string
+
+const (
+	StepSeccomp      Step = "seccomp"
+	StepWaitLayers   Step = "wait-layers"
+	StepMountPrivate Step = "mount-private"
+	StepLoadConfig   Step = "load-config"
+	StepSetEnv       Step = "set-env"
+	StepMountOverlay Step = "mount-overlay"
+	StepMountRootfs  Step = "mount-rootfs"
+	StepMountBaseFs  Step = "mount-basefs"
+	StepMaskProc     Step = "mask-proc"
+	StepMountVolume  Step = "mount-volume"
+	StepSetHostname  Step = "set-hostname"
+	StepWriteHosts   Step = "write-hosts"
+	StepResolvConf   Step = "resolv-conf"
+	StepNsswitch     Step = "nsswitch"
+	StepPivotRoot    Step = "pivot-root"
+	StepChdir        Step = "chdir"
+	StepPrep         Step = "prep"
+	StepStartCommand Step = "start-command"
+	StepWaitCommand  Step = "wait-command"
+)
+
+// StepError 是容器在某一步失败的错误，调用方用 errors.As 取出后按 Step 处理
+// 容器命令自身的退出状态不是 StepError，见 ExitCode
+type StepError struct {
+	Step Step
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// stepError 把 err 标记为在 step 失败
+func stepError(step Step, err error) error {
+	return &StepError{Step: step, Err: err}
+}
+
+// stepFd 是子进程把 StepError 传回父进程的管道，即 ExtraFiles 中的第二个文件
+const stepFd = 4
+
+// stepReport 是经 stepFd 传递的 StepError
+type stepReport struct {
+	Step    Step   `json:"step"`
+	Message string `json:"message"`
+}
+
+// closeStepFdOnExec 保证容器命令不会继承 stepFd
+func closeStepFdOnExec() {
+	syscall.CloseOnExec(stepFd)
+}
+
+// reportStep 把 err 中的 StepError 写给父进程，返回是否写入成功
+func reportStep(err error) bool {
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		return false
+	}
+	file := os.NewFile(stepFd, "step")
+	defer file.Close()
+	data, err := json.Marshal(&stepReport{Step: stepErr.Step, Message: err.Error()})
+	if err != nil {
+		return false
+	}
+	_, err = file.Write(data)
+	return err == nil
+}
+
+// readStepReport 读取子进程传回的 StepError，子进程没有在某一步失败时返回 nil
+func readStepReport(r io.Reader) *StepError {
+	data, err := io.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	report := &stepReport{}
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return nil
+	}
+	return &StepError{Step: report.Step, Err: errors.New(report.Message)}
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// stepTestEnv 非空时 TestStepReportRoundTrip 在重新执行的测试进程中经 stepFd 报告错误
+const stepTestEnv = "STEP_TEST_REPORT"
+
+// fdOpen 在新启动的 shell 中检查 fd 是否打开
+func fdOpen(fd int) bool {
+	return exec.Command("/bin/sh", "-c", fmt.Sprintf("[ -e /proc/self/fd/%d ]", fd)).Run() == nil
+}
+
+func TestStepReportRoundTrip(t *testing.T) {
+	switch os.Getenv(stepTestEnv) {
+	case "step":
+		// 容器命令不能继承 stepFd
+		inherited := fdOpen(stepFd)
+		closeStepFdOnExec()
+		if !inherited || fdOpen(stepFd) {
+			fmt.Println("closeStepFdOnExec did not close the step fd")
+			os.Exit(1)
+		}
+		err := errors.Wrap(stepError(StepMountVolume, errors.New("bind mount failed")), "child")
+		if !reportStep(err) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "other":
+		// 不是 StepError 时不写入
+		if reportStep(errors.New("exit status 3")) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	report := func(mode string) *StepError {
+		t.Helper()
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		command := exec.Command(os.Args[0], "-test.run=^TestStepReportRoundTrip$")
+		command.Env = append(os.Environ(), stepTestEnv+"="+mode)
+		// 和 runInNamespace 一样，ExtraFiles 中的第二个文件是 stepFd
+		command.ExtraFiles = []*os.File{os.Stdin, writer}
+		out, err := command.Output()
+		writer.Close()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", mode, err, out)
+		}
+		return readStepReport(reader)
+	}
+	stepErr := report("step")
+	if stepErr == nil {
+		t.Fatal("the StepError was not read back")
+	}
+	// 消息包含外层的包装
+	if stepErr.Step != StepMountVolume || stepErr.Error() != "child: bind mount failed" {
+		t.Errorf("read back %s: %q, want %s: %q", stepErr.Step, stepErr.Error(), StepMountVolume, "child: bind mount failed")
+	}
+	if stepErr := report("other"); stepErr != nil {
+		t.Errorf("read back %+v for an error without a step", stepErr)
+	}
+}
+
+func TestReadStepReportIgnoresGarbage(t *testing.T) {
+	for _, data := range []string{"", "{", "exit status 3"} {
+		if stepErr := readStepReport(strings.NewReader(data)); stepErr != nil {
+			t.Errorf("readStepReport(%q) = %+v, want nil", data, stepErr)
+		}
+	}
+}
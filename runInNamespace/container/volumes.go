@@ -0,0 +1,107 @@
+package container
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// VolumeMaps 是可重复的 -v hostDir:containerPath 参数
+type VolumeMaps []string
+
+func (v *VolumeMaps) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *VolumeMaps) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !filepath.IsAbs(parts[1]) {
+		return errors.Errorf("无效的 -v 参数 %s，格式应为 hostDir:containerPath，containerPath 必须是绝对路径", value)
+	}
+	*v = append(*v, value)
+	return nil
+}
+
+// byContainerPath 按容器内路径索引 -v 参数，值为宿主机目录
+func (v VolumeMaps) byContainerPath() map[string]string {
+	maps := map[string]string{}
+	for _, entry := range v {
+		parts := strings.SplitN(entry, ":", 2)
+		maps[filepath.Clean(parts[1])] = parts[0]
+	}
+	return maps
+}
+
+// resolveVolumeDir 把宿主机目录转为不含符号链接的绝对路径，相对路径相对于当前目录
+// noSymlinks 时路径中有符号链接即报错，避免 volume 经符号链接指向别处
+func resolveVolumeDir(hostDir string, noSymlinks bool) (string, error) {
+	abs, err := filepath.Abs(hostDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "解析 volume 目录 %s 时出错", hostDir)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", errors.Wrapf(err, "volume 目录 %s 不存在", hostDir)
+	}
+	if noSymlinks && resolved != abs {
+		return "", errors.Errorf("volume 目录 %s 经符号链接指向 %s，--no-symlink-volumes 时不允许", abs, resolved)
+	}
+	return resolved, nil
+}
+
+// mountImageVolumes 挂载镜像 config.json 中声明的 VOLUME 和 -v 指定的目录
+// 用 -v 映射了宿主机目录的 bind mount 宿主机目录，否则挂载一个匿名 tmpfs，
+// 避免应用写入 volume 的数据落到 overlay 的 upper 层
+func mountImageVolumes(targetDir string, declared []string, maps VolumeMaps, noSymlinks, privileged, dryRun bool) error {
+	hostDirs := maps.byContainerPath()
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, p := range declared {
+		p = filepath.Clean(p)
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, entry := range maps {
+		p := filepath.Clean(strings.SplitN(entry, ":", 2)[1])
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range paths {
+		target := filepath.Join(targetDir, p)
+		err := mkdirAll(target, dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "创建 volume 目录 %s 时出错", p)
+		}
+		hostDir, ok := hostDirs[p]
+		if !ok {
+			flags := mountFlags("tmp", privileged)
+			slog.Info("mounting anonymous volume", "cmd", tmpfsCmd("tmpfs", target, flagOptions(flags, "")))
+			err = mount("tmpfs", target, "tmpfs", flags, "", dryRun)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		hostDir, err = resolveVolumeDir(hostDir, noSymlinks)
+		if err != nil {
+			return err
+		}
+		slog.Info("mounting volume", "cmd", "mount --bind "+hostDir+" "+target)
+		err = mount(hostDir, target, "", syscall.MS_BIND, "", dryRun)
+		if err != nil {
+			return err
+		}
+		err = hardenBind(target, mountFlags("volume", privileged), dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestVolumeMapsSet(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"/srv/data:/data", true},
+		{"data:/data", true},
+		{"/srv/data:/var/lib/a:b", true},
+		{"/srv/data", false},
+		{":/data", false},
+		{"/srv/data:data", false},
+		{"/srv/data:", false},
+	}
+	for _, test := range tests {
+		var maps VolumeMaps
+		if err := maps.Set(test.value); (err == nil) != test.ok {
+			t.Errorf("Set(%q) = %v, want ok %v", test.value, err, test.ok)
+		}
+	}
+	maps := VolumeMaps{"/a:/data/", "/b:/logs", "/c:/data"}
+	// 同一路径后出现的 -v 生效
+	want := map[string]string{"/data": "/c", "/logs": "/b"}
+	if got := maps.byContainerPath(); !reflect.DeepEqual(got, want) {
+		t.Errorf("byContainerPath = %v, want %v", got, want)
+	}
+}
+
+func TestMountImageVolumes(t *testing.T) {
+	targetDir, logs, extra := t.TempDir(), t.TempDir(), t.TempDir()
+	calls := recordMounts(t, nil)
+	// 镜像声明的 VOLUME 先于只在 -v 中出现的路径，重复的路径只挂载一次
+	err := mountImageVolumes(targetDir, []string{"/data", "/var/log/", "/data"},
+		VolumeMaps{logs + ":/var/log", extra + ":/extra"}, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mountCall{
+		{source: "tmpfs", target: filepath.Join(targetDir, "data"), fstype: "tmpfs"},
+		{source: logs, target: filepath.Join(targetDir, "var/log"), flags: syscall.MS_BIND},
+		{source: extra, target: filepath.Join(targetDir, "extra"), flags: syscall.MS_BIND},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("mounts = %+v, want %+v", *calls, want)
+	}
+	for _, p := range []string{"data", "var/log", "extra"} {
+		if info, err := os.Stat(filepath.Join(targetDir, p)); err != nil || !info.IsDir() {
+			t.Errorf("the mountpoint %s was not created: %v", p, err)
+		}
+	}
+}
+
+func TestMountImageVolumesHardened(t *testing.T) {
+	targetDir, logs := t.TempDir(), t.TempDir()
+	calls := recordMounts(t, nil)
+	err := mountImageVolumes(targetDir, []string{"/data", "/var/log"}, VolumeMaps{logs + ":/var/log"}, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 3 {
+		t.Fatalf("mounts = %+v, want tmpfs, bind and remount", *calls)
+	}
+	if tmpfs := (*calls)[0]; tmpfs.flags != hardenedFlags["tmp"] {
+		t.Errorf("the anonymous volume flags = %#x, want %#x", tmpfs.flags, hardenedFlags["tmp"])
+	}
+	remount := (*calls)[2]
+	want := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | hardenedFlags["volume"])
+	if remount.target != filepath.Join(targetDir, "var/log") || remount.flags&want != want {
+		t.Errorf("the volume remount = %+v, want flags %#x", remount, want)
+	}
+}
+
+func TestMountImageVolumesSymlink(t *testing.T) {
+	hostDir := t.TempDir()
+	link := filepath.Join(t.TempDir(), "link")
+	err := os.Symlink(hostDir, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := recordMounts(t, nil)
+	targetDir := t.TempDir()
+	err = mountImageVolumes(targetDir, nil, VolumeMaps{link + ":/data"}, true, true, false)
+	if err == nil {
+		t.Error("--no-symlink-volumes accepted a symlinked volume")
+	}
+	// 不限制时 bind mount 符号链接指向的目录
+	err = mountImageVolumes(targetDir, nil, VolumeMaps{link + ":/data"}, false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := filepath.EvalSymlinks(hostDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1 || (*calls)[0].source != resolved {
+		t.Errorf("mounts = %+v, want a bind mount of %s", *calls, resolved)
+	}
+}
+
+func TestMountImageVolumesDryRun(t *testing.T) {
+	targetDir := t.TempDir()
+	calls := recordMounts(t, nil)
+	plan := captureLog(t, func() {
+		err := mountImageVolumes(targetDir, []string{"/data"}, nil, false, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(*calls) != 0 {
+		t.Errorf("a dry run mounted %+v", *calls)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "data")); !os.IsNotExist(err) {
+		t.Error("a dry run created the volume mountpoint")
+	}
+	if want := "mount -t tmpfs -o nosuid,nodev tmpfs " + filepath.Join(targetDir, "data"); !strings.Contains(plan, want) {
+		t.Errorf("the plan has no %q:\n%s", want, plan)
+	}
+}
+
+func TestResolveVolumeDir(t *testing.T) {
+	// t.TempDir 本身可能经过符号链接，先解析出真实路径
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(root, "data")
+	err = os.MkdirAll(filepath.Join(data, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(data, filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		hostDir    string
+		noSymlinks bool
+		want       string
+	}{
+		// 相对路径相对于当前目录，. 和 .. 以及结尾的 / 被规范化
+		{"data", false, data},
+		{"./data/", false, data},
+		{"data/sub/..", false, data},
+		{data + "//sub/", false, filepath.Join(data, "sub")},
+		{"link", false, data},
+		{"link/sub", false, filepath.Join(data, "sub")},
+		{"data/sub", true, filepath.Join(data, "sub")},
+		// 路径中任何一段是符号链接都拒绝
+		{"link", true, ""},
+		{"link/sub", true, ""},
+		{"missing", false, ""},
+	}
+	for _, test := range tests {
+		got, err := resolveVolumeDir(test.hostDir, test.noSymlinks)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("resolveVolumeDir(%q, %v) = %s, want an error", test.hostDir, test.noSymlinks, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("resolveVolumeDir(%q, %v) = %s, %v, want %s", test.hostDir, test.noSymlinks, got, err, test.want)
+		}
+	}
+}
+
+func TestMountVolumeDryRunMissingDir(t *testing.T) {
+	// Run 在启动子进程之前才创建 volume 目录，dry run 时按绝对路径打印
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetDir := t.TempDir()
+	plan := captureLog(t, func() {
+		err = mountVolume("not-created-yet", targetDir, false, false, true, true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "mount --bind " + filepath.Join(wd, "not-created-yet") + " " + filepath.Join(targetDir, "volume")
+	if !strings.Contains(plan, want) {
+		t.Errorf("the plan has no %q:\n%s", want, plan)
+	}
+	if err := mountVolume("not-created-yet", targetDir, false, false, true, false); err == nil {
+		t.Error("mountVolume accepted a missing volume dir")
+	}
+}
@@ -2,4 +2,10 @@ module runInNamespace
 
 go 1.23.0
 
-require github.com/pkg/errors v0.9.1
+require (
+	common v0.0.0
+	github.com/pkg/errors v0.9.1
+	golang.org/x/sys v0.18.0
+)
+
+replace common => ../common
@@ -2,350 +2,280 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"syscall"
+
+	"runInNamespace/container"
 
 	"github.com/pkg/errors"
 )
 
-// Config 是从配置文件读取的Env信息
-type Config struct {
-	Config SubConfigStruct `json:"config"`
-}
-
-type SubConfigStruct struct {
-	Env []string `json:"Env"`
-}
-
-// Manifest 是从配置文件读取的 Layers 信息
-type Manifest struct {
-	Layers []Layer
-}
-
-// Layer 代表一个 Docker 镜像层
-type Layer struct {
-	Digest    string
-	MediaType string
-	Size      uint64
+// cliOptions 是命令行中不属于 Spec 的参数
+type cliOptions struct {
+	dumpConfig bool
+	fileArgs   []string
+	specPath   string
 }
 
-// loadConfig 加载 config.json 文件
-func loadConfig(configPath string) ([]string, error) {
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var config Config
-	err = json.NewDecoder(file).Decode(&config)
-	if err != nil {
-		return nil, err
-	}
-
-	return config.Config.Env, nil
-}
-
-// loadManifest 加载 manifest.json 文件
-func loadManifest(manifestPath string) ([]Layer, error) {
-	file, err := os.Open(manifestPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var manifest Manifest
-	err = json.NewDecoder(file).Decode(&manifest)
-	if err != nil {
-		return nil, err
-	}
-
-	return manifest.Layers, nil
-}
-
-func mountRecPrivate() error {
-	fmt.Println("mounting recursive private: mount --make-rprivate /")
-	cmd := exec.Command("mount", "--make-rprivate", "/")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	return nil
-}
-
-// setEnv 设置环境变量
-func setEnv(configPath string) error {
-	// 读取环境变量并设置
-	envVars, err := loadConfig(configPath)
-	if err != nil {
-		return errors.Wrap(err, "读取 config.json 时出错")
-	}
-	fmt.Println("setting env vars:", envVars)
-	for _, e := range envVars {
-		parts := strings.SplitN(e, "=", 2)
-		if len(parts) != 2 {
-			return errors.Errorf("无效的环境变量: %s", e)
+// newFlagSet 定义 runInNamespace 的参数，解析结果写入 spec 和 opts
+func newFlagSet(spec *container.Spec, opts *cliOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("runInNamespace", flag.ContinueOnError)
+	fs.StringVar(&spec.Name, "name", "", "容器名，可用于 kill <name>")
+	fs.StringVar(&spec.PidFile, "pidfile", "", "容器运行期间把 1 号进程的 pid 写入该文件")
+	fs.Var(&spec.Labels, "label", "给容器添加 key=value 标签，运行期间和镜像、pid 一起记录在 /run/runInNamespace 下的 state.json 中，可重复指定")
+	fs.StringVar(&spec.ConfigPath, "config", spec.ConfigPath, "镜像 config.json 路径，- 表示从标准输入读取")
+	fs.StringVar(&spec.ManifestPath, "manifest", spec.ManifestPath, "镜像 manifest.json 路径，- 表示从标准输入读取")
+	fs.StringVar(&spec.LayersRoot, "layers", spec.LayersRoot, "docker2fs 解压出的 layers 目录")
+	fs.StringVar(&spec.BaseDir, "base", spec.BaseDir, "overlay 工作目录")
+	fs.StringVar(&spec.VolumeDir, "volume", spec.VolumeDir, "挂载到容器 /volume 的宿主机目录")
+	fs.Var(&spec.Volumes, "v", "把宿主机目录 bind mount 到容器内，格式为 hostDir:containerPath，可重复指定")
+	fs.Var(&spec.Env, "env", "设置容器命令的环境变量 KEY=VALUE，只给出 KEY 时取宿主机的值，覆盖镜像和 -env-file 中的同名变量，可重复指定")
+	fs.Var(&spec.EnvFiles, "env-file", "从文件读取 KEY=VALUE 形式的环境变量，覆盖镜像中的同名变量，可重复指定")
+	fs.StringVar(&spec.Bundle, "bundle", "", "从 docker2fs 生成的 bundle.img 中 loop 挂载 layer，替代 -layers")
+	fs.StringVar(&spec.Rootfs, "rootfs", "", "把已经准备好的 rootfs 目录 bind mount 为容器的根目录，跳过 manifest 和 overlay，容器内的写入直接落在该目录上，缺少的 proc、sys、dev、run、tmp 挂载点会在其中创建")
+	fs.StringVar(&spec.UpperDir, "upperdir", "", "把 overlay 的 upperdir 放在宿主机目录上，容器内的写入直接落盘")
+	fs.StringVar(&spec.Persist, "persist", "", "把 overlay 的 upperdir 和 workdir 放在该宿主机目录下，容器的修改在重启后保留")
+	fs.StringVar(&spec.TmpfsSize, "tmpfs-size", spec.TmpfsSize, "base 目录 tmpfs 的大小上限，如 512m、2g 或内存的百分比 20%")
+	fs.StringVar(&spec.ShmSize, "shm-size", "", "容器 /dev/shm 的大小，如 256m、1g，默认使用 tmpfs 的默认大小")
+	fs.BoolVar(&spec.Init, "init", false, "由 1 号进程转发信号并回收容器内的孤儿进程，容器命令退出后容器随之退出")
+	fs.BoolVar(&spec.Init, "pid1-init", false, "--init 的别名")
+	fs.BoolVar(&spec.SlaveVolume, "mount-slave-propagation", false, "以 rslave 方式挂载 volume，宿主机上新增的子挂载对容器可见（要求宿主机目录是 shared 挂载）")
+	fs.BoolVar(&spec.NoSymlinkVolumes, "no-symlink-volumes", false, "volume 的宿主机目录经符号链接指向别处时拒绝挂载")
+	fs.StringVar(&spec.Seccomp, "seccomp", "", "为容器命令加载 seccomp 过滤器，default 或 Docker 格式的 profile 路径")
+	fs.StringVar(&spec.Hostname, "hostname", "", "容器的主机名，同时写入 /etc/hosts")
+	fs.Var(&spec.AddHosts, "add-host", "向容器 /etc/hosts 添加 name:ip 条目，可重复指定")
+	fs.StringVar(&spec.Network, "network", spec.Network, "容器的网络: none 在独立的 net namespace 中没有网络，host 共享宿主机的网络且不设置 /etc/resolv.conf")
+	fs.BoolVar(&spec.ShareIPC, "share-ipc", false, "不创建 ipc namespace，和宿主机共享 System V IPC 和 POSIX 消息队列")
+	fs.BoolVar(&spec.SharePID, "share-pid", false, "不创建 pid namespace，容器内能看到宿主机的进程")
+	fs.BoolVar(&spec.ShareUTS, "share-uts", false, "不创建 uts namespace，使用宿主机的主机名")
+	fs.BoolVar(&spec.ShareNet, "share-net", false, "不创建 net namespace，等同于 --network host")
+	fs.StringVar(&spec.DNSMode, "dns-mode", spec.DNSMode, "容器 /etc/resolv.conf 的来源: copy 复制宿主机文件，bind 只读挂载宿主机文件")
+	fs.BoolVar(&spec.WriteNsswitch, "write-nsswitch", false, "镜像没有 /etc/nsswitch.conf 时写入 hosts: files dns 等默认配置")
+	fs.StringVar(&spec.EntrypointCwd, "entrypoint-cwd", "", "容器命令的工作目录，覆盖镜像的 WorkingDir")
+	fs.BoolVar(&spec.OverwriteHosts, "overwrite-hosts", false, "覆盖镜像自带的 /etc/hosts")
+	fs.BoolVar(&spec.OverlayLazyExtract, "overlay-lazy-extract", false, "配合 docker2fs convert -manifest-first 使用（docker2fs run -lazy-extract 会自动加上），镜像所需的 layer 解压完成后立即启动，不等整个转换结束")
+	fs.DurationVar(&spec.LazyTimeout, "lazy-timeout", spec.LazyTimeout, "--overlay-lazy-extract 等待 layer 的最长时间")
+	fs.BoolVar(&spec.VerboseMount, "verbose-mount", false, "pivot_root 之前打印 /proc/self/mountinfo 中本次新增或变化的行")
+	fs.IntVar(&spec.OverlayRetries, "overlay-retries", spec.OverlayRetries, "overlay 挂载遇到 EBUSY 时的重试次数")
+	fs.DurationVar(&spec.OverlayRetryDelay, "overlay-retry-delay", spec.OverlayRetryDelay, "overlay 挂载重试的间隔")
+	fs.Var(&spec.OverlayOpts, "overlay-opt", "追加 overlay 挂载参数，如 metacopy=on、redirect_dir=on，只允许 metacopy、redirect_dir、index、xino、nfs_export、volatile 和 userxattr，可重复指定")
+	fs.BoolVar(&spec.KeepMounts, "keep-mounts", false, "容器启动失败时保留挂载并打印要查看的路径，按 Ctrl-C 退出")
+	fs.BoolVar(&spec.DryRun, "dry-run", false, "只打印将要执行的挂载命令，不实际执行")
+	fs.Func("log-level", "日志级别: debug, info, warn, error (默认 info)", func(s string) error {
+		var lvl slog.Level
+		err := lvl.UnmarshalText([]byte(s))
+		if err != nil {
+			return err
 		}
-		err = os.Setenv(parts[0], parts[1])
+		spec.LogLevel = s
+		return nil
+	})
+	fs.BoolVar(&spec.Quiet, "quiet", false, "只输出错误日志")
+	fs.BoolVar(&opts.dumpConfig, "dump-config", false, "以 JSON 打印解析后的运行配置后退出")
+	fs.StringVar(&spec.Prep, "prep", "", "启动容器命令前在容器内用 /bin/sh -c 运行的准备命令，必须成功")
+	fs.BoolVar(&spec.MaskProc, "mask-proc", false, "像 Docker 一样隐藏 /proc/kcore 等路径，/proc/sys 等路径和 /sys 只读")
+	fs.BoolVar(&spec.Privileged, "privileged", false, "挂载宿主机的全部设备，默认 /dev 中只有 null、zero、full、random、urandom 和 tty")
+	fs.BoolVar(&spec.UserNS, "userns", false, "在新的 user namespace 中运行，非 root 用户也可以使用，layer 需要由同一用户转换")
+	fs.Func("args-file", "从 JSON 字符串数组文件读取容器命令，替代镜像的 Cmd 和命令行给出的命令", func(s string) error {
+		var err error
+		opts.fileArgs, err = loadArgsFile(s)
 		if err != nil {
-			return errors.Wrap(err, "设置环境变量时出错")
+			return errors.Wrapf(err, "读取 %s 时出错", s)
 		}
-	}
-	return nil
+		spec.ArgsFile = s
+		return nil
+	})
+	fs.BoolVar(&spec.ShellForm, "shell-form", false, "只给出一个命令参数时按 /bin/sh -c 运行")
+	fs.StringVar(&opts.specPath, "spec", "", "从 JSON 文件读取完整的运行配置，字段同 --dump-config 输出的 options，命令行给出的参数覆盖文件中的值")
+	return fs
 }
 
-func mountTmpfs(targetDir string) error {
-	fmt.Println("mounting tmpfs filesystem: mount -t tmpfs tmpfs", targetDir)
-	cmd := exec.Command("mount", "-t", "tmpfs", "tmpfs", targetDir)
-	output, err := cmd.CombinedOutput()
+// parseOptions 解析命令行参数，dumpConfig 表示只打印运行配置
+// 给出 --spec 时优先级从低到高依次是默认值、--spec 文件和命令行参数：命令行参数在文件读出的 spec 上
+// 重新解析一遍，只有给出的参数覆盖文件中的值，可重复的参数追加到文件中的列表之后，
+// 命令行给出的命令替换文件中的 args，--args-file 又替换两者
+func parseOptions(args []string) (spec *container.Spec, dumpConfig bool, err error) {
+	spec = container.DefaultSpec()
+	opts := &cliOptions{}
+	fs := newFlagSet(spec, opts)
+	err = fs.Parse(args)
 	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
+		return nil, false, err
 	}
-	return nil
-}
-
-func prepareDirs(baseDir string, dirs []string) error {
-	err := os.MkdirAll(baseDir, os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "创建 base 目录时出错")
+	if opts.specPath != "" {
+		// 第一遍解析只用来找到 --spec，结果随默认值一起丢弃
+		fileSpec, err := container.LoadSpec(opts.specPath)
+		if err != nil {
+			err = errors.Wrap(err, "读取 --spec 时出错")
+			fmt.Fprintln(fs.Output(), err)
+			return nil, false, err
+		}
+		// 定义 flag 时会把字段设为默认值，定义完再填入文件中的值
+		spec, opts = container.DefaultSpec(), &cliOptions{}
+		fs = newFlagSet(spec, opts)
+		*spec = *fileSpec
+		err = fs.Parse(args)
+		if err != nil {
+			return nil, false, err
+		}
 	}
-	err = mountTmpfs(baseDir)
-	if err != nil {
-		return errors.Wrap(err, "挂载 tmpfs 时出错")
+	if fs.NArg() > 0 || opts.specPath == "" {
+		spec.Args = fs.Args()
 	}
-	fmt.Println("making dirs: mkdir -pv", dirs)
-	for _, dir := range dirs {
-		err = os.MkdirAll(dir, os.ModePerm)
+	// --spec 文件中的 argsFile 没有经过 --args-file 的解析，这里补读
+	if spec.ArgsFile != "" && opts.fileArgs == nil {
+		opts.fileArgs, err = loadArgsFile(spec.ArgsFile)
 		if err != nil {
-			return errors.Wrapf(err, "创建 %s 目录时出错", dir)
+			err = errors.Wrapf(err, "读取 %s 时出错", spec.ArgsFile)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, false, err
 		}
 	}
-	return nil
-}
-
-func setLayers(manifestPath, baseDir, targetDir string) error {
-	// 读取 layers 信息
-	layers, err := loadManifest(manifestPath)
-	if err != nil {
-		return errors.Wrap(err, "读取 manifest.json 时出错")
+	if spec.ArgsFile != "" {
+		spec.Args = opts.fileArgs
 	}
-
-	// 创建必要的目录
-	upperDir := filepath.Join(baseDir, "upper")
-	workDir := filepath.Join(baseDir, "work")
-	prepareDirs(baseDir, []string{upperDir, workDir, targetDir})
-
-	lowerDirs := []string{}
-	// lower要求layers逆序挂载
-	for i := len(layers) - 1; i >= 0; i-- {
-		layer := layers[i]
-		layerPath := filepath.Join("/tmp/proxy_pool/layers", strings.Split(layer.Digest, ":")[1])
-		lowerDirs = append(lowerDirs, layerPath)
-	}
-
-	// 挂载 overlay 文件系统
-	err = mountOverlayFS(lowerDirs, upperDir, workDir, targetDir)
+	// 和 flag 包一样输出参数错误和用法
+	err = spec.Validate()
 	if err != nil {
-		return errors.Wrap(err, "挂载 overlay 文件系统时出错")
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return nil, false, err
 	}
-	return nil
-}
-
-// mountOverlayFS 挂载 overlay 文件系统
-func mountOverlayFS(lowerDirs []string, upperDir, workDir, targetDir string) error {
-	lowerdir := strings.Join(lowerDirs, ":")
-	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperDir, workDir)
-
-	fmt.Println("mounting overlay filesystem: mount -t overlay overlay -o", options, targetDir)
-
-	// 调用系统 mount 命令
-	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, targetDir)
-	output, err := cmd.CombinedOutput() // 获取命令输出
+	err = container.SetupLogger(spec.LogLevel, spec.Quiet)
 	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
+		return nil, false, err
 	}
-	return nil
+	return spec, opts.dumpConfig, nil
 }
 
-func mountBaseFs(targetDir string) error {
-	fmt.Println("mounting proc filesystem: mount -t proc none", filepath.Join(targetDir, "proc"))
-	cmd := exec.Command("mount", "-t", "proc", "none", filepath.Join(targetDir, "proc"))
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	fmt.Println("mounting sys filesystem: mount -t sysfs none", filepath.Join(targetDir, "sys"))
-	cmd = exec.Command("mount", "-t", "sysfs", "none", filepath.Join(targetDir, "sys"))
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	fmt.Println("mounting dev filesystem: mount -t devtmpfs devtmpfs", filepath.Join(targetDir, "dev"))
-	cmd = exec.Command("mount", "-t", "devtmpfs", "devtmpfs", filepath.Join(targetDir, "dev"))
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	fmt.Println("mounting devpts filesystem: mount -t devpts devpts", filepath.Join(targetDir, "dev/pts"))
-	cmd = exec.Command("mount", "-t", "devpts", "devpts", filepath.Join(targetDir, "dev/pts"))
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	fmt.Println("mounting shm filesystem: mount -t tmpfs shm", filepath.Join(targetDir, "dev/shm"))
-	cmd = exec.Command("mount", "-t", "tmpfs", "shm", filepath.Join(targetDir, "dev/shm"))
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	fmt.Println("mounting run filesystem: mount -t tmpfs tmpfs", filepath.Join(targetDir, "run"))
-	cmd = exec.Command("mount", "-t", "tmpfs", "tmpfs", filepath.Join(targetDir, "run"))
-	output, err = cmd.CombinedOutput()
+// writeDump 以缩进的 JSON 向 w 打印 --dump-config 的完整运行配置
+func writeDump(w io.Writer, spec *container.Spec) error {
+	dump, err := container.Dump(spec)
 	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
+		return err
 	}
-	fmt.Println("mounting tmp filesystem: mount -t tmpfs tmpfs", filepath.Join(targetDir, "tmp"))
-	cmd = exec.Command("mount", "-t", "tmpfs", "tmpfs", filepath.Join(targetDir, "tmp"))
-	output, err = cmd.CombinedOutput()
+	data, err := json.MarshalIndent(dump, "", "  ")
 	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
+		return err
 	}
-	return nil
+	_, err = fmt.Fprintln(w, string(data))
+	return err
 }
 
-func mountVolume(volumeDir, targetDir string) error {
-	if _, err := os.Stat(volumeDir); os.IsNotExist(err) {
-		return errors.Wrap(err, "volume 目录不存在")
-	}
-	targetVolumeDir := filepath.Join(targetDir, "volume")
-	err := os.MkdirAll(targetVolumeDir, os.ModePerm)
+// loadArgsFile 读取 --args-file，文件内容必须是非空的 JSON 字符串数组
+func loadArgsFile(argsPath string) ([]string, error) {
+	data, err := os.ReadFile(argsPath)
 	if err != nil {
-		return errors.Wrap(err, "创建 volume 目录时出错")
+		return nil, err
 	}
-	fmt.Println("mounting volume filesystem: mount --bind", volumeDir, targetVolumeDir)
-	cmd := exec.Command("mount", "--bind", volumeDir, targetVolumeDir)
-	output, err := cmd.CombinedOutput()
+	var args []string
+	err = json.Unmarshal(data, &args)
 	if err != nil {
-		return errors.Wrapf(err, "mount output: %s", string(output))
-	}
-	return nil
-}
-
-func chroot(targetDir string) error {
-	fmt.Println("change current dir :", "cd", targetDir)
-	if err := os.Chdir(targetDir); err != nil {
-		return errors.Wrap(err, "chdir 时出错")
+		return nil, errors.Wrap(err, "内容必须是 JSON 字符串数组")
 	}
-	fmt.Println("change rootfs: pivot_root . .")
-	if err := syscall.PivotRoot(".", "."); err != nil {
-		return errors.Wrap(err, "pivot_root 时出错")
+	if len(args) == 0 {
+		return nil, errors.New("命令不能为空")
 	}
-	fmt.Println("unmounting old root: umount -l .")
-	cmd := exec.Command("umount", "-l", ".")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "umount output: %s", string(output))
-	}
-	return nil
+	return args, nil
 }
 
-// runInNamespace 启动子进程并在隔离的 namespace 和 chroot 环境中运行
-func runInNamespace(configPath, manifestPath, baseDir, volumeDir string) error {
-	cmd := exec.Command("/proc/self/exe", append([]string{"child"}, configPath, manifestPath, baseDir, volumeDir)...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// 设置子进程的 SysProcAttr，进入新的 namespaces
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS |
-			syscall.CLONE_NEWIPC |
-			syscall.CLONE_NEWNET |
-			syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWPID,
-	}
-
-	return cmd.Run()
-}
+func main() {
+	// container.Run 重新执行自身，子进程在 Init 中运行容器后退出
+	container.Init()
 
-// childProcess 处理子进程的逻辑
-func childProcess(configPath, manifestPath, baseDir, volumeDir string) {
-	err := mountRecPrivate()
-	if err != nil {
-		fmt.Printf("mountRecPrivate 时出错: %v\n", err)
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		err := statsCommand(os.Args[2:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
-	err = setEnv(configPath)
-	if err != nil {
-		fmt.Printf("设置环境变量时出错: %v\n", err)
+
+	if len(os.Args) > 1 && os.Args[1] == "cgroup-cleanup" {
+		err := cgroupCleanupCommand(os.Args[2:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	targetDir := filepath.Join(baseDir, "merged")
-	err = setLayers(manifestPath, baseDir, targetDir)
-	if err != nil {
-		fmt.Printf("设置 layers 时出错: %v\n", err)
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		err := cleanupCommand(os.Args[2:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	err = mountBaseFs(targetDir)
-	if err != nil {
-		fmt.Printf("挂载基础文件系统时出错: %v\n", err)
+	if len(os.Args) > 1 && os.Args[1] == "exec" {
+		err := execCommand(os.Args[2:])
+		if code, ok := container.ExitCode(err); ok {
+			os.Exit(code)
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	err = mountVolume(volumeDir, targetDir)
-	if err != nil {
-		fmt.Printf("挂载 volume 时出错: %v\n", err)
+	if len(os.Args) > 1 && os.Args[1] == "commit" {
+		err := commitCommand(os.Args[2:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	err = chroot(targetDir)
-	if err != nil {
-		fmt.Printf("chroot 时出错: %v\n", err)
+	if len(os.Args) > 1 && os.Args[1] == "kill" {
+		err := killCommand(os.Args[2:])
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	// 启动 sh shell 并连接标准输入输出
-	cmd := exec.Command("/bin/sh")
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("运行 /bin/sh 时出错: %v\n", err)
+	spec, dumpConfig, err := parseOptions(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
 	}
-}
 
-func main() {
-	// 如果参数包含 "child"，则进入子进程逻辑
-	if len(os.Args) > 1 && os.Args[1] == "child" {
-		if len(os.Args) != 6 {
-			fmt.Println("Invalid number of arguments for child process")
+	if dumpConfig {
+		err = writeDump(os.Stdout, spec)
+		if err != nil {
+			slog.Error(err.Error())
 			os.Exit(1)
 		}
-		childProcess(os.Args[2], os.Args[3], os.Args[4], os.Args[5])
 		return
 	}
 
-	configPath := "/tmp/proxy_pool/config.json"
-	manifestPath := "/tmp/proxy_pool/manifest.json"
-	baseDir := "/tmp/proxy_pool/overlay"
-	volumeDir := "/tmp/proxy_pool/volume"
+	// 切换到隔离的 namespace 和 chroot 环境中运行
+	os.Exit(runExitCode(container.Run(spec)))
+}
 
-	err := os.MkdirAll(volumeDir, os.ModePerm)
-	if err != nil {
-		fmt.Printf("创建 volume 目录时出错: %v\n", err)
-		return
+// runExitCode 把 container.Run 的结果转为进程的退出码：容器命令的退出码原样返回，
+// 启动过程中任何一步失败都打印错误并返回 1
+func runExitCode(err error) int {
+	if code, ok := container.ExitCode(err); ok {
+		slog.Debug("container exited", "code", code)
+		return code
+	}
+	var stepErr *container.StepError
+	if errors.As(err, &stepErr) {
+		slog.Error("在 namespace 和 chroot 环境中运行时出错", "step", stepErr.Step, "err", err.Error())
+		return 1
 	}
-
-	// 切换到隔离的 namespace 和 chroot 环境中运行
-	err = runInNamespace(configPath, manifestPath, baseDir, volumeDir)
 	if err != nil {
-		fmt.Printf("在 namespace 和 chroot 环境中运行时出错: %v\n", err)
-		return
+		slog.Error("在 namespace 和 chroot 环境中运行时出错", "err", err.Error())
+		return 1
 	}
+	return 0
 }
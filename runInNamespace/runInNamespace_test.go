@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"runInNamespace/container"
+)
+
+// container.Run 重新执行测试程序进入子进程，子进程和 main 一样先交给 Init
+func TestMain(m *testing.M) {
+	container.Init()
+	os.Exit(m.Run())
+}
+
+func TestPid1InitIsInit(t *testing.T) {
+	for _, flag := range []string{"--init", "--pid1-init"} {
+		spec, _, err := parseOptions([]string{"--dry-run", flag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !spec.Init {
+			t.Errorf("%s did not enable the init", flag)
+		}
+	}
+	spec, _, err := parseOptions([]string{"--dry-run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Init {
+		t.Error("the init is on by default")
+	}
+}
+
+func TestSpecFilePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "spec.json")
+	err := os.WriteFile(specPath, []byte(`{
+		"hostname": "from-file",
+		"tmpfsSize": "1g",
+		"dryRun": true,
+		"env": ["FROM_FILE=1"],
+		"args": ["/bin/file"]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令行在 --spec 之前或之后给出都覆盖文件中的值
+	for _, args := range [][]string{
+		{"--hostname", "from-flag", "--env", "FROM_FLAG=2", "--spec", specPath},
+		{"--spec", specPath, "--hostname", "from-flag", "--env", "FROM_FLAG=2"},
+	} {
+		spec, _, err := parseOptions(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.Hostname != "from-flag" {
+			t.Errorf("%v: hostname = %s, want the flag's", args, spec.Hostname)
+		}
+		// 没有在命令行给出的字段保留文件中的值，而不是默认值
+		if spec.TmpfsSize != "1g" || !spec.DryRun {
+			t.Errorf("%v: tmpfsSize = %s, dryRun = %v, want the file's", args, spec.TmpfsSize, spec.DryRun)
+		}
+		if want := (container.EnvVars{"FROM_FILE=1", "FROM_FLAG=2"}); !reflect.DeepEqual(spec.Env, want) {
+			t.Errorf("%v: env = %v, want %v", args, spec.Env, want)
+		}
+		if want := []string{"/bin/file"}; !reflect.DeepEqual(spec.Args, want) {
+			t.Errorf("%v: args = %v, want the file's %v", args, spec.Args, want)
+		}
+	}
+
+	spec, _, err := parseOptions([]string{"--spec", specPath, "/bin/flag", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/flag", "x"}; !reflect.DeepEqual(spec.Args, want) {
+		t.Errorf("args = %v, want the command line's %v", spec.Args, want)
+	}
+
+	argsPath := filepath.Join(dir, "args.json")
+	err = os.WriteFile(argsPath, []byte(`["/bin/args-file"]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, _, err = parseOptions([]string{"--spec", specPath, "--args-file", argsPath, "/bin/flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/args-file"}; !reflect.DeepEqual(spec.Args, want) {
+		t.Errorf("args = %v, want the args file's %v", spec.Args, want)
+	}
+}
+
+func TestArgsFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// 参数原样传给容器命令，不经过 shell 拆分
+	argsPath := write("args.json", `["/bin/sh", "-c", "echo \"$HOME\" 'a b'", ""]`)
+	spec, _, err := parseOptions([]string{"--dry-run", "--args-file", argsPath, "/bin/ignored", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/sh", "-c", `echo "$HOME" 'a b'`, ""}; !reflect.DeepEqual(spec.Args, want) {
+		t.Errorf("args = %q, want %q", spec.Args, want)
+	}
+	if spec.ArgsFile != argsPath {
+		t.Errorf("ArgsFile = %s, want %s", spec.ArgsFile, argsPath)
+	}
+
+	for _, data := range []string{`[]`, `null`, `"/bin/sh"`, `["/bin/sh", 1]`, `[`} {
+		path := write("bad.json", data)
+		if _, err := loadArgsFile(path); err == nil {
+			t.Errorf("loadArgsFile accepted %s", data)
+		}
+		if _, _, err := parseOptions([]string{"--dry-run", "--args-file", path}); err == nil {
+			t.Errorf("--args-file accepted %s", data)
+		}
+	}
+	if _, err := loadArgsFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("loadArgsFile accepted a missing file")
+	}
+}
+
+func TestLayersFlag(t *testing.T) {
+	spec, _, err := parseOptions([]string{"--dry-run", "--layers", "/srv/layers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.LayersRoot != "/srv/layers" {
+		t.Errorf("LayersRoot = %s, want /srv/layers", spec.LayersRoot)
+	}
+}
+
+func TestLogLevelFlag(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	tests := []struct {
+		args    []string
+		enabled slog.Level
+		muted   slog.Level
+	}{
+		{nil, slog.LevelInfo, slog.LevelDebug},
+		{[]string{"--log-level", "debug"}, slog.LevelDebug, slog.LevelDebug - 1},
+		{[]string{"--log-level", "WARN"}, slog.LevelWarn, slog.LevelInfo},
+		{[]string{"--log-level", "error"}, slog.LevelError, slog.LevelWarn},
+		// --quiet 压过 --log-level
+		{[]string{"--log-level", "debug", "--quiet"}, slog.LevelError, slog.LevelWarn},
+	}
+	for _, test := range tests {
+		_, _, err := parseOptions(append([]string{"--dry-run"}, test.args...))
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+		handler := slog.Default().Handler()
+		if !handler.Enabled(context.Background(), test.enabled) || handler.Enabled(context.Background(), test.muted) {
+			t.Errorf("%v: level %v should be the lowest enabled", test.args, test.enabled)
+		}
+	}
+	if _, _, err := parseOptions([]string{"--dry-run", "--log-level", "verbose"}); err == nil {
+		t.Error("an unknown log level was accepted")
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	exitErr := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	signaled := exec.Command("/bin/sh", "-c", "kill -TERM $$").Run()
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{exitErr, 3},
+		{signaled, 128 + int(syscall.SIGTERM)},
+		{&container.StepError{Step: container.StepLoadConfig, Err: os.ErrNotExist}, 1},
+		{os.ErrPermission, 1},
+	}
+	for _, test := range tests {
+		if code := runExitCode(test.err); code != test.code {
+			t.Errorf("runExitCode(%v) = %d, want %d", test.err, code, test.code)
+		}
+	}
+}
+
+// failingChildSpec 返回一个真正启动子进程的 spec，子进程在读取 config.json 这一步失败
+func failingChildSpec(t *testing.T, args ...string) *container.Spec {
+	t.Helper()
+	base := t.TempDir()
+	t.Setenv("PROXY_POOL_PATH", base)
+	args = append([]string{"--base", filepath.Join(base, "overlay"), "--volume", filepath.Join(base, "volume")}, args...)
+	spec, _, err := parseOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(spec.ManifestPath, []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "layers": []}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(spec.ConfigPath, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestChildErrorExitsNonZero(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces needs root")
+	}
+	err := container.Run(failingChildSpec(t))
+	stepErr, ok := err.(*container.StepError)
+	if !ok {
+		t.Fatalf("Run = %v, want the StepError the child reported", err)
+	}
+	if stepErr.Step != container.StepLoadConfig {
+		t.Errorf("the child failed at %s, want %s", stepErr.Step, container.StepLoadConfig)
+	}
+	if code := runExitCode(err); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+}
+
+func TestPidFileRemovedOnExit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces needs root")
+	}
+	// pid 文件是 FIFO 时写入会阻塞到这里读取，读到的就是运行期间的内容
+	pidFile := filepath.Join(t.TempDir(), "container.pid")
+	err := syscall.Mkfifo(pidFile, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan string, 1)
+	go func() {
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			t.Error(err)
+		}
+		written <- string(data)
+	}()
+	err = container.Run(failingChildSpec(t, "--pidfile", pidFile))
+	if _, ok := err.(*container.StepError); !ok {
+		t.Fatalf("Run = %v, want the StepError the child reported", err)
+	}
+	data := <-written
+	if pid, err := strconv.Atoi(strings.TrimSuffix(data, "\n")); err != nil || pid <= 0 {
+		t.Errorf("the pid file had %q, want the child pid", data)
+	}
+	// 子进程失败退出后同样删除 pid 文件
+	if _, err := os.Lstat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("the pid file is left after the container exited: %v", err)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("PROXY_POOL_PATH", base)
+	err := os.WriteFile(filepath.Join(base, "config.json"), []byte(`{"config": {
+		"Env": ["PATH=/usr/bin", "LANG=C"],
+		"Entrypoint": ["/app"],
+		"Cmd": ["--serve"],
+		"WorkingDir": "/srv"
+	}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(base, "manifest.json"), []byte(`{"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"layers": [{"digest": "sha256:aaaa"}, {"digest": "sha256:bbbb"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, dumpConfig, err := parseOptions([]string{"--dump-config", "--hostname", "web", "--share-net", "--env", "LANG=en_US.UTF-8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dumpConfig {
+		t.Fatal("--dump-config was not recognized")
+	}
+	var out bytes.Buffer
+	err = writeDump(&out, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Options    map[string]any `json:"options"`
+		Namespaces []string       `json:"namespaces"`
+		Env        []string       `json:"env"`
+		LowerDirs  []string       `json:"lowerDirs"`
+		UpperDir   string         `json:"upperDir"`
+		Command    []string       `json:"command"`
+		Cwd        string         `json:"cwd"`
+	}
+	err = json.Unmarshal(out.Bytes(), &dump)
+	if err != nil {
+		t.Fatalf("the dump is not JSON: %v\n%s", err, out.String())
+	}
+	layers := filepath.Join(base, "layers")
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"options.hostname", dump.Options["hostname"], "web"},
+		// --share-net 时不创建 net namespace
+		{"namespaces", dump.Namespaces, []string{"uts", "ipc", "mnt", "pid"}},
+		{"env", dump.Env, []string{"PATH=/usr/bin", "LANG=en_US.UTF-8"}},
+		{"lowerDirs", dump.LowerDirs, []string{filepath.Join(layers, "bbbb"), filepath.Join(layers, "aaaa")}},
+		{"upperDir", dump.UpperDir, filepath.Join(spec.BaseDir, "upper")},
+		{"command", dump.Command, []string{"/app", "--serve"}},
+		{"cwd", dump.Cwd, "/srv"},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.want) {
+			t.Errorf("%s = %v, want %v", check.name, check.got, check.want)
+		}
+	}
+	// options 可以原样作为 --spec 文件
+	options, err := json.Marshal(dump.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specPath := filepath.Join(t.TempDir(), "spec.json")
+	err = os.WriteFile(specPath, options, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDump, _, err := parseOptions([]string{"--spec", specPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromDump, spec) {
+		t.Errorf("the dumped options don't load back as the same spec:\n%+v\n%+v", fromDump, spec)
+	}
+}